@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"sort"
+)
+
+const (
+	// Allocator names used in the configuration file
+	ALLOCATOR_SIMPLE    = "simple"
+	ALLOCATOR_RING      = "ring"
+	ALLOCATOR_FREESPACE = "freespace"
+)
+
+// Allocators decide the order in which the devices of a cluster
+// are tried when placing a brick.  Devices without enough space,
+// on nodes which are not online, or in the failure domain of another
+// replica of the brick are skipped by the caller.
+type Allocator interface {
+	// Return the devices of the cluster in the order they
+	// should be tried for the brick with id brickId
+	GetDevices(tx *bolt.Tx, cluster, brickId string) ([]string, error)
+
+	// Notify the allocator that devices have been added to
+	// or removed from the cluster
+	DevicesChanged(cluster string)
+}
+
+// Tries the devices in db key order.  Fills the first devices
+// in the cluster before using the rest.
+type SimpleAllocator struct{}
+
+// Tries the devices with the most free space first
+type FreeSpaceAllocator struct{}
+
+// Sorts devices from most to least free space
+type devicesByFreeSpace []*DeviceEntry
+
+func (d devicesByFreeSpace) Len() int      { return len(d) }
+func (d devicesByFreeSpace) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d devicesByFreeSpace) Less(i, j int) bool {
+	return d[i].Info.Storage.Free > d[j].Info.Storage.Free
+}
+
+func NewAllocator(name string) (Allocator, error) {
+	switch name {
+	case ALLOCATOR_SIMPLE:
+		return NewSimpleAllocator(), nil
+	case "", ALLOCATOR_RING:
+		return NewRingAllocator(), nil
+	case ALLOCATOR_FREESPACE:
+		return NewFreeSpaceAllocator(), nil
+	default:
+		return nil, ErrUnknownAllocator
+	}
+}
+
+// Return the devices of all the nodes in the cluster
+func clusterDevices(tx *bolt.Tx, cluster string) ([]*DeviceEntry, error) {
+	entry, err := NewClusterEntryFromId(tx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]*DeviceEntry, 0)
+	for _, nodeId := range entry.Info.Nodes {
+		node, err := NewNodeEntryFromId(tx, nodeId)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, deviceId := range node.Devices {
+			device, err := NewDeviceEntryFromId(tx, deviceId)
+			if err != nil {
+				return nil, err
+			}
+			devices = append(devices, device)
+		}
+	}
+
+	return devices, nil
+}
+
+func NewSimpleAllocator() *SimpleAllocator {
+	return &SimpleAllocator{}
+}
+
+func (s *SimpleAllocator) GetDevices(tx *bolt.Tx,
+	cluster, brickId string) ([]string, error) {
+
+	devices, err := clusterDevices(tx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make(sort.StringSlice, len(devices))
+	for i, device := range devices {
+		list[i] = device.Info.Id
+	}
+	list.Sort()
+
+	return list, nil
+}
+
+func (s *SimpleAllocator) DevicesChanged(cluster string) {
+}
+
+func NewFreeSpaceAllocator() *FreeSpaceAllocator {
+	return &FreeSpaceAllocator{}
+}
+
+func (f *FreeSpaceAllocator) GetDevices(tx *bolt.Tx,
+	cluster, brickId string) ([]string, error) {
+
+	devices, err := clusterDevices(tx, cluster)
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(devicesByFreeSpace(devices))
+
+	list := make([]string, len(devices))
+	for i, device := range devices {
+		list[i] = device.Info.Id
+	}
+
+	return list, nil
+}
+
+func (f *FreeSpaceAllocator) DevicesChanged(cluster string) {
+}
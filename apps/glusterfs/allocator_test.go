@@ -0,0 +1,232 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/tests"
+	"os"
+	"sort"
+	"testing"
+)
+
+// Allocator which always returns the same devices
+type mockAllocator struct {
+	devices []string
+	calls   int
+}
+
+func (m *mockAllocator) GetDevices(tx *bolt.Tx,
+	cluster, brickId string) ([]string, error) {
+	m.calls++
+	return m.devices, nil
+}
+
+func (m *mockAllocator) DevicesChanged(cluster string) {
+}
+
+func setupAllocatorTest(t *testing.T, tmpfile string) (*App, string) {
+	app := NewTestApp(tmpfile)
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		2,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	var cluster string
+	err = app.db.View(func(tx *bolt.Tx) error {
+		cluster = EntryKeys(tx, BOLTDB_BUCKET_CLUSTER)[0]
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	return app, cluster
+}
+
+func TestNewAllocator(t *testing.T) {
+	a, err := NewAllocator("")
+	tests.Assert(t, err == nil)
+	_, ok := a.(*RingAllocator)
+	tests.Assert(t, ok)
+
+	a, err = NewAllocator(ALLOCATOR_RING)
+	tests.Assert(t, err == nil)
+	_, ok = a.(*RingAllocator)
+	tests.Assert(t, ok)
+
+	a, err = NewAllocator(ALLOCATOR_SIMPLE)
+	tests.Assert(t, err == nil)
+	_, ok = a.(*SimpleAllocator)
+	tests.Assert(t, ok)
+
+	a, err = NewAllocator(ALLOCATOR_FREESPACE)
+	tests.Assert(t, err == nil)
+	_, ok = a.(*FreeSpaceAllocator)
+	tests.Assert(t, ok)
+
+	a, err = NewAllocator("bogus")
+	tests.Assert(t, err == ErrUnknownAllocator)
+	tests.Assert(t, a == nil)
+}
+
+func TestNewAppAllocator(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	appConfig := bytes.NewBuffer([]byte(`{
+		"glusterfs" : {
+			"executor" : "mock",
+			"allocator" : "freespace",
+			"db" : "` + tmpfile + `"
+		}
+	}`))
+	app := NewApp(appConfig)
+	tests.Assert(t, app != nil)
+	defer app.Close()
+	_, ok := app.allocator.(*FreeSpaceAllocator)
+	tests.Assert(t, ok)
+
+	// Each app has its own allocator
+	tmpfile2 := tests.Tempfile()
+	defer os.Remove(tmpfile2)
+	appConfig = bytes.NewBuffer([]byte(`{
+		"glusterfs" : {
+			"executor" : "mock",
+			"allocator" : "simple",
+			"db" : "` + tmpfile2 + `"
+		}
+	}`))
+	app2 := NewApp(appConfig)
+	tests.Assert(t, app2 != nil)
+	defer app2.Close()
+	_, ok = app2.allocator.(*SimpleAllocator)
+	tests.Assert(t, ok)
+	_, ok = app.allocator.(*FreeSpaceAllocator)
+	tests.Assert(t, ok)
+
+	appConfig = bytes.NewBuffer([]byte(`{
+		"glusterfs" : {
+			"executor" : "mock",
+			"allocator" : "bogus",
+			"db" : "` + tmpfile + `"
+		}
+	}`))
+	tests.Assert(t, NewApp(appConfig) == nil)
+}
+
+func TestSimpleAllocator(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	app, cluster := setupAllocatorTest(t, tmpfile)
+	defer app.Close()
+
+	a := NewSimpleAllocator()
+	err := app.db.View(func(tx *bolt.Tx) error {
+		devices, err := a.GetDevices(tx, cluster, "abc")
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(devices) == 4)
+		tests.Assert(t, sort.StringsAreSorted(devices))
+
+		_, err = a.GetDevices(tx, "bogus", "abc")
+		tests.Assert(t, err == ErrNotFound)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestFreeSpaceAllocator(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	app, cluster := setupAllocatorTest(t, tmpfile)
+	defer app.Close()
+
+	// Use different amounts of space on each device
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		devices, err := DeviceList(tx)
+		tests.Assert(t, err == nil)
+		for i, id := range devices {
+			device, err := NewDeviceEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			device.StorageAllocate(uint64(i+1) * 10 * GB)
+			err = device.Save(tx)
+			tests.Assert(t, err == nil)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	a := NewFreeSpaceAllocator()
+	err = app.db.View(func(tx *bolt.Tx) error {
+		devices, err := a.GetDevices(tx, cluster, "abc")
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(devices) == 4)
+
+		free := uint64(500 * GB)
+		for _, id := range devices {
+			device, err := NewDeviceEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, device.Info.Storage.Free < free)
+			free = device.Info.Storage.Free
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryCreateInjectedAllocator(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	app, _ := setupAllocatorTest(t, tmpfile)
+	defer app.Close()
+
+	// Only offer one device on each node
+	m := &mockAllocator{}
+	err := app.db.View(func(tx *bolt.Tx) error {
+		nodes := EntryKeys(tx, BOLTDB_BUCKET_NODE)
+		for _, id := range nodes {
+			node, err := NewNodeEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			m.devices = append(m.devices, node.Devices[0])
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+	app.allocator = m
+
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, m.calls == len(v.Bricks))
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		for _, id := range v.Bricks {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, brick.Info.DeviceId == m.devices[0] ||
+				brick.Info.DeviceId == m.devices[1])
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
@@ -27,16 +27,23 @@ import (
 	"github.com/heketi/heketi/utils"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 )
 
 const (
-	ASYNC_ROUTE           = "/queue"
-	BOLTDB_BUCKET_CLUSTER = "CLUSTER"
-	BOLTDB_BUCKET_NODE    = "NODE"
-	BOLTDB_BUCKET_VOLUME  = "VOLUME"
-	BOLTDB_BUCKET_DEVICE  = "DEVICE"
-	BOLTDB_BUCKET_BRICK   = "BRICK"
+	ASYNC_ROUTE               = "/queue"
+	BOLTDB_BUCKET_CLUSTER     = "CLUSTER"
+	BOLTDB_BUCKET_NODE        = "NODE"
+	BOLTDB_BUCKET_VOLUME      = "VOLUME"
+	BOLTDB_BUCKET_DEVICE      = "DEVICE"
+	BOLTDB_BUCKET_BRICK       = "BRICK"
+	BOLTDB_BUCKET_SNAPSHOT    = "SNAPSHOT"
+	BOLTDB_BUCKET_SCHEDULE    = "SCHEDULE"
+	BOLTDB_BUCKET_QUOTA       = "QUOTA"
+	BOLTDB_BUCKET_VOLUME_NAME = "VOLUMENAME"
+	BOLTDB_BUCKET_METADATA    = "METADATA"
+	BOLTDB_BUCKET_PENDING     = "PENDING"
 )
 
 var (
@@ -48,8 +55,24 @@ type App struct {
 	asyncManager *rest.AsyncHttpManager
 	db           *bolt.DB
 	executor     executors.Executor
+	allocator    Allocator
 	conf         *GlusterFSConfig
 
+	// Snapshot scheduler
+	schedulerStop chan struct{}
+	schedulerDone chan struct{}
+
+	// Schedules being run, and the handler of the last
+	// run of each schedule, by volume id
+	schedulerLock     sync.Mutex
+	schedulerRunning  map[string]bool
+	schedulerHandlers map[string]*rest.AsyncHttpHandler
+	schedulerRuns     sync.WaitGroup
+
+	// Periodic db backups
+	backupStop chan struct{}
+	backupDone chan struct{}
+
 	// For testing only.  Keep access to the object
 	// not through the interface
 	xo *mockexec.MockExecutor
@@ -79,13 +102,29 @@ func NewApp(configIo io.Reader) *App {
 	}
 	logger.Debug("Loaded %v executor", app.conf.Executor)
 
+	// Setup allocator
+	var err error
+	app.allocator, err = NewAllocator(app.conf.Allocator)
+	if err != nil {
+		logger.LogError("Unknown allocator %v", app.conf.Allocator)
+		return nil
+	}
+	logger.Debug("Loaded %v allocator", app.conf.Allocator)
+
+	// Check the db encoding
+	switch app.conf.DBEncoding {
+	case "", DB_ENCODING_GOB, DB_ENCODING_JSON:
+	default:
+		logger.LogError("Unknown db encoding %v", app.conf.DBEncoding)
+		return nil
+	}
+
 	// Set db is set in the configuration file
 	if app.conf.DBfile != "" {
 		dbfilename = app.conf.DBfile
 	}
 
 	// Setup BoltDB database
-	var err error
 	app.db, err = bolt.Open(dbfilename, 0600, &bolt.Options{Timeout: 3 * time.Second})
 	if err != nil {
 		logger.LogError("Unable to open database")
@@ -128,14 +167,74 @@ func NewApp(configIo io.Reader) *App {
 			return err
 		}
 
+		// Create Snapshot Bucket
+		_, err = tx.CreateBucketIfNotExists([]byte(BOLTDB_BUCKET_SNAPSHOT))
+		if err != nil {
+			logger.LogError("Unable to create snapshot bucket in DB")
+			return err
+		}
+
+		// Create Snapshot Schedule Bucket
+		_, err = tx.CreateBucketIfNotExists([]byte(BOLTDB_BUCKET_SCHEDULE))
+		if err != nil {
+			logger.LogError("Unable to create snapshot schedule bucket in DB")
+			return err
+		}
+
+		// Create Quota Bucket
+		_, err = tx.CreateBucketIfNotExists([]byte(BOLTDB_BUCKET_QUOTA))
+		if err != nil {
+			logger.LogError("Unable to create quota bucket in DB")
+			return err
+		}
+
+		// Create Volume Name Index Bucket
+		_, err = tx.CreateBucketIfNotExists([]byte(BOLTDB_BUCKET_VOLUME_NAME))
+		if err != nil {
+			logger.LogError("Unable to create volume name bucket in DB")
+			return err
+		}
+
+		// Create Metadata Bucket
+		_, err = tx.CreateBucketIfNotExists([]byte(BOLTDB_BUCKET_METADATA))
+		if err != nil {
+			logger.LogError("Unable to create metadata bucket in DB")
+			return err
+		}
+
+		// Create Pending Operations Bucket
+		_, err = tx.CreateBucketIfNotExists([]byte(BOLTDB_BUCKET_PENDING))
+		if err != nil {
+			logger.LogError("Unable to create pending operations bucket in DB")
+			return err
+		}
+
+		// Migrate the db to the current schema
+		err = dbUpgrade(tx, app.conf.DBEncoding)
+		if err != nil {
+			logger.LogError("Unable to upgrade the db: %v", err)
+			return err
+		}
+
 		return nil
 
 	})
 	if err != nil {
 		logger.Err(err)
+		app.db.Close()
 		return nil
 	}
 
+	// Finish or undo the operations interrupted when
+	// the server stopped
+	app.recoverOperations()
+
+	// Take the scheduled snapshots
+	app.startSnapshotScheduler()
+
+	// Back up the db
+	app.startBackups()
+
 	logger.Info("GlusterFS Application Loaded")
 
 	return app
@@ -198,6 +297,16 @@ func (a *App) SetRoutes(router *mux.Router) error {
 			Method:      "DELETE",
 			Pattern:     "/nodes/{id:[A-Fa-f0-9]+}",
 			HandlerFunc: a.NodeDelete},
+		rest.Route{
+			Name:        "NodeSetState",
+			Method:      "POST",
+			Pattern:     "/nodes/{id:[A-Fa-f0-9]+}/state",
+			HandlerFunc: a.NodeSetState},
+		rest.Route{
+			Name:        "NodeRemove",
+			Method:      "POST",
+			Pattern:     "/nodes/{id:[A-Fa-f0-9]+}/remove",
+			HandlerFunc: a.NodeRemove},
 
 		// Devices
 		rest.Route{
@@ -215,6 +324,18 @@ func (a *App) SetRoutes(router *mux.Router) error {
 			Method:      "DELETE",
 			Pattern:     "/devices/{id:[A-Fa-f0-9]+}",
 			HandlerFunc: a.DeviceDelete},
+		rest.Route{
+			Name:        "DeviceRemove",
+			Method:      "POST",
+			Pattern:     "/devices/{id:[A-Fa-f0-9]+}/remove",
+			HandlerFunc: a.DeviceRemove},
+
+		// Bricks
+		rest.Route{
+			Name:        "BrickReplace",
+			Method:      "POST",
+			Pattern:     "/bricks/{id:[A-Fa-f0-9]+}/replace",
+			HandlerFunc: a.BrickReplace},
 
 		// Volume
 		rest.Route{
@@ -232,6 +353,16 @@ func (a *App) SetRoutes(router *mux.Router) error {
 			Method:      "POST",
 			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/expand",
 			HandlerFunc: a.VolumeExpand},
+		rest.Route{
+			Name:        "VolumeShrink",
+			Method:      "POST",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/shrink",
+			HandlerFunc: a.VolumeShrink},
+		rest.Route{
+			Name:        "VolumeSetOptions",
+			Method:      "PATCH",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/options",
+			HandlerFunc: a.VolumeSetOptions},
 		rest.Route{
 			Name:        "VolumeDelete",
 			Method:      "DELETE",
@@ -242,6 +373,89 @@ func (a *App) SetRoutes(router *mux.Router) error {
 			Method:      "GET",
 			Pattern:     "/volumes",
 			HandlerFunc: a.VolumeList},
+
+		// Snapshot
+		rest.Route{
+			Name:        "SnapshotCreate",
+			Method:      "POST",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/snapshots",
+			HandlerFunc: a.SnapshotCreate},
+		rest.Route{
+			Name:        "SnapshotList",
+			Method:      "GET",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/snapshots",
+			HandlerFunc: a.SnapshotList},
+		rest.Route{
+			Name:        "SnapshotInfo",
+			Method:      "GET",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/snapshots/{snapshot:[A-Fa-f0-9]+}",
+			HandlerFunc: a.SnapshotInfo},
+		rest.Route{
+			Name:        "SnapshotDelete",
+			Method:      "DELETE",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/snapshots/{snapshot:[A-Fa-f0-9]+}",
+			HandlerFunc: a.SnapshotDelete},
+		rest.Route{
+			Name:        "SnapshotRestore",
+			Method:      "POST",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/snapshots/{snapshot:[A-Fa-f0-9]+}/restore",
+			HandlerFunc: a.SnapshotRestore},
+		rest.Route{
+			Name:        "SnapshotScheduleSet",
+			Method:      "PUT",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/snapshots/schedule",
+			HandlerFunc: a.SnapshotScheduleSet},
+		rest.Route{
+			Name:        "SnapshotScheduleInfo",
+			Method:      "GET",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/snapshots/schedule",
+			HandlerFunc: a.SnapshotScheduleInfo},
+		rest.Route{
+			Name:        "SnapshotScheduleDelete",
+			Method:      "DELETE",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/snapshots/schedule",
+			HandlerFunc: a.SnapshotScheduleDelete},
+
+		// Quota
+		rest.Route{
+			Name:        "QuotaSet",
+			Method:      "PUT",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/quota",
+			HandlerFunc: a.QuotaSet},
+		rest.Route{
+			Name:        "QuotaInfo",
+			Method:      "GET",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/quota",
+			HandlerFunc: a.QuotaInfo},
+		rest.Route{
+			Name:        "QuotaDisable",
+			Method:      "DELETE",
+			Pattern:     "/volumes/{id:[A-Fa-f0-9]+}/quota",
+			HandlerFunc: a.QuotaDisable},
+
+		// Db
+		rest.Route{
+			Name:        "DbCheck",
+			Method:      "GET",
+			Pattern:     "/db/check",
+			HandlerFunc: a.DbCheck},
+		rest.Route{
+			Name:        "DbRepair",
+			Method:      "POST",
+			Pattern:     "/db/check",
+			HandlerFunc: a.DbRepair},
+		rest.Route{
+			Name:        "DbDump",
+			Method:      "GET",
+			Pattern:     "/db/dump",
+			HandlerFunc: a.DbDump},
+
+		// Backup
+		rest.Route{
+			Name:        "BackupDb",
+			Method:      "GET",
+			Pattern:     "/backup/db",
+			HandlerFunc: a.BackupDb},
 	}
 
 	// Register all routes from the App
@@ -262,6 +476,10 @@ func (a *App) SetRoutes(router *mux.Router) error {
 
 func (a *App) Close() {
 
+	// Stop the snapshot scheduler and backups before closing the DB
+	a.stopSnapshotScheduler()
+	a.stopBackups()
+
 	// Close the DB
 	a.db.Close()
 	logger.Info("Closed")
@@ -0,0 +1,90 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func (a *App) BrickReplace(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// Get the brick and its volume
+	var volume *VolumeEntry
+	err := a.db.View(func(tx *bolt.Tx) error {
+
+		// Access brick entry
+		brick, err := NewBrickEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		// Access volume entry
+		volume, err = NewVolumeEntryFromId(tx, brick.Info.VolumeId)
+		if err == ErrNotFound {
+			http.Error(w, "Brick does not belong to a volume", http.StatusBadRequest)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		// Destroying the brick would destroy the clone bricks
+		if len(volume.Clones) > 0 {
+			http.Error(w, ErrHasClones.Error(), http.StatusConflict)
+			return ErrHasClones
+		}
+
+		// The data of bricks without replicas would be lost
+		if volume.bricksPerSet() < 2 {
+			http.Error(w, ErrNoRedundancy.Error(), http.StatusConflict)
+			return ErrNoRedundancy
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return
+	}
+
+	// Replace brick in an asynchronous function
+	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
+
+		logger.Info("Replacing brick %v in volume %v", id, volume.Info.Id)
+		err := volume.ReplaceBrick(a.db, a.executor, a.allocator, id)
+		if err != nil {
+			logger.LogError("Failed to replace brick %v: %v", id, err)
+			return "", err
+		}
+
+		logger.Info("Replaced brick %v in volume %v", id, volume.Info.Id)
+
+		// Done
+		return "/volumes/" + volume.Info.Id, nil
+	})
+
+}
@@ -156,6 +156,9 @@ func (a *App) ClusterDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Forget the devices of the cluster
+	a.allocator.DevicesChanged(id)
+
 	// Show that the key has been deleted
 	logger.Info("Deleted cluster [%s]", id)
 
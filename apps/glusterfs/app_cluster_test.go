@@ -72,7 +72,7 @@ func TestClusterCreate(t *testing.T) {
 	err = app.db.View(func(tx *bolt.Tx) error {
 		return entry.Unmarshal(
 			tx.Bucket([]byte(BOLTDB_BUCKET_CLUSTER)).
-				Get([]byte(msg.Id)))
+				Get([]byte(msg.Id)), DB_ENCODING_GOB)
 	})
 	tests.Assert(t, err == nil)
 
@@ -108,7 +108,7 @@ func TestClusterList(t *testing.T) {
 			var entry ClusterEntry
 
 			entry.Info.Id = fmt.Sprintf("%v", 5000+i)
-			buffer, err := entry.Marshal()
+			buffer, err := entry.Marshal(DB_ENCODING_GOB)
 			if err != nil {
 				return err
 			}
@@ -196,7 +196,7 @@ func TestClusterInfo(t *testing.T) {
 			return errors.New("Unable to open bucket")
 		}
 
-		buffer, err := entry.Marshal()
+		buffer, err := entry.Marshal(DB_ENCODING_GOB)
 		if err != nil {
 			return err
 		}
@@ -310,7 +310,7 @@ func TestClusterDelete(t *testing.T) {
 		}
 
 		for _, entry := range entries {
-			buffer, err := entry.Marshal()
+			buffer, err := entry.Marshal(DB_ENCODING_GOB)
 			if err != nil {
 				return err
 			}
@@ -348,12 +348,18 @@ func TestClusterDelete(t *testing.T) {
 	tests.Assert(t, r.StatusCode == http.StatusConflict)
 
 	// Delete cluster with no elements
+	ring := NewRingAllocator()
+	ring.rings["000"] = newDeviceRing(nil)
+	app.allocator = ring
 	req, err = http.NewRequest("DELETE", ts.URL+"/clusters/"+"000", nil)
 	tests.Assert(t, err == nil)
 	r, err = http.DefaultClient.Do(req)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, r.StatusCode == http.StatusOK)
 
+	// The ring of the cluster is dropped
+	tests.Assert(t, len(ring.rings) == 0)
+
 	// Check database still has a1,a2, and a3, but not '000'
 	err = app.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BOLTDB_BUCKET_CLUSTER))
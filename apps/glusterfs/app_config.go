@@ -25,7 +25,28 @@ import (
 type GlusterFSConfig struct {
 	DBfile    string            `json:"db"`
 	Executor  string            `json:"executor"`
+	Allocator string            `json:"allocator"`
 	SshConfig sshexec.SshConfig `json:"sshexec"`
+
+	// Encoding of the entries in the db, gob or json.  The
+	// entries are converted when the encoding changes.  The
+	// encoding of an existing db is kept when it is not set.
+	DBEncoding string `json:"db_encoding"`
+
+	// Periodic backups of the db
+	Backup BackupConfig `json:"backup"`
+}
+
+type BackupConfig struct {
+	// Directory to write the backups to.  Periodic backups
+	// are disabled when it is not set.
+	Dir string `json:"dir"`
+
+	// Minutes between backups, 60 by default
+	Interval int `json:"interval"`
+
+	// Number of backups to keep, 7 by default
+	Keep int `json:"keep"`
 }
 
 type ConfigFile struct {
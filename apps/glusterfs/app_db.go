@@ -0,0 +1,110 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"net/http"
+	"strconv"
+)
+
+// Report the problems in the db without changing it
+func (a *App) DbCheck(w http.ResponseWriter, r *http.Request) {
+
+	var result *DbCheckResponse
+	err := a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = DbCheck(tx, false)
+		return err
+	})
+	if err != nil {
+		logger.Err(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		panic(err)
+	}
+}
+
+// Repair the problems in the db.  Entries being changed by an
+// operation in progress may be reported as problems, so this is
+// best done while the server is idle.
+func (a *App) DbRepair(w http.ResponseWriter, r *http.Request) {
+
+	var result *DbCheckResponse
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		result, err = DbCheck(tx, true)
+		return err
+	})
+	if err != nil {
+		logger.Err(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		panic(err)
+	}
+}
+
+// Send every entry in the db
+func (a *App) DbDump(w http.ResponseWriter, r *http.Request) {
+
+	var dump *DbDump
+	err := a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		dump, err = DbDumpCreate(tx)
+		return err
+	})
+	if err != nil {
+		logger.Err(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(dump); err != nil {
+		panic(err)
+	}
+}
+
+// Send a consistent copy of the db file
+func (a *App) BackupDb(w http.ResponseWriter, r *http.Request) {
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="heketi.db"`)
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		w.WriteHeader(http.StatusOK)
+
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		// The status has already been sent
+		logger.Err(err)
+	}
+}
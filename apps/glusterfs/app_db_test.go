@@ -0,0 +1,147 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/tests"
+	"github.com/heketi/heketi/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestDbCheckHandlers(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := setupDbCheckVolume(t, app)
+	problems, orphan := corruptDb(t, app, v)
+
+	// Check without repairing
+	r, err := http.Get(ts.URL + "/db/check")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+	tests.Assert(t, r.Header.Get("Content-Type") == "application/json; charset=UTF-8")
+
+	var msg DbCheckResponse
+	err = utils.GetJsonFromResponse(r, &msg)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, msg.Repair == false)
+	tests.Assert(t, len(msg.Problems) == problems)
+
+	// Repair
+	r, err = http.Post(ts.URL+"/db/check", "application/json", nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+
+	msg = DbCheckResponse{}
+	err = utils.GetJsonFromResponse(r, &msg)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, msg.Repair == true)
+	tests.Assert(t, len(msg.Problems) == problems)
+
+	// The orphan is left
+	r, err = http.Get(ts.URL + "/db/check")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+
+	msg = DbCheckResponse{}
+	err = utils.GetJsonFromResponse(r, &msg)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(msg.Problems) == 1)
+	tests.Assert(t, msg.Problems[0].Id == orphan)
+}
+
+func TestDbDumpHandler(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v, _ := setupDbDump(t, app)
+
+	r, err := http.Get(ts.URL + "/db/dump")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+	tests.Assert(t, r.Header.Get("Content-Type") == "application/json; charset=UTF-8")
+
+	var dump DbDump
+	err = utils.GetJsonFromResponse(r, &dump)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, dump.Version == DB_SCHEMA_VERSION)
+	tests.Assert(t, len(dump.Volumes) == 1)
+	tests.Assert(t, len(dump.Bricks) == len(v.Bricks))
+	tests.Assert(t, len(dump.Nodes) == 4)
+	tests.Assert(t, len(dump.Check()) == 0)
+}
+
+func TestBackupDbHandler(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+	backupfile := tests.Tempfile()
+	defer os.Remove(backupfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	_, dump := setupDbDump(t, app)
+
+	r, err := http.Get(ts.URL + "/backup/db")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+	tests.Assert(t, r.Header.Get("Content-Type") == "application/octet-stream")
+
+	// The copy has the entries of the db
+	fp, err := os.Create(backupfile)
+	tests.Assert(t, err == nil)
+	_, err = io.Copy(fp, r.Body)
+	tests.Assert(t, err == nil)
+	r.Body.Close()
+	fp.Close()
+
+	copied := backupDump(t, backupfile)
+	tests.Assert(t, bytes.Equal(dbDumpJson(t, dump), dbDumpJson(t, copied)))
+}
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"github.com/boltdb/bolt"
 	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/rest"
 	"github.com/heketi/heketi/utils"
 	"net/http"
 )
@@ -106,6 +107,9 @@ func (a *App) DeviceAdd(w http.ResponseWriter, r *http.Request) {
 			return "", err
 		}
 
+		// Place bricks on the new device
+		a.allocator.DevicesChanged(node.Info.ClusterId)
+
 		logger.Info("Added device %v", msg.Name)
 
 		// Done
@@ -161,10 +165,7 @@ func (a *App) DeviceDelete(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	// Check request
-	var (
-		device *DeviceEntry
-		node   *NodeEntry
-	)
+	var device *DeviceEntry
 	err := a.db.View(func(tx *bolt.Tx) error {
 		var err error
 		// Access device entry
@@ -185,7 +186,7 @@ func (a *App) DeviceDelete(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Access node entry
-		node, err = NewNodeEntryFromId(tx, device.NodeId)
+		_, err = NewNodeEntryFromId(tx, device.NodeId)
 		if err != nil {
 			logger.Err(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -202,51 +203,63 @@ func (a *App) DeviceDelete(w http.ResponseWriter, r *http.Request) {
 	logger.Info("Deleting device %v on node %v", device.Info.Id, device.NodeId)
 	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
 
-		// Teardown device
-		err := a.executor.DeviceTeardown(node.ManageHostName(),
-			device.Info.Name, device.Info.Id)
+		// Teardown device and remove it from the db
+		err := device.Destroy(a.db, a.executor, a.allocator)
 		if err != nil {
 			return "", err
 		}
 
-		// Get info from db
-		err = a.db.Update(func(tx *bolt.Tx) error {
+		// Show that the key has been deleted
+		logger.Info("Deleted node [%s]", id)
 
-			// Access node entry
-			node, err := NewNodeEntryFromId(tx, device.NodeId)
-			if err == ErrNotFound {
-				logger.Critical(
-					"Node id %v pointed to by device %v, but it is not in the db",
-					device.NodeId,
-					device.Info.Id)
-				return err
-			} else if err != nil {
-				logger.Err(err)
-				return err
-			}
+		return "", nil
+	})
 
-			// Delete device from node
-			node.DeviceDelete(device.Info.Id)
+}
 
-			// Save node
-			node.Save(tx)
+func (a *App) DeviceRemove(w http.ResponseWriter, r *http.Request) {
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
 
-			// Delete device from db
-			err = device.Delete(tx)
-			if err != nil {
-				logger.Err(err)
-				return err
-			}
+	// Access device entry
+	var device *DeviceEntry
+	err := a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		device, err = NewDeviceEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			logger.Err(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
 
-			return nil
+		return nil
+	})
+	if err != nil {
+		return
+	}
 
-		})
+	// Move the bricks off the device, then delete it
+	logger.Info("Removing device %v on node %v", device.Info.Id, device.NodeId)
+	a.asyncManager.AsyncHttpRedirectHandlerFunc(w, r, func(h *rest.AsyncHttpHandler) (string, error) {
+
+		err := device.Evacuate(a.db, a.executor, a.allocator, h.Progress)
 		if err != nil {
+			logger.LogError("Failed to evacuate device %v: %v", id, err)
 			return "", err
 		}
 
-		// Show that the key has been deleted
-		logger.Info("Deleted node [%s]", id)
+		h.Progress("Deleting device")
+		err = device.Destroy(a.db, a.executor, a.allocator)
+		if err != nil {
+			logger.LogError("Failed to delete device %v: %v", id, err)
+			return "", err
+		}
+
+		logger.Info("Removed device %v", id)
 
 		return "", nil
 	})
@@ -412,3 +412,80 @@ func TestDeviceDeleteErrors(t *testing.T) {
 	tests.Assert(t, err == nil)
 	tests.Assert(t, r.StatusCode == http.StatusInternalServerError)
 }
+
+func TestDeviceRemove(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Get the device of one of the bricks
+	var deviceId string
+	err = app.db.View(func(tx *bolt.Tx) error {
+		brick, err := NewBrickEntryFromId(tx, v.Bricks[0])
+		if err != nil {
+			return err
+		}
+
+		deviceId = brick.Info.DeviceId
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Remove unknown id
+	r, err := http.Post(ts.URL+"/devices/123/remove", "application/json", nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	// Remove the device
+	r, err = http.Post(ts.URL+"/devices/"+deviceId+"/remove", "application/json", nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	for {
+		r, err = http.Get(location.String())
+		tests.Assert(t, err == nil)
+		if r.Header.Get("X-Pending") == "true" {
+			tests.Assert(t, r.StatusCode == http.StatusOK)
+			time.Sleep(time.Millisecond * 10)
+		} else {
+			tests.Assert(t, r.StatusCode == http.StatusNoContent)
+			break
+		}
+	}
+
+	// Check the device is gone and the volume kept its bricks
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewDeviceEntryFromId(tx, deviceId)
+		tests.Assert(t, err == ErrNotFound)
+
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Bricks) == 4)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"github.com/boltdb/bolt"
 	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/rest"
 	"github.com/heketi/heketi/utils"
 	"net/http"
 )
@@ -178,10 +179,7 @@ func (a *App) NodeDelete(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	// Get node info
-	var (
-		peer_node, node *NodeEntry
-		cluster         *ClusterEntry
-	)
+	var node *NodeEntry
 	err := a.db.View(func(tx *bolt.Tx) error {
 
 		// Access node entry
@@ -201,8 +199,8 @@ func (a *App) NodeDelete(w http.ResponseWriter, r *http.Request) {
 			return ErrConflict
 		}
 
-		// Access cluster information and peer node
-		cluster, err = NewClusterEntryFromId(tx, node.Info.ClusterId)
+		// Check the cluster exists
+		_, err = NewClusterEntryFromId(tx, node.Info.ClusterId)
 		if err == ErrNotFound {
 			http.Error(w, "Cluster id does not exist", http.StatusNotFound)
 			return err
@@ -211,12 +209,6 @@ func (a *App) NodeDelete(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		// Get a node in the cluster to execute the Gluster peer command
-		peer_node, err = cluster.PeerNode(tx)
-		if err != nil {
-			logger.Err(err)
-			return err
-		}
 		return nil
 	})
 	if err != nil {
@@ -227,54 +219,122 @@ func (a *App) NodeDelete(w http.ResponseWriter, r *http.Request) {
 	logger.Info("Deleting node %v [%v]", node.ManageHostName(), node.Info.Id)
 	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
 
-		// Remove from trusted pool
-		if peer_node != nil {
-			err := a.executor.PeerDetach(peer_node.ManageHostName(), node.ManageHostName())
-			if err != nil {
-				return "", err
-			}
+		// Remove from trusted pool and db
+		err := node.Destroy(a.db, a.executor, a.allocator)
+		if err != nil {
+			return "", err
 		}
 
-		// Remove from db
-		err = a.db.Update(func(tx *bolt.Tx) error {
+		// Show that the key has been deleted
+		logger.Info("Deleted node [%s]", id)
 
-			// Get Cluster
-			cluster, err := NewClusterEntryFromId(tx, node.Info.ClusterId)
-			if err == ErrNotFound {
-				logger.Critical("Cluster id %v is expected be in db. Pointed to by node %v",
-					node.Info.ClusterId,
-					node.Info.Id)
-				return err
-			} else if err != nil {
-				logger.Err(err)
-				return err
-			}
-			cluster.NodeDelete(node.Info.Id)
+		return "", nil
 
-			// Save cluster
-			err = cluster.Save(tx)
-			if err != nil {
-				logger.Err(err)
-				return err
-			}
+	})
+}
 
-			// Delete node from db
-			err = node.Delete(tx)
-			if err != nil {
-				logger.Err(err)
-				return err
-			}
+func (a *App) NodeSetState(w http.ResponseWriter, r *http.Request) {
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
 
-			return nil
+	var msg NodeStateRequest
+	err := utils.GetJsonFromRequest(r, &msg)
+	if err != nil {
+		http.Error(w, "request unable to be parsed", 422)
+		return
+	}
 
-		})
+	// Check the message
+	if _, ok := nodeStateTransitions[msg.State]; !ok {
+		http.Error(w, "Invalid node state", http.StatusBadRequest)
+		return
+	}
+
+	// Change the state in the db
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		node, err := NewNodeEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		err = node.SetState(msg.State)
+		if err == ErrInvalidState {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return err
+		}
+
+		err = node.Save(tx)
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *App) NodeRemove(w http.ResponseWriter, r *http.Request) {
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// Get node info
+	var node *NodeEntry
+	err := a.db.View(func(tx *bolt.Tx) error {
+
+		// Access node entry
+		var err error
+		node, err = NewNodeEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		// New bricks could be placed on an online node while
+		// it is being evacuated
+		if node.IsOnline() {
+			http.Error(w, ErrNodeOnline.Error(), http.StatusConflict)
+			return ErrNodeOnline
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Evacuate and delete node asynchronously
+	logger.Info("Removing node %v [%v]", node.ManageHostName(), node.Info.Id)
+	a.asyncManager.AsyncHttpRedirectHandlerFunc(w, r, func(h *rest.AsyncHttpHandler) (string, error) {
+
+		err := node.Evacuate(a.db, a.executor, a.allocator, h.Progress)
+		if err != nil {
+			logger.LogError("Failed to evacuate node %v: %v", id, err)
 			return "", err
 		}
-		// Show that the key has been deleted
-		logger.Info("Deleted node [%s]", id)
 
-		return "", nil
+		h.Progress("Removing node from the cluster")
+		err = node.Destroy(a.db, a.executor, a.allocator)
+		if err != nil {
+			logger.LogError("Failed to delete node %v: %v", id, err)
+			return "", err
+		}
+
+		logger.Info("Removed node %v", id)
 
+		return "", nil
 	})
 }
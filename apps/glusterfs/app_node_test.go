@@ -547,7 +547,8 @@ func TestNodePeerDetachFailure(t *testing.T) {
 	// Setup the mock peer probe to fail
 	peer_called := false
 	peer_calls := 0
-	app.xo.MockPeerDetach = func(exec_host, newnode string) error {
+	app.xo.MockPeerDetach = func(exec_host, newnode string, force bool) error {
+		tests.Assert(t, !force)
 		peer_calls++
 		peer_called = true
 		return errors.New("Mock")
@@ -619,3 +620,171 @@ func TestNodePeerDetachFailure(t *testing.T) {
 	})
 	tests.Assert(t, err == nil)
 }
+
+func TestNodeSetState(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,     // clusters
+		2,     // nodes_per_cluster
+		0,     // devices_per_node,
+		50*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	var nodeid string
+	err = app.db.View(func(tx *bolt.Tx) error {
+		nodeid = EntryKeys(tx, BOLTDB_BUCKET_NODE)[0]
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Bad JSON
+	request := []byte(`{ bad json`)
+	r, err := http.Post(ts.URL+"/nodes/"+nodeid+"/state",
+		"application/json",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == 422)
+
+	// Unknown state
+	request = []byte(`{"state" : "bogus"}`)
+	r, err = http.Post(ts.URL+"/nodes/"+nodeid+"/state",
+		"application/json",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Unknown node
+	request = []byte(`{"state" : "offline"}`)
+	r, err = http.Post(ts.URL+"/nodes/123/state",
+		"application/json",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	// Mark node as failed
+	request = []byte(`{"state" : "failed"}`)
+	r, err = http.Post(ts.URL+"/nodes/"+nodeid+"/state",
+		"application/json",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNoContent)
+
+	// A failed node cannot go directly online
+	request = []byte(`{"state" : "online"}`)
+	r, err = http.Post(ts.URL+"/nodes/"+nodeid+"/state",
+		"application/json",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusConflict)
+
+	// Check the state is reported
+	r, err = http.Get(ts.URL + "/nodes/" + nodeid)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+	var info NodeInfoResponse
+	err = utils.GetJsonFromResponse(r, &info)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, info.State == NODE_STATE_FAILED)
+}
+
+func TestNodeRemove(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Get the node of one of the bricks
+	var nodeid string
+	err = app.db.View(func(tx *bolt.Tx) error {
+		brick, err := NewBrickEntryFromId(tx, v.Bricks[0])
+		if err != nil {
+			return err
+		}
+
+		nodeid = brick.Info.NodeId
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Unknown node
+	r, err := http.Post(ts.URL+"/nodes/123/remove", "application/json", nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	// Node must not be online
+	r, err = http.Post(ts.URL+"/nodes/"+nodeid+"/remove", "application/json", nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusConflict)
+
+	request := []byte(`{"state" : "offline"}`)
+	r, err = http.Post(ts.URL+"/nodes/"+nodeid+"/state",
+		"application/json",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNoContent)
+
+	// Remove the node
+	r, err = http.Post(ts.URL+"/nodes/"+nodeid+"/remove", "application/json", nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	for {
+		r, err = http.Get(location.String())
+		tests.Assert(t, err == nil)
+		if r.Header.Get("X-Pending") == "true" {
+			tests.Assert(t, r.StatusCode == http.StatusOK)
+			time.Sleep(time.Millisecond * 10)
+		} else {
+			tests.Assert(t, r.StatusCode == http.StatusNoContent)
+			break
+		}
+	}
+
+	// Check the node is gone and the volume kept its bricks
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewNodeEntryFromId(tx, nodeid)
+		tests.Assert(t, err == ErrNotFound)
+
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Bricks) == 4)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
@@ -0,0 +1,226 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/utils"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Quota directories are absolute, clean paths in the volume.  They
+// are passed to the GlusterFS command line, so characters which the
+// shell would interpret are refused.
+func validQuotaPath(dir string) bool {
+	return strings.HasPrefix(dir, "/") &&
+		path.Clean(dir) == dir &&
+		!strings.ContainsAny(dir, "\"'`$\\\n")
+}
+
+func (a *App) QuotaSet(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var msg QuotaRequest
+	err := utils.GetJsonFromRequest(r, &msg)
+	if err != nil {
+		http.Error(w, "request unable to be parsed", 422)
+		return
+	}
+
+	// Check the message
+	for dir, limit := range msg.Set {
+		if !validQuotaPath(dir) {
+			http.Error(w, fmt.Sprintf("Invalid quota directory %v", dir),
+				http.StatusBadRequest)
+			return
+		}
+		if limit.HardLimit < 1 {
+			http.Error(w, fmt.Sprintf("Invalid hard limit for %v", dir),
+				http.StatusBadRequest)
+			return
+		}
+		if limit.SoftLimit < 0 || limit.SoftLimit > 99 {
+			http.Error(w, fmt.Sprintf("Invalid soft limit for %v", dir),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	for _, dir := range msg.Remove {
+		if !validQuotaPath(dir) {
+			http.Error(w, fmt.Sprintf("Invalid quota directory %v", dir),
+				http.StatusBadRequest)
+			return
+		}
+		if _, ok := msg.Set[dir]; ok {
+			http.Error(w, fmt.Sprintf("Quota of %v cannot be both set and removed", dir),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Quota is enabled on the volume the first time it is set
+	var quota *QuotaEntry
+	enable := false
+	err = a.db.View(func(tx *bolt.Tx) error {
+		_, err := NewVolumeEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		quota, err = NewQuotaEntryFromId(tx, id)
+		if err == ErrNotFound {
+			quota = NewQuotaEntryFromVolumeId(id)
+			enable = true
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if !enable && len(msg.Set) == 0 && len(msg.Remove) == 0 {
+		http.Error(w, "No quota limits to set or remove", http.StatusBadRequest)
+		return
+	}
+
+	// Apply the quota in an asynchronous function
+	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
+
+		if enable {
+			logger.Info("Enabling quota on volume %v", id)
+			err := quota.Enable(a.db, a.executor)
+			if err != nil {
+				logger.LogError("Failed to enable quota on volume %v: %v", id, err)
+				return "", err
+			}
+		}
+
+		if len(msg.Set) != 0 || len(msg.Remove) != 0 {
+			err := quota.SetLimits(a.db, a.executor, &msg)
+			if err != nil {
+				logger.LogError("Failed to set quota on volume %v: %v", id, err)
+				return "", err
+			}
+		}
+
+		logger.Info("Set quota on volume %v", id)
+
+		// Done
+		return "/volumes/" + id + "/quota", nil
+	})
+}
+
+func (a *App) QuotaInfo(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var info *QuotaInfoResponse
+	var quota *QuotaEntry
+	err := a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		quota, err = NewQuotaEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		info, err = quota.NewInfoResponse(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Get the usage from GlusterFS
+	info.Usage, err = quota.Usage(a.db, a.executor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Write msg
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		panic(err)
+	}
+}
+
+func (a *App) QuotaDisable(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var quota *QuotaEntry
+	err := a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		quota, err = NewQuotaEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Disable quota in an asynchronous function
+	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
+
+		logger.Info("Disabling quota on volume %v", id)
+		err := quota.Disable(a.db, a.executor)
+		if err != nil {
+			logger.LogError("Failed to disable quota on volume %v: %v", id, err)
+			return "", err
+		}
+
+		logger.Info("Disabled quota on volume %v", id)
+		return "", nil
+	})
+}
@@ -0,0 +1,204 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/executors"
+	"github.com/heketi/heketi/tests"
+	"github.com/heketi/heketi/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidQuotaPath(t *testing.T) {
+	tests.Assert(t, validQuotaPath("/"))
+	tests.Assert(t, validQuotaPath("/team"))
+	tests.Assert(t, validQuotaPath("/team/a b"))
+	tests.Assert(t, !validQuotaPath(""))
+	tests.Assert(t, !validQuotaPath("team"))
+	tests.Assert(t, !validQuotaPath("/team/"))
+	tests.Assert(t, !validQuotaPath("/team/../other"))
+	tests.Assert(t, !validQuotaPath("/$(reboot)"))
+	tests.Assert(t, !validQuotaPath("/team\"a"))
+}
+
+func TestQuotaSetBadRequest(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := createSampleSnapshotVolume(t, app, false)
+
+	put := func(id string, body string) *http.Response {
+		req, err := http.NewRequest("PUT", ts.URL+"/volumes/"+id+"/quota",
+			bytes.NewBufferString(body))
+		tests.Assert(t, err == nil)
+		r, err := http.DefaultClient.Do(req)
+		tests.Assert(t, err == nil)
+		return r
+	}
+
+	// Bad JSON
+	r := put(v.Info.Id, `{ bad json }`)
+	tests.Assert(t, r.StatusCode == 422)
+
+	// Relative directory
+	r = put(v.Info.Id, `{"set" : {"team" : {"hard_limit" : 10}}}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// No hard limit
+	r = put(v.Info.Id, `{"set" : {"/team" : {"hard_limit" : 0}}}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Bad soft limit
+	r = put(v.Info.Id, `{"set" : {"/team" : {"hard_limit" : 10, "soft_limit" : 100}}}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Set and remove the same directory
+	r = put(v.Info.Id, `{
+		"set" : {"/team" : {"hard_limit" : 10}},
+		"remove" : ["/team"]
+	}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Unknown volume
+	r = put("123", `{"set" : {"/team" : {"hard_limit" : 10}}}`)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	// No quota to report or disable
+	r, err := http.Get(ts.URL + "/volumes/" + v.Info.Id + "/quota")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	req, err := http.NewRequest("DELETE", ts.URL+"/volumes/"+v.Info.Id+"/quota", nil)
+	tests.Assert(t, err == nil)
+	r, err = http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+}
+
+func TestQuotaSetInfoDisable(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := createSampleSnapshotVolume(t, app, false)
+	url := ts.URL + "/volumes/" + v.Info.Id + "/quota"
+
+	app.xo.MockQuotaList = func(host string, volume string) ([]executors.QuotaUsage, error) {
+		return []executors.QuotaUsage{
+			executors.QuotaUsage{
+				Path:      "/team",
+				HardLimit: 10 * GB,
+				SoftLimit: 80,
+				Used:      1 * GB,
+				Available: 9 * GB,
+			},
+		}, nil
+	}
+
+	// Enable quota with a limit
+	request := []byte(`{
+		"set" : {"/team" : {"hard_limit" : 10}}
+	}`)
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	r, err := http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	var info QuotaInfoResponse
+	for {
+		r, err := http.Get(location.String())
+		tests.Assert(t, err == nil)
+		tests.Assert(t, r.StatusCode == http.StatusOK)
+		if r.Header.Get("X-Pending") == "true" {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		} else {
+			err = utils.GetJsonFromResponse(r, &info)
+			tests.Assert(t, err == nil)
+			break
+		}
+	}
+
+	tests.Assert(t, info.VolumeId == v.Info.Id)
+	tests.Assert(t, len(info.Limits) == 1)
+	tests.Assert(t, info.Limits["/team"].HardLimit == 10)
+	tests.Assert(t, len(info.Usage) == 1)
+	tests.Assert(t, info.Usage[0].Path == "/team")
+	tests.Assert(t, info.Usage[0].Used == 1*GB)
+
+	// An empty request has nothing to do once quota is enabled
+	req, err = http.NewRequest("PUT", url, bytes.NewBufferString(`{}`))
+	tests.Assert(t, err == nil)
+	r, err = http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Disable quota
+	req, err = http.NewRequest("DELETE", url, nil)
+	tests.Assert(t, err == nil)
+	r, err = http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err = r.Location()
+	tests.Assert(t, err == nil)
+
+	for {
+		r, err := http.Get(location.String())
+		tests.Assert(t, err == nil)
+		if r.Header.Get("X-Pending") == "true" {
+			tests.Assert(t, r.StatusCode == http.StatusOK)
+			time.Sleep(time.Millisecond * 10)
+			continue
+		} else {
+			tests.Assert(t, r.StatusCode == http.StatusNoContent)
+			break
+		}
+	}
+
+	r, err = http.Get(url)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+}
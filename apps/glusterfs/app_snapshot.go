@@ -0,0 +1,387 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/utils"
+	"net/http"
+)
+
+func (a *App) SnapshotCreate(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var msg SnapshotCreateRequest
+	err := utils.GetJsonFromRequest(r, &msg)
+	if err != nil {
+		http.Error(w, "request unable to be parsed", 422)
+		return
+	}
+
+	// Snapshot names are passed to the GlusterFS command line
+	// like volume names
+	if msg.Name != "" && !volumeNameRegexp.MatchString(msg.Name) {
+		http.Error(w, "Invalid snapshot name", http.StatusBadRequest)
+		return
+	}
+	if !validGlusterValue(msg.Description) {
+		http.Error(w, "Invalid snapshot description", http.StatusBadRequest)
+		return
+	}
+
+	// Check the volume can be snapshotted
+	err = a.db.View(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		if !volume.Info.Snapshot.Enable {
+			http.Error(w, ErrSnapshotDisabled.Error(), http.StatusBadRequest)
+			return ErrSnapshotDisabled
+		}
+
+		// Snapshot names are unique in GlusterFS, not per volume
+		if msg.Name != "" {
+			_, err := SnapshotIdFromName(tx, msg.Name)
+			if err == nil {
+				http.Error(w, fmt.Sprintf("Snapshot name %v already exists", msg.Name),
+					http.StatusConflict)
+				return ErrConflict
+			} else if err != ErrNotFound {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Create a snapshot entry
+	snapshot := NewSnapshotEntryFromRequest(id, &msg)
+
+	// Create snapshot in an asynchronous function
+	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
+
+		logger.Info("Creating snapshot %v of volume %v", snapshot.Info.Id, id)
+		err := snapshot.Create(a.db, a.executor)
+		if err != nil {
+			logger.LogError("Failed to create snapshot %v: %v", snapshot.Info.Id, err)
+			return "", err
+		}
+
+		logger.Info("Created snapshot %v of volume %v", snapshot.Info.Id, id)
+
+		// Done
+		return "/volumes/" + id + "/snapshots/" + snapshot.Info.Id, nil
+	})
+
+}
+
+func (a *App) SnapshotList(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var list SnapshotListResponse
+	err := a.db.View(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		list.Snapshots = volume.SnapshotsIds()
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Send list back
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		panic(err)
+	}
+}
+
+// Returns the snapshot in the URL after checking that it
+// belongs to the volume in the URL
+func (a *App) snapshotFromRequest(w http.ResponseWriter,
+	r *http.Request) (*SnapshotEntry, error) {
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	snapshotId := vars["snapshot"]
+
+	var snapshot *SnapshotEntry
+	err := a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		snapshot, err = NewSnapshotEntryFromId(tx, snapshotId)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		if snapshot.Info.VolumeId != id {
+			http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+			return ErrNotFound
+		}
+
+		return nil
+	})
+
+	return snapshot, err
+}
+
+func (a *App) SnapshotInfo(w http.ResponseWriter, r *http.Request) {
+
+	snapshot, err := a.snapshotFromRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	info, err := snapshot.NewInfoResponse(nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Write msg
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		panic(err)
+	}
+}
+
+func (a *App) SnapshotDelete(w http.ResponseWriter, r *http.Request) {
+
+	snapshot, err := a.snapshotFromRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	// Delete snapshot in an asynchronous function
+	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
+
+		logger.Info("Deleting snapshot %v", snapshot.Info.Id)
+		err := snapshot.Destroy(a.db, a.executor)
+		if err != nil {
+			logger.LogError("Failed to delete snapshot %v: %v", snapshot.Info.Id, err)
+			return "", err
+		}
+
+		logger.Info("Deleted snapshot %v", snapshot.Info.Id)
+		return "", nil
+	})
+
+}
+
+func (a *App) SnapshotRestore(w http.ResponseWriter, r *http.Request) {
+
+	snapshot, err := a.snapshotFromRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	// Restore volume in an asynchronous function
+	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
+
+		logger.Info("Restoring volume %v from snapshot %v",
+			snapshot.Info.VolumeId, snapshot.Info.Id)
+		err := snapshot.Restore(a.db, a.executor)
+		if err != nil {
+			logger.LogError("Failed to restore snapshot %v: %v", snapshot.Info.Id, err)
+			return "", err
+		}
+
+		logger.Info("Restored volume %v from snapshot %v",
+			snapshot.Info.VolumeId, snapshot.Info.Id)
+
+		// Done
+		return "/volumes/" + snapshot.Info.VolumeId, nil
+	})
+
+}
+
+func (a *App) SnapshotScheduleSet(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var msg SnapshotScheduleRequest
+	err := utils.GetJsonFromRequest(r, &msg)
+	if err != nil {
+		http.Error(w, "request unable to be parsed", 422)
+		return
+	}
+
+	// Check the message
+	if msg.Interval < 1 {
+		http.Error(w, "Invalid snapshot interval", http.StatusBadRequest)
+		return
+	}
+	if msg.Retention < 1 {
+		http.Error(w, "Invalid snapshot retention", http.StatusBadRequest)
+		return
+	}
+
+	var info *SnapshotScheduleInfo
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		if !volume.Info.Snapshot.Enable {
+			http.Error(w, ErrSnapshotDisabled.Error(), http.StatusBadRequest)
+			return ErrSnapshotDisabled
+		}
+
+		// Keep the record of the last run when changing a schedule
+		schedule, err := NewSnapshotScheduleEntryFromId(tx, id)
+		if err == ErrNotFound {
+			schedule = NewSnapshotScheduleEntryFromRequest(id, &msg)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		} else {
+			schedule.Info.SnapshotScheduleRequest = msg
+		}
+
+		err = schedule.Save(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		info, err = schedule.NewInfoResponse(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Write msg
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		panic(err)
+	}
+}
+
+func (a *App) SnapshotScheduleInfo(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var info *SnapshotScheduleInfo
+	err := a.db.View(func(tx *bolt.Tx) error {
+		schedule, err := NewSnapshotScheduleEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		info, err = schedule.NewInfoResponse(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Write msg
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		panic(err)
+	}
+}
+
+func (a *App) SnapshotScheduleDelete(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// The snapshots already taken are kept
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		schedule, err := NewSnapshotScheduleEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		err = schedule.Delete(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Write msg
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,410 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/executors"
+	"github.com/heketi/heketi/tests"
+	"github.com/heketi/heketi/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSnapshotCreateVolumeNotFound(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := []byte(`{}`)
+	r, err := http.Post(ts.URL+"/volumes/12345/snapshots", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	r, err = http.Get(ts.URL + "/volumes/12345/snapshots")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+}
+
+func TestSnapshotCreateDisabled(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := createSampleSnapshotVolume(t, app, false)
+
+	request := []byte(`{}`)
+	r, err := http.Post(ts.URL+"/volumes/"+v.Info.Id+"/snapshots", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	s, err := utils.GetStringFromResponse(r)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, s == ErrSnapshotDisabled.Error()+"\n")
+}
+
+func TestSnapshotCreateBadRequest(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+
+	// Names and descriptions the shell would interpret
+	for _, request := range []string{
+		`{"name" : "mysnap; reboot"}`,
+		`{"name" : "mysnap", "description" : "$(reboot)"}`,
+		`{"name" : "mysnap", "description" : "\"; reboot; \""}`,
+	} {
+		r, err := http.Post(ts.URL+"/volumes/"+v.Info.Id+"/snapshots", "application/json",
+			bytes.NewBufferString(request))
+		tests.Assert(t, err == nil)
+		tests.Assert(t, r.StatusCode == http.StatusBadRequest, request)
+	}
+}
+
+func TestSnapshotCreateInfoListDelete(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+
+	// Create a snapshot
+	request := []byte(`{
+        "name" : "mysnap",
+        "description" : "before migration"
+    }`)
+	r, err := http.Post(ts.URL+"/volumes/"+v.Info.Id+"/snapshots", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	var info SnapshotInfo
+	for {
+		r, err = http.Get(location.String())
+		tests.Assert(t, err == nil)
+		tests.Assert(t, r.StatusCode == http.StatusOK)
+		if r.Header.Get("X-Pending") == "true" {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		} else {
+			err = utils.GetJsonFromResponse(r, &info)
+			tests.Assert(t, err == nil)
+			break
+		}
+	}
+	tests.Assert(t, info.Id != "")
+	tests.Assert(t, info.Name == "mysnap")
+	tests.Assert(t, info.Description == "before migration")
+	tests.Assert(t, info.VolumeId == v.Info.Id)
+	tests.Assert(t, info.Created != 0)
+
+	// List the snapshots of the volume
+	var list SnapshotListResponse
+	r, err = http.Get(ts.URL + "/volumes/" + v.Info.Id + "/snapshots")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+	err = utils.GetJsonFromResponse(r, &list)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(list.Snapshots) == 1)
+	tests.Assert(t, list.Snapshots[0] == info.Id)
+
+	// Snapshot names are unique
+	r, err = http.Post(ts.URL+"/volumes/"+v.Info.Id+"/snapshots", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusConflict)
+
+	// The snapshot must belong to the volume in the URL
+	r, err = http.Get(ts.URL + "/volumes/12345/snapshots/" + info.Id)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	// The volume cannot be deleted while it has snapshots
+	req, err := http.NewRequest("DELETE", ts.URL+"/volumes/"+v.Info.Id, nil)
+	tests.Assert(t, err == nil)
+	r, err = http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusConflict)
+
+	// Delete the snapshot
+	app.xo.MockSnapshotList = func(host string, volume string) ([]string, error) {
+		return []string{"mysnap"}, nil
+	}
+	req, err = http.NewRequest("DELETE", ts.URL+"/volumes/"+v.Info.Id+"/snapshots/"+info.Id, nil)
+	tests.Assert(t, err == nil)
+	r, err = http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err = r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	for {
+		r, err = http.Get(location.String())
+		tests.Assert(t, err == nil)
+		if r.Header.Get("X-Pending") == "true" {
+			tests.Assert(t, r.StatusCode == http.StatusOK)
+			time.Sleep(time.Millisecond * 10)
+			continue
+		} else {
+			tests.Assert(t, r.StatusCode == http.StatusNoContent)
+			break
+		}
+	}
+
+	// Check it is not there
+	r, err = http.Get(ts.URL + "/volumes/" + v.Info.Id + "/snapshots/" + info.Id)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+	s := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	// Snapshot not found
+	r, err := http.Post(ts.URL+"/volumes/"+v.Info.Id+"/snapshots/12345/restore", "application/json", nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	// Restore the volume
+	restored := ""
+	app.xo.MockSnapshotRestore = func(host string, volume string, snapshot string) ([]executors.RestoreBrickInfo, error) {
+		restored = snapshot
+		return []executors.RestoreBrickInfo{}, nil
+	}
+	r, err = http.Post(ts.URL+"/volumes/"+v.Info.Id+"/snapshots/"+s.Info.Id+"/restore", "application/json", nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	var info VolumeInfoResponse
+	for {
+		r, err = http.Get(location.String())
+		tests.Assert(t, err == nil)
+		tests.Assert(t, r.StatusCode == http.StatusOK)
+		if r.Header.Get("X-Pending") == "true" {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		} else {
+			err = utils.GetJsonFromResponse(r, &info)
+			tests.Assert(t, err == nil)
+			break
+		}
+	}
+	tests.Assert(t, info.Id == v.Info.Id)
+	tests.Assert(t, restored == s.Info.Name)
+
+	// The snapshot is consumed by the restore
+	r, err = http.Get(ts.URL + "/volumes/" + v.Info.Id + "/snapshots/" + s.Info.Id)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+}
+
+func TestVolumeCreateCloneSnapshotNotFound(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	createSampleSnapshotVolume(t, app, true)
+
+	request := []byte(`{
+        "source_snapshot" : "12345"
+    }`)
+	r, err := http.Post(ts.URL+"/volumes", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	s, err := utils.GetStringFromResponse(r)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, s == "Snapshot id 12345 not found\n")
+}
+
+func TestSnapshotSchedule(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+	url := ts.URL + "/volumes/" + v.Info.Id + "/snapshots/schedule"
+
+	// No schedule yet
+	r, err := http.Get(url)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	// Invalid interval
+	request := []byte(`{
+        "interval" : 0,
+        "retention" : 24
+    }`)
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	r, err = http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Invalid retention
+	request = []byte(`{
+        "interval" : 60,
+        "retention" : 0
+    }`)
+	req, err = http.NewRequest("PUT", url, bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	r, err = http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Set the schedule
+	request = []byte(`{
+        "interval" : 60,
+        "retention" : 24
+    }`)
+	req, err = http.NewRequest("PUT", url, bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	r, err = http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+
+	var info SnapshotScheduleInfo
+	r, err = http.Get(url)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+	err = utils.GetJsonFromResponse(r, &info)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, info.VolumeId == v.Info.Id)
+	tests.Assert(t, info.Interval == 60)
+	tests.Assert(t, info.Retention == 24)
+	tests.Assert(t, info.LastRun == 0)
+
+	// Delete the schedule
+	req, err = http.NewRequest("DELETE", url, nil)
+	tests.Assert(t, err == nil)
+	r, err = http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+
+	r, err = http.Get(url)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+}
+
+func TestSnapshotScheduleDisabled(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := createSampleSnapshotVolume(t, app, false)
+
+	request := []byte(`{
+        "interval" : 60,
+        "retention" : 24
+    }`)
+	req, err := http.NewRequest("PUT", ts.URL+"/volumes/"+v.Info.Id+"/snapshots/schedule", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	r, err := http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	s, err := utils.GetStringFromResponse(r)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, s == ErrSnapshotDisabled.Error()+"\n")
+}
@@ -21,14 +21,43 @@ import (
 	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/rest"
 	"github.com/heketi/heketi/utils"
 	"net/http"
+	"regexp"
+	"strings"
 )
 
 const (
 	VOLUME_CREATE_MAX_SNAPSHOT_FACTOR = 100
 )
 
+var (
+	// Volume names are passed to the GlusterFS command line
+	volumeNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	// Volume option names, like "performance.cache-size"
+	volumeOptionRegexp = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+)
+
+// Values like volume options and snapshot descriptions are passed
+// to the GlusterFS command line, so characters which the shell would
+// interpret are refused.
+func validGlusterValue(value string) bool {
+	return !strings.ContainsAny(value, "\"'`$\\\n")
+}
+
+// Returns an error message if an option cannot be set
+func checkVolumeOption(option, value string) string {
+	if !volumeOptionRegexp.MatchString(option) {
+		return fmt.Sprintf("Invalid option name %v", option)
+	}
+	if !validGlusterValue(value) {
+		return fmt.Sprintf("Invalid value for option %v", option)
+	}
+	return ""
+}
+
 func (a *App) VolumeCreate(w http.ResponseWriter, r *http.Request) {
 
 	var msg VolumeCreateRequest
@@ -38,17 +67,52 @@ func (a *App) VolumeCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check the message has devices
-	if msg.Size < 1 {
+	// Check the message has devices.  Clones get the
+	// size of the volume of the snapshot
+	if msg.Size < 1 && msg.SourceSnapshot == "" {
 		http.Error(w, "Invalid volume size", http.StatusBadRequest)
 		return
 	}
+	if msg.Name != "" && !volumeNameRegexp.MatchString(msg.Name) {
+		http.Error(w, "Invalid volume name", http.StatusBadRequest)
+		return
+	}
+	for option, value := range msg.Options {
+		if e := checkVolumeOption(option, value); e != "" {
+			http.Error(w, e, http.StatusBadRequest)
+			return
+		}
+	}
 	if msg.Snapshot.Enable {
 		if msg.Snapshot.Factor < 1 || msg.Snapshot.Factor > VOLUME_CREATE_MAX_SNAPSHOT_FACTOR {
 			http.Error(w, "Invalid snapshot factor", http.StatusBadRequest)
 			return
 		}
 	}
+	switch msg.Durability.Type {
+	case "", DURABILITY_NONE, DURABILITY_REPLICATE:
+	case DURABILITY_DISPERSE:
+		disperse := msg.Durability.Disperse
+		if disperse.Data != 0 || disperse.Redundancy != 0 {
+			if disperse.Data < 2 ||
+				disperse.Redundancy < 1 ||
+				disperse.Redundancy >= disperse.Data {
+				http.Error(w, "Invalid disperse data and redundancy counts", http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Unknown durability type", http.StatusBadRequest)
+		return
+	}
+	if msg.Arbiter.Enable {
+		if msg.Durability.Type == DURABILITY_DISPERSE ||
+			msg.Durability.Type == DURABILITY_NONE ||
+			(msg.Replica != 0 && msg.Replica != ARBITER_REPLICA) {
+			http.Error(w, "Arbiter volumes require replica 3", http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Check that the clusters requested are avilable
 	err = a.db.View(func(tx *bolt.Tx) error {
@@ -65,6 +129,28 @@ func (a *App) VolumeCreate(w http.ResponseWriter, r *http.Request) {
 			return ErrNotFound
 		}
 
+		// Check the snapshot to clone exists
+		if msg.SourceSnapshot != "" {
+			snapshot, err := NewSnapshotEntryFromId(tx, msg.SourceSnapshot)
+			if err == ErrNotFound {
+				http.Error(w, fmt.Sprintf("Snapshot id %v not found", msg.SourceSnapshot), http.StatusBadRequest)
+				return err
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return err
+			}
+
+			// Clones are created in the cluster of their source volume
+			source, err := NewVolumeEntryFromId(tx, snapshot.Info.VolumeId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return err
+			}
+			clusters = []string{source.Info.Cluster}
+		} else if len(msg.Clusters) != 0 {
+			clusters = msg.Clusters
+		}
+
 		// Check the clusters requested are correct
 		for _, clusterid := range msg.Clusters {
 			_, err := NewClusterEntryFromId(tx, clusterid)
@@ -74,6 +160,21 @@ func (a *App) VolumeCreate(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		// Check the name is free in at least one of the clusters
+		if msg.Name != "" {
+			for _, clusterid := range clusters {
+				_, err := VolumeIdFromName(tx, clusterid, msg.Name)
+				if err == ErrNotFound {
+					return nil
+				} else if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return err
+				}
+			}
+			http.Error(w, fmt.Sprintf("Volume name %v already exists", msg.Name), http.StatusConflict)
+			return ErrConflict
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -87,7 +188,7 @@ func (a *App) VolumeCreate(w http.ResponseWriter, r *http.Request) {
 	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
 
 		logger.Info("Creating volume %v", vol.Info.Id)
-		err := vol.Create(a.db)
+		err := vol.Create(a.db, a.executor, a.allocator)
 		if err != nil {
 			logger.LogError("Failed to create volume %v", vol.Info.Id)
 			return "", err
@@ -105,11 +206,18 @@ func (a *App) VolumeList(w http.ResponseWriter, r *http.Request) {
 
 	var list VolumeListResponse
 
-	// Get all the cluster ids from the DB
+	// Volumes can be looked up by name
+	name := r.URL.Query().Get("name")
+
+	// Get all the volume ids from the DB
 	err := a.db.View(func(tx *bolt.Tx) error {
 		var err error
 
-		list.Volumes, err = VolumeList(tx)
+		if name != "" {
+			list.Volumes, err = VolumeIdsFromName(tx, name)
+		} else {
+			list.Volumes, err = VolumeList(tx)
+		}
 		if err != nil {
 			return err
 		}
@@ -190,6 +298,18 @@ func (a *App) VolumeDelete(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
+		// GlusterFS does not delete volumes which have snapshots
+		if len(volume.Snapshots) > 0 {
+			http.Error(w, ErrHasSnapshots.Error(), http.StatusConflict)
+			return ErrHasSnapshots
+		}
+
+		// Destroying the bricks would destroy the clones
+		if len(volume.Clones) > 0 {
+			http.Error(w, ErrHasClones.Error(), http.StatusConflict)
+			return ErrHasClones
+		}
+
 		return nil
 
 	})
@@ -200,7 +320,7 @@ func (a *App) VolumeDelete(w http.ResponseWriter, r *http.Request) {
 	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
 
 		// Actually destroy the Volume here
-		err := volume.Destroy(a.db)
+		err := volume.Destroy(a.db, a.executor)
 
 		// If it fails for some reason, we will need to add to the DB again
 		// or hold state on the entry "DELETING"
@@ -263,10 +383,11 @@ func (a *App) VolumeExpand(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Expand device in an asynchronous function
-	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
+	a.asyncManager.AsyncHttpRedirectHandlerFunc(w, r, func(h *rest.AsyncHttpHandler) (string, error) {
 
 		logger.Info("Expanding volume %v", volume.Info.Id)
-		err := volume.Expand(a.db, msg.Size)
+		h.Progress("Adding bricks")
+		err := volume.Expand(a.db, a.executor, a.allocator, msg.Size)
 		if err != nil {
 			logger.LogError("Failed to expand volume %v", volume.Info.Id)
 			return "", err
@@ -274,6 +395,166 @@ func (a *App) VolumeExpand(w http.ResponseWriter, r *http.Request) {
 
 		logger.Info("Expanded volume %v", volume.Info.Id)
 
+		// Spread the data over the new bricks
+		if msg.Rebalance {
+			err = volume.Rebalance(a.db, a.executor, h.Progress)
+			if err != nil {
+				logger.LogError("Failed to rebalance volume %v", volume.Info.Id)
+				return "", err
+			}
+		}
+
+		// Done
+		return "/volumes/" + volume.Info.Id, nil
+	})
+
+}
+
+func (a *App) VolumeShrink(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var msg VolumeShrinkRequest
+	err := utils.GetJsonFromRequest(r, &msg)
+	if err != nil {
+		http.Error(w, "request unable to be parsed", 422)
+		return
+	}
+
+	// Check the message
+	if msg.Size < 1 {
+		http.Error(w, "Invalid volume size", http.StatusBadRequest)
+		return
+	}
+
+	// Get volume entry
+	var volume *VolumeEntry
+	err = a.db.View(func(tx *bolt.Tx) error {
+
+		// Access volume entry
+		var err error
+		volume, err = NewVolumeEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		// Check the volume can be shrunk by the requested size
+		if msg.Size >= volume.Info.Size {
+			http.Error(w, "Invalid volume size", http.StatusBadRequest)
+			return ErrShrinkSize
+		}
+		_, _, err = volume.bricksToShrink(tx, msg.Size)
+		if err == ErrShrinkSize {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return err
+		} else if err == ErrHasClones {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return
+	}
+
+	// Shrink volume in an asynchronous function
+	a.asyncManager.AsyncHttpRedirectHandlerFunc(w, r, func(h *rest.AsyncHttpHandler) (string, error) {
+
+		logger.Info("Shrinking volume %v", volume.Info.Id)
+		err := volume.Shrink(a.db, a.executor, msg.Size, h.Progress)
+		if err != nil {
+			logger.LogError("Failed to shrink volume %v", volume.Info.Id)
+			return "", err
+		}
+
+		logger.Info("Shrank volume %v", volume.Info.Id)
+
+		// Done
+		return "/volumes/" + volume.Info.Id, nil
+	})
+
+}
+
+func (a *App) VolumeSetOptions(w http.ResponseWriter, r *http.Request) {
+
+	// Get the id from the URL
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var msg VolumeOptionsRequest
+	err := utils.GetJsonFromRequest(r, &msg)
+	if err != nil {
+		http.Error(w, "request unable to be parsed", 422)
+		return
+	}
+
+	// Check the message
+	if len(msg.Set) == 0 && len(msg.Reset) == 0 {
+		http.Error(w, "No options to set or reset", http.StatusBadRequest)
+		return
+	}
+	for option, value := range msg.Set {
+		if e := checkVolumeOption(option, value); e != "" {
+			http.Error(w, e, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, option := range msg.Reset {
+		if !volumeOptionRegexp.MatchString(option) {
+			http.Error(w, fmt.Sprintf("Invalid option name %v", option),
+				http.StatusBadRequest)
+			return
+		}
+		if _, ok := msg.Set[option]; ok {
+			http.Error(w, fmt.Sprintf("Option %v cannot be both set and reset", option),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Get volume entry
+	var volume *VolumeEntry
+	err = a.db.View(func(tx *bolt.Tx) error {
+
+		// Access volume entry
+		var err error
+		volume, err = NewVolumeEntryFromId(tx, id)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return err
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return
+	}
+
+	// Apply the options in an asynchronous function
+	a.asyncManager.AsyncHttpRedirectFunc(w, r, func() (string, error) {
+
+		logger.Info("Setting options on volume %v", volume.Info.Id)
+		err := volume.SetOptions(a.db, a.executor, &msg)
+		if err != nil {
+			logger.LogError("Failed to set options on volume %v: %v", volume.Info.Id, err)
+			return "", err
+		}
+
 		// Done
 		return "/volumes/" + volume.Info.Id, nil
 	})
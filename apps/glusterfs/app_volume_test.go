@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"github.com/boltdb/bolt"
 	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/executors"
 	"github.com/heketi/heketi/tests"
 	"github.com/heketi/heketi/utils"
 	"io"
@@ -117,6 +118,36 @@ func TestVolumeCreateSmallSize(t *testing.T) {
 	tests.Assert(t, strings.Contains(string(body), "Invalid volume size"))
 }
 
+func TestVolumeCreateBadName(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// VolumeCreate JSON Request
+	request := []byte(`{
+        "size" : 100,
+        "name" : "myvol; rm -rf /"
+    }`)
+
+	// Send request
+	r, err := http.Post(ts.URL+"/volumes", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	tests.Assert(t, err == nil)
+	r.Body.Close()
+	tests.Assert(t, strings.Contains(string(body), "Invalid volume name"))
+}
+
 func TestVolumeCreateBadClusters(t *testing.T) {
 	tmpfile := tests.Tempfile()
 	defer os.Remove(tmpfile)
@@ -228,6 +259,132 @@ func TestVolumeCreateBadSnapshotFactor(t *testing.T) {
 
 }
 
+func TestVolumeCreateBadDurability(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Create JSON with an unknown durability type
+	request := []byte(`{
+        "size" : 100,
+        "durability" : {
+            "type" : "mirror"
+        }
+    }`)
+
+	// Send request
+	r, err := http.Post(ts.URL+"/volumes", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	tests.Assert(t, err == nil)
+	r.Body.Close()
+	tests.Assert(t, strings.Contains(string(body), "Unknown durability type"))
+
+	// Create JSON with more redundancy than data bricks
+	request = []byte(`{
+        "size" : 100,
+        "durability" : {
+            "type" : "disperse",
+            "disperse" : {
+                "data" : 2,
+                "redundancy" : 2
+            }
+        }
+    }`)
+
+	// Send request
+	r, err = http.Post(ts.URL+"/volumes", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	body, err = ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	tests.Assert(t, err == nil)
+	r.Body.Close()
+	tests.Assert(t, strings.Contains(string(body), "Invalid disperse data and redundancy counts"))
+
+	// Create JSON without redundancy
+	request = []byte(`{
+        "size" : 100,
+        "durability" : {
+            "type" : "disperse",
+            "disperse" : {
+                "data" : 4
+            }
+        }
+    }`)
+
+	// Send request
+	r, err = http.Post(ts.URL+"/volumes", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	body, err = ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	tests.Assert(t, err == nil)
+	r.Body.Close()
+	tests.Assert(t, strings.Contains(string(body), "Invalid disperse data and redundancy counts"))
+}
+
+func TestVolumeCreateBadArbiter(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Create JSON with an arbiter on a replica 2 volume
+	request := []byte(`{
+        "size" : 100,
+        "replica" : 2,
+        "arbiter" : {
+            "enable" : true
+        }
+    }`)
+
+	// Send request
+	r, err := http.Post(ts.URL+"/volumes", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	tests.Assert(t, err == nil)
+	r.Body.Close()
+	tests.Assert(t, strings.Contains(string(body), "Arbiter volumes require replica 3"))
+
+	// Create JSON with an arbiter on a disperse volume
+	request = []byte(`{
+        "size" : 100,
+        "durability" : {
+            "type" : "disperse"
+        },
+        "arbiter" : {
+            "enable" : true
+        }
+    }`)
+
+	// Send request
+	r, err = http.Post(ts.URL+"/volumes", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	body, err = ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	tests.Assert(t, err == nil)
+	r.Body.Close()
+	tests.Assert(t, strings.Contains(string(body), "Arbiter volumes require replica 3"))
+}
+
 func TestVolumeCreate(t *testing.T) {
 	tmpfile := tests.Tempfile()
 	defer os.Remove(tmpfile)
@@ -291,6 +448,76 @@ func TestVolumeCreate(t *testing.T) {
 	tests.Assert(t, info.Snapshot.Factor == 1)
 }
 
+func TestVolumeCreateDistributeOnly(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Setup database
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		10,   // nodes_per_cluster
+		10,   // devices_per_node,
+		5*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Check the volume is created without replication
+	var req *executors.VolumeRequest
+	app.xo.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		req = volume
+		return nil
+	}
+
+	// VolumeCreate JSON Request with the durability shorthand
+	request := []byte(`{
+        "size" : 100,
+        "durability" : "none"
+    }`)
+
+	// Send request
+	r, err := http.Post(ts.URL+"/volumes", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	var info VolumeInfoResponse
+	for {
+		r, err = http.Get(location.String())
+		tests.Assert(t, err == nil)
+		tests.Assert(t, r.StatusCode == http.StatusOK)
+		if r.ContentLength <= 0 {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		} else {
+			err = utils.GetJsonFromResponse(r, &info)
+			tests.Assert(t, err == nil)
+			break
+		}
+	}
+	tests.Assert(t, info.Id != "")
+	tests.Assert(t, info.Durability.Type == DURABILITY_NONE)
+	tests.Assert(t, info.Replica == 1)
+	tests.Assert(t, len(info.Bricks) == 2) // Only two 50GB bricks needed
+	tests.Assert(t, info.Bricks[0].Size == 50*GB)
+	tests.Assert(t, info.Bricks[1].Size == 50*GB)
+	tests.Assert(t, req != nil)
+	tests.Assert(t, req.Replica == 1)
+	tests.Assert(t, req.BricksPerSet() == 1)
+	tests.Assert(t, len(req.Bricks) == 2)
+}
+
 func TestVolumeInfoIdNotFound(t *testing.T) {
 	tmpfile := tests.Tempfile()
 	defer os.Remove(tmpfile)
@@ -342,7 +569,7 @@ func TestVolumeInfo(t *testing.T) {
 		return v.Save(tx)
 	})
 	tests.Assert(t, err == nil)
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Now that we have some data in the database, we can
@@ -502,7 +729,7 @@ func TestVolumeDelete(t *testing.T) {
 	// Create a volume
 	v := createSampleVolumeEntry(100)
 	tests.Assert(t, v != nil)
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Delete the volume
@@ -647,7 +874,7 @@ func TestVolumeExpand(t *testing.T) {
 	// Create a volume
 	v := createSampleVolumeEntry(100)
 	tests.Assert(t, v != nil)
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Keep a copy
@@ -687,3 +914,365 @@ func TestVolumeExpand(t *testing.T) {
 	tests.Assert(t, info.Size == 100+1000)
 	tests.Assert(t, len(vc.Bricks) < len(info.Bricks))
 }
+
+func TestVolumeExpandRebalance(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+	defer tests.Patch(&rebalancePollInterval, time.Millisecond).Restore()
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Create a cluster
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		10,   // nodes_per_cluster
+		10,   // devices_per_node,
+		5*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create a volume
+	v := createSampleVolumeEntry(100)
+	tests.Assert(t, v != nil)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Fail the rebalance after the expansion
+	app.xo.MockVolumeRebalanceStatus = func(host string,
+		volume string) (*executors.RebalanceStatus, error) {
+		return &executors.RebalanceStatus{
+			Status:    "failed",
+			Completed: true,
+			Failed:    true,
+		}, nil
+	}
+
+	// JSON Request
+	request := []byte(`{
+        "expand_size" : 1000,
+        "rebalance" : true
+    }`)
+
+	// Send request
+	r, err := http.Post(ts.URL+"/volumes/"+v.Info.Id+"/expand",
+		"application/json",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	for {
+		r, err := http.Get(location.String())
+		tests.Assert(t, err == nil)
+		if r.Header.Get("X-Pending") == "true" {
+			tests.Assert(t, r.StatusCode == http.StatusOK)
+			time.Sleep(time.Millisecond * 10)
+			continue
+		} else {
+			tests.Assert(t, r.StatusCode == http.StatusInternalServerError)
+			s, err := utils.GetStringFromResponse(r)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, strings.TrimSpace(s) == ErrRebalance.Error())
+			break
+		}
+	}
+
+	// The volume is still expanded
+	var entry *VolumeEntry
+	err = app.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = NewVolumeEntryFromId(tx, v.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, entry.Info.Size == 100+1000)
+}
+
+func TestVolumeShrink(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Create a cluster
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		10,   // nodes_per_cluster
+		10,   // devices_per_node,
+		5*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create a volume with two replica sets of 100GB
+	v := createSampleVolumeEntry(200)
+	tests.Assert(t, v != nil)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Volume not found
+	request := []byte(`{
+        "shrink_size" : 100
+    }`)
+	r, err := http.Post(ts.URL+"/volumes/12345/shrink",
+		"application/json",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+
+	// Invalid sizes
+	for _, size := range []string{"0", "200", "50"} {
+		request = []byte(`{
+	        "shrink_size" : ` + size + `
+	    }`)
+		r, err = http.Post(ts.URL+"/volumes/"+v.Info.Id+"/shrink",
+			"application/json",
+			bytes.NewBuffer(request))
+		tests.Assert(t, err == nil)
+		tests.Assert(t, r.StatusCode == http.StatusBadRequest, size)
+	}
+
+	// Shrink the volume
+	request = []byte(`{
+        "shrink_size" : 100
+    }`)
+	r, err = http.Post(ts.URL+"/volumes/"+v.Info.Id+"/shrink",
+		"application/json",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	var info VolumeInfoResponse
+	for {
+		r, err := http.Get(location.String())
+		tests.Assert(t, err == nil)
+		tests.Assert(t, r.StatusCode == http.StatusOK)
+		if r.Header.Get("X-Pending") == "true" {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		} else {
+			err = utils.GetJsonFromResponse(r, &info)
+			tests.Assert(t, err == nil)
+			break
+		}
+	}
+
+	tests.Assert(t, info.Size == 100)
+	tests.Assert(t, len(info.Bricks) == 2)
+}
+
+func TestVolumeSetOptionsBadRequest(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Create a cluster
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		4,    // nodes_per_cluster
+		4,    // devices_per_node,
+		1*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create a volume
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	patch := func(id string, body string) *http.Response {
+		req, err := http.NewRequest("PATCH",
+			ts.URL+"/volumes/"+id+"/options",
+			bytes.NewBufferString(body))
+		tests.Assert(t, err == nil)
+		req.Header.Set("Content-Type", "application/json")
+		r, err := http.DefaultClient.Do(req)
+		tests.Assert(t, err == nil)
+		return r
+	}
+
+	// Bad JSON
+	r := patch(v.Info.Id, `{ bad json }`)
+	tests.Assert(t, r.StatusCode == 422)
+
+	// Nothing to do
+	r = patch(v.Info.Id, `{}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Empty option name
+	r = patch(v.Info.Id, `{"set" : {"" : "on"}}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Option names and values the shell would interpret
+	r = patch(v.Info.Id, `{"set" : {"nfs.disable;reboot" : "on"}}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	r = patch(v.Info.Id, `{"set" : {"nfs.disable" : "on\"; reboot; \""}}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	r = patch(v.Info.Id, `{"set" : {"auth.allow" : "$(reboot)"}}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+	r = patch(v.Info.Id, `{"reset" : ["nfs.disable`+"`reboot`"+`"]}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Set and reset the same option
+	r = patch(v.Info.Id, `{
+		"set" : {"nfs.disable" : "on"},
+		"reset" : ["nfs.disable"]
+	}`)
+	tests.Assert(t, r.StatusCode == http.StatusBadRequest)
+
+	// Unknown volume
+	r = patch("123", `{"set" : {"nfs.disable" : "on"}}`)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+}
+
+func TestVolumeSetOptions(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Create a cluster
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		4,    // nodes_per_cluster
+		4,    // devices_per_node,
+		1*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create a volume with an option
+	v := createSampleVolumeEntry(100)
+	v.Info.Options = map[string]string{"nfs.disable": "on"}
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// JSON Request
+	request := []byte(`{
+		"set" : {"performance.cache-size" : "256MB"},
+		"reset" : ["nfs.disable"]
+	}`)
+	req, err := http.NewRequest("PATCH",
+		ts.URL+"/volumes/"+v.Info.Id+"/options",
+		bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	req.Header.Set("Content-Type", "application/json")
+	r, err := http.DefaultClient.Do(req)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Query queue until finished
+	var info VolumeInfoResponse
+	for {
+		r, err := http.Get(location.String())
+		tests.Assert(t, err == nil)
+		tests.Assert(t, r.StatusCode == http.StatusOK)
+		if r.Header.Get("X-Pending") == "true" {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		} else {
+			err = utils.GetJsonFromResponse(r, &info)
+			tests.Assert(t, err == nil)
+			break
+		}
+	}
+
+	tests.Assert(t, len(info.Options) == 1)
+	tests.Assert(t, info.Options["performance.cache-size"] == "256MB")
+}
+
+func TestVolumeCreateDuplicateName(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Create a cluster
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		4,    // nodes_per_cluster
+		4,    // devices_per_node,
+		1*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create a volume
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Name = "myvol"
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Creating another volume with the same name is refused
+	request := []byte(`{
+        "size" : 100,
+        "name" : "myvol"
+    }`)
+	r, err := http.Post(ts.URL+"/volumes", "application/json", bytes.NewBuffer(request))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusConflict)
+
+	// Look up the volume by name
+	var list VolumeListResponse
+	r, err = http.Get(ts.URL + "/volumes?name=myvol")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+	err = utils.GetJsonFromResponse(r, &list)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(list.Volumes) == 1)
+	tests.Assert(t, list.Volumes[0] == v.Info.Id)
+
+	r, err = http.Get(ts.URL + "/volumes?name=other")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusOK)
+	err = utils.GetJsonFromResponse(r, &list)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(list.Volumes) == 0)
+}
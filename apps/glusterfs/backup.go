@@ -0,0 +1,170 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/lpabon/godbc"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Backups are named heketi-<time>.db so that they sort
+	// by time
+	backupPrefix     = "heketi-"
+	backupSuffix     = ".db"
+	backupTimeFormat = "20060102-150405"
+
+	// Used when the configuration does not set them
+	backupIntervalDefault = 60
+	backupKeepDefault     = 7
+)
+
+// Write a consistent copy of the db to a new file in the directory.
+// The copy is written to a temporary file first so that a partial
+// copy never has the name of a backup.  Returns the name of the file.
+func BackupDb(db *bolt.DB, dir string, now time.Time) (string, error) {
+	godbc.Require(db != nil)
+	godbc.Require(dir != "")
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(dir,
+		backupPrefix+now.UTC().Format(backupTimeFormat)+backupSuffix)
+	tmpfile := filename + ".tmp"
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(tmpfile, 0600)
+	})
+	if err != nil {
+		os.Remove(tmpfile)
+		return "", err
+	}
+
+	err = os.Rename(tmpfile, filename)
+	if err != nil {
+		os.Remove(tmpfile)
+		return "", err
+	}
+
+	return filename, nil
+}
+
+// Returns the backups in the directory, oldest first
+func backupList(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*"+backupSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]string, 0, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file),
+			backupPrefix), backupSuffix)
+		if _, err := time.Parse(backupTimeFormat, name); err == nil {
+			backups = append(backups, file)
+		}
+	}
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+// Remove the oldest backups in the directory, keeping the newest ones
+func backupRotate(dir string, keep int) error {
+	godbc.Require(keep > 0)
+
+	backups, err := backupList(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > keep {
+		err := os.Remove(backups[0])
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// Take a backup and remove the old ones
+func (a *App) runBackup(now time.Time) {
+	filename, err := BackupDb(a.db, a.conf.Backup.Dir, now)
+	if err != nil {
+		logger.LogError("Unable to back up the db: %v", err)
+		return
+	}
+	logger.Info("Backed up the db to %v", filename)
+
+	keep := a.conf.Backup.Keep
+	if keep <= 0 {
+		keep = backupKeepDefault
+	}
+	err = backupRotate(a.conf.Backup.Dir, keep)
+	if err != nil {
+		logger.LogError("Unable to remove old backups: %v", err)
+	}
+}
+
+// Back up the db periodically when a backup directory is set
+func (a *App) startBackups() {
+	if a.conf.Backup.Dir == "" {
+		return
+	}
+
+	interval := a.conf.Backup.Interval
+	if interval <= 0 {
+		interval = backupIntervalDefault
+	}
+
+	a.backupStop = make(chan struct{})
+	a.backupDone = make(chan struct{})
+
+	go func() {
+		defer close(a.backupDone)
+
+		ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.backupStop:
+				return
+			case now := <-ticker.C:
+				a.runBackup(now)
+			}
+		}
+	}()
+}
+
+func (a *App) stopBackups() {
+	if a.backupStop == nil {
+		return
+	}
+	close(a.backupStop)
+	<-a.backupDone
+}
@@ -0,0 +1,147 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/tests"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns the dump of a db file
+func backupDump(t *testing.T, filename string) *DbDump {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	tests.Assert(t, err == nil)
+	defer db.Close()
+
+	var dump *DbDump
+	err = db.View(func(tx *bolt.Tx) error {
+		var err error
+		dump, err = DbDumpCreate(tx)
+		return err
+	})
+	tests.Assert(t, err == nil)
+
+	return dump
+}
+
+func TestBackupDb(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+	dir, err := ioutil.TempDir("", "heketi")
+	tests.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	_, dump := setupDbDump(t, app)
+
+	// The backup directory is created
+	backupdir := filepath.Join(dir, "backups")
+	now := time.Date(2015, 11, 2, 10, 30, 0, 0, time.UTC)
+	filename, err := BackupDb(app.db, backupdir, now)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, filename == filepath.Join(backupdir, "heketi-20151102-103000.db"))
+
+	// The backup has the entries of the db
+	copied := backupDump(t, filename)
+	tests.Assert(t, bytes.Equal(dbDumpJson(t, dump), dbDumpJson(t, copied)))
+
+	// No temporary file is left
+	files, err := ioutil.ReadDir(backupdir)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(files) == 1)
+}
+
+func TestBackupRotate(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+	dir, err := ioutil.TempDir("", "heketi")
+	tests.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Other files are not removed
+	other := filepath.Join(dir, "heketi-notes.db")
+	err = ioutil.WriteFile(other, []byte("notes"), 0600)
+	tests.Assert(t, err == nil)
+
+	now := time.Date(2015, 11, 2, 10, 30, 0, 0, time.UTC)
+	backups := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		filename, err := BackupDb(app.db, dir, now.Add(time.Duration(i)*time.Hour))
+		tests.Assert(t, err == nil)
+		backups = append(backups, filename)
+	}
+
+	list, err := backupList(dir)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(list) == 5)
+
+	// The newest backups are kept
+	err = backupRotate(dir, 2)
+	tests.Assert(t, err == nil)
+	list, err = backupList(dir)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(list) == 2)
+	tests.Assert(t, list[0] == backups[3])
+	tests.Assert(t, list[1] == backups[4])
+
+	_, err = os.Stat(other)
+	tests.Assert(t, err == nil)
+}
+
+func TestBackupRun(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+	dir, err := ioutil.TempDir("", "heketi")
+	tests.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	// Create the app with backups
+	app := NewApp(bytes.NewBuffer([]byte(`{
+		"glusterfs" : {
+			"executor" : "mock",
+			"db" : "` + tmpfile + `",
+			"backup" : {
+				"dir" : "` + dir + `",
+				"keep" : 3
+			}
+		}
+	}`)))
+	tests.Assert(t, app != nil)
+	defer app.Close()
+	tests.Assert(t, app.backupStop != nil)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		app.runBackup(now.Add(time.Duration(i) * time.Minute))
+	}
+
+	list, err := backupList(dir)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(list) == 3)
+}
@@ -17,15 +17,33 @@
 package glusterfs
 
 import (
-	"bytes"
-	"encoding/gob"
 	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
 	"github.com/heketi/heketi/utils"
 	"github.com/lpabon/godbc"
 )
 
+const (
+	// Thin pool metadata is sized as a percentage of the
+	// thin pool, bounded by the limits supported by LVM
+	BRICK_POOL_METADATA_RATIO = 0.005
+	BRICK_POOL_METADATA_MIN   = uint64(2 * MB)
+	BRICK_POOL_METADATA_MAX   = uint64(16 * GB)
+)
+
 type BrickEntry struct {
 	Info BrickInfo
+
+	// Sizes in KB
+	TpSize           uint64
+	PoolMetadataSize uint64
+
+	// Bricks with the same id hold replicas of the same data
+	ReplicaSetId string
+
+	// Cloned bricks are thin snapshots in the thin pool of a brick
+	// of another volume, and do not have a thin pool of their own
+	Cloned bool
 }
 
 func BrickList(tx *bolt.Tx) ([]string, error) {
@@ -37,16 +55,46 @@ func BrickList(tx *bolt.Tx) ([]string, error) {
 	return list, nil
 }
 
-func NewBrickEntry(size uint64, deviceid, nodeid string) *BrickEntry {
+func NewBrickEntry(size, tpsize, poolMetadataSize uint64,
+	deviceid, nodeid string) *BrickEntry {
+
+	godbc.Require(size > 0)
+	godbc.Require(tpsize > 0)
+	godbc.Require(deviceid != "")
+	godbc.Require(nodeid != "")
+
 	entry := &BrickEntry{}
+	entry.TpSize = tpsize
+	entry.PoolMetadataSize = poolMetadataSize
 	entry.Info.Id = utils.GenUUID()
 	entry.Info.Size = size
 	entry.Info.NodeId = nodeid
 	entry.Info.DeviceId = deviceid
 
+	godbc.Ensure(entry.Info.Id != "")
+	godbc.Ensure(entry.TpSize == tpsize)
+	godbc.Ensure(entry.PoolMetadataSize == poolMetadataSize)
+	godbc.Ensure(entry.Info.Size == size)
+	godbc.Ensure(entry.Info.NodeId == nodeid)
+	godbc.Ensure(entry.Info.DeviceId == deviceid)
+
 	return entry
 }
 
+// Return the size in KB of the thin pool metadata for
+// a thin pool of size tpsize
+func BrickPoolMetadataSize(tpsize uint64) uint64 {
+	size := uint64(float64(tpsize) * BRICK_POOL_METADATA_RATIO)
+
+	if size < BRICK_POOL_METADATA_MIN {
+		size = BRICK_POOL_METADATA_MIN
+	} else if size > BRICK_POOL_METADATA_MAX {
+		size = BRICK_POOL_METADATA_MAX
+	}
+
+	return size
+}
+
 func NewBrickEntryFromId(tx *bolt.Tx, id string) (*BrickEntry, error) {
 	godbc.Require(tx != nil)
 
@@ -89,17 +137,12 @@ func (b *BrickEntry) NewInfoResponse(tx *bolt.Tx) (*BrickInfo, error) {
 	return info, nil
 }
 
-func (b *BrickEntry) Marshal() ([]byte, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	err := enc.Encode(*b)
-
-	return buffer.Bytes(), err
+func (b *BrickEntry) Marshal(encoding string) ([]byte, error) {
+	return entryEncode(encoding, b)
 }
 
-func (b *BrickEntry) Unmarshal(buffer []byte) error {
-	dec := gob.NewDecoder(bytes.NewReader(buffer))
-	err := dec.Decode(b)
+func (b *BrickEntry) Unmarshal(buffer []byte, encoding string) error {
+	err := entryDecode(encoding, buffer, b)
 	if err != nil {
 		return err
 	}
@@ -107,12 +150,177 @@ func (b *BrickEntry) Unmarshal(buffer []byte) error {
 	return nil
 }
 
-func (b *BrickEntry) Create(db *bolt.DB) error {
+func (b *BrickEntry) newBrickRequest() *executors.BrickRequest {
+	req := &executors.BrickRequest{}
+	req.Name = b.Info.Id
+	req.VgId = b.Info.DeviceId
+	req.Size = b.Info.Size
+	req.TpSize = b.TpSize
+	req.PoolMetadataSize = b.PoolMetadataSize
+
+	return req
+}
+
+func (b *BrickEntry) host(db *bolt.DB) (string, error) {
+	var host string
+	err := db.View(func(tx *bolt.Tx) error {
+		node, err := NewNodeEntryFromId(tx, b.Info.NodeId)
+		if err != nil {
+			return err
+		}
+
+		host = node.ManageHostName()
+		return nil
+	})
+
+	return host, err
+}
+
+func (b *BrickEntry) Create(db *bolt.DB, executor executors.Executor) error {
+	godbc.Require(db != nil)
+	godbc.Require(b.TpSize > 0)
+	godbc.Require(b.Info.Size > 0)
+
+	// Get node hostname
+	host, err := b.host(db)
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	// Create brick on node
 	logger.Info("Creating brick %v", b.Info.Id)
+	info, err := executor.BrickCreate(host, b.newBrickRequest())
+	if err != nil {
+		return err
+	}
+	b.Info.Path = info.Path
+
+	// Save brick location
+	err = db.Update(func(tx *bolt.Tx) error {
+		return b.Save(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+		executor.BrickDestroy(host, b.newBrickRequest())
+		return err
+	}
+
+	godbc.Ensure(b.Info.Path != "")
+
 	return nil
 }
 
-func (b *BrickEntry) Destroy(db *bolt.DB) error {
+func (b *BrickEntry) Destroy(db *bolt.DB, executor executors.Executor) error {
+	godbc.Require(db != nil)
+	godbc.Require(b.Info.Size > 0)
+
+	// GlusterFS removes the cloned bricks when it deletes the volume
+	if b.Cloned {
+		logger.Debug("Brick %v was cloned from a snapshot, nothing to destroy", b.Info.Id)
+		return nil
+	}
+	godbc.Require(b.TpSize > 0)
+
+	// Get node hostname
+	host, err := b.host(db)
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	// Destroy brick on node
 	logger.Info("Destroying brick %v", b.Info.Id)
+	return executor.BrickDestroy(host, b.newBrickRequest())
+}
+
+// Fill in the fields of the bricks of each volume which older versions
+// of heketi did not record.  Their thin pools were the size of the brick
+// times the snapshot factor, and the devices did not account for any
+// thin pool metadata.  Which bricks held replicas of each other was not
+// recorded either, so the bricks of each volume are grouped into sets in
+// the order of their ids.
+func brickEntriesUpgrade(tx *bolt.Tx) error {
+	volumes, err := VolumeList(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range volumes {
+		volume, err := NewVolumeEntryFromId(tx, id)
+		if err != nil {
+			return err
+		}
+
+		perSet := volume.bricksPerSet()
+		if perSet < 1 {
+			perSet = 1
+		}
+
+		setId := ""
+		for i, brickId := range volume.BricksIds() {
+			if i%perSet == 0 {
+				setId = utils.GenUUID()
+			}
+
+			brick, err := NewBrickEntryFromId(tx, brickId)
+			if err == ErrNotFound {
+				logger.LogError("Brick %v of volume %v is not in the db",
+					brickId, id)
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			if brick.Info.VolumeId == "" {
+				brick.Info.VolumeId = id
+			}
+			if brick.ReplicaSetId == "" {
+				brick.ReplicaSetId = setId
+			}
+			if brick.TpSize == 0 && !brick.Cloned {
+				err := volume.brickSizesUpgrade(tx, brick)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = brick.Save(tx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
+
+// Set the thin pool sizes of a brick written by an older version of
+// heketi, and allocate its thin pool metadata on its device
+func (v *VolumeEntry) brickSizesUpgrade(tx *bolt.Tx, brick *BrickEntry) error {
+	tpsize, metadatasize, _ := v.brickDeviceSizes(brick.Info.Size)
+	if tpsize == 0 {
+		tpsize = brick.Info.Size
+	}
+	brick.TpSize = tpsize
+
+	device, err := NewDeviceEntryFromId(tx, brick.Info.DeviceId)
+	if err == ErrNotFound {
+		logger.LogError("Device %v of brick %v is not in the db",
+			brick.Info.DeviceId, brick.Info.Id)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Keep the accounting of full devices as it was
+	if !device.StorageCheck(metadatasize) {
+		logger.Warning("No space on device %v for the thin pool metadata of brick %v",
+			device.Info.Id, brick.Info.Id)
+		return nil
+	}
+	brick.PoolMetadataSize = metadatasize
+	device.StorageAllocate(metadatasize)
+
+	return device.Save(tx)
+}
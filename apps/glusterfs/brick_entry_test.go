@@ -17,7 +17,9 @@
 package glusterfs
 
 import (
+	"errors"
 	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
 	"github.com/heketi/heketi/tests"
 	"os"
 	"reflect"
@@ -27,29 +29,42 @@ import (
 func TestNewBrickEntry(t *testing.T) {
 
 	size := uint64(10)
+	tpsize := size * 2
+	metadatasize := uint64(5)
 	deviceid := "abc"
 	nodeid := "def"
 
-	c := NewBrickEntry(size, deviceid, nodeid)
+	c := NewBrickEntry(size, tpsize, metadatasize, deviceid, nodeid)
 	tests.Assert(t, c.Info.Id != "")
 	tests.Assert(t, c.Info.DeviceId == deviceid)
 	tests.Assert(t, c.Info.NodeId == nodeid)
 	tests.Assert(t, c.Info.Size == size)
+	tests.Assert(t, c.TpSize == tpsize)
+	tests.Assert(t, c.PoolMetadataSize == metadatasize)
+}
+
+func TestBrickPoolMetadataSize(t *testing.T) {
+	tests.Assert(t, BrickPoolMetadataSize(100*MB) == BRICK_POOL_METADATA_MIN)
+	tests.Assert(t, BrickPoolMetadataSize(100*GB) == uint64(512*MB))
+	tests.Assert(t, BrickPoolMetadataSize(16*TB) == BRICK_POOL_METADATA_MAX)
 }
 
 func TestBrickEntryMarshal(t *testing.T) {
 	size := uint64(10)
+	tpsize := size * 2
+	metadatasize := uint64(5)
 	deviceid := "abc"
 	nodeid := "def"
-	m := NewBrickEntry(size, deviceid, nodeid)
+	m := NewBrickEntry(size, tpsize, metadatasize, deviceid, nodeid)
+	m.Info.Path = "/somepath"
 
-	buffer, err := m.Marshal()
+	buffer, err := m.Marshal(DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, buffer != nil)
 	tests.Assert(t, len(buffer) > 0)
 
 	um := &BrickEntry{}
-	err = um.Unmarshal(buffer)
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 
 	tests.Assert(t, reflect.DeepEqual(um, m))
@@ -81,7 +96,7 @@ func TestNewBrickEntryFromId(t *testing.T) {
 	defer app.Close()
 
 	// Create a brick
-	b := NewBrickEntry(10, "abc", "def")
+	b := NewBrickEntry(10, 20, 5, "abc", "def")
 
 	// Save element in database
 	err := app.db.Update(func(tx *bolt.Tx) error {
@@ -109,7 +124,7 @@ func TestNewBrickEntrySaveDelete(t *testing.T) {
 	defer app.Close()
 
 	// Create a brick
-	b := NewBrickEntry(10, "abc", "def")
+	b := NewBrickEntry(10, 20, 5, "abc", "def")
 
 	// Save element in database
 	err := app.db.Update(func(tx *bolt.Tx) error {
@@ -154,7 +169,7 @@ func TestNewBrickEntryNewInfoResponse(t *testing.T) {
 	defer app.Close()
 
 	// Create a brick
-	b := NewBrickEntry(10, "abc", "def")
+	b := NewBrickEntry(10, 20, 5, "abc", "def")
 
 	// Save element in database
 	err := app.db.Update(func(tx *bolt.Tx) error {
@@ -175,3 +190,123 @@ func TestNewBrickEntryNewInfoResponse(t *testing.T) {
 	tests.Assert(t, err == nil)
 	tests.Assert(t, reflect.DeepEqual(*info, b.Info))
 }
+
+func TestBrickEntryCreate(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Create a node for the brick
+	node := createSampleNodeEntry()
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		return node.Save(tx)
+	})
+	tests.Assert(t, err == nil)
+
+	// Create a brick
+	b := NewBrickEntry(10, 20, 5, "abc", node.Info.Id)
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		return b.Save(tx)
+	})
+	tests.Assert(t, err == nil)
+
+	// Mock executor
+	var called bool
+	app.xo.MockBrickCreate = func(host string,
+		brick *executors.BrickRequest) (*executors.BrickInfo, error) {
+		called = true
+		tests.Assert(t, host == node.ManageHostName())
+		tests.Assert(t, brick.Name == b.Info.Id)
+		tests.Assert(t, brick.VgId == "abc")
+		tests.Assert(t, brick.Size == 10)
+		tests.Assert(t, brick.TpSize == 20)
+		tests.Assert(t, brick.PoolMetadataSize == 5)
+
+		return &executors.BrickInfo{Path: "/brick/path"}, nil
+	}
+
+	// Create brick
+	err = b.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, called)
+	tests.Assert(t, b.Info.Path == "/brick/path")
+
+	// Check the path was saved in the db
+	var brick *BrickEntry
+	err = app.db.View(func(tx *bolt.Tx) error {
+		var err error
+		brick, err = NewBrickEntryFromId(tx, b.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, brick.Info.Path == "/brick/path")
+}
+
+func TestBrickEntryCreateFailure(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Create a node for the brick
+	node := createSampleNodeEntry()
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		return node.Save(tx)
+	})
+	tests.Assert(t, err == nil)
+
+	// Mock executor failure
+	ErrMock := errors.New("MOCK")
+	app.xo.MockBrickCreate = func(host string,
+		brick *executors.BrickRequest) (*executors.BrickInfo, error) {
+		return nil, ErrMock
+	}
+
+	b := NewBrickEntry(10, 20, 5, "abc", node.Info.Id)
+	err = b.Create(app.db, app.executor)
+	tests.Assert(t, err == ErrMock)
+	tests.Assert(t, b.Info.Path == "")
+
+	// Node missing
+	b = NewBrickEntry(10, 20, 5, "abc", "def")
+	err = b.Create(app.db, app.executor)
+	tests.Assert(t, err == ErrNotFound)
+}
+
+func TestBrickEntryDestroy(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Create a node for the brick
+	node := createSampleNodeEntry()
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		return node.Save(tx)
+	})
+	tests.Assert(t, err == nil)
+
+	// Mock executor
+	var called bool
+	b := NewBrickEntry(10, 20, 5, "abc", node.Info.Id)
+	app.xo.MockBrickDestroy = func(host string,
+		brick *executors.BrickRequest) error {
+		called = true
+		tests.Assert(t, host == node.ManageHostName())
+		tests.Assert(t, brick.Name == b.Info.Id)
+		tests.Assert(t, brick.VgId == "abc")
+
+		return nil
+	}
+
+	err = b.Destroy(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, called)
+}
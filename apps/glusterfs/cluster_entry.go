@@ -17,8 +17,6 @@
 package glusterfs
 
 import (
-	"bytes"
-	"encoding/gob"
 	"github.com/boltdb/bolt"
 	"github.com/heketi/heketi/utils"
 	"github.com/lpabon/godbc"
@@ -95,17 +93,12 @@ func (c *ClusterEntry) NewClusterInfoResponse(tx *bolt.Tx) (*ClusterInfoResponse
 	return info, nil
 }
 
-func (c *ClusterEntry) Marshal() ([]byte, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	err := enc.Encode(*c)
-
-	return buffer.Bytes(), err
+func (c *ClusterEntry) Marshal(encoding string) ([]byte, error) {
+	return entryEncode(encoding, c)
 }
 
-func (c *ClusterEntry) Unmarshal(buffer []byte) error {
-	dec := gob.NewDecoder(bytes.NewReader(buffer))
-	err := dec.Decode(c)
+func (c *ClusterEntry) Unmarshal(buffer []byte, encoding string) error {
+	err := entryDecode(encoding, buffer, c)
 	if err != nil {
 		return err
 	}
@@ -123,13 +116,16 @@ func (c *ClusterEntry) Unmarshal(buffer []byte) error {
 
 func (c *ClusterEntry) PeerNode(tx *bolt.Tx) (*NodeEntry, error) {
 
-	if len(c.Info.Nodes) > 0 {
-		node, err := NewNodeEntryFromId(tx, c.Info.Nodes[0])
+	// Only online nodes can execute commands
+	for _, id := range c.Info.Nodes {
+		node, err := NewNodeEntryFromId(tx, id)
 		if err != nil {
 			return nil, err
 		}
 
-		return node, nil
+		if node.IsOnline() {
+			return node, nil
+		}
 	}
 
 	return nil, nil
@@ -57,13 +57,13 @@ func TestClusterEntryMarshal(t *testing.T) {
 	m.Info.Nodes = []string{"1", "2"}
 	m.Info.Volumes = []string{"3", "4", "5"}
 
-	buffer, err := m.Marshal()
+	buffer, err := m.Marshal(DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, buffer != nil)
 	tests.Assert(t, len(buffer) > 0)
 
 	um := NewClusterEntry()
-	err = um.Unmarshal(buffer)
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 
 	tests.Assert(t, m.Info.Id == um.Info.Id)
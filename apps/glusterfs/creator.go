@@ -18,7 +18,9 @@ package glusterfs
 
 import (
 	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
 	"github.com/heketi/heketi/utils"
+	"sync"
 )
 
 type CreateType int
@@ -28,17 +30,32 @@ const (
 	CREATOR_DESTROY
 )
 
-func createDestroyConcurrently(db *bolt.DB, brick_entries []*BrickEntry, create_type CreateType) error {
+func createDestroyConcurrently(db *bolt.DB,
+	executor executors.Executor,
+	brick_entries []*BrickEntry,
+	create_type CreateType) error {
+
 	sg := utils.NewStatusGroup()
 
+	// Keep track of the bricks which were created
+	// in case they need to be rolled back
+	var lock sync.Mutex
+	created := make([]*BrickEntry, 0)
+
 	for _, brick := range brick_entries {
 		sg.Add(1)
 		go func(b *BrickEntry) {
 			defer sg.Done()
 			if create_type == CREATOR_CREATE {
-				sg.Err(b.Create(db))
+				err := b.Create(db, executor)
+				if err == nil {
+					lock.Lock()
+					created = append(created, b)
+					lock.Unlock()
+				}
+				sg.Err(err)
 			} else {
-				sg.Err(b.Destroy(db))
+				sg.Err(b.Destroy(db, executor))
 			}
 		}(brick)
 	}
@@ -46,15 +63,21 @@ func createDestroyConcurrently(db *bolt.DB, brick_entries []*BrickEntry, create_
 	err := sg.Result()
 	if err != nil {
 		logger.Err(err)
+
+		// Destroy the bricks which were created
+		if create_type == CREATOR_CREATE && len(created) > 0 {
+			logger.Debug("Destroying %v bricks created before the failure", len(created))
+			createDestroyConcurrently(db, executor, created, CREATOR_DESTROY)
+		}
 	}
 
 	return err
 }
 
-func CreateBricks(db *bolt.DB, brick_entries []*BrickEntry) error {
-	return createDestroyConcurrently(db, brick_entries, CREATOR_CREATE)
+func CreateBricks(db *bolt.DB, executor executors.Executor, brick_entries []*BrickEntry) error {
+	return createDestroyConcurrently(db, executor, brick_entries, CREATOR_CREATE)
 }
 
-func DestroyBricks(db *bolt.DB, brick_entries []*BrickEntry) error {
-	return createDestroyConcurrently(db, brick_entries, CREATOR_DESTROY)
+func DestroyBricks(db *bolt.DB, executor executors.Executor, brick_entries []*BrickEntry) error {
+	return createDestroyConcurrently(db, executor, brick_entries, CREATOR_DESTROY)
 }
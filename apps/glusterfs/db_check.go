@@ -0,0 +1,436 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/utils"
+	"github.com/lpabon/godbc"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// An id in a list which does not refer back to the entry
+	// holding the list
+	DB_PROBLEM_DANGLING = "dangling"
+
+	// An entry missing from the list of the entry it refers to
+	DB_PROBLEM_BACKREF = "backref"
+
+	// An entry which refers to an entry which does not exist
+	DB_PROBLEM_ORPHAN = "orphan"
+
+	// A device whose storage does not add up
+	DB_PROBLEM_STORAGE = "storage"
+
+	// A brick on a device of another node
+	DB_PROBLEM_NODE = "node"
+
+	// An entry of a dump which cannot be imported
+	DB_PROBLEM_ENTRY = "entry"
+)
+
+// Checks the references between the clusters, nodes, devices,
+// volumes and bricks in the db.  The reference an entry has to
+// its parent is trusted over the lists of the parent.
+type dbChecker struct {
+	clusters map[string]*ClusterEntry
+	nodes    map[string]*NodeEntry
+	devices  map[string]*DeviceEntry
+	volumes  map[string]*VolumeEntry
+	bricks   map[string]*BrickEntry
+
+	// Keys of each map in db order
+	clusterIds, nodeIds, deviceIds, volumeIds, brickIds []string
+
+	// Volumes with an operation in progress, whose bricks are
+	// added to or removed from the db when it finishes
+	pending map[string]bool
+
+	// Entries to save after a repair, by id
+	modified map[string]DbEntry
+
+	problems []DbCheckProblem
+}
+
+func newDbChecker() *dbChecker {
+	return &dbChecker{
+		clusters: make(map[string]*ClusterEntry),
+		nodes:    make(map[string]*NodeEntry),
+		devices:  make(map[string]*DeviceEntry),
+		volumes:  make(map[string]*VolumeEntry),
+		bricks:   make(map[string]*BrickEntry),
+		pending:  make(map[string]bool),
+		modified: make(map[string]DbEntry),
+		problems: make([]DbCheckProblem, 0),
+	}
+}
+
+// Copy a list of ids so it can be changed while iterating over it
+func idsCopy(ids sort.StringSlice) sort.StringSlice {
+	list := make(sort.StringSlice, len(ids))
+	copy(list, ids)
+	return list
+}
+
+func (c *dbChecker) report(problem, bucket, id string, repaired bool,
+	format string, v ...interface{}) {
+
+	c.problems = append(c.problems, DbCheckProblem{
+		Type:        problem,
+		Bucket:      bucket,
+		Id:          id,
+		Description: fmt.Sprintf(format, v...),
+		Repaired:    repaired,
+	})
+}
+
+func (c *dbChecker) load(tx *bolt.Tx) error {
+	var err error
+
+	if c.clusterIds, err = ClusterList(tx); err != nil {
+		return err
+	}
+	for _, id := range c.clusterIds {
+		if c.clusters[id], err = NewClusterEntryFromId(tx, id); err != nil {
+			return err
+		}
+	}
+
+	if c.nodeIds = EntryKeys(tx, BOLTDB_BUCKET_NODE); c.nodeIds == nil {
+		return ErrAccessList
+	}
+	for _, id := range c.nodeIds {
+		if c.nodes[id], err = NewNodeEntryFromId(tx, id); err != nil {
+			return err
+		}
+	}
+
+	if c.deviceIds, err = DeviceList(tx); err != nil {
+		return err
+	}
+	for _, id := range c.deviceIds {
+		if c.devices[id], err = NewDeviceEntryFromId(tx, id); err != nil {
+			return err
+		}
+	}
+
+	if c.volumeIds, err = VolumeList(tx); err != nil {
+		return err
+	}
+	for _, id := range c.volumeIds {
+		if c.volumes[id], err = NewVolumeEntryFromId(tx, id); err != nil {
+			return err
+		}
+	}
+
+	if c.brickIds, err = BrickList(tx); err != nil {
+		return err
+	}
+	for _, id := range c.brickIds {
+		if c.bricks[id], err = NewBrickEntryFromId(tx, id); err != nil {
+			return err
+		}
+	}
+
+	// Dbs of older versions have no pending operations
+	for _, id := range EntryKeys(tx, BOLTDB_BUCKET_PENDING) {
+		op, err := NewPendingOperationEntryFromId(tx, id)
+		if err != nil {
+			return err
+		}
+		c.pending[op.VolumeId] = true
+	}
+
+	return nil
+}
+
+// Remove the ids in the lists of each entry which do not exist
+// or do not refer back to the entry
+func (c *dbChecker) checkLists() {
+	for _, id := range c.clusterIds {
+		cluster := c.clusters[id]
+		for _, nodeId := range idsCopy(cluster.Info.Nodes) {
+			if node, ok := c.nodes[nodeId]; ok && node.Info.ClusterId == id {
+				continue
+			}
+			cluster.NodeDelete(nodeId)
+			c.modified[id] = cluster
+			c.report(DB_PROBLEM_DANGLING, BOLTDB_BUCKET_CLUSTER, id, true,
+				"Cluster lists node %v which does not belong to it", nodeId)
+		}
+		for _, volumeId := range idsCopy(cluster.Info.Volumes) {
+			if volume, ok := c.volumes[volumeId]; ok && volume.Info.Cluster == id {
+				continue
+			}
+			cluster.VolumeDelete(volumeId)
+			c.modified[id] = cluster
+			c.report(DB_PROBLEM_DANGLING, BOLTDB_BUCKET_CLUSTER, id, true,
+				"Cluster lists volume %v which does not belong to it", volumeId)
+		}
+	}
+
+	for _, id := range c.nodeIds {
+		node := c.nodes[id]
+		for _, deviceId := range idsCopy(node.Devices) {
+			if device, ok := c.devices[deviceId]; ok && device.NodeId == id {
+				continue
+			}
+			node.DeviceDelete(deviceId)
+			c.modified[id] = node
+			c.report(DB_PROBLEM_DANGLING, BOLTDB_BUCKET_NODE, id, true,
+				"Node lists device %v which does not belong to it", deviceId)
+		}
+	}
+
+	for _, id := range c.deviceIds {
+		device := c.devices[id]
+		for _, brickId := range device.BricksIds() {
+			if brick, ok := c.bricks[brickId]; ok && brick.Info.DeviceId == id {
+				continue
+			}
+			device.BrickDelete(brickId)
+			c.modified[id] = device
+			c.report(DB_PROBLEM_DANGLING, BOLTDB_BUCKET_DEVICE, id, true,
+				"Device lists brick %v which does not belong to it", brickId)
+		}
+	}
+
+	for _, id := range c.volumeIds {
+		volume := c.volumes[id]
+		for _, brickId := range volume.BricksIds() {
+			if brick, ok := c.bricks[brickId]; ok && brick.Info.VolumeId == id {
+				continue
+			}
+			volume.BrickDelete(brickId)
+			c.modified[id] = volume
+			c.report(DB_PROBLEM_DANGLING, BOLTDB_BUCKET_VOLUME, id, true,
+				"Volume lists brick %v which does not belong to it", brickId)
+		}
+	}
+}
+
+// Add each entry to the list of the entry it refers to, and
+// report the entries which refer to entries which do not exist
+func (c *dbChecker) checkParents() {
+	for _, id := range c.nodeIds {
+		node := c.nodes[id]
+		cluster, ok := c.clusters[node.Info.ClusterId]
+		if !ok {
+			c.report(DB_PROBLEM_ORPHAN, BOLTDB_BUCKET_NODE, id, false,
+				"Node belongs to cluster %v which does not exist",
+				node.Info.ClusterId)
+			continue
+		}
+		if !utils.SortedStringHas(cluster.Info.Nodes, id) {
+			cluster.NodeAdd(id)
+			c.modified[cluster.Info.Id] = cluster
+			c.report(DB_PROBLEM_BACKREF, BOLTDB_BUCKET_NODE, id, true,
+				"Node is not listed by its cluster %v", cluster.Info.Id)
+		}
+	}
+
+	for _, id := range c.deviceIds {
+		device := c.devices[id]
+		node, ok := c.nodes[device.NodeId]
+		if !ok {
+			c.report(DB_PROBLEM_ORPHAN, BOLTDB_BUCKET_DEVICE, id, false,
+				"Device belongs to node %v which does not exist",
+				device.NodeId)
+			continue
+		}
+		if !utils.SortedStringHas(node.Devices, id) {
+			node.DeviceAdd(id)
+			c.modified[node.Info.Id] = node
+			c.report(DB_PROBLEM_BACKREF, BOLTDB_BUCKET_DEVICE, id, true,
+				"Device is not listed by its node %v", node.Info.Id)
+		}
+	}
+
+	for _, id := range c.volumeIds {
+		volume := c.volumes[id]
+		cluster, ok := c.clusters[volume.Info.Cluster]
+		if !ok {
+			c.report(DB_PROBLEM_ORPHAN, BOLTDB_BUCKET_VOLUME, id, false,
+				"Volume belongs to cluster %v which does not exist",
+				volume.Info.Cluster)
+			continue
+		}
+		if !utils.SortedStringHas(cluster.Info.Volumes, id) {
+			cluster.VolumeAdd(id)
+			c.modified[cluster.Info.Id] = cluster
+			c.report(DB_PROBLEM_BACKREF, BOLTDB_BUCKET_VOLUME, id, true,
+				"Volume is not listed by its cluster %v", cluster.Info.Id)
+		}
+	}
+
+	for _, id := range c.brickIds {
+		brick := c.bricks[id]
+
+		if device, ok := c.devices[brick.Info.DeviceId]; !ok {
+			c.report(DB_PROBLEM_ORPHAN, BOLTDB_BUCKET_BRICK, id, false,
+				"Brick is on device %v which does not exist",
+				brick.Info.DeviceId)
+		} else {
+			if !utils.SortedStringHas(device.Bricks, id) {
+				device.BrickAdd(id)
+				c.modified[device.Info.Id] = device
+				c.report(DB_PROBLEM_BACKREF, BOLTDB_BUCKET_BRICK, id, true,
+					"Brick is not listed by its device %v", device.Info.Id)
+			}
+			if brick.Info.NodeId != device.NodeId {
+				c.report(DB_PROBLEM_NODE, BOLTDB_BUCKET_BRICK, id, true,
+					"Brick is on node %v but its device is on node %v",
+					brick.Info.NodeId, device.NodeId)
+				brick.Info.NodeId = device.NodeId
+				c.modified[id] = brick
+			}
+		}
+
+		// The bricks of an operation in progress are not in their
+		// volume, which may not be saved yet
+		if c.pending[brick.Info.VolumeId] {
+			continue
+		}
+
+		if volume, ok := c.volumes[brick.Info.VolumeId]; !ok {
+			c.report(DB_PROBLEM_ORPHAN, BOLTDB_BUCKET_BRICK, id, false,
+				"Brick belongs to volume %v which does not exist",
+				brick.Info.VolumeId)
+		} else if !utils.SortedStringHas(volume.Bricks, id) {
+			volume.BrickAdd(id)
+			c.modified[volume.Info.Id] = volume
+			c.report(DB_PROBLEM_BACKREF, BOLTDB_BUCKET_BRICK, id, true,
+				"Brick is not listed by its volume %v", volume.Info.Id)
+		}
+	}
+}
+
+// Check the storage used by each device is the storage of its bricks
+func (c *dbChecker) checkStorage() {
+	for _, id := range c.deviceIds {
+		device := c.devices[id]
+		storage := &device.Info.Storage
+
+		used := uint64(0)
+		for _, brickId := range device.Bricks {
+			brick := c.bricks[brickId]
+			if !brick.Cloned {
+				used += brick.TpSize + brick.PoolMetadataSize
+			}
+		}
+
+		if storage.Used == used && storage.Free+storage.Used == storage.Total {
+			continue
+		}
+
+		if used > storage.Total {
+			c.report(DB_PROBLEM_STORAGE, BOLTDB_BUCKET_DEVICE, id, false,
+				"Bricks use %v KB of a device of %v KB", used, storage.Total)
+			continue
+		}
+
+		c.report(DB_PROBLEM_STORAGE, BOLTDB_BUCKET_DEVICE, id, true,
+			"Device has %v KB used and %v KB free of %v KB but its bricks use %v KB",
+			storage.Used, storage.Free, storage.Total, used)
+		storage.Used = used
+		storage.Free = storage.Total - used
+		c.modified[id] = device
+	}
+}
+
+func (c *dbChecker) check() {
+	c.checkLists()
+	c.checkParents()
+	c.checkStorage()
+}
+
+// Check the clusters, nodes, devices, volumes and bricks in the
+// db.  The problems found are repaired in memory, and saved to
+// the db only if repair is set.  Problems which cannot be
+// repaired, like an entry whose parent does not exist, are only
+// reported.
+func DbCheck(tx *bolt.Tx, repair bool) (*DbCheckResponse, error) {
+	godbc.Require(tx != nil)
+
+	c := newDbChecker()
+	err := c.load(tx)
+	if err != nil {
+		return nil, err
+	}
+	c.check()
+
+	if repair {
+		for id, entry := range c.modified {
+			err := EntrySave(tx, entry, id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		for i := range c.problems {
+			c.problems[i].Repaired = false
+		}
+	}
+
+	return &DbCheckResponse{
+		Problems: c.problems,
+		Repair:   repair,
+	}, nil
+}
+
+// Check the db file of a stopped server
+func DbCheckFile(filename string, repair bool) (*DbCheckResponse, error) {
+	// bolt creates the file if it does not exist
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var result *DbCheckResponse
+	check := func(tx *bolt.Tx) error {
+		version, err := DbSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > DB_SCHEMA_VERSION {
+			return ErrDbVersion
+		}
+
+		result, err = DbCheck(tx, repair)
+		return err
+	}
+
+	if repair {
+		err = db.Update(check)
+	} else {
+		err = db.View(check)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
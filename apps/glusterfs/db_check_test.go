@@ -0,0 +1,232 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/tests"
+	"github.com/heketi/heketi/utils"
+	"os"
+	"testing"
+)
+
+// Create a topology with a volume, and return the volume
+func setupDbCheckVolume(t *testing.T, app *App) *VolumeEntry {
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		3,    // nodes_per_cluster
+		2,    // devices_per_node,
+		1*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	return v
+}
+
+// Break the references in the db.  Returns the number of
+// problems added and the id of the brick without a volume.
+func corruptDb(t *testing.T, app *App, v *VolumeEntry) (int, string) {
+	orphan := ""
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		cluster, err := NewClusterEntryFromId(tx, v.Info.Cluster)
+		tests.Assert(t, err == nil)
+
+		// Node missing from its cluster
+		cluster.NodeDelete(cluster.Info.Nodes[0])
+
+		// Volume which does not exist in the cluster
+		cluster.VolumeAdd(utils.GenUUID())
+		tests.Assert(t, cluster.Save(tx) == nil)
+
+		brick, err := NewBrickEntryFromId(tx, v.Bricks[0])
+		tests.Assert(t, err == nil)
+		device, err := NewDeviceEntryFromId(tx, brick.Info.DeviceId)
+		tests.Assert(t, err == nil)
+
+		// Brick which does not exist on the device, and
+		// storage which does not add up
+		device.BrickAdd(utils.GenUUID())
+		device.Info.Storage.Used += 10
+		tests.Assert(t, device.Save(tx) == nil)
+
+		// Brick on the wrong node
+		brick.Info.NodeId = utils.GenUUID()
+		tests.Assert(t, brick.Save(tx) == nil)
+
+		// Brick of a volume which does not exist
+		lost := NewBrickEntry(10, 10, 1, device.Info.Id, device.NodeId)
+		lost.Info.VolumeId = utils.GenUUID()
+		tests.Assert(t, lost.Save(tx) == nil)
+		orphan = lost.Id()
+
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// The lost brick is also missing from its device
+	return 7, orphan
+}
+
+func TestDbCheckClean(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Empty db
+	err := app.db.View(func(tx *bolt.Tx) error {
+		result, err := DbCheck(tx, false)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(result.Problems) == 0)
+		tests.Assert(t, result.Repair == false)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Db with a volume
+	setupDbCheckVolume(t, app)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		result, err := DbCheck(tx, false)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(result.Problems) == 0, result.Problems)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestDbCheckDryRun(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := setupDbCheckVolume(t, app)
+	problems, _ := corruptDb(t, app, v)
+
+	// Problems are reported twice since nothing is saved
+	for i := 0; i < 2; i++ {
+		err := app.db.Update(func(tx *bolt.Tx) error {
+			result, err := DbCheck(tx, false)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, len(result.Problems) == problems, result.Problems)
+			for _, problem := range result.Problems {
+				tests.Assert(t, !problem.Repaired)
+			}
+			return nil
+		})
+		tests.Assert(t, err == nil)
+	}
+}
+
+func TestDbCheckRepair(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := setupDbCheckVolume(t, app)
+	problems, orphan := corruptDb(t, app, v)
+
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		result, err := DbCheck(tx, true)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, result.Repair == true)
+		tests.Assert(t, len(result.Problems) == problems, result.Problems)
+
+		types := make(map[string]int)
+		for _, problem := range result.Problems {
+			types[problem.Type]++
+			if problem.Type == DB_PROBLEM_ORPHAN {
+				tests.Assert(t, !problem.Repaired)
+				tests.Assert(t, problem.Id == orphan)
+				tests.Assert(t, problem.Bucket == BOLTDB_BUCKET_BRICK)
+			} else {
+				tests.Assert(t, problem.Repaired)
+			}
+		}
+		tests.Assert(t, types[DB_PROBLEM_DANGLING] == 2, types)
+		tests.Assert(t, types[DB_PROBLEM_BACKREF] == 2, types)
+		tests.Assert(t, types[DB_PROBLEM_ORPHAN] == 1, types)
+		tests.Assert(t, types[DB_PROBLEM_STORAGE] == 1, types)
+		tests.Assert(t, types[DB_PROBLEM_NODE] == 1, types)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Only the orphan is left
+	err = app.db.View(func(tx *bolt.Tx) error {
+		result, err := DbCheck(tx, false)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(result.Problems) == 1, result.Problems)
+		tests.Assert(t, result.Problems[0].Id == orphan)
+
+		cluster, err := NewClusterEntryFromId(tx, v.Info.Cluster)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(cluster.Info.Nodes) == 3)
+		tests.Assert(t, len(cluster.Info.Volumes) == 1)
+
+		brick, err := NewBrickEntryFromId(tx, v.Bricks[0])
+		tests.Assert(t, err == nil)
+		device, err := NewDeviceEntryFromId(tx, brick.Info.DeviceId)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, brick.Info.NodeId == device.NodeId)
+		tests.Assert(t, utils.SortedStringHas(device.Bricks, orphan))
+
+		storage := device.Info.Storage
+		tests.Assert(t, storage.Free+storage.Used == storage.Total)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestDbCheckFile(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// A missing file is not created
+	_, err := DbCheckFile(tmpfile, false)
+	tests.Assert(t, err != nil)
+	_, err = os.Stat(tmpfile)
+	tests.Assert(t, os.IsNotExist(err))
+
+	app := NewTestApp(tmpfile)
+	v := setupDbCheckVolume(t, app)
+	problems, _ := corruptDb(t, app, v)
+	app.Close()
+
+	result, err := DbCheckFile(tmpfile, false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(result.Problems) == problems)
+
+	result, err = DbCheckFile(tmpfile, true)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(result.Problems) == problems)
+
+	result, err = DbCheckFile(tmpfile, false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(result.Problems) == 1)
+}
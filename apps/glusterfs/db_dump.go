@@ -0,0 +1,427 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/lpabon/godbc"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Every entry in the db, by bucket and id.  Used to move the
+// db to another host or to recover it.
+type DbDump struct {
+	// Schema version of the entries
+	Version uint64 `json:"version"`
+
+	Clusters  map[string]*ClusterEntry          `json:"clusters"`
+	Nodes     map[string]*NodeEntry             `json:"nodes"`
+	Devices   map[string]*DeviceEntry           `json:"devices"`
+	Volumes   map[string]*VolumeEntry           `json:"volumes"`
+	Bricks    map[string]*BrickEntry            `json:"bricks"`
+	Snapshots map[string]*SnapshotEntry         `json:"snapshots"`
+	Schedules map[string]*SnapshotScheduleEntry `json:"schedules"`
+	Quotas    map[string]*QuotaEntry            `json:"quotas"`
+
+	// Operations in progress, which are finished or undone when
+	// the server starts with the imported db
+	Pending map[string]*PendingOperationEntry `json:"pending"`
+}
+
+// An entry of the dump with the key it is saved under.  Entry
+// is nil if the dump has a null entry.
+type dbDumpEntry struct {
+	bucket string
+	key    string
+	id     string
+	entry  DbEntry
+}
+
+func NewDbDump() *DbDump {
+	return &DbDump{
+		Version:   DB_SCHEMA_VERSION,
+		Clusters:  make(map[string]*ClusterEntry),
+		Nodes:     make(map[string]*NodeEntry),
+		Devices:   make(map[string]*DeviceEntry),
+		Volumes:   make(map[string]*VolumeEntry),
+		Bricks:    make(map[string]*BrickEntry),
+		Snapshots: make(map[string]*SnapshotEntry),
+		Schedules: make(map[string]*SnapshotScheduleEntry),
+		Quotas:    make(map[string]*QuotaEntry),
+		Pending:   make(map[string]*PendingOperationEntry),
+	}
+}
+
+// Load the entries of a bucket.  newEntry creates the entry
+// for an id and adds it to the dump.
+func dbDumpBucket(tx *bolt.Tx, bucket string, newEntry func(id string) DbEntry) error {
+	ids := EntryKeys(tx, bucket)
+	if ids == nil {
+		return ErrAccessList
+	}
+
+	for _, id := range ids {
+		err := EntryLoad(tx, newEntry(id), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns every entry in the db
+func DbDumpCreate(tx *bolt.Tx) (*DbDump, error) {
+	godbc.Require(tx != nil)
+
+	dump := NewDbDump()
+	buckets := []struct {
+		name     string
+		newEntry func(id string) DbEntry
+	}{
+		{BOLTDB_BUCKET_CLUSTER, func(id string) DbEntry {
+			dump.Clusters[id] = NewClusterEntry()
+			return dump.Clusters[id]
+		}},
+		{BOLTDB_BUCKET_NODE, func(id string) DbEntry {
+			dump.Nodes[id] = NewNodeEntry()
+			return dump.Nodes[id]
+		}},
+		{BOLTDB_BUCKET_DEVICE, func(id string) DbEntry {
+			dump.Devices[id] = NewDeviceEntry()
+			return dump.Devices[id]
+		}},
+		{BOLTDB_BUCKET_VOLUME, func(id string) DbEntry {
+			dump.Volumes[id] = NewVolumeEntry()
+			return dump.Volumes[id]
+		}},
+		{BOLTDB_BUCKET_BRICK, func(id string) DbEntry {
+			dump.Bricks[id] = &BrickEntry{}
+			return dump.Bricks[id]
+		}},
+		{BOLTDB_BUCKET_SNAPSHOT, func(id string) DbEntry {
+			dump.Snapshots[id] = NewSnapshotEntry()
+			return dump.Snapshots[id]
+		}},
+		{BOLTDB_BUCKET_SCHEDULE, func(id string) DbEntry {
+			dump.Schedules[id] = NewSnapshotScheduleEntry()
+			return dump.Schedules[id]
+		}},
+		{BOLTDB_BUCKET_QUOTA, func(id string) DbEntry {
+			dump.Quotas[id] = NewQuotaEntry()
+			return dump.Quotas[id]
+		}},
+		{BOLTDB_BUCKET_PENDING, func(id string) DbEntry {
+			dump.Pending[id] = NewPendingOperationEntry()
+			return dump.Pending[id]
+		}},
+	}
+
+	for _, bucket := range buckets {
+		err := dbDumpBucket(tx, bucket.name, bucket.newEntry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dump, nil
+}
+
+type dbDumpEntries []dbDumpEntry
+
+func (e dbDumpEntries) Len() int      { return len(e) }
+func (e dbDumpEntries) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e dbDumpEntries) Less(i, j int) bool {
+	if e[i].bucket != e[j].bucket {
+		return e[i].bucket < e[j].bucket
+	}
+	return e[i].key < e[j].key
+}
+
+// Returns the entries of the dump sorted by bucket and key
+func (d *DbDump) entries() dbDumpEntries {
+	entries := make(dbDumpEntries, 0)
+	add := func(bucket, key, id string, entry DbEntry) {
+		entries = append(entries, dbDumpEntry{
+			bucket: bucket,
+			key:    key,
+			id:     id,
+			entry:  entry,
+		})
+	}
+
+	for key, e := range d.Clusters {
+		if e == nil {
+			add(BOLTDB_BUCKET_CLUSTER, key, "", nil)
+		} else {
+			add(BOLTDB_BUCKET_CLUSTER, key, e.Info.Id, e)
+		}
+	}
+	for key, e := range d.Nodes {
+		if e == nil {
+			add(BOLTDB_BUCKET_NODE, key, "", nil)
+		} else {
+			add(BOLTDB_BUCKET_NODE, key, e.Info.Id, e)
+		}
+	}
+	for key, e := range d.Devices {
+		if e == nil {
+			add(BOLTDB_BUCKET_DEVICE, key, "", nil)
+		} else {
+			add(BOLTDB_BUCKET_DEVICE, key, e.Info.Id, e)
+		}
+	}
+	for key, e := range d.Volumes {
+		if e == nil {
+			add(BOLTDB_BUCKET_VOLUME, key, "", nil)
+		} else {
+			add(BOLTDB_BUCKET_VOLUME, key, e.Info.Id, e)
+		}
+	}
+	for key, e := range d.Bricks {
+		if e == nil {
+			add(BOLTDB_BUCKET_BRICK, key, "", nil)
+		} else {
+			add(BOLTDB_BUCKET_BRICK, key, e.Info.Id, e)
+		}
+	}
+	for key, e := range d.Snapshots {
+		if e == nil {
+			add(BOLTDB_BUCKET_SNAPSHOT, key, "", nil)
+		} else {
+			add(BOLTDB_BUCKET_SNAPSHOT, key, e.Info.Id, e)
+		}
+	}
+	for key, e := range d.Schedules {
+		if e == nil {
+			add(BOLTDB_BUCKET_SCHEDULE, key, "", nil)
+		} else {
+			add(BOLTDB_BUCKET_SCHEDULE, key, e.Info.VolumeId, e)
+		}
+	}
+	for key, e := range d.Quotas {
+		if e == nil {
+			add(BOLTDB_BUCKET_QUOTA, key, "", nil)
+		} else {
+			add(BOLTDB_BUCKET_QUOTA, key, e.Info.VolumeId, e)
+		}
+	}
+	for key, e := range d.Pending {
+		if e == nil {
+			add(BOLTDB_BUCKET_PENDING, key, "", nil)
+		} else {
+			add(BOLTDB_BUCKET_PENDING, key, e.Id, e)
+		}
+	}
+
+	sort.Sort(entries)
+	return entries
+}
+
+// Check the references between the entries of the dump.  Returns
+// the problems found, which must all be fixed before the dump
+// can be imported.
+func (d *DbDump) Check() []DbCheckProblem {
+	c := newDbChecker()
+
+	// Entries saved under another id would be loaded as
+	// another entry
+	for _, e := range d.entries() {
+		if e.entry == nil {
+			c.report(DB_PROBLEM_ENTRY, e.bucket, e.key, false,
+				"Entry is empty")
+			continue
+		}
+		if e.key != e.id {
+			c.report(DB_PROBLEM_ENTRY, e.bucket, e.key, false,
+				"Entry has id %v", e.id)
+			continue
+		}
+
+		switch e.bucket {
+		case BOLTDB_BUCKET_CLUSTER:
+			c.clusterIds = append(c.clusterIds, e.key)
+		case BOLTDB_BUCKET_NODE:
+			c.nodeIds = append(c.nodeIds, e.key)
+		case BOLTDB_BUCKET_DEVICE:
+			c.deviceIds = append(c.deviceIds, e.key)
+		case BOLTDB_BUCKET_VOLUME:
+			c.volumeIds = append(c.volumeIds, e.key)
+		case BOLTDB_BUCKET_BRICK:
+			c.brickIds = append(c.brickIds, e.key)
+		case BOLTDB_BUCKET_PENDING:
+			c.pending[d.Pending[e.key].VolumeId] = true
+		}
+	}
+	if len(c.problems) != 0 {
+		return c.problems
+	}
+
+	// The checker changes the entries it repairs, so it
+	// checks copies of them
+	clone := func(entry, dst DbEntry) {
+		buffer, err := entry.Marshal(DB_ENCODING_GOB)
+		godbc.Check(err == nil)
+		godbc.Check(dst.Unmarshal(buffer, DB_ENCODING_GOB) == nil)
+	}
+	for id, e := range d.Clusters {
+		c.clusters[id] = NewClusterEntry()
+		clone(e, c.clusters[id])
+	}
+	for id, e := range d.Nodes {
+		c.nodes[id] = NewNodeEntry()
+		clone(e, c.nodes[id])
+	}
+	for id, e := range d.Devices {
+		c.devices[id] = NewDeviceEntry()
+		clone(e, c.devices[id])
+	}
+	for id, e := range d.Volumes {
+		c.volumes[id] = NewVolumeEntry()
+		clone(e, c.volumes[id])
+	}
+	for id, e := range d.Bricks {
+		c.bricks[id] = &BrickEntry{}
+		clone(e, c.bricks[id])
+	}
+	c.check()
+
+	// Snapshots, schedules and quotas belong to volumes
+	for _, id := range c.volumeIds {
+		volume := d.Volumes[id]
+		for _, snapshotId := range volume.Snapshots {
+			if snapshot, ok := d.Snapshots[snapshotId]; !ok ||
+				snapshot.Info.VolumeId != id {
+				c.report(DB_PROBLEM_DANGLING, BOLTDB_BUCKET_VOLUME, id, false,
+					"Volume lists snapshot %v which does not belong to it",
+					snapshotId)
+			}
+		}
+		for _, cloneId := range volume.Clones {
+			if v, ok := d.Volumes[cloneId]; !ok || v.SourceVolumeId != id {
+				c.report(DB_PROBLEM_DANGLING, BOLTDB_BUCKET_VOLUME, id, false,
+					"Volume lists clone %v which was not cloned from it",
+					cloneId)
+			}
+		}
+		if volume.SourceVolumeId != "" {
+			if _, ok := d.Volumes[volume.SourceVolumeId]; !ok {
+				c.report(DB_PROBLEM_ORPHAN, BOLTDB_BUCKET_VOLUME, id, false,
+					"Volume was cloned from volume %v which does not exist",
+					volume.SourceVolumeId)
+			}
+		}
+	}
+	for _, e := range d.entries() {
+		var volumeId string
+		switch entry := e.entry.(type) {
+		case *SnapshotEntry:
+			volumeId = entry.Info.VolumeId
+		case *SnapshotScheduleEntry:
+			volumeId = entry.Info.VolumeId
+		case *QuotaEntry:
+			volumeId = entry.Info.VolumeId
+		default:
+			continue
+		}
+		if _, ok := d.Volumes[volumeId]; !ok {
+			c.report(DB_PROBLEM_ORPHAN, e.bucket, e.key, false,
+				"Entry belongs to volume %v which does not exist", volumeId)
+		}
+	}
+
+	// Nothing is repaired in a dump
+	for i := range c.problems {
+		c.problems[i].Repaired = false
+	}
+
+	return c.problems
+}
+
+// Create a new db file with the entries of the dump.  The dump is
+// checked first, and if it has problems they are returned with
+// ErrDbDump and no file is created.
+func DbImport(filename string, dump *DbDump) ([]DbCheckProblem, error) {
+	godbc.Require(dump != nil)
+
+	if dump.Version > DB_SCHEMA_VERSION {
+		return nil, ErrDbVersion
+	}
+
+	if _, err := os.Stat(filename); err == nil {
+		return nil, &os.PathError{Op: "import", Path: filename, Err: os.ErrExist}
+	}
+
+	problems := dump.Check()
+	if len(problems) != 0 {
+		return problems, ErrDbDump
+	}
+
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		buckets := []string{
+			BOLTDB_BUCKET_VOLUME_NAME,
+			BOLTDB_BUCKET_METADATA,
+		}
+		for _, newEntry := range dbEntryTypes {
+			buckets = append(buckets, newEntry().BucketName())
+		}
+		for _, bucket := range buckets {
+			_, err := tx.CreateBucket([]byte(bucket))
+			if err != nil {
+				return err
+			}
+		}
+
+		// Entries are saved with the default encoding, and
+		// converted when the server starts
+		for _, e := range dump.entries() {
+			err := EntrySave(tx, e.entry, e.key)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := volumeNameIndexBuild(tx)
+		if err != nil {
+			return err
+		}
+
+		// Bring the entries to the current schema
+		err = dbMetadataSet(tx, DB_METADATA_SCHEMA_VERSION,
+			strconv.FormatUint(dump.Version, 10))
+		if err != nil {
+			return err
+		}
+		return dbUpgrade(tx, "")
+	})
+	db.Close()
+	if err != nil {
+		logger.Err(err)
+		os.Remove(filename)
+		return nil, err
+	}
+
+	return nil, nil
+}
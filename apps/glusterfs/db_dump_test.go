@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/tests"
+	"os"
+	"testing"
+)
+
+// Create a db with a volume with a snapshot and quota
+func setupDbDump(t *testing.T, app *App) (*VolumeEntry, *DbDump) {
+	v := createSampleSnapshotVolume(t, app, true)
+
+	s := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	q := NewQuotaEntryFromVolumeId(v.Info.Id)
+	err = q.Enable(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	var dump *DbDump
+	err = app.db.View(func(tx *bolt.Tx) error {
+		var err error
+		dump, err = DbDumpCreate(tx)
+		return err
+	})
+	tests.Assert(t, err == nil)
+
+	return v, dump
+}
+
+func dbDumpJson(t *testing.T, dump *DbDump) []byte {
+	buffer, err := json.Marshal(dump)
+	tests.Assert(t, err == nil)
+	return buffer
+}
+
+func TestDbDumpCreate(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v, dump := setupDbDump(t, app)
+	tests.Assert(t, dump.Version == DB_SCHEMA_VERSION)
+	tests.Assert(t, len(dump.Clusters) == 1)
+	tests.Assert(t, len(dump.Nodes) == 4)
+	tests.Assert(t, len(dump.Devices) == 16)
+	tests.Assert(t, len(dump.Volumes) == 1)
+	tests.Assert(t, len(dump.Bricks) == len(v.Bricks))
+	tests.Assert(t, len(dump.Snapshots) == 1)
+	tests.Assert(t, len(dump.Schedules) == 0)
+	tests.Assert(t, len(dump.Quotas) == 1)
+	tests.Assert(t, dump.Volumes[v.Info.Id].Info.Name == v.Info.Name)
+	tests.Assert(t, len(dump.Check()) == 0)
+}
+
+func TestDbImport(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+	importfile := tests.Tempfile()
+	defer os.Remove(importfile)
+
+	app := NewTestApp(tmpfile)
+	v, dump := setupDbDump(t, app)
+	app.Close()
+
+	// Import through JSON
+	var imported DbDump
+	err := json.Unmarshal(dbDumpJson(t, dump), &imported)
+	tests.Assert(t, err == nil)
+
+	problems, err := DbImport(importfile, &imported)
+	tests.Assert(t, err == nil, err)
+	tests.Assert(t, len(problems) == 0)
+
+	// The new db has the same entries, and its
+	// name index and schema version
+	app = NewTestApp(importfile)
+	defer app.Close()
+	err = app.db.View(func(tx *bolt.Tx) error {
+		copied, err := DbDumpCreate(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, bytes.Equal(dbDumpJson(t, dump), dbDumpJson(t, copied)))
+
+		id, err := VolumeIdFromName(tx, v.Info.Cluster, v.Info.Name)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, id == v.Info.Id)
+
+		version, err := DbSchemaVersion(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, version == DB_SCHEMA_VERSION)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Only fresh db files are created
+	problems, err = DbImport(importfile, dump)
+	tests.Assert(t, os.IsExist(err))
+	tests.Assert(t, len(problems) == 0)
+}
+
+func TestDbImportProblems(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+	importfile := tests.Tempfile()
+	defer os.Remove(importfile)
+
+	app := NewTestApp(tmpfile)
+	v, dump := setupDbDump(t, app)
+	app.Close()
+
+	// Remove the volume, leaving its bricks, snapshot and
+	// quota behind, and save a cluster under another id
+	cluster := dump.Clusters[v.Info.Cluster]
+	cluster.Info.Nodes = nil
+	delete(dump.Volumes, v.Info.Id)
+	delete(dump.Clusters, v.Info.Cluster)
+	dump.Clusters["abc"] = cluster
+
+	problems, err := DbImport(importfile, dump)
+	tests.Assert(t, err == ErrDbDump)
+	tests.Assert(t, len(problems) == 1, problems)
+	tests.Assert(t, problems[0].Type == DB_PROBLEM_ENTRY)
+	tests.Assert(t, problems[0].Id == "abc")
+	_, err = os.Stat(importfile)
+	tests.Assert(t, os.IsNotExist(err))
+
+	// Put the cluster back under its id
+	delete(dump.Clusters, "abc")
+	dump.Clusters[cluster.Info.Id] = cluster
+
+	problems, err = DbImport(importfile, dump)
+	tests.Assert(t, err == ErrDbDump)
+	types := make(map[string]int)
+	for _, problem := range problems {
+		tests.Assert(t, !problem.Repaired)
+		types[problem.Type]++
+	}
+
+	// Each node is missing from the cluster, the cluster lists
+	// the volume, and each brick, the snapshot and the quota
+	// belong to the missing volume
+	tests.Assert(t, types[DB_PROBLEM_BACKREF] == 4, types)
+	tests.Assert(t, types[DB_PROBLEM_DANGLING] == 1, types)
+	tests.Assert(t, types[DB_PROBLEM_ORPHAN] == len(v.Bricks)+2, types)
+	_, err = os.Stat(importfile)
+	tests.Assert(t, os.IsNotExist(err))
+
+	// A dump from a newer version of heketi
+	dump = NewDbDump()
+	dump.Version = DB_SCHEMA_VERSION + 1
+	_, err = DbImport(importfile, dump)
+	tests.Assert(t, err == ErrDbVersion)
+}
@@ -0,0 +1,200 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/lpabon/godbc"
+	"strconv"
+)
+
+const (
+	// Schema version of the db written by this version of heketi.
+	// Increase it when adding a migration.
+	DB_SCHEMA_VERSION = uint64(2)
+
+	// Keys in the metadata bucket
+	DB_METADATA_SCHEMA_VERSION = "schema_version"
+	DB_METADATA_ENCODING       = "encoding"
+)
+
+// A migration brings the db from the previous schema version
+// to its version
+type dbMigration struct {
+	Version     uint64
+	Description string
+	Migrate     func(tx *bolt.Tx) error
+}
+
+var (
+	// Migrations in the order they are run.  Databases without
+	// a schema version are at version 0.
+	dbMigrations = []dbMigration{
+		dbMigration{
+			Version:     1,
+			Description: "Index the names of the volumes",
+			Migrate:     volumeNameIndexBuild,
+		},
+		dbMigration{
+			Version:     2,
+			Description: "Record the sizes, volume and replica set of the bricks",
+			Migrate:     brickEntriesUpgrade,
+		},
+	}
+
+	// Constructors for the entries in each bucket, used to
+	// convert the entries between encodings
+	dbEntryTypes = []func() DbEntry{
+		func() DbEntry { return NewClusterEntry() },
+		func() DbEntry { return NewNodeEntry() },
+		func() DbEntry { return NewDeviceEntry() },
+		func() DbEntry { return NewVolumeEntry() },
+		func() DbEntry { return &BrickEntry{} },
+		func() DbEntry { return NewSnapshotEntry() },
+		func() DbEntry { return NewSnapshotScheduleEntry() },
+		func() DbEntry { return NewQuotaEntry() },
+		func() DbEntry { return NewPendingOperationEntry() },
+	}
+)
+
+func dbMetadataGet(tx *bolt.Tx, key string) string {
+	b := tx.Bucket([]byte(BOLTDB_BUCKET_METADATA))
+	if b == nil {
+		return ""
+	}
+	return string(b.Get([]byte(key)))
+}
+
+func dbMetadataSet(tx *bolt.Tx, key, value string) error {
+	b := tx.Bucket([]byte(BOLTDB_BUCKET_METADATA))
+	if b == nil {
+		logger.LogError("Unable to access metadata bucket")
+		return ErrDbAccess
+	}
+	return b.Put([]byte(key), []byte(value))
+}
+
+// Returns the schema version recorded in the db
+func DbSchemaVersion(tx *bolt.Tx) (uint64, error) {
+	godbc.Require(tx != nil)
+
+	version := dbMetadataGet(tx, DB_METADATA_SCHEMA_VERSION)
+	if version == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(version, 10, 64)
+}
+
+// Returns the encoding of the entries in the db
+func DbEncoding(tx *bolt.Tx) string {
+	godbc.Require(tx != nil)
+
+	encoding := dbMetadataGet(tx, DB_METADATA_ENCODING)
+	if encoding == "" {
+		return DB_ENCODING_GOB
+	}
+	return encoding
+}
+
+// Run the migrations the db has not had yet, then convert its
+// entries to the requested encoding.  An empty encoding keeps
+// the encoding of the db.
+func dbUpgrade(tx *bolt.Tx, encoding string) error {
+	godbc.Require(tx != nil)
+
+	version, err := DbSchemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version > DB_SCHEMA_VERSION {
+		logger.LogError("Db schema version %v is newer than %v",
+			version, DB_SCHEMA_VERSION)
+		return ErrDbVersion
+	}
+
+	current := DbEncoding(tx)
+
+	for _, migration := range dbMigrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		logger.Info("Migrating db to schema version %v: %v",
+			migration.Version, migration.Description)
+		err := migration.Migrate(tx)
+		if err != nil {
+			logger.LogError("Db migration to version %v failed: %v",
+				migration.Version, err)
+			return err
+		}
+		version = migration.Version
+	}
+
+	err = dbMetadataSet(tx, DB_METADATA_SCHEMA_VERSION,
+		strconv.FormatUint(version, 10))
+	if err != nil {
+		return err
+	}
+
+	if encoding != "" && encoding != current {
+		logger.Info("Converting db entries from %v to %v", current, encoding)
+		err := dbConvertEncoding(tx, current, encoding)
+		if err != nil {
+			return err
+		}
+		current = encoding
+	}
+
+	return dbMetadataSet(tx, DB_METADATA_ENCODING, current)
+}
+
+// Load every entry with one encoding and save it with another
+func dbConvertEncoding(tx *bolt.Tx, from, to string) error {
+	for _, newEntry := range dbEntryTypes {
+		bucket := newEntry().BucketName()
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			logger.LogError("Unable to access bucket %v", bucket)
+			return ErrDbAccess
+		}
+
+		keys := EntryKeys(tx, bucket)
+		if keys == nil {
+			return ErrAccessList
+		}
+
+		for _, key := range keys {
+			entry := newEntry()
+			err := entry.Unmarshal(b.Get([]byte(key)), from)
+			if err != nil {
+				return err
+			}
+
+			buffer, err := entry.Marshal(to)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put([]byte(key), buffer)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
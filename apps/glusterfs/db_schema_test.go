@@ -0,0 +1,407 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/tests"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func newTestAppWithEncoding(dbfile, encoding string) *App {
+	return NewApp(bytes.NewBuffer([]byte(`{
+		"glusterfs" : {
+			"executor" : "mock",
+			"db" : "` + dbfile + `",
+			"db_encoding" : "` + encoding + `"
+		}
+	}`)))
+}
+
+func TestDbSchemaNewDb(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := app.db.View(func(tx *bolt.Tx) error {
+		version, err := DbSchemaVersion(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, version == DB_SCHEMA_VERSION)
+		tests.Assert(t, DbEncoding(tx) == DB_ENCODING_GOB)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestDbSchemaNewerDb(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		return dbMetadataSet(tx, DB_METADATA_SCHEMA_VERSION,
+			strconv.FormatUint(DB_SCHEMA_VERSION+1, 10))
+	})
+	tests.Assert(t, err == nil)
+	app.Close()
+
+	// A db from a newer version of heketi is not loaded
+	app = newTestAppWithEncoding(tmpfile, "")
+	tests.Assert(t, app == nil)
+}
+
+func TestDbSchemaMigrations(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app and forget the schema version
+	app := NewTestApp(tmpfile)
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(BOLTDB_BUCKET_METADATA))
+	})
+	tests.Assert(t, err == nil)
+	app.Close()
+
+	saved := dbMigrations
+	defer func() {
+		dbMigrations = saved
+	}()
+
+	// A failed migration does not load the db
+	dbMigrations = []dbMigration{
+		dbMigration{
+			Version:     1,
+			Description: "Fail",
+			Migrate: func(tx *bolt.Tx) error {
+				return errors.New("MOCK ERROR")
+			},
+		},
+	}
+	app = newTestAppWithEncoding(tmpfile, "")
+	tests.Assert(t, app == nil)
+
+	// Migrations run once
+	runs := 0
+	dbMigrations = []dbMigration{
+		dbMigration{
+			Version:     1,
+			Description: "Count",
+			Migrate: func(tx *bolt.Tx) error {
+				runs++
+				return nil
+			},
+		},
+	}
+	app = NewTestApp(tmpfile)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		version, err := DbSchemaVersion(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, version == 1)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+	app.Close()
+	tests.Assert(t, runs == 1)
+
+	app = NewTestApp(tmpfile)
+	app.Close()
+	tests.Assert(t, runs == 1)
+}
+
+// Entries as written by the first versions of heketi
+type baselineBrickEntry struct {
+	Info struct {
+		Id       string
+		Path     string
+		DeviceId string
+		NodeId   string
+		Size     uint64
+	}
+}
+
+type baselineVolumeEntry struct {
+	Info struct {
+		VolumeCreateRequest struct {
+			Size     int
+			Clusters []string
+			Name     string
+			Replica  int
+			Snapshot struct {
+				Enable bool
+				Factor float32
+			}
+		}
+		Id      string
+		Cluster string
+	}
+	Bricks sort.StringSlice
+}
+
+func baselineEncode(t *testing.T, tx *bolt.Tx, bucket, key string, entry interface{}) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(entry)
+	tests.Assert(t, err == nil)
+	err = tx.Bucket([]byte(bucket)).Put([]byte(key), buffer.Bytes())
+	tests.Assert(t, err == nil)
+}
+
+func TestDbSchemaBaselineBricks(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(100)
+	v.Info.Snapshot.Enable = true
+	v.Info.Snapshot.Factor = 1.5
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Rewrite the volume and its bricks as the first versions of heketi
+	// did, without the thin pool metadata on the devices
+	expected := make(map[string]*BrickEntry)
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		old := &baselineVolumeEntry{}
+		old.Info.VolumeCreateRequest.Size = v.Info.Size
+		old.Info.VolumeCreateRequest.Name = v.Info.Name
+		old.Info.VolumeCreateRequest.Replica = v.Info.Replica
+		old.Info.VolumeCreateRequest.Snapshot.Enable = v.Info.Snapshot.Enable
+		old.Info.VolumeCreateRequest.Snapshot.Factor = v.Info.Snapshot.Factor
+		old.Info.Id = v.Info.Id
+		old.Info.Cluster = v.Info.Cluster
+		old.Bricks = v.Bricks
+		baselineEncode(t, tx, BOLTDB_BUCKET_VOLUME, v.Info.Id, old)
+
+		for _, id := range v.Bricks {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			expected[id] = brick
+
+			old := &baselineBrickEntry{}
+			old.Info.Id = brick.Info.Id
+			old.Info.Path = brick.Info.Path
+			old.Info.DeviceId = brick.Info.DeviceId
+			old.Info.NodeId = brick.Info.NodeId
+			old.Info.Size = brick.Info.Size
+			baselineEncode(t, tx, BOLTDB_BUCKET_BRICK, id, old)
+
+			device, err := NewDeviceEntryFromId(tx, brick.Info.DeviceId)
+			tests.Assert(t, err == nil)
+			device.StorageFree(brick.PoolMetadataSize)
+			tests.Assert(t, device.Save(tx) == nil)
+		}
+
+		tests.Assert(t, tx.DeleteBucket([]byte(BOLTDB_BUCKET_METADATA)) == nil)
+		tests.Assert(t, tx.DeleteBucket([]byte(BOLTDB_BUCKET_VOLUME_NAME)) == nil)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+	app.Close()
+
+	// The bricks are upgraded when the db is loaded
+	app = NewTestApp(tmpfile)
+	defer app.Close()
+	err = app.db.View(func(tx *bolt.Tx) error {
+		version, err := DbSchemaVersion(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, version == DB_SCHEMA_VERSION)
+
+		result, err := DbCheck(tx, false)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(result.Problems) == 0, result.Problems)
+
+		sets := make(map[string]int)
+		for id, want := range expected {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, brick.Info.VolumeId == v.Info.Id)
+			tests.Assert(t, brick.TpSize == want.TpSize)
+			tests.Assert(t, brick.PoolMetadataSize == want.PoolMetadataSize)
+			tests.Assert(t, brick.ReplicaSetId != "")
+			sets[brick.ReplicaSetId]++
+		}
+		tests.Assert(t, len(sets) == len(expected)/v.Info.Replica)
+		for _, n := range sets {
+			tests.Assert(t, n == v.Info.Replica)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// The volume can be deleted
+	err = app.db.View(func(tx *bolt.Tx) error {
+		v, err = NewVolumeEntryFromId(tx, v.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == nil)
+	err = v.Destroy(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		devices, err := DeviceList(tx)
+		tests.Assert(t, err == nil)
+		for _, id := range devices {
+			device, err := NewDeviceEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, device.Info.Storage.Used == 0)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestDbEncodingJson(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create a volume in a gob db
+	app := NewTestApp(tmpfile)
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		3,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Options = map[string]string{"nfs.disable": "on"}
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	app.Close()
+
+	rawVolume := func(app *App) []byte {
+		var raw []byte
+		err := app.db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(BOLTDB_BUCKET_VOLUME))
+			raw = append(raw, b.Get([]byte(v.Info.Id))...)
+			return nil
+		})
+		tests.Assert(t, err == nil)
+		return raw
+	}
+	loadVolume := func(app *App) *VolumeEntry {
+		var volume *VolumeEntry
+		err := app.db.View(func(tx *bolt.Tx) error {
+			var err error
+			volume, err = NewVolumeEntryFromId(tx, v.Info.Id)
+			return err
+		})
+		tests.Assert(t, err == nil)
+		return volume
+	}
+
+	// Convert the db to JSON
+	app = newTestAppWithEncoding(tmpfile, DB_ENCODING_JSON)
+	tests.Assert(t, app != nil)
+
+	var record jsonEntry
+	err = json.Unmarshal(rawVolume(app), &record)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, record.Version == DB_SCHEMA_VERSION)
+	tests.Assert(t, reflect.DeepEqual(loadVolume(app), v))
+	app.Close()
+
+	// The encoding of the db is kept when none is configured
+	app = NewTestApp(tmpfile)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		tests.Assert(t, DbEncoding(tx) == DB_ENCODING_JSON)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, json.Valid(rawVolume(app)))
+	tests.Assert(t, reflect.DeepEqual(loadVolume(app), v))
+	app.Close()
+
+	// Convert it back to gob
+	app = newTestAppWithEncoding(tmpfile, DB_ENCODING_GOB)
+	tests.Assert(t, app != nil)
+	defer app.Close()
+	tests.Assert(t, !json.Valid(rawVolume(app)))
+	tests.Assert(t, reflect.DeepEqual(loadVolume(app), v))
+}
+
+func TestDbEncodingPerDb(t *testing.T) {
+	gobfile := tests.Tempfile()
+	defer os.Remove(gobfile)
+	jsonfile := tests.Tempfile()
+	defer os.Remove(jsonfile)
+
+	// Dbs with different encodings can be open at the same time
+	gobapp := newTestAppWithEncoding(gobfile, DB_ENCODING_GOB)
+	tests.Assert(t, gobapp != nil)
+	defer gobapp.Close()
+	jsonapp := newTestAppWithEncoding(jsonfile, DB_ENCODING_JSON)
+	tests.Assert(t, jsonapp != nil)
+	defer jsonapp.Close()
+
+	for _, app := range []*App{gobapp, jsonapp} {
+		err := setupSampleDbWithTopology(app.db,
+			1,      // clusters
+			3,      // nodes_per_cluster
+			2,      // devices_per_node,
+			500*GB, // disksize)
+		)
+		tests.Assert(t, err == nil)
+	}
+
+	for _, app := range []*App{gobapp, jsonapp} {
+		err := app.db.View(func(tx *bolt.Tx) error {
+			clusters, err := ClusterList(tx)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, len(clusters) == 1)
+
+			raw := tx.Bucket([]byte(BOLTDB_BUCKET_CLUSTER)).Get([]byte(clusters[0]))
+			tests.Assert(t, json.Valid(raw) == (app == jsonapp))
+
+			cluster, err := NewClusterEntryFromId(tx, clusters[0])
+			tests.Assert(t, err == nil)
+			tests.Assert(t, len(cluster.Info.Nodes) == 3)
+			return nil
+		})
+		tests.Assert(t, err == nil)
+	}
+}
+
+func TestDbEncodingUnknown(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	app := newTestAppWithEncoding(tmpfile, "xml")
+	tests.Assert(t, app == nil)
+}
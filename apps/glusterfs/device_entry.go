@@ -17,9 +17,9 @@
 package glusterfs
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
 	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
 	"github.com/heketi/heketi/utils"
 	"github.com/lpabon/godbc"
 	"sort"
@@ -29,6 +29,10 @@ type DeviceEntry struct {
 	Info   DeviceInfo
 	Bricks sort.StringSlice
 	NodeId string
+
+	// Bricks are not placed on devices which are being
+	// evacuated or deleted
+	Draining bool
 }
 
 func DeviceList(tx *bolt.Tx) ([]string, error) {
@@ -150,17 +154,12 @@ func (d *DeviceEntry) NewInfoResponse(tx *bolt.Tx) (*DeviceInfoResponse, error)
 	return info, nil
 }
 
-func (d *DeviceEntry) Marshal() ([]byte, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	err := enc.Encode(*d)
-
-	return buffer.Bytes(), err
+func (d *DeviceEntry) Marshal(encoding string) ([]byte, error) {
+	return entryEncode(encoding, d)
 }
 
-func (d *DeviceEntry) Unmarshal(buffer []byte) error {
-	dec := gob.NewDecoder(bytes.NewReader(buffer))
-	err := dec.Decode(d)
+func (d *DeviceEntry) Unmarshal(buffer []byte, encoding string) error {
+	err := entryDecode(encoding, buffer, d)
 	if err != nil {
 		return err
 	}
@@ -184,6 +183,12 @@ func (d *DeviceEntry) BrickDelete(id string) {
 	d.Bricks = utils.SortedStringsDelete(d.Bricks, id)
 }
 
+func (d *DeviceEntry) BricksIds() sort.StringSlice {
+	ids := make(sort.StringSlice, len(d.Bricks))
+	copy(ids, d.Bricks)
+	return ids
+}
+
 func (d *DeviceEntry) StorageSet(amount uint64) {
 	d.Info.Storage.Free = amount
 	d.Info.Storage.Total = amount
@@ -202,3 +207,194 @@ func (d *DeviceEntry) StorageFree(amount uint64) {
 func (d *DeviceEntry) StorageCheck(amount uint64) bool {
 	return d.Info.Storage.Free > amount
 }
+
+// Move every brick on the device to other devices in the cluster
+// by replacing them in their volumes.  Progress is reported through
+// progress() if it is not nil.
+func (d *DeviceEntry) Evacuate(db *bolt.DB,
+	executor executors.Executor,
+	allocator Allocator,
+	progress func(string)) error {
+
+	// Stop placing bricks on the device while they are moved
+	err := d.setDraining(db, true)
+	if err != nil {
+		return err
+	}
+
+	err = d.moveBricks(db, executor, allocator, progress)
+	if err != nil {
+		// Place bricks on the device again
+		if err := d.setDraining(db, false); err != nil {
+			logger.Err(err)
+		}
+		return err
+	}
+
+	// Refresh the entry now that the bricks have been moved
+	return db.View(func(tx *bolt.Tx) error {
+		entry, err := NewDeviceEntryFromId(tx, d.Info.Id)
+		if err != nil {
+			return err
+		}
+
+		*d = *entry
+		return nil
+	})
+}
+
+// Set whether bricks are placed on the device, and refresh the entry
+func (d *DeviceEntry) setDraining(db *bolt.DB, draining bool) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		entry, err := NewDeviceEntryFromId(tx, d.Info.Id)
+		if err != nil {
+			return err
+		}
+
+		entry.Draining = draining
+		err = entry.Save(tx)
+		if err != nil {
+			return err
+		}
+
+		*d = *entry
+		return nil
+	})
+}
+
+func (d *DeviceEntry) moveBricks(db *bolt.DB,
+	executor executors.Executor,
+	allocator Allocator,
+	progress func(string)) error {
+
+	bricks := d.BricksIds()
+	for i, brickId := range bricks {
+
+		// Get the volume which uses the brick
+		var volume *VolumeEntry
+		err := db.View(func(tx *bolt.Tx) error {
+			brick, err := NewBrickEntryFromId(tx, brickId)
+			if err != nil {
+				return err
+			}
+
+			volume, err = NewVolumeEntryFromId(tx, brick.Info.VolumeId)
+			return err
+		})
+		if err != nil {
+			logger.LogError("Unable to find volume for brick %v: %v", brickId, err)
+			return err
+		}
+
+		if progress != nil {
+			progress(fmt.Sprintf("Replacing brick %v of %v in volume %v",
+				i+1, len(bricks), volume.Info.Name))
+		}
+
+		err = volume.ReplaceBrick(db, executor, allocator, brickId)
+		if err != nil {
+			logger.LogError("Unable to move brick %v off device %v: %v",
+				brickId, d.Info.Id, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Teardown the device on its node and remove it from the db.  Returns
+// ErrConflict if the device has bricks.
+func (d *DeviceEntry) Destroy(db *bolt.DB,
+	executor executors.Executor,
+	allocator Allocator) error {
+
+	// Check the device is still empty and stop placing bricks on it
+	var host string
+	err := db.Update(func(tx *bolt.Tx) error {
+		entry, err := NewDeviceEntryFromId(tx, d.Info.Id)
+		if err != nil {
+			return err
+		}
+		if !entry.IsDeleteOk() {
+			logger.Warning("Unable to delete device [%v] because it contains bricks",
+				d.Info.Id)
+			return ErrConflict
+		}
+
+		entry.Draining = true
+		err = entry.Save(tx)
+		if err != nil {
+			return err
+		}
+		*d = *entry
+
+		// Get node hostname
+		node, err := NewNodeEntryFromId(tx, d.NodeId)
+		if err != nil {
+			return err
+		}
+
+		host = node.ManageHostName()
+		return nil
+	})
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	// Teardown device
+	err = executor.DeviceTeardown(host, d.Info.Name, d.Info.Id)
+	if err != nil {
+		if err := d.setDraining(db, false); err != nil {
+			logger.Err(err)
+		}
+		return err
+	}
+
+	return d.removeFromDb(db, allocator)
+}
+
+// Remove the device from its node and delete it from the db
+func (d *DeviceEntry) removeFromDb(db *bolt.DB, allocator Allocator) error {
+	var cluster string
+	err := db.Update(func(tx *bolt.Tx) error {
+
+		// Access node entry
+		node, err := NewNodeEntryFromId(tx, d.NodeId)
+		if err == ErrNotFound {
+			logger.Critical(
+				"Node id %v pointed to by device %v, but it is not in the db",
+				d.NodeId,
+				d.Info.Id)
+			return err
+		} else if err != nil {
+			logger.Err(err)
+			return err
+		}
+
+		// Delete device from node
+		node.DeviceDelete(d.Info.Id)
+		cluster = node.Info.ClusterId
+
+		// Save node
+		node.Save(tx)
+
+		// Delete device from db
+		err = d.Delete(tx)
+		if err != nil {
+			logger.Err(err)
+			return err
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	// Stop placing bricks on the device
+	allocator.DevicesChanged(cluster)
+
+	return nil
+}
@@ -17,7 +17,9 @@
 package glusterfs
 
 import (
+	"errors"
 	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
 	"github.com/heketi/heketi/tests"
 	"github.com/heketi/heketi/utils"
 	"os"
@@ -86,13 +88,13 @@ func TestNewDeviceEntryMarshal(t *testing.T) {
 	d.BrickAdd("abc")
 	d.BrickAdd("def")
 
-	buffer, err := d.Marshal()
+	buffer, err := d.Marshal(DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, buffer != nil)
 	tests.Assert(t, len(buffer) > 0)
 
 	um := &DeviceEntry{}
-	err = um.Unmarshal(buffer)
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, reflect.DeepEqual(um, d))
 
@@ -364,3 +366,153 @@ func TestDeviceEntryStorage(t *testing.T) {
 	tests.Assert(t, d.Info.Storage.Total == 2000)
 	tests.Assert(t, d.Info.Storage.Used == 0)
 }
+
+func TestDeviceEntryEvacuateDestroy(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Get the device of one of the bricks
+	var device *DeviceEntry
+	err = app.db.View(func(tx *bolt.Tx) error {
+		brick, err := NewBrickEntryFromId(tx, v.Bricks[0])
+		if err != nil {
+			return err
+		}
+
+		device, err = NewDeviceEntryFromId(tx, brick.Info.DeviceId)
+		return err
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(device.Bricks) > 0)
+	bricks := device.BricksIds()
+
+	// Unable to delete a device with bricks
+	err = device.Destroy(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == ErrConflict)
+	tests.Assert(t, !device.Draining)
+
+	// Unable to replace the bricks
+	ErrMock := errors.New("MOCK")
+	app.xo.MockVolumeReplaceBrick = func(host string, volume string,
+		oldBrick, newBrick *executors.BrickInfo) error {
+		return ErrMock
+	}
+	err = device.Evacuate(app.db, app.executor, app.allocator, nil)
+	tests.Assert(t, err == ErrMock)
+	tests.Assert(t, reflect.DeepEqual(device.BricksIds(), bricks))
+	tests.Assert(t, !device.Draining)
+
+	// Evacuate the device
+	app.xo.MockVolumeReplaceBrick = func(host string, volume string,
+		oldBrick, newBrick *executors.BrickInfo) error {
+		return nil
+	}
+	reports := make([]string, 0)
+	err = device.Evacuate(app.db, app.executor, app.allocator, func(progress string) {
+		reports = append(reports, progress)
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(device.Bricks) == 0)
+	tests.Assert(t, device.Info.Storage.Used == 0)
+	tests.Assert(t, len(reports) == len(bricks))
+	tests.Assert(t, device.Draining)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Bricks) == 4)
+
+		for _, id := range volume.Bricks {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, brick.Info.DeviceId != device.Info.Id)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Destroy the device
+	teardown := false
+	app.xo.MockDeviceTeardown = func(host, dev, vgid string) error {
+		tests.Assert(t, dev == device.Info.Name)
+		tests.Assert(t, vgid == device.Info.Id)
+		teardown = true
+		return nil
+	}
+	err = device.Destroy(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, teardown)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewDeviceEntryFromId(tx, device.Info.Id)
+		tests.Assert(t, err == ErrNotFound)
+
+		node, err := NewNodeEntryFromId(tx, device.NodeId)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, !utils.SortedStringHas(node.Devices, device.Info.Id))
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestDeviceEntryDraining(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		1,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Drain one of the devices
+	var device *DeviceEntry
+	err = app.db.View(func(tx *bolt.Tx) error {
+		devices, err := DeviceList(tx)
+		if err != nil {
+			return err
+		}
+
+		device, err = NewDeviceEntryFromId(tx, devices[0])
+		return err
+	})
+	tests.Assert(t, err == nil)
+	err = device.setDraining(app.db, true)
+	tests.Assert(t, err == nil)
+
+	// No bricks are placed on it
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewDeviceEntryFromId(tx, device.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, entry.Draining)
+		tests.Assert(t, len(entry.Bricks) == 0)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
@@ -17,14 +17,30 @@
 package glusterfs
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"github.com/boltdb/bolt"
 	"github.com/lpabon/godbc"
 )
 
+const (
+	// Encodings of the entries in the db
+	DB_ENCODING_GOB  = "gob"
+	DB_ENCODING_JSON = "json"
+)
+
+// Entries encoded as JSON record the schema version
+// of the db they were written with
+type jsonEntry struct {
+	Version uint64          `json:"version"`
+	Entry   json.RawMessage `json:"entry"`
+}
+
 type DbEntry interface {
 	BucketName() string
-	Marshal() ([]byte, error)
-	Unmarshal(buffer []byte) error
+	Marshal(encoding string) ([]byte, error)
+	Unmarshal(buffer []byte, encoding string) error
 }
 
 func EntryKeys(tx *bolt.Tx, bucket string) []string {
@@ -60,7 +76,7 @@ func EntrySave(tx *bolt.Tx, entry DbEntry, key string) error {
 	}
 
 	// Save device entry to db
-	buffer, err := entry.Marshal()
+	buffer, err := entry.Marshal(DbEncoding(tx))
 	if err != nil {
 		logger.Err(err)
 		return err
@@ -114,7 +130,7 @@ func EntryLoad(tx *bolt.Tx, entry DbEntry, key string) error {
 		return ErrNotFound
 	}
 
-	err := entry.Unmarshal(val)
+	err := entry.Unmarshal(val, DbEncoding(tx))
 	if err != nil {
 		logger.Err(err)
 		return err
@@ -122,3 +138,43 @@ func EntryLoad(tx *bolt.Tx, entry DbEntry, key string) error {
 
 	return nil
 }
+
+// Encode an entry using the given encoding of the db
+func entryEncode(encoding string, entry interface{}) ([]byte, error) {
+	if encoding == DB_ENCODING_JSON {
+		buffer, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(&jsonEntry{
+			Version: DB_SCHEMA_VERSION,
+			Entry:   buffer,
+		})
+	}
+
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	err := enc.Encode(entry)
+
+	return buffer.Bytes(), err
+}
+
+// Decode an entry using the given encoding of the db
+func entryDecode(encoding string, buffer []byte, entry interface{}) error {
+	if encoding == DB_ENCODING_JSON {
+		var record jsonEntry
+		err := json.Unmarshal(buffer, &record)
+		if err != nil {
+			return err
+		}
+		if record.Version > DB_SCHEMA_VERSION {
+			return ErrDbVersion
+		}
+
+		return json.Unmarshal(record.Entry, entry)
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(buffer))
+	return dec.Decode(entry)
+}
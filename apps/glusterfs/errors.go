@@ -29,4 +29,17 @@ var (
 	ErrMininumBrickSize = errors.New("Minimum brick size limit reached.  Out of space.")
 	ErrDbAccess         = errors.New("Unable to access db")
 	ErrAccessList       = errors.New("Unable to access list")
+	ErrRebalance        = errors.New("Volume rebalance failed")
+	ErrShrinkSize       = errors.New("No set of bricks can be removed to shrink the volume by the requested size")
+	ErrRemoveBricks     = errors.New("Unable to migrate data out of the bricks being removed")
+	ErrInvalidState     = errors.New("Invalid node state transition")
+	ErrNodeOnline       = errors.New("Node must be offline or failed to be removed")
+	ErrNotEnoughNodes   = errors.New("Not enough online nodes to place each replica on a different node")
+	ErrUnknownAllocator = errors.New("Unknown allocator")
+	ErrSnapshotDisabled = errors.New("Volume was not created with snapshots enabled")
+	ErrHasSnapshots     = errors.New("Volume has snapshots which must be deleted first")
+	ErrHasClones        = errors.New("Volume has clones which share its bricks")
+	ErrNoRedundancy     = errors.New("Volume has a single copy of its data, so its bricks cannot be replaced")
+	ErrDbVersion        = errors.New("Database was written by a newer version of heketi")
+	ErrDbDump           = errors.New("Dump has inconsistent references")
 )
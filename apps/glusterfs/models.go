@@ -21,6 +21,7 @@
 package glusterfs
 
 import (
+	"encoding/json"
 	"sort"
 )
 
@@ -42,6 +43,7 @@ type BrickInfo struct {
 	Path     string `json:"path"`
 	DeviceId string `json:"device"`
 	NodeId   string `json:"node"`
+	VolumeId string `json:"volume"`
 
 	// Size in KB
 	Size uint64 `json:"size"`
@@ -78,7 +80,12 @@ type NodeAddRequest struct {
 
 type NodeInfo struct {
 	NodeAddRequest
-	Id string `json:"id"`
+	Id    string `json:"id"`
+	State string `json:"state"`
+}
+
+type NodeStateRequest struct {
+	State string `json:"state"`
 }
 
 type NodeInfoResponse struct {
@@ -98,12 +105,49 @@ type ClusterListResponse struct {
 }
 
 // Volume
+type DisperseDurability struct {
+	Data       int `json:"data"`
+	Redundancy int `json:"redundancy"`
+}
+
+type VolumeDurabilityInfo struct {
+	Type     string             `json:"type"`
+	Disperse DisperseDurability `json:"disperse"`
+}
+
+// Accepts either a durability section or only the durability
+// type as a string, for example "durability": "none"
+func (d *VolumeDurabilityInfo) UnmarshalJSON(data []byte) error {
+	var durabilityType string
+	if err := json.Unmarshal(data, &durabilityType); err == nil {
+		*d = VolumeDurabilityInfo{Type: durabilityType}
+		return nil
+	}
+
+	type durabilityInfo VolumeDurabilityInfo
+	return json.Unmarshal(data, (*durabilityInfo)(d))
+}
+
 type VolumeCreateRequest struct {
 	// Size in GB
-	Size     int      `json:"size"`
-	Clusters []string `json:"clusters,omitempty"`
-	Name     string   `json:"name"`
-	Replica  int      `json:"replica"`
+	Size       int                  `json:"size"`
+	Clusters   []string             `json:"clusters,omitempty"`
+	Name       string               `json:"name"`
+	Replica    int                  `json:"replica"`
+	Durability VolumeDurabilityInfo `json:"durability"`
+
+	// Snapshot id to clone the volume from
+	SourceSnapshot string `json:"source_snapshot,omitempty"`
+
+	// GlusterFS volume options
+	Options map[string]string `json:"options,omitempty"`
+
+	Arbiter struct {
+		Enable bool `json:"enable"`
+
+		// Expected number of files, used to size the arbiter bricks
+		Files uint64 `json:"files"`
+	} `json:"arbiter"`
 	Snapshot struct {
 		Enable bool    `json:"enable"`
 		Factor float32 `json:"factor"`
@@ -132,7 +176,116 @@ type VolumeListResponse struct {
 }
 
 type VolumeExpandRequest struct {
-	Size int `json:"expand_size"`
+	Size      int  `json:"expand_size"`
+	Rebalance bool `json:"rebalance"`
+}
+
+type VolumeShrinkRequest struct {
+	Size int `json:"shrink_size"`
+}
+
+type VolumeOptionsRequest struct {
+	// Options to set to the given values
+	Set map[string]string `json:"set"`
+
+	// Options to reset to their defaults
+	Reset []string `json:"reset"`
+}
+
+type SnapshotCreateRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type SnapshotInfo struct {
+	SnapshotCreateRequest
+	Id       string `json:"id"`
+	VolumeId string `json:"volume"`
+
+	// Creation time in seconds since the epoch
+	Created int64 `json:"created"`
+
+	// Taken by the snapshot schedule of the volume
+	Scheduled bool `json:"scheduled"`
+}
+
+type SnapshotListResponse struct {
+	Snapshots []string `json:"snapshots"`
+}
+
+type SnapshotScheduleRequest struct {
+	// Minutes between snapshots
+	Interval int `json:"interval"`
+
+	// Number of scheduled snapshots to keep
+	Retention int `json:"retention"`
+}
+
+type SnapshotScheduleInfo struct {
+	SnapshotScheduleRequest
+	VolumeId string `json:"volume"`
+
+	// Last scheduled run, in seconds since the epoch, and the
+	// asynchronous operation which tracks it
+	LastRun    int64  `json:"last_run"`
+	LastRunUrl string `json:"last_run_url"`
+	LastError  string `json:"last_error"`
+}
+
+// Quota
+type QuotaLimit struct {
+	// Hard limit in GB
+	HardLimit int `json:"hard_limit"`
+
+	// Percentage of the hard limit at which GlusterFS starts
+	// logging warnings.  Zero uses the GlusterFS default.
+	SoftLimit int `json:"soft_limit,omitempty"`
+}
+
+type QuotaRequest struct {
+	// Limits to set, by directory in the volume.  The
+	// directory "/" limits the whole volume.
+	Set map[string]QuotaLimit `json:"set"`
+
+	// Directories whose limits are removed
+	Remove []string `json:"remove"`
+}
+
+type QuotaInfo struct {
+	VolumeId string                `json:"volume"`
+	Limits   map[string]QuotaLimit `json:"limits"`
+}
+
+// Usage values in KB
+type QuotaUsage struct {
+	Path              string `json:"path"`
+	HardLimit         uint64 `json:"hard_limit"`
+	SoftLimit         int    `json:"soft_limit"`
+	Used              uint64 `json:"used"`
+	Available         uint64 `json:"available"`
+	SoftLimitExceeded bool   `json:"soft_limit_exceeded"`
+	HardLimitExceeded bool   `json:"hard_limit_exceeded"`
+}
+
+type QuotaInfoResponse struct {
+	QuotaInfo
+	Usage []QuotaUsage `json:"usage"`
+}
+
+// Db
+type DbCheckProblem struct {
+	Type        string `json:"type"`
+	Bucket      string `json:"bucket"`
+	Id          string `json:"id"`
+	Description string `json:"description"`
+	Repaired    bool   `json:"repaired"`
+}
+
+type DbCheckResponse struct {
+	Problems []DbCheckProblem `json:"problems"`
+
+	// False when the problems were only reported
+	Repair bool `json:"repair"`
 }
 
 // Constructors
@@ -17,14 +17,31 @@
 package glusterfs
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
 	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
 	"github.com/heketi/heketi/utils"
 	"github.com/lpabon/godbc"
 	"sort"
 )
 
+const (
+	// Node states.  New bricks are only placed on online nodes
+	NODE_STATE_ONLINE  = "online"
+	NODE_STATE_OFFLINE = "offline"
+	NODE_STATE_FAILED  = "failed"
+)
+
+var (
+	// Allowed state transitions.  A failed node must be brought
+	// offline before it is put back online
+	nodeStateTransitions = map[string][]string{
+		NODE_STATE_ONLINE:  []string{NODE_STATE_OFFLINE, NODE_STATE_FAILED},
+		NODE_STATE_OFFLINE: []string{NODE_STATE_ONLINE, NODE_STATE_FAILED},
+		NODE_STATE_FAILED:  []string{NODE_STATE_OFFLINE},
+	}
+)
+
 type NodeEntry struct {
 	Info    NodeInfo
 	Devices sort.StringSlice
@@ -45,6 +62,7 @@ func NewNodeEntryFromRequest(req *NodeAddRequest) *NodeEntry {
 	node.Info.ClusterId = req.ClusterId
 	node.Info.Hostnames = req.Hostnames
 	node.Info.Zone = req.Zone
+	node.Info.State = NODE_STATE_ONLINE
 
 	return node
 }
@@ -116,6 +134,7 @@ func (n *NodeEntry) NewInfoReponse(tx *bolt.Tx) (*NodeInfoResponse, error) {
 	info.Hostnames = n.Info.Hostnames
 	info.Id = n.Info.Id
 	info.Zone = n.Info.Zone
+	info.State = n.Info.State
 	info.DevicesInfo = make([]DeviceInfoResponse, 0)
 
 	// Add each drive information
@@ -135,17 +154,12 @@ func (n *NodeEntry) NewInfoReponse(tx *bolt.Tx) (*NodeInfoResponse, error) {
 	return info, nil
 }
 
-func (n *NodeEntry) Marshal() ([]byte, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	err := enc.Encode(*n)
-
-	return buffer.Bytes(), err
+func (n *NodeEntry) Marshal(encoding string) ([]byte, error) {
+	return entryEncode(encoding, n)
 }
 
-func (n *NodeEntry) Unmarshal(buffer []byte) error {
-	dec := gob.NewDecoder(bytes.NewReader(buffer))
-	err := dec.Decode(n)
+func (n *NodeEntry) Unmarshal(buffer []byte, encoding string) error {
+	err := entryDecode(encoding, buffer, n)
 	if err != nil {
 		return err
 	}
@@ -155,6 +169,11 @@ func (n *NodeEntry) Unmarshal(buffer []byte) error {
 		n.Devices = make(sort.StringSlice, 0)
 	}
 
+	// Nodes saved before states were added are online
+	if n.Info.State == "" {
+		n.Info.State = NODE_STATE_ONLINE
+	}
+
 	return nil
 }
 
@@ -168,3 +187,202 @@ func (n *NodeEntry) DeviceAdd(id string) {
 func (n *NodeEntry) DeviceDelete(id string) {
 	n.Devices = utils.SortedStringsDelete(n.Devices, id)
 }
+
+func (n *NodeEntry) IsOnline() bool {
+	return n.Info.State == NODE_STATE_ONLINE
+}
+
+// Change the state of the node.  Returns ErrInvalidState if the
+// node cannot move from its current state to the new one.
+func (n *NodeEntry) SetState(state string) error {
+	if state == n.Info.State {
+		return nil
+	}
+
+	for _, allowed := range nodeStateTransitions[n.Info.State] {
+		if allowed == state {
+			logger.Info("Node %v changed state from %v to %v",
+				n.Info.Id, n.Info.State, state)
+			n.Info.State = state
+			return nil
+		}
+	}
+
+	return ErrInvalidState
+}
+
+// Move every brick off the devices of the node and delete the
+// devices.  Returns ErrNodeOnline if the node is online, since new
+// bricks could be placed on it while it is being evacuated.  Progress
+// is reported through progress() if it is not nil.
+func (n *NodeEntry) Evacuate(db *bolt.DB,
+	executor executors.Executor,
+	allocator Allocator,
+	progress func(string)) error {
+
+	// The entry may have changed since it was read
+	err := n.refresh(db)
+	if err != nil {
+		return err
+	}
+	if n.IsOnline() {
+		return ErrNodeOnline
+	}
+
+	devices := make(sort.StringSlice, len(n.Devices))
+	copy(devices, n.Devices)
+	for i, id := range devices {
+		var device *DeviceEntry
+		err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			device, err = NewDeviceEntryFromId(tx, id)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		// Report the device being evacuated along with the
+		// progress of each of its bricks
+		var deviceProgress func(string)
+		if progress != nil {
+			progress(fmt.Sprintf("Evacuating device %v of %v", i+1, len(devices)))
+			deviceProgress = func(msg string) {
+				progress(fmt.Sprintf("Device %v of %v: %v", i+1, len(devices), msg))
+			}
+		}
+
+		err = device.Evacuate(db, executor, allocator, deviceProgress)
+		if err != nil {
+			return err
+		}
+
+		err = device.Destroy(db, executor, allocator)
+		if err != nil && n.Info.State == NODE_STATE_FAILED {
+			// The node cannot be reached, so only remove the
+			// device from the db
+			logger.LogError("Unable to teardown device %v on failed node %v: %v",
+				id, n.Info.Id, err)
+			err = device.removeFromDb(db, allocator)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Refresh the entry now that the devices have been removed
+	return n.refresh(db)
+}
+
+// Read the entry again from the db
+func (n *NodeEntry) refresh(db *bolt.DB) error {
+	return db.View(func(tx *bolt.Tx) error {
+		entry, err := NewNodeEntryFromId(tx, n.Info.Id)
+		if err != nil {
+			return err
+		}
+
+		*n = *entry
+		return nil
+	})
+}
+
+// Remove the node from the trusted storage pool and from the db.
+// Returns ErrConflict if the node has devices.
+func (n *NodeEntry) Destroy(db *bolt.DB,
+	executor executors.Executor,
+	allocator Allocator) error {
+
+	// Get a node in the cluster to execute the Gluster peer command
+	var peer_node *NodeEntry
+	err := db.View(func(tx *bolt.Tx) error {
+
+		// The entry may have changed since it was read
+		entry, err := NewNodeEntryFromId(tx, n.Info.Id)
+		if err != nil {
+			return err
+		}
+		*n = *entry
+		if !n.IsDeleteOk() {
+			logger.Warning("Unable to delete node [%v] because it contains devices",
+				n.Info.Id)
+			return ErrConflict
+		}
+
+		cluster, err := NewClusterEntryFromId(tx, n.Info.ClusterId)
+		if err != nil {
+			return err
+		}
+
+		peer_node, err = cluster.PeerNode(tx)
+		return err
+	})
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	// Remove from trusted pool.  Nodes which are not online may
+	// not be reachable, so they are detached with force.
+	if peer_node != nil {
+		err := executor.PeerDetach(peer_node.ManageHostName(), n.ManageHostName(),
+			n.Info.State == NODE_STATE_FAILED || n.Info.State == NODE_STATE_OFFLINE)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Remove from db
+	err = db.Update(func(tx *bolt.Tx) error {
+
+		// Devices may have been added while the node was detached
+		entry, err := NewNodeEntryFromId(tx, n.Info.Id)
+		if err != nil {
+			return err
+		}
+		*n = *entry
+		if !n.IsDeleteOk() {
+			logger.Warning("Unable to delete node [%v] because devices were added to it",
+				n.Info.Id)
+			return ErrConflict
+		}
+
+		// Get Cluster
+		cluster, err := NewClusterEntryFromId(tx, n.Info.ClusterId)
+		if err == ErrNotFound {
+			logger.Critical("Cluster id %v is expected be in db. Pointed to by node %v",
+				n.Info.ClusterId,
+				n.Info.Id)
+			return err
+		} else if err != nil {
+			logger.Err(err)
+			return err
+		}
+		cluster.NodeDelete(n.Info.Id)
+
+		// Save cluster
+		err = cluster.Save(tx)
+		if err != nil {
+			logger.Err(err)
+			return err
+		}
+
+		// Delete node from db
+		err = n.Delete(tx)
+		if err != nil {
+			logger.Err(err)
+			return err
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	// Stop using the node when placing bricks
+	allocator.DevicesChanged(n.Info.ClusterId)
+
+	return nil
+}
@@ -17,6 +17,7 @@
 package glusterfs
 
 import (
+	"errors"
 	"github.com/boltdb/bolt"
 	"github.com/heketi/heketi/tests"
 	"github.com/heketi/heketi/utils"
@@ -83,13 +84,13 @@ func TestNewNodeEntryMarshal(t *testing.T) {
 	n.DeviceAdd("abc")
 	n.DeviceAdd("def")
 
-	buffer, err := n.Marshal()
+	buffer, err := n.Marshal(DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, buffer != nil)
 	tests.Assert(t, len(buffer) > 0)
 
 	um := &NodeEntry{}
-	err = um.Unmarshal(buffer)
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, reflect.DeepEqual(n, um))
 
@@ -328,3 +329,226 @@ func TestNewNodeEntryNewInfoResponse(t *testing.T) {
 	tests.Assert(t, reflect.DeepEqual(info.Hostnames.Manage, n.Info.Hostnames.Manage))
 	tests.Assert(t, reflect.DeepEqual(info.Hostnames.Storage, n.Info.Hostnames.Storage))
 }
+
+func TestNodeEntryState(t *testing.T) {
+	n := createSampleNodeEntry()
+	tests.Assert(t, n.Info.State == NODE_STATE_ONLINE)
+	tests.Assert(t, n.IsOnline())
+
+	// Allowed transitions
+	tests.Assert(t, n.SetState(NODE_STATE_OFFLINE) == nil)
+	tests.Assert(t, !n.IsOnline())
+	tests.Assert(t, n.SetState(NODE_STATE_ONLINE) == nil)
+	tests.Assert(t, n.SetState(NODE_STATE_FAILED) == nil)
+	tests.Assert(t, n.SetState(NODE_STATE_FAILED) == nil)
+	tests.Assert(t, n.Info.State == NODE_STATE_FAILED)
+
+	// A failed node must be brought offline first
+	tests.Assert(t, n.SetState(NODE_STATE_ONLINE) == ErrInvalidState)
+	tests.Assert(t, n.Info.State == NODE_STATE_FAILED)
+	tests.Assert(t, n.SetState(NODE_STATE_OFFLINE) == nil)
+	tests.Assert(t, n.SetState(NODE_STATE_ONLINE) == nil)
+
+	// Unknown state
+	tests.Assert(t, n.SetState("bogus") == ErrInvalidState)
+	tests.Assert(t, n.IsOnline())
+
+	// Nodes saved without a state are online
+	n.Info.State = ""
+	buffer, err := n.Marshal(DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+	um := &NodeEntry{}
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, um.IsOnline())
+}
+
+func TestNodeEntryEvacuateDestroy(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Take the node of one of the bricks offline
+	var node *NodeEntry
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		brick, err := NewBrickEntryFromId(tx, v.Bricks[0])
+		if err != nil {
+			return err
+		}
+
+		node, err = NewNodeEntryFromId(tx, brick.Info.NodeId)
+		if err != nil {
+			return err
+		}
+
+		err = node.SetState(NODE_STATE_OFFLINE)
+		if err != nil {
+			return err
+		}
+		return node.Save(tx)
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(node.Devices) == 4)
+
+	// Nodes with devices cannot be destroyed
+	err = node.Destroy(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == ErrConflict)
+
+	// The state of the node is checked in the db
+	setState := func(state string) {
+		err := app.db.Update(func(tx *bolt.Tx) error {
+			entry, err := NewNodeEntryFromId(tx, node.Info.Id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, entry.SetState(state) == nil)
+			return entry.Save(tx)
+		})
+		tests.Assert(t, err == nil)
+	}
+	setState(NODE_STATE_ONLINE)
+	err = node.Evacuate(app.db, app.executor, app.allocator, nil)
+	tests.Assert(t, err == ErrNodeOnline)
+	setState(NODE_STATE_OFFLINE)
+
+	// Evacuate the node
+	reports := make([]string, 0)
+	err = node.Evacuate(app.db, app.executor, app.allocator, func(progress string) {
+		reports = append(reports, progress)
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(node.Devices) == 0)
+	tests.Assert(t, len(reports) >= 4)
+	tests.Assert(t, reports[0] == "Evacuating device 1 of 4", reports)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Bricks) == 4)
+
+		for _, id := range volume.Bricks {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, brick.Info.NodeId != node.Info.Id)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Devices added while the node is detached keep it in the db
+	device := createSampleDeviceEntry(node.Info.Id, 500*GB)
+	app.xo.MockPeerDetach = func(exec_host, detachnode string, force bool) error {
+		return app.db.Update(func(tx *bolt.Tx) error {
+			entry, err := NewNodeEntryFromId(tx, node.Info.Id)
+			tests.Assert(t, err == nil)
+			entry.DeviceAdd(device.Info.Id)
+			err = entry.Save(tx)
+			tests.Assert(t, err == nil)
+			return device.Save(tx)
+		})
+	}
+	err = node.Destroy(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == ErrConflict)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewNodeEntryFromId(tx, node.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(entry.Devices) == 1)
+
+		cluster, err := NewClusterEntryFromId(tx, node.Info.ClusterId)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, utils.SortedStringHas(cluster.Info.Nodes, node.Info.Id))
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Remove the device again
+	err = device.removeFromDb(app.db, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Destroy the node.  It is offline, so it is detached with force.
+	detached := false
+	app.xo.MockPeerDetach = func(exec_host, detachnode string, force bool) error {
+		tests.Assert(t, force)
+		detached = true
+		return nil
+	}
+	err = node.Destroy(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, detached)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewNodeEntryFromId(tx, node.Info.Id)
+		tests.Assert(t, err == ErrNotFound)
+
+		cluster, err := NewClusterEntryFromId(tx, node.Info.ClusterId)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, !utils.SortedStringHas(cluster.Info.Nodes, node.Info.Id))
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestNodeEntryEvacuateFailed(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Mark a node as failed
+	var node *NodeEntry
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		nodes := EntryKeys(tx, BOLTDB_BUCKET_NODE)
+		var err error
+		node, err = NewNodeEntryFromId(tx, nodes[0])
+		if err != nil {
+			return err
+		}
+
+		err = node.SetState(NODE_STATE_FAILED)
+		if err != nil {
+			return err
+		}
+		return node.Save(tx)
+	})
+	tests.Assert(t, err == nil)
+
+	// The devices are removed from the db even if
+	// the node cannot be reached
+	app.xo.MockDeviceTeardown = func(host, device, vgid string) error {
+		return errors.New("Mock")
+	}
+	err = node.Evacuate(app.db, app.executor, app.allocator, nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(node.Devices) == 0)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		devices, err := DeviceList(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(devices) == 6)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
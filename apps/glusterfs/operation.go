@@ -0,0 +1,463 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
+	"github.com/heketi/heketi/utils"
+	"github.com/lpabon/godbc"
+	"time"
+)
+
+const (
+	OPERATION_VOLUME_CREATE  = "volume-create"
+	OPERATION_VOLUME_EXPAND  = "volume-expand"
+	OPERATION_VOLUME_DESTROY = "volume-destroy"
+	OPERATION_BRICK_REPLACE  = "brick-replace"
+
+	// The remote work of the operation may not have finished.
+	// Interrupted operations in this state are rolled back.
+	OPERATION_STATE_PENDING = "pending"
+
+	// The remote work of the operation finished but the db was
+	// not updated.  Interrupted operations in this state are
+	// rolled forward.
+	OPERATION_STATE_DONE = "done"
+
+	// The new bricks of an expansion or replacement may have been
+	// added to the volume, so they cannot be destroyed.  Interrupted
+	// operations in this state are rolled forward.
+	OPERATION_STATE_BRICKS_ADDED = "bricks-added"
+)
+
+// Operations which change the db in several transactions around
+// remote work are recorded before they start, and deleted in the
+// transaction which commits them.  The operations left in the db
+// were interrupted, and are finished or undone when the server
+// starts.
+//
+// Bricks are saved with the id of their volume as soon as they are
+// allocated, so the bricks of an operation are found from its volume.
+type PendingOperationEntry struct {
+	Id       string
+	Type     string
+	State    string
+	VolumeId string
+
+	// Volume being created
+	Volume *VolumeEntry
+
+	// Size in GB added by an expansion
+	Size int
+
+	// Brick being replaced
+	BrickId string
+
+	// Start time in seconds since the epoch
+	Started int64
+}
+
+func PendingOperationList(tx *bolt.Tx) ([]string, error) {
+
+	list := EntryKeys(tx, BOLTDB_BUCKET_PENDING)
+	if list == nil {
+		return nil, ErrAccessList
+	}
+	return list, nil
+}
+
+func NewPendingOperationEntry() *PendingOperationEntry {
+	return &PendingOperationEntry{}
+}
+
+func NewPendingOperationEntryFromVolume(opType string,
+	v *VolumeEntry) *PendingOperationEntry {
+
+	godbc.Require(v != nil)
+	godbc.Require(v.Info.Id != "")
+
+	op := NewPendingOperationEntry()
+	op.Id = utils.GenUUID()
+	op.Type = opType
+	op.State = OPERATION_STATE_PENDING
+	op.VolumeId = v.Info.Id
+	op.Started = time.Now().Unix()
+
+	return op
+}
+
+func NewPendingOperationEntryFromId(tx *bolt.Tx, id string) (*PendingOperationEntry, error) {
+	godbc.Require(tx != nil)
+
+	entry := NewPendingOperationEntry()
+	err := EntryLoad(tx, entry, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (op *PendingOperationEntry) BucketName() string {
+	return BOLTDB_BUCKET_PENDING
+}
+
+func (op *PendingOperationEntry) Save(tx *bolt.Tx) error {
+	godbc.Require(tx != nil)
+	godbc.Require(len(op.Id) > 0)
+
+	return EntrySave(tx, op, op.Id)
+}
+
+func (op *PendingOperationEntry) Delete(tx *bolt.Tx) error {
+	return EntryDelete(tx, op, op.Id)
+}
+
+func (op *PendingOperationEntry) Marshal(encoding string) ([]byte, error) {
+	return entryEncode(encoding, op)
+}
+
+func (op *PendingOperationEntry) Unmarshal(buffer []byte, encoding string) error {
+	err := entryDecode(encoding, buffer, op)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Record the operation before it changes anything
+func (op *PendingOperationEntry) Record(db *bolt.DB) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return op.Save(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	return nil
+}
+
+// Record that the remote work of the operation finished.  If this
+// fails the operation is still rolled back when interrupted, so the
+// caller must undo the remote work or keep it from being undone.
+func (op *PendingOperationEntry) Done(db *bolt.DB) error {
+	return op.setState(db, OPERATION_STATE_DONE)
+}
+
+func (op *PendingOperationEntry) setState(db *bolt.DB, state string) error {
+	previous := op.State
+	op.State = state
+	err := db.Update(func(tx *bolt.Tx) error {
+		return op.Save(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+		op.State = previous
+		return err
+	}
+
+	return nil
+}
+
+// Returns true if the operation is finished instead of undone
+// when interrupted
+func (op *PendingOperationEntry) rollsForward() bool {
+	return op.State == OPERATION_STATE_DONE ||
+		op.State == OPERATION_STATE_BRICKS_ADDED
+}
+
+// Delete the operation after it failed and was undone
+func (op *PendingOperationEntry) Clear(db *bolt.DB) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return op.Delete(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+	}
+}
+
+// Returns the bricks of the volume which are not in its list of
+// bricks, which were allocated by an operation on the volume
+func operationBricks(tx *bolt.Tx, v *VolumeEntry) ([]*BrickEntry, error) {
+	ids, err := BrickList(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	bricks := make([]*BrickEntry, 0)
+	for _, id := range ids {
+		brick, err := NewBrickEntryFromId(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if brick.Info.VolumeId == v.Info.Id &&
+			!utils.SortedStringHas(v.Bricks, id) {
+			bricks = append(bricks, brick)
+		}
+	}
+
+	return bricks, nil
+}
+
+// Best effort removal of what the remote work of an operation
+// may have created.  Failures are expected since the remote
+// work may not have been done.
+func (op *PendingOperationEntry) destroyRemote(db *bolt.DB,
+	executor executors.Executor,
+	v *VolumeEntry,
+	bricks []*BrickEntry) {
+
+	if op.Type == OPERATION_VOLUME_CREATE {
+		// Clones know their cluster, but their bricks are
+		// only saved together with the volume
+		cluster := v.Info.Cluster
+		var err error
+		if len(bricks) != 0 {
+			err = db.View(func(tx *bolt.Tx) error {
+				node, err := NewNodeEntryFromId(tx, bricks[0].Info.NodeId)
+				if err != nil {
+					return err
+				}
+				cluster = node.Info.ClusterId
+				return nil
+			})
+		}
+		if err == nil && cluster != "" {
+			var host string
+			host, err = v.peerHost(db, cluster)
+			if err == nil {
+				err = executor.VolumeDestroy(host, v.Info.Name)
+			}
+		}
+		if err != nil {
+			logger.Info("Unable to delete volume %v: %v", v.Info.Name, err)
+		}
+	}
+
+	err := DestroyBricks(db, executor, bricks)
+	if err != nil {
+		logger.Info("Unable to delete bricks of volume %v: %v", v.Info.Name, err)
+	}
+}
+
+// Undo an operation whose remote work may not have finished
+func (op *PendingOperationEntry) rollBack(db *bolt.DB,
+	executor executors.Executor) error {
+
+	if op.Type == OPERATION_VOLUME_DESTROY {
+		// The volume is still in the db, and can be destroyed again
+		return db.Update(func(tx *bolt.Tx) error {
+			return op.Delete(tx)
+		})
+	}
+
+	// Get the volume and the bricks of the operation
+	var v *VolumeEntry
+	var bricks []*BrickEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		if op.Type == OPERATION_VOLUME_CREATE {
+			v = op.Volume
+			v.Bricks = nil
+		} else {
+			v, err = NewVolumeEntryFromId(tx, op.VolumeId)
+			if err != nil {
+				return err
+			}
+		}
+
+		bricks, err = operationBricks(tx, v)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	op.destroyRemote(db, executor, v, bricks)
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, brick := range bricks {
+			err := v.removeBrickFromDb(tx, brick)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The name of a new volume may be reserved in any cluster
+		if op.Type == OPERATION_VOLUME_CREATE {
+			clusters, err := ClusterList(tx)
+			if err != nil {
+				return err
+			}
+			for _, cluster := range clusters {
+				err := volumeNameRelease(tx, cluster, v.Info.Name, v.Info.Id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return op.Delete(tx)
+	})
+}
+
+// Update the db for an operation whose remote work finished
+func (op *PendingOperationEntry) rollForward(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		switch op.Type {
+		case OPERATION_VOLUME_CREATE:
+			v := op.Volume
+			err := v.Save(tx)
+			if err != nil {
+				return err
+			}
+
+			cluster, err := NewClusterEntryFromId(tx, v.Info.Cluster)
+			if err != nil {
+				return err
+			}
+			cluster.VolumeAdd(v.Info.Id)
+			err = cluster.Save(tx)
+			if err != nil {
+				return err
+			}
+
+		case OPERATION_VOLUME_EXPAND:
+			v, err := NewVolumeEntryFromId(tx, op.VolumeId)
+			if err != nil {
+				return err
+			}
+
+			bricks, err := operationBricks(tx, v)
+			if err != nil {
+				return err
+			}
+			for _, brick := range bricks {
+				v.BrickAdd(brick.Id())
+			}
+			v.Info.Size += op.Size
+
+			err = v.Save(tx)
+			if err != nil {
+				return err
+			}
+
+		case OPERATION_BRICK_REPLACE:
+			v, err := NewVolumeEntryFromId(tx, op.VolumeId)
+			if err != nil {
+				return err
+			}
+
+			bricks, err := operationBricks(tx, v)
+			if err != nil {
+				return err
+			}
+			for _, brick := range bricks {
+				v.BrickAdd(brick.Id())
+			}
+
+			// The replaced brick is no longer part of the volume
+			oldBrick, err := NewBrickEntryFromId(tx, op.BrickId)
+			if err == nil {
+				logger.Warning("Replaced brick %v may still be on device %v",
+					oldBrick.Info.Id, oldBrick.Info.DeviceId)
+				err = v.removeBrickFromDb(tx, oldBrick)
+				if err != nil {
+					return err
+				}
+			} else if err != ErrNotFound {
+				return err
+			}
+
+			err = v.Save(tx)
+			if err != nil {
+				return err
+			}
+
+		case OPERATION_VOLUME_DESTROY:
+			v, err := NewVolumeEntryFromId(tx, op.VolumeId)
+			if err == ErrNotFound {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			bricks := make([]*BrickEntry, 0)
+			for _, id := range v.BricksIds() {
+				brick, err := NewBrickEntryFromId(tx, id)
+				if err == ErrNotFound {
+					continue
+				} else if err != nil {
+					return err
+				}
+				bricks = append(bricks, brick)
+			}
+
+			err = v.removeFromDb(tx, bricks)
+			if err != nil {
+				return err
+			}
+		}
+
+		return op.Delete(tx)
+	})
+}
+
+// Finish or undo the operations which were interrupted when the
+// server stopped.  Operations which cannot be recovered are kept
+// and tried again the next time the server starts.
+func (a *App) recoverOperations() {
+	var ops []*PendingOperationEntry
+	err := a.db.View(func(tx *bolt.Tx) error {
+		ids, err := PendingOperationList(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			op, err := NewPendingOperationEntryFromId(tx, id)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, op)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.LogError("Unable to get the interrupted operations: %v", err)
+		return
+	}
+
+	for _, op := range ops {
+		if op.rollsForward() {
+			logger.Info("Finishing interrupted %v of volume %v",
+				op.Type, op.VolumeId)
+			err = op.rollForward(a.db)
+		} else {
+			logger.Info("Undoing interrupted %v of volume %v",
+				op.Type, op.VolumeId)
+			err = op.rollBack(a.db, a.executor)
+		}
+		if err != nil {
+			logger.LogError("Unable to recover %v of volume %v: %v",
+				op.Type, op.VolumeId, err)
+		}
+	}
+}
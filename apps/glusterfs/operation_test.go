@@ -0,0 +1,604 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
+	"github.com/heketi/heketi/tests"
+	"github.com/heketi/heketi/utils"
+	"os"
+	"testing"
+)
+
+func setupOperationTopology(t *testing.T, app *App) {
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		3,    // nodes_per_cluster
+		2,    // devices_per_node,
+		1*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+}
+
+func pendingOperations(t *testing.T, app *App) []string {
+	var ids []string
+	err := app.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ids, err = PendingOperationList(tx)
+		return err
+	})
+	tests.Assert(t, err == nil)
+	return ids
+}
+
+// Asserts the db has no problems, and whether any storage is used
+func assertOperationDbClean(t *testing.T, app *App, used bool) {
+	err := app.db.View(func(tx *bolt.Tx) error {
+		result, err := DbCheck(tx, false)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(result.Problems) == 0, result.Problems)
+
+		devices, err := DeviceList(tx)
+		tests.Assert(t, err == nil)
+		total := uint64(0)
+		for _, id := range devices {
+			device, err := NewDeviceEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			total += device.Info.Storage.Used
+		}
+		tests.Assert(t, (total != 0) == used, total)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+// Stop and start the server
+func restartTestApp(app *App, dbfile string) *App {
+	app.Close()
+	return NewTestApp(dbfile)
+}
+
+func TestPendingOperationEntryMarshal(t *testing.T) {
+	v := createSampleVolumeEntry(100)
+	v.Info.Cluster = "abc"
+	op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_CREATE, v)
+	op.Volume = v
+	op.Size = 10
+
+	buffer, err := op.Marshal(DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+
+	um := NewPendingOperationEntry()
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, um.Id == op.Id)
+	tests.Assert(t, um.Type == OPERATION_VOLUME_CREATE)
+	tests.Assert(t, um.State == OPERATION_STATE_PENDING)
+	tests.Assert(t, um.VolumeId == v.Info.Id)
+	tests.Assert(t, um.Volume.Info.Cluster == "abc")
+	tests.Assert(t, um.Size == 10)
+	tests.Assert(t, um.Started != 0)
+}
+
+func TestPendingOperationsCleared(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	setupOperationTopology(t, app)
+
+	// Successful operations
+	v := createSampleVolumeEntry(100)
+	err := v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+
+	err = v.Expand(app.db, app.executor, app.allocator, 100)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+
+	err = v.Destroy(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+
+	// Failed operations
+	app.xo.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		return errors.New("MOCK ERROR")
+	}
+	v = createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err != nil)
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+	assertOperationDbClean(t, app, false)
+}
+
+func TestPendingOperationCreateRollBack(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	setupOperationTopology(t, app)
+
+	// Stop after the bricks were allocated
+	v := createSampleVolumeEntry(100)
+	op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_CREATE, v)
+	op.Volume = v
+	tests.Assert(t, op.Record(app.db) == nil)
+
+	var cluster string
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		clusters, err := ClusterList(tx)
+		tests.Assert(t, err == nil)
+		cluster = clusters[0]
+		return volumeNameReserve(tx, cluster, v.Info.Name, v.Info.Id)
+	})
+	tests.Assert(t, err == nil)
+	bricks, err := v.allocBricksInCluster(app.db, app.allocator, cluster, v.Info.Size)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(bricks) > 0)
+
+	// The bricks and the name are removed
+	app = restartTestApp(app, tmpfile)
+	defer app.Close()
+
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+	assertOperationDbClean(t, app, false)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		bricks, err := BrickList(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(bricks) == 0)
+
+		_, err = VolumeIdFromName(tx, cluster, v.Info.Name)
+		tests.Assert(t, err == ErrNotFound)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestPendingOperationCloneRollBack(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	source := createSampleSnapshotVolume(t, app, true)
+	s := NewSnapshotEntryFromRequest(source.Info.Id, &SnapshotCreateRequest{})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	// Stop after the snapshot was cloned
+	req := &VolumeCreateRequest{}
+	req.SourceSnapshot = s.Info.Id
+	v := NewVolumeEntryFromRequest(req)
+	v.Info.Cluster = source.Info.Cluster
+	op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_CREATE, v)
+	op.Volume = v
+	tests.Assert(t, op.Record(app.db) == nil)
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		return volumeNameReserve(tx, v.Info.Cluster, v.Info.Name, v.Info.Id)
+	})
+	tests.Assert(t, err == nil)
+
+	// The clone is deleted and its name released
+	destroyed := ""
+	app.xo.MockVolumeDestroy = func(host string, volume string) error {
+		destroyed = volume
+		return nil
+	}
+	err = op.rollBack(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, destroyed == v.Info.Name)
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := VolumeIdFromName(tx, v.Info.Cluster, v.Info.Name)
+		tests.Assert(t, err == ErrNotFound)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestPendingOperationCreateRollForward(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	setupOperationTopology(t, app)
+
+	// Stop after the GlusterFS volume was created
+	v := createSampleVolumeEntry(100)
+	op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_CREATE, v)
+	op.Volume = v
+	tests.Assert(t, op.Record(app.db) == nil)
+
+	var cluster string
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		clusters, err := ClusterList(tx)
+		tests.Assert(t, err == nil)
+		cluster = clusters[0]
+		return volumeNameReserve(tx, cluster, v.Info.Name, v.Info.Id)
+	})
+	tests.Assert(t, err == nil)
+	bricks, err := v.allocBricksInCluster(app.db, app.allocator, cluster, v.Info.Size)
+	tests.Assert(t, err == nil)
+	v.Info.Cluster = cluster
+	op.Done(app.db)
+
+	// The volume is saved
+	app = restartTestApp(app, tmpfile)
+	defer app.Close()
+
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+	assertOperationDbClean(t, app, true)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, entry.Info.Cluster == cluster)
+		tests.Assert(t, len(entry.Bricks) == len(bricks))
+
+		id, err := VolumeIdFromName(tx, cluster, v.Info.Name)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, id == v.Info.Id)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestPendingOperationExpand(t *testing.T) {
+	states := []string{
+		OPERATION_STATE_PENDING,
+		OPERATION_STATE_BRICKS_ADDED,
+		OPERATION_STATE_DONE,
+	}
+	for _, state := range states {
+		tmpfile := tests.Tempfile()
+		defer os.Remove(tmpfile)
+
+		// Create the app
+		app := NewTestApp(tmpfile)
+		setupOperationTopology(t, app)
+
+		v := createSampleVolumeEntry(100)
+		err := v.Create(app.db, app.executor, app.allocator)
+		tests.Assert(t, err == nil)
+		numbricks := len(v.Bricks)
+
+		// Stop after the bricks were allocated, while they were
+		// added to the GlusterFS volume, or after they were added
+		op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_EXPAND, v)
+		op.Size = 100
+		tests.Assert(t, op.Record(app.db) == nil)
+		bricks, err := v.allocBricksInCluster(app.db, app.allocator, v.Info.Cluster, 100)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, op.setState(app.db, state) == nil)
+		done := state != OPERATION_STATE_PENDING
+
+		app = restartTestApp(app, tmpfile)
+		tests.Assert(t, len(pendingOperations(t, app)) == 0)
+		assertOperationDbClean(t, app, true)
+		err = app.db.View(func(tx *bolt.Tx) error {
+			entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+			tests.Assert(t, err == nil)
+			if done {
+				tests.Assert(t, len(entry.Bricks) == numbricks+len(bricks))
+				tests.Assert(t, entry.Info.Size == 200)
+			} else {
+				tests.Assert(t, len(entry.Bricks) == numbricks)
+				tests.Assert(t, entry.Info.Size == 100)
+			}
+			return nil
+		})
+		tests.Assert(t, err == nil)
+		app.Close()
+	}
+}
+
+func TestPendingOperationDestroy(t *testing.T) {
+	for _, done := range []bool{false, true} {
+		tmpfile := tests.Tempfile()
+		defer os.Remove(tmpfile)
+
+		// Create the app
+		app := NewTestApp(tmpfile)
+		setupOperationTopology(t, app)
+
+		v := createSampleVolumeEntry(100)
+		err := v.Create(app.db, app.executor, app.allocator)
+		tests.Assert(t, err == nil)
+
+		// Stop before or after the GlusterFS volume was deleted
+		op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_DESTROY, v)
+		tests.Assert(t, op.Record(app.db) == nil)
+		if done {
+			op.Done(app.db)
+		}
+
+		app = restartTestApp(app, tmpfile)
+		tests.Assert(t, len(pendingOperations(t, app)) == 0)
+		assertOperationDbClean(t, app, !done)
+		err = app.db.View(func(tx *bolt.Tx) error {
+			_, err := NewVolumeEntryFromId(tx, v.Info.Id)
+			if done {
+				tests.Assert(t, err == ErrNotFound)
+			} else {
+				tests.Assert(t, err == nil)
+			}
+			return nil
+		})
+		tests.Assert(t, err == nil)
+		app.Close()
+	}
+}
+
+func TestPendingOperationCheckDump(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+	importfile := tests.Tempfile()
+	defer os.Remove(importfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	setupOperationTopology(t, app)
+
+	v := createSampleVolumeEntry(100)
+	err := v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	numbricks := len(v.Bricks)
+
+	// Stop after the bricks of an expansion were allocated
+	op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_EXPAND, v)
+	op.Size = 100
+	tests.Assert(t, op.Record(app.db) == nil)
+	_, err = v.allocBricksInCluster(app.db, app.allocator, v.Info.Cluster, 100)
+	tests.Assert(t, err == nil)
+
+	// The checker does not add the bricks to the volume
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		result, err := DbCheck(tx, true)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(result.Problems) == 0, result.Problems)
+
+		entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(entry.Bricks) == numbricks)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// The operation is dumped and imported
+	var dump *DbDump
+	err = app.db.View(func(tx *bolt.Tx) error {
+		var err error
+		dump, err = DbDumpCreate(tx)
+		return err
+	})
+	tests.Assert(t, err == nil)
+	app.Close()
+	tests.Assert(t, len(dump.Pending) == 1)
+	tests.Assert(t, dump.Pending[op.Id].VolumeId == v.Info.Id)
+	tests.Assert(t, len(dump.Check()) == 0)
+
+	problems, err := DbImport(importfile, dump)
+	tests.Assert(t, err == nil, err)
+	tests.Assert(t, len(problems) == 0)
+
+	// It is undone when the server starts with the imported db
+	app = NewTestApp(importfile)
+	defer app.Close()
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+	assertOperationDbClean(t, app, true)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(entry.Bricks) == numbricks)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestPendingOperationExpandSaveFailure(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	setupOperationTopology(t, app)
+
+	v := createSampleVolumeEntry(100)
+	err := v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	numbricks := len(v.Bricks)
+
+	// The volume cannot be saved after the bricks were added to it
+	app.xo.MockVolumeExpand = func(host string, volume *executors.VolumeRequest) error {
+		return app.db.Update(func(tx *bolt.Tx) error {
+			return tx.DeleteBucket([]byte(BOLTDB_BUCKET_VOLUME))
+		})
+	}
+	err = v.Expand(app.db, app.executor, app.allocator, 100)
+	tests.Assert(t, err == ErrDbAccess, err)
+
+	// The bricks and the operation are kept
+	ids := pendingOperations(t, app)
+	tests.Assert(t, len(ids) == 1)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		op, err := NewPendingOperationEntryFromId(tx, ids[0])
+		tests.Assert(t, err == nil)
+		tests.Assert(t, op.State == OPERATION_STATE_BRICKS_ADDED)
+
+		bricks, err := BrickList(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(bricks) > numbricks)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+	app.Close()
+}
+
+func TestPendingOperationExpandBricksAdded(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	setupOperationTopology(t, app)
+
+	v := createSampleVolumeEntry(100)
+	err := v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// The bricks are kept if the server stops while they are added
+	called := false
+	app.xo.MockVolumeExpand = func(host string, volume *executors.VolumeRequest) error {
+		called = true
+		ids := pendingOperations(t, app)
+		tests.Assert(t, len(ids) == 1)
+		return app.db.View(func(tx *bolt.Tx) error {
+			op, err := NewPendingOperationEntryFromId(tx, ids[0])
+			tests.Assert(t, err == nil)
+			tests.Assert(t, op.rollsForward())
+			return nil
+		})
+	}
+	err = v.Expand(app.db, app.executor, app.allocator, 100)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, called)
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+
+	// Bricks which were not added are destroyed
+	app.xo.MockVolumeExpand = func(host string, volume *executors.VolumeRequest) error {
+		return errors.New("MOCK ERROR")
+	}
+	numbricks := len(v.Bricks)
+	err = v.Expand(app.db, app.executor, app.allocator, 100)
+	tests.Assert(t, err != nil)
+	tests.Assert(t, len(v.Bricks) == numbricks)
+	tests.Assert(t, len(pendingOperations(t, app)) == 0)
+	assertOperationDbClean(t, app, true)
+}
+
+func TestPendingOperationReplaceBrick(t *testing.T) {
+	for _, state := range []string{OPERATION_STATE_PENDING, OPERATION_STATE_BRICKS_ADDED} {
+		tmpfile := tests.Tempfile()
+		defer os.Remove(tmpfile)
+
+		// Create the app
+		app := NewTestApp(tmpfile)
+		err := setupSampleDbWithTopology(app.db,
+			1,      // clusters
+			4,      // nodes_per_cluster
+			4,      // devices_per_node,
+			500*GB, // disksize)
+		)
+		tests.Assert(t, err == nil)
+
+		v := createSampleVolumeEntry(100)
+		err = v.Create(app.db, app.executor, app.allocator)
+		tests.Assert(t, err == nil)
+		oldBrickId := v.Bricks[0]
+
+		// Stop after the new brick was allocated, or after it
+		// may have been added to the GlusterFS volume
+		op := NewPendingOperationEntryFromVolume(OPERATION_BRICK_REPLACE, v)
+		op.BrickId = oldBrickId
+		tests.Assert(t, op.Record(app.db) == nil)
+		var newBrick *BrickEntry
+		err = app.db.Update(func(tx *bolt.Tx) error {
+			oldBrick, err := NewBrickEntryFromId(tx, oldBrickId)
+			tests.Assert(t, err == nil)
+			newBrick, err = v.allocReplacementBrick(tx, app.allocator, oldBrick)
+			return err
+		})
+		tests.Assert(t, err == nil)
+		tests.Assert(t, op.setState(app.db, state) == nil)
+
+		app = restartTestApp(app, tmpfile)
+		tests.Assert(t, len(pendingOperations(t, app)) == 0)
+		assertOperationDbClean(t, app, true)
+		err = app.db.View(func(tx *bolt.Tx) error {
+			entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, len(entry.Bricks) == 4)
+
+			bricks, err := BrickList(tx)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, len(bricks) == 4)
+
+			replaced := state == OPERATION_STATE_BRICKS_ADDED
+			tests.Assert(t, utils.SortedStringHas(entry.Bricks, newBrick.Id()) == replaced)
+			tests.Assert(t, utils.SortedStringHas(entry.Bricks, oldBrickId) == !replaced)
+			return nil
+		})
+		tests.Assert(t, err == nil)
+		app.Close()
+	}
+}
+
+func TestPendingOperationReplaceBrickSaveFailure(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// The volume cannot be saved after the brick was replaced
+	app.xo.MockVolumeReplaceBrick = func(host string, volume string,
+		oldBrick, newBrick *executors.BrickInfo) error {
+		return app.db.Update(func(tx *bolt.Tx) error {
+			return tx.DeleteBucket([]byte(BOLTDB_BUCKET_VOLUME))
+		})
+	}
+	err = v.ReplaceBrick(app.db, app.executor, app.allocator, v.Bricks[0])
+	tests.Assert(t, err == ErrDbAccess, err)
+
+	// The new brick and the operation are kept
+	ids := pendingOperations(t, app)
+	tests.Assert(t, len(ids) == 1)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		op, err := NewPendingOperationEntryFromId(tx, ids[0])
+		tests.Assert(t, err == nil)
+		tests.Assert(t, op.Type == OPERATION_BRICK_REPLACE)
+		tests.Assert(t, op.State == OPERATION_STATE_BRICKS_ADDED)
+
+		bricks, err := BrickList(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(bricks) == 5)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
@@ -0,0 +1,87 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// Tracks the failure domains used by the bricks of a replica set.
+// Each brick must be on a different node, and on a different zone
+// when the cluster has enough zones for every replica.
+type replicaPlacement struct {
+	zoneAware bool
+	nodes     map[string]bool
+	zones     map[int]bool
+}
+
+// Return the number of online nodes in the cluster and
+// the number of zones they are in
+func clusterFailureDomains(tx *bolt.Tx, cluster string) (int, int, error) {
+	entry, err := NewClusterEntryFromId(tx, cluster)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	nodes := 0
+	zones := make(map[int]bool)
+	for _, id := range entry.Info.Nodes {
+		node, err := NewNodeEntryFromId(tx, id)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if node.IsOnline() {
+			nodes++
+			zones[node.Info.Zone] = true
+		}
+	}
+
+	return nodes, len(zones), nil
+}
+
+func newReplicaPlacement(replica, nodes, zones int) (*replicaPlacement, error) {
+	if nodes < replica {
+		logger.LogError("Replica %v requires %v nodes, but only %v are online",
+			replica, replica, nodes)
+		return nil, ErrNotEnoughNodes
+	}
+
+	p := &replicaPlacement{}
+	p.zoneAware = zones >= replica
+	p.nodes = make(map[string]bool)
+	p.zones = make(map[int]bool)
+
+	return p, nil
+}
+
+// Returns true if a brick of the replica set can be placed on node
+func (p *replicaPlacement) Allowed(node *NodeEntry) bool {
+	if p.nodes[node.Info.Id] {
+		return false
+	}
+	if p.zoneAware && p.zones[node.Info.Zone] {
+		return false
+	}
+	return true
+}
+
+// Record that a brick of the replica set has been placed on node
+func (p *replicaPlacement) Add(node *NodeEntry) {
+	p.nodes[node.Info.Id] = true
+	p.zones[node.Info.Zone] = true
+}
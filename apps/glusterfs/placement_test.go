@@ -0,0 +1,63 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/heketi/heketi/tests"
+	"testing"
+)
+
+func TestReplicaPlacementNotEnoughNodes(t *testing.T) {
+	p, err := newReplicaPlacement(3, 2, 2)
+	tests.Assert(t, err == ErrNotEnoughNodes)
+	tests.Assert(t, p == nil)
+}
+
+func TestReplicaPlacementZones(t *testing.T) {
+	p, err := newReplicaPlacement(2, 4, 2)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, p.zoneAware)
+
+	n1 := createSampleNodeEntry()
+	n1.Info.Zone = 1
+	n2 := createSampleNodeEntry()
+	n2.Info.Zone = 1
+	n3 := createSampleNodeEntry()
+	n3.Info.Zone = 2
+
+	tests.Assert(t, p.Allowed(n1))
+	p.Add(n1)
+	tests.Assert(t, !p.Allowed(n1))
+	tests.Assert(t, !p.Allowed(n2))
+	tests.Assert(t, p.Allowed(n3))
+}
+
+func TestReplicaPlacementNodes(t *testing.T) {
+	// Not enough zones for each replica
+	p, err := newReplicaPlacement(3, 4, 2)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, !p.zoneAware)
+
+	n1 := createSampleNodeEntry()
+	n1.Info.Zone = 1
+	n2 := createSampleNodeEntry()
+	n2.Info.Zone = 1
+
+	p.Add(n1)
+	tests.Assert(t, !p.Allowed(n1))
+	tests.Assert(t, p.Allowed(n2))
+}
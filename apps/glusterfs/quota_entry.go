@@ -0,0 +1,270 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
+	"github.com/lpabon/godbc"
+	"sort"
+)
+
+// Quotas are saved under the id of their volume.  A volume
+// has an entry only while quota is enabled on it.
+type QuotaEntry struct {
+	Info QuotaInfo
+}
+
+func QuotaList(tx *bolt.Tx) ([]string, error) {
+
+	list := EntryKeys(tx, BOLTDB_BUCKET_QUOTA)
+	if list == nil {
+		return nil, ErrAccessList
+	}
+	return list, nil
+}
+
+func NewQuotaEntry() *QuotaEntry {
+	return &QuotaEntry{}
+}
+
+func NewQuotaEntryFromVolumeId(volumeId string) *QuotaEntry {
+	godbc.Require(volumeId != "")
+
+	entry := NewQuotaEntry()
+	entry.Info.VolumeId = volumeId
+
+	return entry
+}
+
+func NewQuotaEntryFromId(tx *bolt.Tx, volumeId string) (*QuotaEntry, error) {
+	godbc.Require(tx != nil)
+
+	entry := NewQuotaEntry()
+	err := EntryLoad(tx, entry, volumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (q *QuotaEntry) BucketName() string {
+	return BOLTDB_BUCKET_QUOTA
+}
+
+func (q *QuotaEntry) Save(tx *bolt.Tx) error {
+	godbc.Require(tx != nil)
+	godbc.Require(len(q.Info.VolumeId) > 0)
+
+	return EntrySave(tx, q, q.Info.VolumeId)
+}
+
+func (q *QuotaEntry) Delete(tx *bolt.Tx) error {
+	return EntryDelete(tx, q, q.Info.VolumeId)
+}
+
+func (q *QuotaEntry) NewInfoResponse(tx *bolt.Tx) (*QuotaInfoResponse, error) {
+	info := &QuotaInfoResponse{}
+	info.VolumeId = q.Info.VolumeId
+	info.Limits = make(map[string]QuotaLimit)
+	for path, limit := range q.Info.Limits {
+		info.Limits[path] = limit
+	}
+	info.Usage = make([]QuotaUsage, 0)
+
+	return info, nil
+}
+
+func (q *QuotaEntry) Marshal(encoding string) ([]byte, error) {
+	return entryEncode(encoding, q)
+}
+
+func (q *QuotaEntry) Unmarshal(buffer []byte, encoding string) error {
+	err := entryDecode(encoding, buffer, q)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the volume of the quota and a host to run
+// GlusterFS commands on
+func (q *QuotaEntry) volumeHost(db *bolt.DB) (*VolumeEntry, string, error) {
+	var volume *VolumeEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		volume, err = NewVolumeEntryFromId(tx, q.Info.VolumeId)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	host, err := volume.peerHost(db, volume.Info.Cluster)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return volume, host, nil
+}
+
+// Enable quota on the volume and save the entry
+func (q *QuotaEntry) Enable(db *bolt.DB, executor executors.Executor) error {
+	volume, host, err := q.volumeHost(db)
+	if err != nil {
+		return err
+	}
+
+	err = executor.QuotaEnable(host, volume.Info.Name)
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return q.Save(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	return nil
+}
+
+// Remove then set the limits in the request.  The limits which
+// were applied are saved even if a later one fails.
+func (q *QuotaEntry) SetLimits(db *bolt.DB,
+	executor executors.Executor,
+	req *QuotaRequest) error {
+
+	godbc.Require(req != nil)
+
+	volume, host, err := q.volumeHost(db)
+	if err != nil {
+		return err
+	}
+
+	var opErr error
+	for _, path := range req.Remove {
+		opErr = executor.QuotaLimitRemove(host, volume.Info.Name, path)
+		if opErr != nil {
+			break
+		}
+		delete(q.Info.Limits, path)
+	}
+
+	if opErr == nil {
+		paths := make([]string, 0, len(req.Set))
+		for path := range req.Set {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			limit := req.Set[path]
+			opErr = executor.QuotaLimitSet(host, volume.Info.Name,
+				&executors.QuotaLimitRequest{
+					Path:      path,
+					HardLimit: uint64(limit.HardLimit) * GB,
+					SoftLimit: limit.SoftLimit,
+				})
+			if opErr != nil {
+				break
+			}
+			if q.Info.Limits == nil {
+				q.Info.Limits = make(map[string]QuotaLimit)
+			}
+			q.Info.Limits[path] = limit
+		}
+	}
+	if len(q.Info.Limits) == 0 {
+		q.Info.Limits = nil
+	}
+
+	// Save the limits which were applied
+	err = db.Update(func(tx *bolt.Tx) error {
+		entry, err := NewQuotaEntryFromId(tx, q.Info.VolumeId)
+		if err != nil {
+			return err
+		}
+
+		entry.Info.Limits = q.Info.Limits
+		return entry.Save(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	return opErr
+}
+
+// Disable quota on the volume, which removes all of its
+// limits, and delete the entry
+func (q *QuotaEntry) Disable(db *bolt.DB, executor executors.Executor) error {
+	volume, host, err := q.volumeHost(db)
+	if err != nil {
+		return err
+	}
+
+	err = executor.QuotaDisable(host, volume.Info.Name)
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return q.Delete(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	return nil
+}
+
+// Returns the limits of the volume with their usage
+func (q *QuotaEntry) Usage(db *bolt.DB,
+	executor executors.Executor) ([]QuotaUsage, error) {
+
+	volume, host, err := q.volumeHost(db)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := executor.QuotaList(host, volume.Info.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make([]QuotaUsage, 0, len(list))
+	for _, limit := range list {
+		usage = append(usage, QuotaUsage{
+			Path:              limit.Path,
+			HardLimit:         limit.HardLimit,
+			SoftLimit:         limit.SoftLimit,
+			Used:              limit.Used,
+			Available:         limit.Available,
+			SoftLimitExceeded: limit.SoftLimitExceeded,
+			HardLimitExceeded: limit.HardLimitExceeded,
+		})
+	}
+
+	return usage, nil
+}
@@ -0,0 +1,247 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
+	"github.com/heketi/heketi/tests"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestQuotaEntryMarshal(t *testing.T) {
+	m := NewQuotaEntryFromVolumeId("abc")
+	m.Info.Limits = map[string]QuotaLimit{
+		"/":     QuotaLimit{HardLimit: 100},
+		"/team": QuotaLimit{HardLimit: 10, SoftLimit: 70},
+	}
+
+	buffer, err := m.Marshal(DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, buffer != nil)
+	tests.Assert(t, len(buffer) > 0)
+
+	um := &QuotaEntry{}
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+
+	tests.Assert(t, reflect.DeepEqual(um, m))
+}
+
+func TestNewQuotaEntryFromIdNotFound(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Test for ID not found
+	err := app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewQuotaEntryFromId(tx, "123")
+		return err
+	})
+	tests.Assert(t, err == ErrNotFound)
+}
+
+func TestQuotaEntryEnableSetDisable(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, false)
+
+	enabled := false
+	app.xo.MockQuotaEnable = func(host string, volume string) error {
+		tests.Assert(t, volume == v.Info.Name)
+		enabled = true
+		return nil
+	}
+	limits := make([]executors.QuotaLimitRequest, 0)
+	app.xo.MockQuotaLimitSet = func(host string, volume string,
+		limit *executors.QuotaLimitRequest) error {
+		tests.Assert(t, volume == v.Info.Name)
+		limits = append(limits, *limit)
+		return nil
+	}
+
+	// Enable quota
+	q := NewQuotaEntryFromVolumeId(v.Info.Id)
+	err := q.Enable(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, enabled)
+
+	// Set limits
+	err = q.SetLimits(app.db, app.executor, &QuotaRequest{
+		Set: map[string]QuotaLimit{
+			"/team-b": QuotaLimit{HardLimit: 20},
+			"/team-a": QuotaLimit{HardLimit: 10, SoftLimit: 70},
+		},
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, reflect.DeepEqual(limits, []executors.QuotaLimitRequest{
+		{Path: "/team-a", HardLimit: 10 * GB, SoftLimit: 70},
+		{Path: "/team-b", HardLimit: 20 * GB},
+	}))
+
+	// Remove one limit.  The second limit fails.
+	removed := ""
+	app.xo.MockQuotaLimitRemove = func(host string, volume string, path string) error {
+		removed = path
+		return nil
+	}
+	app.xo.MockQuotaLimitSet = func(host string, volume string,
+		limit *executors.QuotaLimitRequest) error {
+		if limit.Path == "/team-d" {
+			return errors.New("MOCK ERROR")
+		}
+		return nil
+	}
+	err = q.SetLimits(app.db, app.executor, &QuotaRequest{
+		Set: map[string]QuotaLimit{
+			"/team-c": QuotaLimit{HardLimit: 30},
+			"/team-d": QuotaLimit{HardLimit: 40},
+		},
+		Remove: []string{"/team-b"},
+	})
+	tests.Assert(t, err != nil)
+	tests.Assert(t, removed == "/team-b")
+
+	// Only the limits which were applied are saved
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewQuotaEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, reflect.DeepEqual(entry.Info.Limits, map[string]QuotaLimit{
+			"/team-a": QuotaLimit{HardLimit: 10, SoftLimit: 70},
+			"/team-c": QuotaLimit{HardLimit: 30},
+		}))
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Disable quota
+	disabled := false
+	app.xo.MockQuotaDisable = func(host string, volume string) error {
+		tests.Assert(t, volume == v.Info.Name)
+		disabled = true
+		return nil
+	}
+	err = q.Disable(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, disabled)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewQuotaEntryFromId(tx, v.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == ErrNotFound)
+}
+
+func TestQuotaEntryEnableFailure(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, false)
+
+	app.xo.MockQuotaEnable = func(host string, volume string) error {
+		return errors.New("MOCK ERROR")
+	}
+
+	// Nothing is saved when quota cannot be enabled
+	q := NewQuotaEntryFromVolumeId(v.Info.Id)
+	err := q.Enable(app.db, app.executor)
+	tests.Assert(t, err != nil)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewQuotaEntryFromId(tx, v.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == ErrNotFound)
+}
+
+func TestQuotaEntryUsage(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, false)
+
+	app.xo.MockQuotaList = func(host string, volume string) ([]executors.QuotaUsage, error) {
+		tests.Assert(t, volume == v.Info.Name)
+		return []executors.QuotaUsage{
+			executors.QuotaUsage{
+				Path:              "/team-a",
+				HardLimit:         10 * GB,
+				SoftLimit:         80,
+				Used:              9 * GB,
+				Available:         1 * GB,
+				SoftLimitExceeded: true,
+			},
+		}, nil
+	}
+
+	q := NewQuotaEntryFromVolumeId(v.Info.Id)
+	usage, err := q.Usage(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, reflect.DeepEqual(usage, []QuotaUsage{
+		QuotaUsage{
+			Path:              "/team-a",
+			HardLimit:         10 * GB,
+			SoftLimit:         80,
+			Used:              9 * GB,
+			Available:         1 * GB,
+			SoftLimitExceeded: true,
+		},
+	}))
+}
+
+func TestVolumeEntryDestroyRemovesQuota(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, false)
+
+	q := NewQuotaEntryFromVolumeId(v.Info.Id)
+	err := q.Enable(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	err = v.Destroy(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewQuotaEntryFromId(tx, v.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == ErrNotFound)
+}
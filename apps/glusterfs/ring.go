@@ -0,0 +1,185 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	// Number of points on the ring for the device with the
+	// largest weight and capacity.  Other devices get a
+	// proportional number of points
+	RING_MAX_DEVICE_POINTS = 100
+
+	// Weight used for devices added without one
+	RING_DEFAULT_DEVICE_WEIGHT = 100
+)
+
+type ringPoint struct {
+	hash     uint32
+	deviceId string
+}
+
+type ringPoints []ringPoint
+
+func (p ringPoints) Len() int      { return len(p) }
+func (p ringPoints) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p ringPoints) Less(i, j int) bool {
+	if p[i].hash == p[j].hash {
+		return p[i].deviceId < p[j].deviceId
+	}
+	return p[i].hash < p[j].hash
+}
+
+// Consistent hash ring of the devices in a cluster.  Each device
+// owns a number of points proportional to its weight and capacity,
+// so ids hashed onto the ring are spread over the devices accordingly.
+type deviceRing struct {
+	points  ringPoints
+	devices int
+}
+
+// Places bricks using a weighted device ring for each cluster.
+// Rings are built when first used and rebuilt after their
+// devices change.
+type RingAllocator struct {
+	lock  sync.Mutex
+	rings map[string]*deviceRing
+}
+
+func ringHash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func newDeviceRing(devices []*DeviceEntry) *deviceRing {
+	r := &deviceRing{}
+	r.points = make(ringPoints, 0)
+
+	// Determine the largest weighted capacity
+	weights := make([]float64, len(devices))
+	max := float64(0)
+	for i, device := range devices {
+		weight := device.Info.Weight
+		if weight <= 0 {
+			weight = RING_DEFAULT_DEVICE_WEIGHT
+		}
+
+		weights[i] = float64(weight) * float64(device.Info.Storage.Total)
+		if weights[i] > max {
+			max = weights[i]
+		}
+	}
+
+	// Add the points of each device
+	for i, device := range devices {
+		if weights[i] == 0 {
+			continue
+		}
+
+		num := int(math.Ceil(RING_MAX_DEVICE_POINTS * weights[i] / max))
+		for p := 0; p < num; p++ {
+			r.points = append(r.points, ringPoint{
+				hash:     ringHash(fmt.Sprintf("%v-%v", device.Info.Id, p)),
+				deviceId: device.Info.Id,
+			})
+		}
+		r.devices++
+	}
+	sort.Sort(r.points)
+
+	return r
+}
+
+// Return every device in the ring in the order found walking the
+// ring from the point where id hashes to
+func (r *deviceRing) Devices(id string) []string {
+	list := make([]string, 0, r.devices)
+	if len(r.points) == 0 {
+		return list
+	}
+
+	hash := ringHash(id)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	found := make(map[string]bool)
+	for i := 0; i < len(r.points) && len(list) < r.devices; i++ {
+		point := r.points[(start+i)%len(r.points)]
+		if !found[point.deviceId] {
+			found[point.deviceId] = true
+			list = append(list, point.deviceId)
+		}
+	}
+
+	return list
+}
+
+func NewRingAllocator() *RingAllocator {
+	r := &RingAllocator{}
+	r.rings = make(map[string]*deviceRing)
+	return r
+}
+
+// Return the ring of the cluster, building it from the
+// devices in the db if needed
+func (r *RingAllocator) ring(tx *bolt.Tx, cluster string) (*deviceRing, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if ring, ok := r.rings[cluster]; ok {
+		return ring, nil
+	}
+
+	devices, err := clusterDevices(tx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("Built ring for cluster %v with %v devices", cluster, len(devices))
+	ring := newDeviceRing(devices)
+	r.rings[cluster] = ring
+
+	return ring, nil
+}
+
+func (r *RingAllocator) GetDevices(tx *bolt.Tx,
+	cluster, brickId string) ([]string, error) {
+
+	ring, err := r.ring(tx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return ring.Devices(brickId), nil
+}
+
+// Rebuild the ring of the cluster the next time it is used
+func (r *RingAllocator) DevicesChanged(cluster string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.rings, cluster)
+}
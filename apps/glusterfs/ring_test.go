@@ -0,0 +1,205 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/tests"
+	"github.com/heketi/heketi/utils"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func createSampleRingDevices(num int, weight int, disksize uint64) []*DeviceEntry {
+	devices := make([]*DeviceEntry, num)
+	for i := range devices {
+		devices[i] = createSampleDeviceEntry("node", disksize)
+		devices[i].Info.Weight = weight
+	}
+
+	return devices
+}
+
+func TestDeviceRingEmpty(t *testing.T) {
+	r := newDeviceRing([]*DeviceEntry{})
+	tests.Assert(t, len(r.Devices("abc")) == 0)
+
+	// Devices without capacity are not added
+	r = newDeviceRing(createSampleRingDevices(2, 100, 0))
+	tests.Assert(t, len(r.Devices("abc")) == 0)
+}
+
+func TestDeviceRingDevices(t *testing.T) {
+	devices := createSampleRingDevices(10, 100, 500*GB)
+	r := newDeviceRing(devices)
+	tests.Assert(t, len(r.points) == 10*RING_MAX_DEVICE_POINTS)
+
+	// Every device is returned once
+	list := r.Devices("abc")
+	tests.Assert(t, len(list) == 10)
+	found := make(map[string]bool)
+	for _, id := range list {
+		found[id] = true
+	}
+	tests.Assert(t, len(found) == 10)
+
+	// Same id gives the same order
+	tests.Assert(t, reflect.DeepEqual(list, r.Devices("abc")))
+
+	// Ring built in a different order is the same
+	reversed := make([]*DeviceEntry, len(devices))
+	for i, device := range devices {
+		reversed[len(devices)-1-i] = device
+	}
+	tests.Assert(t, reflect.DeepEqual(list, newDeviceRing(reversed).Devices("abc")))
+}
+
+func TestDeviceRingWeights(t *testing.T) {
+
+	// Large devices, small devices, and small devices
+	// with a large weight
+	large := createSampleRingDevices(2, 100, 2*TB)
+	small := createSampleRingDevices(2, 100, 1*TB)
+	weighted := createSampleRingDevices(2, 200, 1*TB)
+	devices := append(append(large, small...), weighted...)
+
+	r := newDeviceRing(devices)
+	points := make(map[string]int)
+	for _, point := range r.points {
+		points[point.deviceId]++
+	}
+	for _, device := range large {
+		tests.Assert(t, points[device.Info.Id] == RING_MAX_DEVICE_POINTS)
+	}
+	for _, device := range small {
+		tests.Assert(t, points[device.Info.Id] == RING_MAX_DEVICE_POINTS/2)
+	}
+	for _, device := range weighted {
+		tests.Assert(t, points[device.Info.Id] == RING_MAX_DEVICE_POINTS)
+	}
+
+	// Devices without a weight use the default
+	devices = append(createSampleRingDevices(1, 0, 1*TB),
+		createSampleRingDevices(1, RING_DEFAULT_DEVICE_WEIGHT, 1*TB)...)
+	r = newDeviceRing(devices)
+	tests.Assert(t, len(r.points) == 2*RING_MAX_DEVICE_POINTS)
+
+	// Ids are spread according to the weights
+	r = newDeviceRing(append(large, small...))
+	first := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		first[r.Devices(utils.GenUUID())[0]]++
+	}
+	largeCount := first[large[0].Info.Id] + first[large[1].Info.Id]
+	smallCount := first[small[0].Info.Id] + first[small[1].Info.Id]
+	tests.Assert(t, largeCount > smallCount, largeCount, smallCount)
+	tests.Assert(t, smallCount > 500, smallCount)
+}
+
+func TestRingAllocator(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	r := NewRingAllocator()
+	app.allocator = r
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		2,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	var cluster *ClusterEntry
+	var node *NodeEntry
+	err = app.db.View(func(tx *bolt.Tx) error {
+		var err error
+		cluster, err = NewClusterEntryFromId(tx, EntryKeys(tx, BOLTDB_BUCKET_CLUSTER)[0])
+		if err != nil {
+			return err
+		}
+		node, err = NewNodeEntryFromId(tx, cluster.Info.Nodes[0])
+		return err
+	})
+	tests.Assert(t, err == nil)
+
+	getDevices := func() []string {
+		var devices []string
+		err := app.db.View(func(tx *bolt.Tx) error {
+			var err error
+			devices, err = r.GetDevices(tx, cluster.Info.Id, "abc")
+			return err
+		})
+		tests.Assert(t, err == nil)
+		return devices
+	}
+
+	devices := getDevices()
+	tests.Assert(t, len(devices) == 4)
+	tests.Assert(t, len(r.rings) == 1)
+	tests.Assert(t, reflect.DeepEqual(devices, getDevices()))
+
+	// Add a device without notifying the allocator
+	device := createSampleDeviceEntry(node.Info.Id, 500*GB)
+	node.DeviceAdd(device.Id())
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		err := device.Save(tx)
+		if err != nil {
+			return err
+		}
+		return node.Save(tx)
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(getDevices()) == 4)
+
+	// Rebuilt after the devices change
+	r.DevicesChanged(cluster.Info.Id)
+	tests.Assert(t, len(getDevices()) == 5)
+
+	// Removing a device rebuilds the ring
+	err = device.removeFromDb(app.db, r)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(getDevices()) == 4)
+
+	// Removing a node rebuilds the ring
+	empty := createSampleNodeEntry()
+	empty.Info.ClusterId = cluster.Info.Id
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		cluster, err := NewClusterEntryFromId(tx, cluster.Info.Id)
+		if err != nil {
+			return err
+		}
+		cluster.NodeAdd(empty.Info.Id)
+		err = cluster.Save(tx)
+		if err != nil {
+			return err
+		}
+		return empty.Save(tx)
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(r.rings) == 1)
+
+	err = empty.Destroy(app.db, app.executor, r)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(r.rings) == 0)
+}
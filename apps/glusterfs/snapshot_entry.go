@@ -0,0 +1,322 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
+	"github.com/heketi/heketi/utils"
+	"github.com/lpabon/godbc"
+	"time"
+)
+
+type SnapshotEntry struct {
+	Info SnapshotInfo
+}
+
+func SnapshotList(tx *bolt.Tx) ([]string, error) {
+
+	list := EntryKeys(tx, BOLTDB_BUCKET_SNAPSHOT)
+	if list == nil {
+		return nil, ErrAccessList
+	}
+	return list, nil
+}
+
+// Returns the id of the snapshot with the given name
+func SnapshotIdFromName(tx *bolt.Tx, name string) (string, error) {
+	list, err := SnapshotList(tx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, id := range list {
+		entry, err := NewSnapshotEntryFromId(tx, id)
+		if err != nil {
+			return "", err
+		}
+		if entry.Info.Name == name {
+			return id, nil
+		}
+	}
+
+	return "", ErrNotFound
+}
+
+func NewSnapshotEntry() *SnapshotEntry {
+	return &SnapshotEntry{}
+}
+
+func NewSnapshotEntryFromRequest(volumeId string,
+	req *SnapshotCreateRequest) *SnapshotEntry {
+
+	godbc.Require(req != nil)
+	godbc.Require(volumeId != "")
+
+	entry := NewSnapshotEntry()
+	entry.Info.Id = utils.GenUUID()
+	entry.Info.VolumeId = volumeId
+	entry.Info.Description = req.Description
+
+	// Set default name
+	if req.Name == "" {
+		entry.Info.Name = "snap_" + entry.Info.Id
+	} else {
+		entry.Info.Name = req.Name
+	}
+
+	return entry
+}
+
+func NewSnapshotEntryFromId(tx *bolt.Tx, id string) (*SnapshotEntry, error) {
+	godbc.Require(tx != nil)
+
+	entry := NewSnapshotEntry()
+	err := EntryLoad(tx, entry, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (s *SnapshotEntry) BucketName() string {
+	return BOLTDB_BUCKET_SNAPSHOT
+}
+
+func (s *SnapshotEntry) Save(tx *bolt.Tx) error {
+	godbc.Require(tx != nil)
+	godbc.Require(len(s.Info.Id) > 0)
+
+	return EntrySave(tx, s, s.Info.Id)
+}
+
+func (s *SnapshotEntry) Delete(tx *bolt.Tx) error {
+	return EntryDelete(tx, s, s.Info.Id)
+}
+
+func (s *SnapshotEntry) NewInfoResponse(tx *bolt.Tx) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{}
+	*info = s.Info
+
+	return info, nil
+}
+
+func (s *SnapshotEntry) Marshal(encoding string) ([]byte, error) {
+	return entryEncode(encoding, s)
+}
+
+func (s *SnapshotEntry) Unmarshal(buffer []byte, encoding string) error {
+	err := entryDecode(encoding, buffer, s)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the volume of the snapshot and the host used
+// to run the snapshot commands
+func (s *SnapshotEntry) volumeHost(db *bolt.DB) (*VolumeEntry, string, error) {
+	var volume *VolumeEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		volume, err = NewVolumeEntryFromId(tx, s.Info.VolumeId)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	host, err := volume.peerHost(db, volume.Info.Cluster)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return volume, host, nil
+}
+
+// Remove the snapshot from its volume and from the db
+func (s *SnapshotEntry) removeFromDb(tx *bolt.Tx) error {
+	volume, err := NewVolumeEntryFromId(tx, s.Info.VolumeId)
+	if err == ErrNotFound {
+		logger.Critical("Volume id %v is expected be in db. Pointed to by snapshot %v",
+			s.Info.VolumeId,
+			s.Info.Id)
+	} else if err != nil {
+		return err
+	} else {
+		volume.SnapshotDelete(s.Info.Id)
+		err = volume.Save(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Delete(tx)
+}
+
+func (s *SnapshotEntry) Create(db *bolt.DB, executor executors.Executor) error {
+	godbc.Require(db != nil)
+
+	volume, host, err := s.volumeHost(db)
+	if err != nil {
+		return err
+	}
+
+	// Snapshots need the thin pool space reserved when
+	// the volume was created
+	if !volume.Info.Snapshot.Enable {
+		return ErrSnapshotDisabled
+	}
+
+	// Snapshot names are unique in GlusterFS
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := SnapshotIdFromName(tx, s.Info.Name)
+		if err == nil {
+			return ErrConflict
+		} else if err != ErrNotFound {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	req := &executors.SnapshotRequest{}
+	req.Name = s.Info.Name
+	req.Volume = volume.Info.Name
+	req.Description = s.Info.Description
+	err = executor.SnapshotCreate(host, req)
+	if err != nil {
+		return err
+	}
+	s.Info.Created = time.Now().Unix()
+
+	// Save the snapshot and add it to the volume
+	err = db.Update(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, s.Info.VolumeId)
+		if err != nil {
+			return err
+		}
+
+		volume.SnapshotAdd(s.Info.Id)
+		err = volume.Save(tx)
+		if err != nil {
+			return err
+		}
+
+		return s.Save(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+		executor.SnapshotDelete(host, s.Info.Name)
+		return err
+	}
+
+	return nil
+}
+
+func (s *SnapshotEntry) Destroy(db *bolt.DB, executor executors.Executor) error {
+	godbc.Require(db != nil)
+
+	volume, host, err := s.volumeHost(db)
+	if err != nil {
+		return err
+	}
+
+	// Only delete the snapshot if it still exists in GlusterFS.
+	// It may have been removed outside of heketi.
+	snapshots, err := executor.SnapshotList(host, volume.Info.Name)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, name := range snapshots {
+		if name == s.Info.Name {
+			found = true
+			break
+		}
+	}
+	if found {
+		err = executor.SnapshotDelete(host, s.Info.Name)
+		if err != nil {
+			return err
+		}
+	} else {
+		logger.Warning("Snapshot %v not found in volume %v",
+			s.Info.Name, volume.Info.Name)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return s.removeFromDb(tx)
+	})
+}
+
+// Restore the volume to the contents of the snapshot.  The volume
+// is unavailable while it is being restored.
+func (s *SnapshotEntry) Restore(db *bolt.DB, executor executors.Executor) error {
+	godbc.Require(db != nil)
+
+	volume, host, err := s.volumeHost(db)
+	if err != nil {
+		return err
+	}
+
+	restored, err := executor.SnapshotRestore(host, volume.Info.Name, s.Info.Name)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, volume.Info.Id)
+		if err != nil {
+			return err
+		}
+
+		// Bricks of the volume by path
+		bricks := make(map[string]*BrickEntry)
+		for _, id := range volume.BricksIds() {
+			brick, err := NewBrickEntryFromId(tx, id)
+			if err != nil {
+				return err
+			}
+			bricks[brick.Info.Path] = brick
+		}
+
+		// The bricks are now mounted from the snapshot
+		for _, restored_brick := range restored {
+			brick, ok := bricks[restored_brick.SourcePath]
+			if !ok {
+				logger.LogError("No brick of volume %v found at %v",
+					volume.Info.Id, restored_brick.SourcePath)
+				return ErrNotFound
+			}
+			delete(bricks, restored_brick.SourcePath)
+
+			brick.Info.Path = restored_brick.Path
+			err = brick.Save(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		// GlusterFS removes the snapshot once it has been restored
+		return s.removeFromDb(tx)
+	})
+}
@@ -0,0 +1,361 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
+	"github.com/heketi/heketi/tests"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func createSampleSnapshotVolume(t *testing.T, app *App, enable bool) *VolumeEntry {
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Snapshot.Enable = enable
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	return v
+}
+
+func TestNewSnapshotEntryFromRequest(t *testing.T) {
+	req := &SnapshotCreateRequest{}
+	s := NewSnapshotEntryFromRequest("abc", req)
+	tests.Assert(t, s.Info.Id != "")
+	tests.Assert(t, s.Info.VolumeId == "abc")
+	tests.Assert(t, s.Info.Name == "snap_"+s.Info.Id)
+
+	req.Name = "mysnap"
+	req.Description = "before migration"
+	s = NewSnapshotEntryFromRequest("abc", req)
+	tests.Assert(t, s.Info.Name == "mysnap")
+	tests.Assert(t, s.Info.Description == "before migration")
+}
+
+func TestSnapshotEntryMarshal(t *testing.T) {
+	req := &SnapshotCreateRequest{}
+	req.Name = "mysnap"
+	m := NewSnapshotEntryFromRequest("abc", req)
+	m.Info.Created = 12345
+
+	buffer, err := m.Marshal(DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, buffer != nil)
+	tests.Assert(t, len(buffer) > 0)
+
+	um := &SnapshotEntry{}
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+
+	tests.Assert(t, reflect.DeepEqual(um, m))
+}
+
+func TestNewSnapshotEntryFromIdNotFound(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Test for ID not found
+	err := app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewSnapshotEntryFromId(tx, "123")
+		return err
+	})
+	tests.Assert(t, err == ErrNotFound)
+}
+
+func TestSnapshotEntryCreateDisabled(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, false)
+
+	called := false
+	app.xo.MockSnapshotCreate = func(host string, snapshot *executors.SnapshotRequest) error {
+		called = true
+		return nil
+	}
+
+	s := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err == ErrSnapshotDisabled)
+	tests.Assert(t, !called)
+}
+
+func TestSnapshotEntryCreateDestroy(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+
+	var req *executors.SnapshotRequest
+	app.xo.MockSnapshotCreate = func(host string, snapshot *executors.SnapshotRequest) error {
+		req = snapshot
+		return nil
+	}
+
+	s := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{Name: "mysnap"})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, req != nil)
+	tests.Assert(t, req.Name == "mysnap")
+	tests.Assert(t, req.Volume == v.Info.Name)
+	tests.Assert(t, s.Info.Created != 0)
+
+	// Snapshot names are unique
+	req = nil
+	dup := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{Name: "mysnap"})
+	err = dup.Create(app.db, app.executor)
+	tests.Assert(t, err == ErrConflict)
+	tests.Assert(t, req == nil)
+
+	// Check the snapshot is saved and belongs to the volume
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewSnapshotEntryFromId(tx, s.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, reflect.DeepEqual(entry, s))
+
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Snapshots) == 1)
+		tests.Assert(t, volume.Snapshots[0] == s.Info.Id)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Destroy the snapshot
+	deleted := ""
+	app.xo.MockSnapshotList = func(host string, volume string) ([]string, error) {
+		tests.Assert(t, volume == v.Info.Name)
+		return []string{"mysnap"}, nil
+	}
+	app.xo.MockSnapshotDelete = func(host string, snapshot string) error {
+		deleted = snapshot
+		return nil
+	}
+	err = s.Destroy(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, deleted == "mysnap")
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewSnapshotEntryFromId(tx, s.Info.Id)
+		tests.Assert(t, err == ErrNotFound)
+
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Snapshots) == 0)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestSnapshotEntryCreateFailure(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+
+	app.xo.MockSnapshotCreate = func(host string, snapshot *executors.SnapshotRequest) error {
+		return errors.New("MOCK ERROR")
+	}
+
+	s := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err != nil)
+
+	// Nothing is saved
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewSnapshotEntryFromId(tx, s.Info.Id)
+		tests.Assert(t, err == ErrNotFound)
+
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Snapshots) == 0)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestSnapshotEntryDestroyMissingFromGluster(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+
+	s := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	// The snapshot was deleted outside of heketi
+	called := false
+	app.xo.MockSnapshotDelete = func(host string, snapshot string) error {
+		called = true
+		return nil
+	}
+	err = s.Destroy(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, !called)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewSnapshotEntryFromId(tx, s.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == ErrNotFound)
+}
+
+func TestSnapshotEntryRestore(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+
+	s := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	// Restore failure keeps the snapshot
+	app.xo.MockSnapshotRestore = func(host string, volume string, snapshot string) ([]executors.RestoreBrickInfo, error) {
+		return nil, errors.New("MOCK ERROR")
+	}
+	err = s.Restore(app.db, app.executor)
+	tests.Assert(t, err != nil)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewSnapshotEntryFromId(tx, s.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == nil)
+
+	// Give each brick its own path
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range v.BricksIds() {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			brick.Info.Path = "/mockpath/" + brick.Id()
+			err = brick.Save(tx)
+			tests.Assert(t, err == nil)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Restoring consumes the snapshot and mounts the bricks
+	// of the snapshot in place of the bricks of the volume
+	restored := ""
+	app.xo.MockSnapshotRestore = func(host string, volume string, snapshot string) ([]executors.RestoreBrickInfo, error) {
+		tests.Assert(t, volume == v.Info.Name)
+		restored = snapshot
+		bricks := make([]executors.RestoreBrickInfo, 0)
+		for _, id := range v.BricksIds() {
+			brick := executors.RestoreBrickInfo{}
+			brick.Path = "/run/gluster/snaps/" + snapshot + "/" + id
+			brick.SourcePath = "/mockpath/" + id
+			bricks = append(bricks, brick)
+		}
+		return bricks, nil
+	}
+	err = s.Restore(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, restored == s.Info.Name)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewSnapshotEntryFromId(tx, s.Info.Id)
+		tests.Assert(t, err == ErrNotFound)
+
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Snapshots) == 0)
+
+		for _, id := range volume.BricksIds() {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, brick.Info.Path == "/run/gluster/snaps/"+s.Info.Name+"/"+id)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestSnapshotEntryRestoreUnknownBrick(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+
+	s := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	// GlusterFS lists a brick which is not part of the volume
+	app.xo.MockSnapshotRestore = func(host string, volume string, snapshot string) ([]executors.RestoreBrickInfo, error) {
+		brick := executors.RestoreBrickInfo{}
+		brick.Path = "/run/gluster/snaps/" + snapshot + "/brick"
+		brick.SourcePath = "/unknown"
+		return []executors.RestoreBrickInfo{brick}, nil
+	}
+	err = s.Restore(app.db, app.executor)
+	tests.Assert(t, err == ErrNotFound)
+
+	// No brick was changed
+	err = app.db.View(func(tx *bolt.Tx) error {
+		for _, id := range v.BricksIds() {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, brick.Info.Path == "/mockpath")
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
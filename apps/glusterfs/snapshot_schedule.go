@@ -0,0 +1,355 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
+	"github.com/heketi/heketi/rest"
+	"github.com/heketi/heketi/utils"
+	"github.com/lpabon/godbc"
+	"sort"
+	"time"
+)
+
+var (
+	// How often the scheduler looks for snapshots to take
+	snapshotSchedulerInterval = time.Minute
+)
+
+// Snapshot schedules are saved under the id of their volume
+type SnapshotScheduleEntry struct {
+	Info SnapshotScheduleInfo
+}
+
+func SnapshotScheduleList(tx *bolt.Tx) ([]string, error) {
+
+	list := EntryKeys(tx, BOLTDB_BUCKET_SCHEDULE)
+	if list == nil {
+		return nil, ErrAccessList
+	}
+	return list, nil
+}
+
+func NewSnapshotScheduleEntry() *SnapshotScheduleEntry {
+	return &SnapshotScheduleEntry{}
+}
+
+func NewSnapshotScheduleEntryFromRequest(volumeId string,
+	req *SnapshotScheduleRequest) *SnapshotScheduleEntry {
+
+	godbc.Require(req != nil)
+	godbc.Require(volumeId != "")
+
+	entry := NewSnapshotScheduleEntry()
+	entry.Info.VolumeId = volumeId
+	entry.Info.SnapshotScheduleRequest = *req
+
+	return entry
+}
+
+func NewSnapshotScheduleEntryFromId(tx *bolt.Tx, volumeId string) (*SnapshotScheduleEntry, error) {
+	godbc.Require(tx != nil)
+
+	entry := NewSnapshotScheduleEntry()
+	err := EntryLoad(tx, entry, volumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (s *SnapshotScheduleEntry) BucketName() string {
+	return BOLTDB_BUCKET_SCHEDULE
+}
+
+func (s *SnapshotScheduleEntry) Save(tx *bolt.Tx) error {
+	godbc.Require(tx != nil)
+	godbc.Require(len(s.Info.VolumeId) > 0)
+
+	return EntrySave(tx, s, s.Info.VolumeId)
+}
+
+func (s *SnapshotScheduleEntry) Delete(tx *bolt.Tx) error {
+	return EntryDelete(tx, s, s.Info.VolumeId)
+}
+
+func (s *SnapshotScheduleEntry) NewInfoResponse(tx *bolt.Tx) (*SnapshotScheduleInfo, error) {
+	info := &SnapshotScheduleInfo{}
+	*info = s.Info
+
+	return info, nil
+}
+
+func (s *SnapshotScheduleEntry) Marshal(encoding string) ([]byte, error) {
+	return entryEncode(encoding, s)
+}
+
+func (s *SnapshotScheduleEntry) Unmarshal(buffer []byte, encoding string) error {
+	err := entryDecode(encoding, buffer, s)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns true if a snapshot should be taken at the given time
+func (s *SnapshotScheduleEntry) Due(now time.Time) bool {
+	next := time.Unix(s.Info.LastRun, 0).Add(time.Duration(s.Info.Interval) * time.Minute)
+	return !now.Before(next)
+}
+
+// Take a snapshot of the volume, then delete the oldest
+// scheduled snapshots which are beyond the retention count
+func (s *SnapshotScheduleEntry) Run(db *bolt.DB, executor executors.Executor) error {
+	snapshot := NewSnapshotEntryFromRequest(s.Info.VolumeId, &SnapshotCreateRequest{})
+	snapshot.Info.Scheduled = true
+	err := snapshot.Create(db, executor)
+	if err != nil {
+		return err
+	}
+
+	// Get the scheduled snapshots of the volume
+	scheduled := make([]*SnapshotEntry, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, s.Info.VolumeId)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range volume.SnapshotsIds() {
+			entry, err := NewSnapshotEntryFromId(tx, id)
+			if err != nil {
+				return err
+			}
+			if entry.Info.Scheduled {
+				scheduled = append(scheduled, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Delete the oldest first
+	sort.Sort(snapshotsByCreation(scheduled))
+	for len(scheduled) > s.Info.Retention {
+		logger.Info("Deleting snapshot %v of volume %v beyond the retention of %v",
+			scheduled[0].Info.Id, s.Info.VolumeId, s.Info.Retention)
+		err := scheduled[0].Destroy(db, executor)
+		if err != nil {
+			return err
+		}
+		scheduled = scheduled[1:]
+	}
+
+	return nil
+}
+
+// Sorts snapshots from oldest to newest
+type snapshotsByCreation []*SnapshotEntry
+
+func (s snapshotsByCreation) Len() int      { return len(s) }
+func (s snapshotsByCreation) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s snapshotsByCreation) Less(i, j int) bool {
+	if s[i].Info.Created == s[j].Info.Created {
+		return s[i].Info.Id < s[j].Info.Id
+	}
+	return s[i].Info.Created < s[j].Info.Created
+}
+
+func (a *App) startSnapshotScheduler() {
+	a.schedulerStop = make(chan struct{})
+	a.schedulerDone = make(chan struct{})
+	a.schedulerRunning = make(map[string]bool)
+	a.schedulerHandlers = make(map[string]*rest.AsyncHttpHandler)
+
+	go func() {
+		defer close(a.schedulerDone)
+
+		ticker := time.NewTicker(snapshotSchedulerInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.schedulerStop:
+				return
+			case now := <-ticker.C:
+				a.runSnapshotSchedules(now)
+			}
+		}
+	}()
+}
+
+// Stop looking for snapshots to take.  Snapshots being taken
+// are not waited for.
+func (a *App) stopSnapshotScheduler() {
+	close(a.schedulerStop)
+	<-a.schedulerDone
+}
+
+// Returns true if the schedule of the volume is being run
+func (a *App) scheduleRunning(volumeId string) bool {
+	a.schedulerLock.Lock()
+	defer a.schedulerLock.Unlock()
+
+	return a.schedulerRunning[volumeId]
+}
+
+// Start the snapshot schedules which are due.  Each schedule runs on
+// its own, so that a snapshot which does not finish does not hold up
+// the others.  Each run is tracked by the asynchronous manager and
+// its result saved in the schedule.
+func (a *App) runSnapshotSchedules(now time.Time) {
+
+	// Get the schedules which are due, and record their run
+	// so that they are not started again
+	due := make([]*SnapshotScheduleEntry, 0)
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		ids, err := SnapshotScheduleList(tx)
+		if err != nil {
+			return err
+		}
+
+		// Forget the last runs of schedules which were removed
+		a.schedulerLock.Lock()
+		for id, handler := range a.schedulerHandlers {
+			if !utils.SortedStringHas(ids, id) {
+				handler.Remove()
+				delete(a.schedulerHandlers, id)
+			}
+		}
+		a.schedulerLock.Unlock()
+
+		for _, id := range ids {
+			schedule, err := NewSnapshotScheduleEntryFromId(tx, id)
+			if err != nil {
+				return err
+			}
+			if !schedule.Due(now) || a.scheduleRunning(id) {
+				continue
+			}
+
+			schedule.Info.LastRun = now.Unix()
+			err = schedule.Save(tx)
+			if err != nil {
+				return err
+			}
+
+			due = append(due, schedule)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.LogError("Unable to get snapshot schedules: %v", err)
+		return
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	// Track the runs now that they are recorded, so that no
+	// handler is left which never completes.  Only the last run
+	// of each schedule is kept, since only its url is saved.
+	handlers := make(map[string]*rest.AsyncHttpHandler)
+	a.schedulerLock.Lock()
+	for _, schedule := range due {
+		id := schedule.Info.VolumeId
+		if previous, ok := a.schedulerHandlers[id]; ok {
+			previous.Remove()
+		}
+		handlers[id] = a.asyncManager.NewHandler()
+		a.schedulerHandlers[id] = handlers[id]
+	}
+	a.schedulerLock.Unlock()
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		for _, schedule := range due {
+			entry, err := NewSnapshotScheduleEntryFromId(tx, schedule.Info.VolumeId)
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			entry.Info.LastRunUrl = handlers[schedule.Info.VolumeId].Url()
+			err = entry.Save(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Err(err)
+	}
+
+	for _, schedule := range due {
+		a.schedulerLock.Lock()
+		a.schedulerRunning[schedule.Info.VolumeId] = true
+		a.schedulerLock.Unlock()
+
+		a.schedulerRuns.Add(1)
+		go a.runSnapshotSchedule(schedule, handlers[schedule.Info.VolumeId])
+	}
+}
+
+// Take the snapshot of the schedule and save the result
+func (a *App) runSnapshotSchedule(schedule *SnapshotScheduleEntry,
+	handler *rest.AsyncHttpHandler) {
+
+	defer a.schedulerRuns.Done()
+	defer func() {
+		a.schedulerLock.Lock()
+		delete(a.schedulerRunning, schedule.Info.VolumeId)
+		a.schedulerLock.Unlock()
+	}()
+
+	logger.Info("Taking scheduled snapshot of volume %v", schedule.Info.VolumeId)
+	runErr := schedule.Run(a.db, a.executor)
+	if runErr != nil {
+		logger.LogError("Scheduled snapshot of volume %v failed: %v",
+			schedule.Info.VolumeId, runErr)
+	}
+
+	// Save the result unless the schedule was removed
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		entry, err := NewSnapshotScheduleEntryFromId(tx, schedule.Info.VolumeId)
+		if err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		entry.Info.LastError = ""
+		if runErr != nil {
+			entry.Info.LastError = runErr.Error()
+		}
+		return entry.Save(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+	}
+
+	if runErr != nil {
+		handler.CompletedWithError(runErr)
+	} else {
+		handler.CompletedWithLocation("/volumes/" + schedule.Info.VolumeId + "/snapshots")
+	}
+}
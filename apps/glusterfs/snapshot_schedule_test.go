@@ -0,0 +1,361 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/heketi/heketi/executors"
+	"github.com/heketi/heketi/tests"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Make every snapshot of the volume older so that the
+// snapshots taken next are sorted after them
+func ageVolumeSnapshots(t *testing.T, db *bolt.DB, volumeId string) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, volumeId)
+		tests.Assert(t, err == nil)
+		for _, id := range volume.Snapshots {
+			snapshot, err := NewSnapshotEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			snapshot.Info.Created -= 100
+			err = snapshot.Save(tx)
+			tests.Assert(t, err == nil)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestSnapshotScheduleEntryMarshal(t *testing.T) {
+	req := &SnapshotScheduleRequest{
+		Interval:  60,
+		Retention: 24,
+	}
+	m := NewSnapshotScheduleEntryFromRequest("abc", req)
+	m.Info.LastRun = 12345
+	m.Info.LastError = "error"
+
+	buffer, err := m.Marshal(DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, buffer != nil)
+	tests.Assert(t, len(buffer) > 0)
+
+	um := &SnapshotScheduleEntry{}
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
+	tests.Assert(t, err == nil)
+
+	tests.Assert(t, reflect.DeepEqual(um, m))
+}
+
+func TestSnapshotScheduleEntryDue(t *testing.T) {
+	s := NewSnapshotScheduleEntryFromRequest("abc", &SnapshotScheduleRequest{
+		Interval:  30,
+		Retention: 1,
+	})
+
+	// Never run
+	now := time.Now()
+	tests.Assert(t, s.Due(now))
+
+	s.Info.LastRun = now.Unix()
+	tests.Assert(t, !s.Due(now))
+	tests.Assert(t, !s.Due(now.Add(29*time.Minute)))
+	tests.Assert(t, s.Due(now.Add(30*time.Minute)))
+}
+
+func TestSnapshotScheduleEntryRunRetention(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+
+	// Snapshots taken by hand are not pruned
+	manual := NewSnapshotEntryFromRequest(v.Info.Id, &SnapshotCreateRequest{})
+	err := manual.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	ageVolumeSnapshots(t, app.db, v.Info.Id)
+
+	// GlusterFS has every snapshot in the db
+	deleted := make([]string, 0)
+	app.xo.MockSnapshotList = func(host string, volume string) ([]string, error) {
+		names := make([]string, 0)
+		err := app.db.View(func(tx *bolt.Tx) error {
+			ids, err := SnapshotList(tx)
+			tests.Assert(t, err == nil)
+			for _, id := range ids {
+				snapshot, err := NewSnapshotEntryFromId(tx, id)
+				tests.Assert(t, err == nil)
+				names = append(names, snapshot.Info.Name)
+			}
+			return nil
+		})
+		return names, err
+	}
+	app.xo.MockSnapshotDelete = func(host string, snapshot string) error {
+		deleted = append(deleted, snapshot)
+		return nil
+	}
+
+	s := NewSnapshotScheduleEntryFromRequest(v.Info.Id, &SnapshotScheduleRequest{
+		Interval:  60,
+		Retention: 2,
+	})
+
+	// Take three scheduled snapshots
+	var first *SnapshotEntry
+	for i := 0; i < 3; i++ {
+		err = s.Run(app.db, app.executor)
+		tests.Assert(t, err == nil)
+
+		if first == nil {
+			err = app.db.View(func(tx *bolt.Tx) error {
+				volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+				tests.Assert(t, err == nil)
+				for _, id := range volume.Snapshots {
+					snapshot, err := NewSnapshotEntryFromId(tx, id)
+					tests.Assert(t, err == nil)
+					if snapshot.Info.Scheduled {
+						first = snapshot
+					}
+				}
+				return nil
+			})
+			tests.Assert(t, err == nil)
+		}
+		ageVolumeSnapshots(t, app.db, v.Info.Id)
+	}
+
+	// The oldest scheduled snapshot was deleted
+	tests.Assert(t, first != nil)
+	tests.Assert(t, len(deleted) == 1)
+	tests.Assert(t, deleted[0] == first.Info.Name)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Snapshots) == 3)
+
+		scheduled := 0
+		for _, id := range volume.Snapshots {
+			snapshot, err := NewSnapshotEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, snapshot.Info.Id != first.Info.Id)
+			if snapshot.Info.Scheduled {
+				scheduled++
+			} else {
+				tests.Assert(t, snapshot.Info.Id == manual.Info.Id)
+			}
+		}
+		tests.Assert(t, scheduled == 2)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestAppRunSnapshotSchedules(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	router := mux.NewRouter()
+	app.SetRoutes(router)
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := createSampleSnapshotVolume(t, app, true)
+
+	s := NewSnapshotScheduleEntryFromRequest(v.Info.Id, &SnapshotScheduleRequest{
+		Interval:  60,
+		Retention: 2,
+	})
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		return s.Save(tx)
+	})
+	tests.Assert(t, err == nil)
+
+	// Take the first snapshot
+	now := time.Now()
+	app.runSnapshotSchedules(now)
+	app.schedulerRuns.Wait()
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		volume, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(volume.Snapshots) == 1)
+
+		s, err = NewSnapshotScheduleEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, s.Info.LastRun == now.Unix())
+	tests.Assert(t, s.Info.LastRunUrl != "")
+	tests.Assert(t, s.Info.LastError == "")
+
+	// The run is tracked by the asynchronous manager
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return errors.New("Stop")
+		},
+	}
+	r, _ := client.Get(ts.URL + s.Info.LastRunUrl)
+	tests.Assert(t, r.StatusCode == http.StatusSeeOther)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, location.Path == "/volumes/"+v.Info.Id+"/snapshots")
+
+	// Not due again until the interval has passed
+	called := 0
+	app.xo.MockSnapshotCreate = func(host string, snapshot *executors.SnapshotRequest) error {
+		called++
+		return errors.New("MOCK ERROR")
+	}
+	app.runSnapshotSchedules(now.Add(59 * time.Minute))
+	app.schedulerRuns.Wait()
+	tests.Assert(t, called == 0)
+
+	// Failures are saved in the schedule and tracked
+	app.runSnapshotSchedules(now.Add(60 * time.Minute))
+	app.schedulerRuns.Wait()
+	tests.Assert(t, called == 1)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		s, err = NewSnapshotScheduleEntryFromId(tx, v.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, s.Info.LastError == "MOCK ERROR")
+
+	r, err = http.Get(ts.URL + s.Info.LastRunUrl)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusInternalServerError)
+
+	// Only the last run of the schedule is tracked
+	previous := s.Info.LastRunUrl
+	app.runSnapshotSchedules(now.Add(120 * time.Minute))
+	app.schedulerRuns.Wait()
+	app.runSnapshotSchedules(now.Add(180 * time.Minute))
+	app.schedulerRuns.Wait()
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		s, err = NewSnapshotScheduleEntryFromId(tx, v.Info.Id)
+		return err
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, s.Info.LastRunUrl != previous)
+	tests.Assert(t, len(app.schedulerHandlers) == 1)
+
+	// The handler of a removed schedule is dropped
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		return s.Delete(tx)
+	})
+	tests.Assert(t, err == nil)
+	app.runSnapshotSchedules(now.Add(240 * time.Minute))
+	app.schedulerRuns.Wait()
+	tests.Assert(t, len(app.schedulerHandlers) == 0)
+
+	r, err = http.Get(ts.URL + s.Info.LastRunUrl)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, r.StatusCode == http.StatusNotFound)
+}
+
+func TestAppRunSnapshotSchedulesHung(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	volumes := make([]*VolumeEntry, 2)
+	for i := range volumes {
+		req := &VolumeCreateRequest{}
+		req.Size = 100
+		req.Snapshot.Enable = true
+		volumes[i] = NewVolumeEntryFromRequest(req)
+		err = volumes[i].Create(app.db, app.executor, app.allocator)
+		tests.Assert(t, err == nil)
+
+		s := NewSnapshotScheduleEntryFromRequest(volumes[i].Info.Id, &SnapshotScheduleRequest{
+			Interval:  60,
+			Retention: 2,
+		})
+		err = app.db.Update(func(tx *bolt.Tx) error {
+			return s.Save(tx)
+		})
+		tests.Assert(t, err == nil)
+	}
+
+	// The snapshot of the first volume does not finish
+	hung := make(chan struct{})
+	defer close(hung)
+	taken := make(chan string, 2)
+	app.xo.MockSnapshotCreate = func(host string, snapshot *executors.SnapshotRequest) error {
+		if snapshot.Volume == volumes[0].Info.Name {
+			<-hung
+		}
+		taken <- snapshot.Volume
+		return nil
+	}
+
+	// The other schedule is run
+	now := time.Now()
+	app.runSnapshotSchedules(now)
+	select {
+	case name := <-taken:
+		tests.Assert(t, name == volumes[1].Info.Name)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Scheduled snapshot not taken")
+	}
+
+	// A schedule being run is not started again
+	tests.Assert(t, app.scheduleRunning(volumes[0].Info.Id))
+	app.runSnapshotSchedules(now.Add(60 * time.Minute))
+	select {
+	case name := <-taken:
+		tests.Assert(t, name == volumes[1].Info.Name)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Scheduled snapshot not taken")
+	}
+	tests.Assert(t, app.scheduleRunning(volumes[0].Info.Id))
+
+	// The scheduler stops without waiting for the snapshot
+	app.Close()
+}
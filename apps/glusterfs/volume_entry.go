@@ -17,12 +17,14 @@
 package glusterfs
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
 	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
 	"github.com/heketi/heketi/utils"
 	"github.com/lpabon/godbc"
 	"sort"
+	"strings"
+	"time"
 )
 
 const (
@@ -33,10 +35,25 @@ const (
 	GB = MB * 1024
 	TB = GB * 1024
 
+	// Durability types
+	DURABILITY_NONE      = "none"
+	DURABILITY_REPLICATE = "replicate"
+	DURABILITY_DISPERSE  = "disperse"
+
 	// Default values
 	DEFAULT_REPLICA               = 2
+	DEFAULT_DISPERSE_DATA         = 4
+	DEFAULT_DISPERSE_REDUNDANCY   = 2
+	DEFAULT_ARBITER_FILES         = 1000000
 	DEFAULT_THINP_SNAPSHOT_FACTOR = 1.5
 
+	// Arbiter volumes use replica 3 with the last brick
+	// of each set as the arbiter
+	ARBITER_REPLICA = 3
+
+	// Arbiter bricks only store metadata for each file
+	ARBITER_BRICK_SIZE_PER_FILE = uint64(4 * KB)
+
 	// Default limits
 	BRICK_MIN_SIZE = uint64(1 * GB)
 	BRICK_MAX_SIZE = uint64(4 * TB)
@@ -44,12 +61,39 @@ const (
 )
 
 var (
-	createBricks = CreateBricks
+	createBricks          = CreateBricks
+	rebalancePollInterval = 10 * time.Second
 )
 
 type VolumeEntry struct {
-	Info   VolumeInfo
-	Bricks sort.StringSlice
+	Info      VolumeInfo
+	Bricks    sort.StringSlice
+	Snapshots sort.StringSlice
+
+	// Volumes cloned from snapshots of this volume.  Their bricks
+	// share the thin pools of the bricks of this volume.
+	Clones sort.StringSlice
+
+	// Volume of the snapshot this volume was cloned from
+	SourceVolumeId string
+}
+
+// Sorts replica sets from largest to smallest brick size
+type replicaSetsBySize [][]*BrickEntry
+
+func (s replicaSetsBySize) Len() int           { return len(s) }
+func (s replicaSetsBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s replicaSetsBySize) Less(i, j int) bool { return setBrickSize(s[i]) > setBrickSize(s[j]) }
+
+// Returns the size of the largest brick in the set
+func setBrickSize(set []*BrickEntry) uint64 {
+	size := uint64(0)
+	for _, brick := range set {
+		if brick.Info.Size > size {
+			size = brick.Info.Size
+		}
+	}
+	return size
 }
 
 func VolumeList(tx *bolt.Tx) ([]string, error) {
@@ -74,12 +118,51 @@ func NewVolumeEntryFromRequest(req *VolumeCreateRequest) *VolumeEntry {
 	vol := NewVolumeEntry()
 	vol.Info.Id = utils.GenUUID()
 	vol.Info.Replica = req.Replica
+	vol.Info.Durability = req.Durability
+	vol.Info.Arbiter = req.Arbiter
 	vol.Info.Snapshot = req.Snapshot
 	vol.Info.Size = req.Size
+	vol.Info.SourceSnapshot = req.SourceSnapshot
+	if len(req.Options) > 0 {
+		vol.Info.Options = make(map[string]string)
+		for option, value := range req.Options {
+			vol.Info.Options[option] = value
+		}
+	}
+
+	// Set default durability
+	switch vol.Info.Durability.Type {
+	case DURABILITY_NONE:
+		// Distribute only, with a single copy of the data
+		vol.Info.Replica = 1
+		vol.Info.Durability.Disperse.Data = 0
+		vol.Info.Durability.Disperse.Redundancy = 0
+		vol.Info.Arbiter.Enable = false
+	case DURABILITY_DISPERSE:
+		vol.Info.Replica = 0
+		vol.Info.Arbiter.Enable = false
+		vol.Info.Arbiter.Files = 0
+		if vol.Info.Durability.Disperse.Data == 0 &&
+			vol.Info.Durability.Disperse.Redundancy == 0 {
+			vol.Info.Durability.Disperse.Data = DEFAULT_DISPERSE_DATA
+			vol.Info.Durability.Disperse.Redundancy = DEFAULT_DISPERSE_REDUNDANCY
+		}
+	default:
+		vol.Info.Durability.Type = DURABILITY_REPLICATE
+		vol.Info.Durability.Disperse.Data = 0
+		vol.Info.Durability.Disperse.Redundancy = 0
+		if vol.Info.Arbiter.Enable {
+			vol.Info.Replica = ARBITER_REPLICA
+			if vol.Info.Arbiter.Files == 0 {
+				vol.Info.Arbiter.Files = DEFAULT_ARBITER_FILES
+			}
+		} else if vol.Info.Replica == 0 {
+			vol.Info.Replica = DEFAULT_REPLICA
+		}
+	}
 
-	// Set default replica
-	if vol.Info.Replica == 0 {
-		vol.Info.Replica = DEFAULT_REPLICA
+	if !vol.Info.Arbiter.Enable {
+		vol.Info.Arbiter.Files = 0
 	}
 
 	// Set default name
@@ -135,11 +218,13 @@ func (v *VolumeEntry) NewInfoResponse(tx *bolt.Tx) (*VolumeInfoResponse, error)
 	info := NewVolumeInfoResponse()
 	info.Id = v.Info.Id
 	info.Cluster = v.Info.Cluster
-	info.Mount.GlusterFS.MountPoint = "/some/mount"
-	info.Mount.GlusterFS.Options["some"] = "options"
 	info.Snapshot = v.Info.Snapshot
 	info.Size = v.Info.Size
 	info.Replica = v.Info.Replica
+	info.Durability = v.Info.Durability
+	info.Arbiter = v.Info.Arbiter
+	info.SourceSnapshot = v.Info.SourceSnapshot
+	info.Options = v.Info.Options
 	info.Name = v.Info.Name
 
 	for _, brickid := range v.BricksIds() {
@@ -155,20 +240,63 @@ func (v *VolumeEntry) NewInfoResponse(tx *bolt.Tx) (*VolumeInfoResponse, error)
 		info.Bricks = append(info.Bricks, *brickinfo)
 	}
 
+	// Mount from one of the servers which hold the bricks of the
+	// volume and use the others to get the volume file as backup
+	hosts, err := v.mountHosts(tx, info.Bricks)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) > 0 {
+		info.Mount.GlusterFS.MountPoint = hosts[0] + ":" + v.Info.Name
+		if len(hosts) > 1 {
+			info.Mount.GlusterFS.Options["backup-volfile-servers"] =
+				strings.Join(hosts[1:], ",")
+		}
+	}
+
 	return info, nil
 }
 
-func (v *VolumeEntry) Marshal() ([]byte, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	err := enc.Encode(*v)
+// Returns the storage hostnames of the nodes holding the bricks,
+// with the nodes which are online listed first
+func (v *VolumeEntry) mountHosts(tx *bolt.Tx, bricks []BrickInfo) ([]string, error) {
+	online := make([]string, 0)
+	others := make([]string, 0)
+	nodes := make(map[string]bool)
+	hosts := make(map[string]bool)
+	for _, brick := range bricks {
+		if nodes[brick.NodeId] {
+			continue
+		}
+		nodes[brick.NodeId] = true
+
+		node, err := NewNodeEntryFromId(tx, brick.NodeId)
+		if err != nil {
+			return nil, err
+		}
+		if hosts[node.StorageHostName()] {
+			continue
+		}
+		hosts[node.StorageHostName()] = true
+
+		if node.IsOnline() {
+			online = append(online, node.StorageHostName())
+		} else {
+			others = append(others, node.StorageHostName())
+		}
+	}
+	sort.Strings(online)
+	sort.Strings(others)
+
+	return append(online, others...), nil
+}
 
-	return buffer.Bytes(), err
+func (v *VolumeEntry) Marshal(encoding string) ([]byte, error) {
+	return entryEncode(encoding, v)
 }
 
-func (v *VolumeEntry) Unmarshal(buffer []byte) error {
-	dec := gob.NewDecoder(bytes.NewReader(buffer))
-	err := dec.Decode(v)
+func (v *VolumeEntry) Unmarshal(buffer []byte, encoding string) error {
+	err := entryDecode(encoding, buffer, v)
 	if err != nil {
 		return err
 	}
@@ -192,17 +320,43 @@ func (v *VolumeEntry) BrickDelete(id string) {
 	v.Bricks = utils.SortedStringsDelete(v.Bricks, id)
 }
 
-func (v *VolumeEntry) Create(db *bolt.DB) (e error) {
+func (v *VolumeEntry) SnapshotAdd(id string) {
+	godbc.Require(!utils.SortedStringHas(v.Snapshots, id))
+
+	v.Snapshots = append(v.Snapshots, id)
+	v.Snapshots.Sort()
+}
+
+func (v *VolumeEntry) SnapshotDelete(id string) {
+	v.Snapshots = utils.SortedStringsDelete(v.Snapshots, id)
+}
+
+func (v *VolumeEntry) SnapshotsIds() sort.StringSlice {
+	ids := make(sort.StringSlice, len(v.Snapshots))
+	copy(ids, v.Snapshots)
+	return ids
+}
+
+func (v *VolumeEntry) CloneAdd(id string) {
+	godbc.Require(!utils.SortedStringHas(v.Clones, id))
+
+	v.Clones = append(v.Clones, id)
+	v.Clones.Sort()
+}
+
+func (v *VolumeEntry) CloneDelete(id string) {
+	v.Clones = utils.SortedStringsDelete(v.Clones, id)
+}
+
+func (v *VolumeEntry) Create(db *bolt.DB,
+	executor executors.Executor,
+	allocator Allocator) error {
+
+	// Clones get their bricks from the snapshot
+	if v.Info.SourceSnapshot != "" {
+		return v.createClone(db, executor)
+	}
 
-	defer func() {
-		if e != nil {
-			db.Update(func(tx *bolt.Tx) error {
-				err := v.Delete(tx)
-				godbc.Check(err == nil)
-				return nil
-			})
-		}
-	}()
 	// Get list of clusters
 	var clusters []string
 	if len(v.Info.Clusters) == 0 {
@@ -226,61 +380,113 @@ func (v *VolumeEntry) Create(db *bolt.DB) (e error) {
 	}
 	logger.Debug("Using the following clusters: %+v", clusters)
 
+	// Record the operation, so that it can be finished or undone
+	// if the server stops before the volume is saved
+	op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_CREATE, v)
+	op.Volume = v
+	err := op.Record(db)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			op.Clear(db)
+		}
+	}()
+
 	// For each cluster look for storage space for this volume
+	allocErr := ErrNoSpace
+	conflicts := 0
 	for _, cluster := range clusters {
-		brick_entries, err := v.allocBricksInCluster(db, cluster, v.Info.Size)
-		if err != nil {
+
+		// Reserve the name of the volume in the cluster
+		err := db.Update(func(tx *bolt.Tx) error {
+			return volumeNameReserve(tx, cluster, v.Info.Name, v.Info.Id)
+		})
+		if err == ErrConflict {
+			logger.Debug("Volume name %v already used in cluster %v", v.Info.Name, cluster)
+			conflicts++
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		brick_entries, err := v.allocBricksInCluster(db, allocator, cluster, v.Info.Size)
+		if err == ErrNotEnoughNodes {
+			v.releaseName(db, cluster)
+			allocErr = err
+			continue
+		} else if err != nil {
+			v.releaseName(db, cluster)
 			continue
 		}
 
 		// Volume has been allocated
 		logger.Debug("Volume to be created on cluster %v", cluster)
 
-		// Create bricks
-		err = createBricks(db, brick_entries)
+		// Create bricks and the GlusterFS volume
+		err = v.createVolume(db, executor, cluster, brick_entries)
 		if err != nil {
+			v.removeBricksFromDb(db, brick_entries)
+			v.releaseName(db, cluster)
 			return err
 		}
 
-		// :TODO: Create GlusterFS volume
-
-		// Save information on db
+		// Save information on db.  If the operation cannot be
+		// marked done, the volume is deleted as it would be if
+		// the server stopped.
 		v.Info.Cluster = cluster
-		err = db.Update(func(tx *bolt.Tx) error {
+		err = op.Done(db)
+		if err == nil {
+			err = db.Update(func(tx *bolt.Tx) error {
 
-			// Save volume information
-			err = v.Save(tx)
-			if err != nil {
-				return err
-			}
+				// Save volume information
+				err := v.Save(tx)
+				if err != nil {
+					return err
+				}
 
-			// Save cluster
-			entry, err := NewClusterEntryFromId(tx, cluster)
-			if err != nil {
-				return err
-			}
-			entry.VolumeAdd(v.Info.Id)
-			return entry.Save(tx)
-		})
+				// Save cluster
+				entry, err := NewClusterEntryFromId(tx, cluster)
+				if err != nil {
+					return err
+				}
+				entry.VolumeAdd(v.Info.Id)
+				err = entry.Save(tx)
+				if err != nil {
+					return err
+				}
+
+				return op.Delete(tx)
+			})
+		}
 		if err != nil {
+			logger.Err(err)
+			v.destroyVolume(db, executor, cluster, brick_entries)
+			v.removeBricksFromDb(db, brick_entries)
+			v.releaseName(db, cluster)
+			v.Info.Cluster = ""
 			return err
 		}
 
+		committed = true
 		return nil
 	}
 
-	return ErrNoSpace
+	// Every cluster already has a volume with this name
+	if conflicts == len(clusters) {
+		return ErrConflict
+	}
+
+	return allocErr
 
 }
 
-func (v *VolumeEntry) Destroy(db *bolt.DB) error {
+func (v *VolumeEntry) Destroy(db *bolt.DB, executor executors.Executor) error {
 	logger.Info("Destroying volume %v", v.Info.Id)
 
-	// :TODO: Stop volume
-
-	// :TODO: Destroy the volume
-
-	// Destroy bricks - create a list of brick entries
+	// Get the entries for the bricks
 	brick_entries := make([]*BrickEntry, 0)
 	db.View(func(tx *bolt.Tx) error {
 		for _, id := range v.BricksIds() {
@@ -294,43 +500,142 @@ func (v *VolumeEntry) Destroy(db *bolt.DB) error {
 		return nil
 	})
 
-	// Destroy bricks
-	err := DestroyBricks(db, brick_entries)
+	// Record the operation, so that it can be finished if
+	// the server stops before it is saved
+	op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_DESTROY, v)
+	err := op.Record(db)
 	if err != nil {
-		logger.LogError("Unable to delete bricks: %v", err)
 		return err
 	}
 
+	// Stop and delete the volume, then destroy the bricks
+	err = v.destroyVolume(db, executor, v.Info.Cluster, brick_entries)
+	if err != nil {
+		op.Clear(db)
+		return err
+	}
+
+	// The volume is gone, so it is removed from the db even if
+	// the operation cannot be marked done.  Deleting the volume
+	// again succeeds if the removal is interrupted.
+	op.Done(db)
+
 	// Remove from db
-	err = db.Update(func(tx *bolt.Tx) error {
-		for _, brick := range brick_entries {
-			err = v.removeBrickFromDb(tx, brick)
-			if err != nil {
-				logger.Err(err)
-				return err
-			}
+	return db.Update(func(tx *bolt.Tx) error {
+		err := v.removeFromDb(tx, brick_entries)
+		if err != nil {
+			return err
 		}
-		v.Delete(tx)
 
-		return nil
+		return op.Delete(tx)
 	})
+}
+
+// Remove the volume, its bricks, and the entries which
+// belong to it from the db
+func (v *VolumeEntry) removeFromDb(tx *bolt.Tx, brick_entries []*BrickEntry) error {
+	for _, brick := range brick_entries {
+		err := v.removeBrickFromDb(tx, brick)
+		if err != nil {
+			logger.Err(err)
+			return err
+		}
+	}
+
+	// Remove the snapshot schedule of the volume
+	schedule, err := NewSnapshotScheduleEntryFromId(tx, v.Info.Id)
+	if err == nil {
+		err = schedule.Delete(tx)
+		if err != nil {
+			logger.Err(err)
+			return err
+		}
+	} else if err != ErrNotFound {
+		logger.Err(err)
+		return err
+	}
+
+	// Remove the quota of the volume
+	quota, err := NewQuotaEntryFromId(tx, v.Info.Id)
+	if err == nil {
+		err = quota.Delete(tx)
+		if err != nil {
+			logger.Err(err)
+			return err
+		}
+	} else if err != ErrNotFound {
+		logger.Err(err)
+		return err
+	}
+
+	// Remove clone from its source volume
+	if v.SourceVolumeId != "" {
+		err := v.removeFromSourceVolume(tx)
+		if err != nil {
+			logger.Err(err)
+			return err
+		}
+	}
+
+	// Remove volume from cluster
+	cluster, err := NewClusterEntryFromId(tx, v.Info.Cluster)
+	if err == ErrNotFound {
+		logger.Critical("Cluster id %v is expected be in db. Pointed to by volume %v",
+			v.Info.Cluster,
+			v.Info.Id)
+	} else if err != nil {
+		logger.Err(err)
+		return err
+	} else {
+		cluster.VolumeDelete(v.Info.Id)
+		err = cluster.Save(tx)
+		if err != nil {
+			logger.Err(err)
+			return err
+		}
+	}
+
+	// Free the name of the volume
+	err = volumeNameRelease(tx, v.Info.Cluster, v.Info.Name, v.Info.Id)
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
 
-	return err
+	return v.Delete(tx)
 }
 
-func (v *VolumeEntry) Expand(db *bolt.DB, sizeGB int) (e error) {
+func (v *VolumeEntry) Expand(db *bolt.DB,
+	executor executors.Executor,
+	allocator Allocator,
+	sizeGB int) (e error) {
+
+	// Record the operation, so that it can be finished or undone
+	// if the server stops before the volume is saved
+	op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_EXPAND, v)
+	op.Size = sizeGB
+	err := op.Record(db)
+	if err != nil {
+		return err
+	}
 
 	// Allocate new bricks in the cluster
-	brick_entries, err := v.allocBricksInCluster(db, v.Info.Cluster, sizeGB)
+	brick_entries, err := v.allocBricksInCluster(db, allocator, v.Info.Cluster, sizeGB)
 	if err != nil {
+		op.Clear(db)
 		return err
 	}
 
 	// Setup cleanup function
+	size := v.Info.Size
+	expanded := false
 	defer func() {
-		if e != nil {
+		if e != nil && !expanded {
 			logger.Debug("Error detected, cleaning up")
 
+			// Restore the previous size
+			v.Info.Size = size
+
 			// Remove from db
 			db.Update(func(tx *bolt.Tx) error {
 				for _, brick := range brick_entries {
@@ -341,105 +646,682 @@ func (v *VolumeEntry) Expand(db *bolt.DB, sizeGB int) (e error) {
 
 				return nil
 			})
+			op.Clear(db)
 		}
 	}()
 
 	// Create bricks
-	err = createBricks(db, brick_entries)
+	err = createBricks(db, executor, brick_entries)
 	if err != nil {
 		logger.Err(err)
 		return err
 	}
 
-	// Setup cleanup function
-	defer func() {
-		if err != nil {
-			logger.Debug("Error detected, cleaning up")
-			DestroyBricks(db, brick_entries)
-		}
-	}()
+	// Once they may be part of the volume, the bricks are kept
+	// if the server stops
+	err = op.setState(db, OPERATION_STATE_BRICKS_ADDED)
+	if err != nil {
+		DestroyBricks(db, executor, brick_entries)
+		return err
+	}
 
-	// :TODO: Add them to the volume
+	// Add the bricks to the volume
+	err = v.expandVolume(db, executor, brick_entries)
+	if err != nil {
+		logger.LogError("Unable to add bricks to volume %v: %v", v.Info.Name, err)
+		DestroyBricks(db, executor, brick_entries)
+		return err
+	}
 
 	// Increase the recorded volume size
 	v.Info.Size += sizeGB
 
 	// Save volume entry
 	err = db.Update(func(tx *bolt.Tx) error {
-		return v.Save(tx)
+		err := v.Save(tx)
+		if err != nil {
+			return err
+		}
+
+		return op.Delete(tx)
 	})
+	if err != nil {
+		// The bricks are now part of the volume, so they cannot
+		// be removed.  The operation is finished when the
+		// server starts again.
+		logger.Critical("Volume %v was expanded, but unable to save it in the db: %v",
+			v.Info.Id, err)
+		expanded = true
+		return err
+	}
 
-	return err
+	return nil
 
 }
 
-func (v *VolumeEntry) allocBricksInCluster(db *bolt.DB, cluster string, gbsize int) ([]*BrickEntry, error) {
+// Rebalance the data across all the bricks of the volume, normally after
+// an expansion.  The function waits until the rebalance has finished
+// and reports its status through progress() if it is not nil.
+func (v *VolumeEntry) Rebalance(db *bolt.DB,
+	executor executors.Executor,
+	progress func(string)) error {
 
-	// This value will keep being halved until either
-	// space is found, or it is determined that the cluster is full
-	size := uint64(gbsize) * GB
-	volSize := size
+	// Get a node to execute the GlusterFS commands
+	host, err := v.peerHost(db, v.Info.Cluster)
+	if err != nil {
+		return err
+	}
 
-	// Continue adjust 'size' until space is found
+	// Start rebalance
+	err = executor.VolumeRebalance(host, v.Info.Name)
+	if err != nil {
+		logger.LogError("Unable to start rebalance on volume %v: %v", v.Info.Name, err)
+		return err
+	}
+
+	// Wait for the rebalance to finish
 	for {
-		// Determine brick size needed
-		brick_size, err := v.determineBrickSize(size)
+		status, err := executor.VolumeRebalanceStatus(host, v.Info.Name)
 		if err != nil {
-			return nil, err
+			logger.LogError("Unable to get rebalance status of volume %v: %v",
+				v.Info.Name, err)
+			return err
 		}
-		logger.Debug("brick_size = %v", brick_size)
-
-		// Calculate number of bricks needed to satisfy the volume request
-		// according to the brick size
-		num_bricks := int(volSize / brick_size)
-		logger.Debug("num_bricks = %v", num_bricks)
 
-		// Check that the volume does not have too many bricks
-		if num_bricks > BRICK_MAX_NUM {
-			logger.Debug("Maximum number of bricks reached")
-			// Try other clusters if possible
-			return nil, ErrMaxBricks
+		if progress != nil {
+			progress(fmt.Sprintf("Rebalance %v: %v files, %v failures",
+				status.Status, status.Files, status.Failures))
 		}
 
-		// Allocate bricks in the cluster
-		brick_entries, err := v.allocBricks(db, cluster, num_bricks, brick_size)
-		if err == ErrNoSpace {
-			logger.Debug("No space, need to reduce size and try again")
-			// Out of space for the specified brick size, try again
-			// with smaller bricks
-			size /= 2
-			continue
-		}
-		if err != nil {
-			logger.Err(err)
-			return nil, err
+		if status.Completed {
+			if status.Failed {
+				logger.LogError("Rebalance of volume %v %v", v.Info.Name, status.Status)
+				return ErrRebalance
+			}
+			break
 		}
 
-		// We were able to allocate bricks
-		return brick_entries, nil
+		time.Sleep(rebalancePollInterval)
 	}
+
+	logger.Info("Rebalance of volume %v completed", v.Info.Name)
+	return nil
 }
 
-// Return size of each brick in KB, error
-func (v *VolumeEntry) determineBrickSize(size uint64) (uint64, error) {
-	brick_size := size / 2
+// Shrink the volume by removing whole replica sets of bricks which
+// together are not larger than sizeGB.  The data in the bricks is first
+// migrated to the rest of the volume.  The function waits until the
+// migration has finished and reports its status through progress()
+// if it is not nil.
+func (v *VolumeEntry) Shrink(db *bolt.DB,
+	executor executors.Executor,
+	sizeGB int,
+	progress func(string)) error {
+
+	// Determine which bricks to remove
+	var (
+		brick_entries []*BrickEntry
+		removed       uint64
+	)
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		brick_entries, removed, err = v.bricksToShrink(tx, sizeGB)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-	if brick_size < BRICK_MIN_SIZE {
-		return 0, ErrMininumBrickSize
-	} else if brick_size > BRICK_MAX_SIZE {
-		return v.determineBrickSize(brick_size)
+	// Get a node to execute the GlusterFS commands
+	host, err := v.peerHost(db, v.Info.Cluster)
+	if err != nil {
+		return err
+	}
+	req, err := v.newVolumeRequest(db, brick_entries)
+	if err != nil {
+		return err
 	}
 
-	return brick_size, nil
-}
+	// Start migrating the data out of the bricks
+	err = executor.VolumeRemoveBricks(host, req)
+	if err != nil {
+		logger.LogError("Unable to remove bricks from volume %v: %v", v.Info.Name, err)
+		return err
+	}
 
-func (v *VolumeEntry) allocBricks(
-	db *bolt.DB,
-	cluster string,
-	num_bricks int,
-	brick_size uint64) (brick_entries []*BrickEntry, e error) {
+	// Wait for the migration to finish
+	for {
+		status, err := executor.VolumeRemoveBricksStatus(host, req)
+		if err != nil {
+			logger.LogError("Unable to get remove-brick status of volume %v: %v",
+				v.Info.Name, err)
+			return err
+		}
 
-	// Setup garbage collector function in case of error
+		if progress != nil {
+			progress(fmt.Sprintf("Data migration %v: %v files, %v failures",
+				status.Status, status.Files, status.Failures))
+		}
+
+		if status.Completed {
+			if status.Failed {
+				logger.LogError("Data migration out of bricks in volume %v %v",
+					v.Info.Name, status.Status)
+				return ErrRemoveBricks
+			}
+			break
+		}
+
+		time.Sleep(rebalancePollInterval)
+	}
+
+	// Remove the bricks from the volume
+	err = executor.VolumeRemoveBricksCommit(host, req)
+	if err != nil {
+		logger.LogError("Unable to commit the removal of bricks from volume %v: %v",
+			v.Info.Name, err)
+		return err
+	}
+
+	// The bricks are no longer part of the volume.  Failing to destroy
+	// them only leaves unused logical volumes on the nodes
+	err = DestroyBricks(db, executor, brick_entries)
+	if err != nil {
+		logger.LogError("Unable to destroy bricks removed from volume %v: %v",
+			v.Info.Name, err)
+	}
+
+	// Free the space on the devices and update the volume size
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, brick := range brick_entries {
+			err := v.removeBrickFromDb(tx, brick)
+			if err != nil {
+				return err
+			}
+		}
+
+		v.Info.Size -= int(removed / GB)
+		return v.Save(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	logger.Info("Shrank volume %v by %v GB", v.Info.Id, removed/GB)
+	return nil
+}
+
+// Replace a brick of the volume with a new brick allocated outside the
+// failure domains of the rest of its replica set.  The
+// data is then recovered from the rest of the replica set by healing
+// the volume.
+func (v *VolumeEntry) ReplaceBrick(db *bolt.DB,
+	executor executors.Executor,
+	allocator Allocator,
+	brickId string) (e error) {
+
+	godbc.Require(utils.SortedStringHas(v.Bricks, brickId))
+
+	// Destroying the old brick would also destroy the clone
+	// bricks in its thin pool
+	if len(v.Clones) > 0 {
+		return ErrHasClones
+	}
+
+	// The new brick is healed from the rest of its set, so the
+	// data of a brick without replicas would be lost
+	if v.bricksPerSet() < 2 {
+		return ErrNoRedundancy
+	}
+
+	// Record the operation, so that it can be finished or undone
+	// if the server stops before the volume is saved
+	op := NewPendingOperationEntryFromVolume(OPERATION_BRICK_REPLACE, v)
+	op.BrickId = brickId
+	err := op.Record(db)
+	if err != nil {
+		return err
+	}
+
+	// Allocate the new brick
+	var oldBrick *BrickEntry
+	var newBrick *BrickEntry
+	err = db.Update(func(tx *bolt.Tx) error {
+		var err error
+		oldBrick, err = NewBrickEntryFromId(tx, brickId)
+		if err != nil {
+			return err
+		}
+
+		newBrick, err = v.allocReplacementBrick(tx, allocator, oldBrick)
+		return err
+	})
+	if err != nil {
+		op.Clear(db)
+		return err
+	}
+
+	// Setup cleanup function
+	replaced := false
+	defer func() {
+		if e != nil && !replaced {
+			logger.Debug("Error detected, cleaning up")
+			db.Update(func(tx *bolt.Tx) error {
+				return v.removeBrickFromDb(tx, newBrick)
+			})
+			op.Clear(db)
+		}
+	}()
+
+	// Create the new brick
+	err = newBrick.Create(db, executor)
+	if err != nil {
+		logger.LogError("Unable to create replacement brick for %v: %v", brickId, err)
+		return err
+	}
+
+	// Get a node to execute the GlusterFS commands
+	host, err := v.peerHost(db, v.Info.Cluster)
+	if err != nil {
+		newBrick.Destroy(db, executor)
+		return err
+	}
+
+	// Once it may be part of the volume, the new brick is kept
+	// if the server stops
+	err = op.setState(db, OPERATION_STATE_BRICKS_ADDED)
+	if err != nil {
+		newBrick.Destroy(db, executor)
+		return err
+	}
+
+	// Replace the brick in the volume
+	req, err := v.newVolumeRequest(db, []*BrickEntry{oldBrick, newBrick})
+	if err == nil {
+		err = executor.VolumeReplaceBrick(host, v.Info.Name,
+			&req.Bricks[0], &req.Bricks[1])
+	}
+	if err != nil {
+		logger.LogError("Unable to replace brick %v in volume %v: %v",
+			brickId, v.Info.Name, err)
+		newBrick.Destroy(db, executor)
+		return err
+	}
+
+	// The old brick is no longer part of the volume.  Its device
+	// has most likely failed, so only log if it cannot be destroyed
+	err = oldBrick.Destroy(db, executor)
+	if err != nil {
+		logger.LogError("Unable to destroy replaced brick %v: %v", brickId, err)
+	}
+
+	// Remove the old brick and save the new one in the volume
+	err = db.Update(func(tx *bolt.Tx) error {
+		err := v.removeBrickFromDb(tx, oldBrick)
+		if err != nil {
+			return err
+		}
+
+		err = v.Save(tx)
+		if err != nil {
+			return err
+		}
+
+		return op.Delete(tx)
+	})
+	if err != nil {
+		// The new brick is already part of the volume, so it cannot
+		// be removed.  The operation is finished when the server
+		// starts again.
+		logger.Critical("Brick %v was replaced by %v in volume %v, but unable to save it in the db: %v",
+			brickId, newBrick.Id(), v.Info.Id, err)
+		replaced = true
+		return err
+	}
+
+	// Recover the data in the new brick from its replicas
+	err = executor.VolumeHeal(host, v.Info.Name)
+	if err != nil {
+		logger.LogError("Unable to heal volume %v: %v", v.Info.Name, err)
+		return nil
+	}
+
+	logger.Info("Replaced brick %v with %v in volume %v",
+		brickId, newBrick.Id(), v.Info.Id)
+	return nil
+}
+
+// Allocate a brick with the same size as oldBrick on a device in the
+// cluster which is not in the failure domain of the rest of the replica
+// set.  The new brick is added to the volume, but the volume is not saved.
+func (v *VolumeEntry) allocReplacementBrick(tx *bolt.Tx,
+	allocator Allocator,
+	oldBrick *BrickEntry) (*BrickEntry, error) {
+
+	nodes, zones, err := clusterFailureDomains(tx, v.Info.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the new brick away from the failure domains
+	// of the rest of the replica set
+	placement, err := newReplicaPlacement(v.bricksPerSet(), nodes, zones)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := v.replicaSets(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		if set[0].ReplicaSetId != oldBrick.ReplicaSetId {
+			continue
+		}
+		for _, brick := range set {
+			if brick.Id() == oldBrick.Id() {
+				continue
+			}
+
+			node, err := NewNodeEntryFromId(tx, brick.Info.NodeId)
+			if err != nil {
+				return nil, err
+			}
+			placement.Add(node)
+		}
+	}
+
+	// Get the brick locations in the cluster
+	brickId := utils.GenUUID()
+	devices, err := allocator.GetDevices(tx, v.Info.Cluster, brickId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cloned bricks do not have a thin pool of their own, so
+	// their replacement gets one
+	tpsize := oldBrick.TpSize
+	metadatasize := oldBrick.PoolMetadataSize
+	if oldBrick.Cloned {
+		tpsize, metadatasize, _ = v.brickDeviceSizes(oldBrick.Info.Size)
+	}
+
+	// Find a device with enough space
+	devicesize := tpsize + metadatasize
+	for _, deviceId := range devices {
+		if deviceId == oldBrick.Info.DeviceId {
+			continue
+		}
+
+		device, err := NewDeviceEntryFromId(tx, deviceId)
+		if err != nil {
+			return nil, err
+		}
+
+		if device.Draining || !device.StorageCheck(devicesize) {
+			continue
+		}
+
+		node, err := NewNodeEntryFromId(tx, device.NodeId)
+		if err != nil {
+			return nil, err
+		}
+		if !node.IsOnline() || !placement.Allowed(node) {
+			continue
+		}
+
+		// Create a new brick element
+		brick := NewBrickEntry(oldBrick.Info.Size,
+			tpsize,
+			metadatasize,
+			device.Id(),
+			device.NodeId)
+		brick.SetId(brickId)
+		brick.Info.VolumeId = v.Info.Id
+		brick.ReplicaSetId = oldBrick.ReplicaSetId
+
+		// Allocate space on device
+		device.StorageAllocate(devicesize)
+		device.BrickAdd(brick.Id())
+		v.BrickAdd(brick.Id())
+
+		// Save values
+		err = device.Save(tx)
+		if err != nil {
+			return nil, err
+		}
+		err = brick.Save(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		return brick, nil
+	}
+
+	return nil, ErrNoSpace
+}
+
+// Return the bricks of the volume grouped by replica set.  Sets
+// are sorted by their id
+func (v *VolumeEntry) replicaSets(tx *bolt.Tx) ([][]*BrickEntry, error) {
+	sets := make(map[string][]*BrickEntry)
+	ids := make(sort.StringSlice, 0)
+
+	for _, id := range v.BricksIds() {
+		brick, err := NewBrickEntryFromId(tx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := sets[brick.ReplicaSetId]; !ok {
+			ids = append(ids, brick.ReplicaSetId)
+		}
+		sets[brick.ReplicaSetId] = append(sets[brick.ReplicaSetId], brick)
+	}
+	ids.Sort()
+
+	list := make([][]*BrickEntry, len(ids))
+	for i, id := range ids {
+		list[i] = sets[id]
+	}
+
+	return list, nil
+}
+
+// Choose the replica sets to remove to shrink the volume by at most
+// sizeGB, starting with the largest sets.  At least one set is always
+// kept, and the sets must provide a whole number of GB, which is how
+// the size of the volume is recorded.  Returns the bricks of the chosen
+// sets and the amount of data space in KB they provide to the volume.
+func (v *VolumeEntry) bricksToShrink(tx *bolt.Tx,
+	sizeGB int) ([]*BrickEntry, uint64, error) {
+
+	// Destroying the removed bricks would also destroy the
+	// clone bricks in their thin pools
+	if len(v.Clones) > 0 {
+		return nil, 0, ErrHasClones
+	}
+
+	sets, err := v.replicaSets(tx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Sort largest sets first
+	sort.Stable(replicaSetsBySize(sets))
+
+	size := uint64(sizeGB) * GB
+	removed := uint64(0)
+	chosen := 0
+	brick_entries := make([]*BrickEntry, 0)
+	for _, set := range sets {
+
+		// Keep at least one set in the volume
+		if chosen == len(sets)-1 {
+			break
+		}
+
+		// Bricks cloned from a snapshot are only removed
+		// by GlusterFS when the volume is deleted
+		if set[0].Cloned {
+			continue
+		}
+
+		setSize := v.setDataSize(set)
+		if removed+setSize <= size {
+			removed += setSize
+			brick_entries = append(brick_entries, set...)
+			chosen++
+		}
+	}
+
+	if len(brick_entries) == 0 {
+		return nil, 0, ErrShrinkSize
+	}
+
+	// Removing part of a GB would leave the recorded size
+	// of the volume larger than the space it provides
+	if removed%GB != 0 {
+		logger.LogError("Bricks of volume %v provide %v KB, which is not a whole number of GB",
+			v.Info.Id, removed)
+		return nil, 0, ErrShrinkSize
+	}
+
+	return brick_entries, removed, nil
+}
+
+func (v *VolumeEntry) allocBricksInCluster(db *bolt.DB, allocator Allocator, cluster string, gbsize int) ([]*BrickEntry, error) {
+
+	// This value will keep being halved until either
+	// space is found, or it is determined that the cluster is full
+	size := uint64(gbsize) * GB
+	volSize := size
+
+	// Continue adjust 'size' until space is found
+	for {
+		// Determine brick size needed
+		brick_size, err := v.determineBrickSize(size)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debug("brick_size = %v", brick_size)
+
+		// Calculate number of sets needed to satisfy the volume request
+		// according to the brick size.  Only the data bricks of a set
+		// add to the volume size
+		num_bricks := int(volSize / (brick_size * uint64(v.dataBricksPerSet())))
+		logger.Debug("num_bricks = %v", num_bricks)
+
+		// Check that the volume does not have too many bricks
+		if num_bricks > BRICK_MAX_NUM {
+			logger.Debug("Maximum number of bricks reached")
+			// Try other clusters if possible
+			return nil, ErrMaxBricks
+		}
+
+		// Allocate bricks in the cluster
+		brick_entries, err := v.allocBricks(db, allocator, cluster, num_bricks, brick_size)
+		if err == ErrNoSpace {
+			logger.Debug("No space, need to reduce size and try again")
+			// Out of space for the specified brick size, try again
+			// with smaller bricks
+			size /= 2
+			continue
+		}
+		if err != nil {
+			logger.Err(err)
+			return nil, err
+		}
+
+		// We were able to allocate bricks
+		return brick_entries, nil
+	}
+}
+
+// Return size of each brick in KB, error
+func (v *VolumeEntry) determineBrickSize(size uint64) (uint64, error) {
+	// The data in each set is split across its data bricks
+	brick_size := size / 2 / uint64(v.dataBricksPerSet())
+
+	if brick_size < BRICK_MIN_SIZE {
+		return 0, ErrMininumBrickSize
+	} else if brick_size > BRICK_MAX_SIZE {
+		return v.determineBrickSize(size / 2)
+	}
+
+	return brick_size, nil
+}
+
+// Returns the number of bricks in each replica or disperse set
+func (v *VolumeEntry) bricksPerSet() int {
+	if v.Info.Durability.Type == DURABILITY_DISPERSE {
+		return v.Info.Durability.Disperse.Data +
+			v.Info.Durability.Disperse.Redundancy
+	}
+	return v.Info.Replica
+}
+
+// Returns the number of bricks in each set which store distinct data
+func (v *VolumeEntry) dataBricksPerSet() int {
+	if v.Info.Durability.Type == DURABILITY_DISPERSE {
+		return v.Info.Durability.Disperse.Data
+	}
+	return 1
+}
+
+// Returns true if the brick at the given position of a set is an arbiter
+func (v *VolumeEntry) isArbiterBrick(position int) bool {
+	return v.Info.Arbiter.Enable && position == v.bricksPerSet()-1
+}
+
+// Return size of each arbiter brick in KB for sets with data bricks
+// of brick_size.  Arbiter bricks only hold file metadata, so the
+// expected files are spread across the sets in proportion to the
+// data each set holds.
+func (v *VolumeEntry) arbiterBrickSize(brick_size uint64) uint64 {
+	volSize := float64(uint64(v.Info.Size) * GB)
+	files := float64(v.Info.Arbiter.Files) * float64(brick_size) / volSize
+	size := uint64(files * float64(ARBITER_BRICK_SIZE_PER_FILE))
+
+	if size < BRICK_MIN_SIZE {
+		size = BRICK_MIN_SIZE
+	}
+	if size > brick_size {
+		size = brick_size
+	}
+
+	return size
+}
+
+// Return the thin pool size, its metadata size, and the total
+// space needed on the device in KB for a brick of the given size
+func (v *VolumeEntry) brickDeviceSizes(size uint64) (tpsize, metadatasize, devicesize uint64) {
+
+	// Allocate size for the brick plus the snapshot
+	tpsize = uint64(float32(size) * v.Info.Snapshot.Factor)
+
+	// Allocate size for the thin pool metadata
+	metadatasize = BrickPoolMetadataSize(tpsize)
+
+	// Total size allocated on the device for each brick
+	devicesize = tpsize + metadatasize
+
+	return
+}
+
+// Returns the amount of volume data stored in the set in KB
+func (v *VolumeEntry) setDataSize(set []*BrickEntry) uint64 {
+	return setBrickSize(set) * uint64(v.dataBricksPerSet())
+}
+
+func (v *VolumeEntry) allocBricks(
+	db *bolt.DB,
+	allocator Allocator,
+	cluster string,
+	num_bricks int,
+	brick_size uint64) (brick_entries []*BrickEntry, e error) {
+
+	// Setup garbage collector function in case of error
 	defer func() {
 
 		// Check the named return value 'err'
@@ -451,6 +1333,7 @@ func (v *VolumeEntry) allocBricks(
 					err := v.removeBrickFromDb(tx, brick)
 					godbc.Check(err == nil)
 				}
+
 				return nil
 			})
 		}
@@ -459,41 +1342,27 @@ func (v *VolumeEntry) allocBricks(
 	// Initialize brick_entries
 	brick_entries = make([]*BrickEntry, 0)
 
-	// Allocate size for the brick plus the snapshot
-	tpsize := uint64(float32(brick_size) * v.Info.Snapshot.Factor)
+	// Arbiter bricks only reserve the space needed for metadata
+	arbiter_size := uint64(0)
+	if v.Info.Arbiter.Enable {
+		arbiter_size = v.arbiterBrickSize(brick_size)
+	}
 
 	// Determine allocation for each brick required for this volume
 	for brick_num := 0; brick_num < num_bricks; brick_num++ {
 
-		// Generate an id for the brick
-		brickId := utils.GenUUID()
+		// Generate an id for the replica set
+		setId := utils.GenUUID()
 
-		// Get list of brick locations
-		// :TODO: Change this to ring XXXXXXXXXXXXXXXX
-		devicelist := NewAllocationList()
+		// Determine the failure domains available to the replicas
+		var placement *replicaPlacement
 		err := db.View(func(tx *bolt.Tx) error {
-			devices, err := DeviceList(tx)
+			nodes, zones, err := clusterFailureDomains(tx, cluster)
 			if err != nil {
 				return err
 			}
 
-			for _, id := range devices {
-
-				device, err := NewDeviceEntryFromId(tx, id)
-				if err != nil {
-					return err
-				}
-
-				node, err := NewNodeEntryFromId(tx, device.NodeId)
-				if err != nil {
-					return err
-				}
-
-				if cluster == node.Info.ClusterId {
-					devicelist.Append(id)
-				}
-
-			}
+			placement, err = newReplicaPlacement(v.bricksPerSet(), nodes, zones)
 			return err
 		})
 		if err != nil {
@@ -501,39 +1370,63 @@ func (v *VolumeEntry) allocBricks(
 		}
 
 		// Check location has space for each brick and its replicas
-		for i := 0; i < v.Info.Replica; i++ {
+		for i := 0; i < v.bricksPerSet(); i++ {
+
+			// The allocator may use the brick id to
+			// determine the order of the devices
+			brickId := utils.GenUUID()
+
+			size := brick_size
+			if v.isArbiterBrick(i) {
+				size = arbiter_size
+			}
+			tpsize, metadatasize, devicesize := v.brickDeviceSizes(size)
 
 			// Do the work in the database context so that the cluster
 			// data does not change while determining brick location
 			err := db.Update(func(tx *bolt.Tx) error {
-				for {
+				devices, err := allocator.GetDevices(tx, cluster, brickId)
+				if err != nil {
+					return err
+				}
 
-					// Check if we have no more nodes
-					if devicelist.IsEmpty() {
-						return ErrNoSpace
-					}
+				for _, deviceId := range devices {
 
 					// Get device entry
-					device, err := NewDeviceEntryFromId(tx, devicelist.Pop())
+					device, err := NewDeviceEntryFromId(tx, deviceId)
+					if err != nil {
+						return err
+					}
+					if device.Draining {
+						continue
+					}
+
+					// Only place bricks on online nodes, keeping the
+					// replicas in different failure domains
+					node, err := NewNodeEntryFromId(tx, device.NodeId)
 					if err != nil {
 						return err
 					}
+					if !node.IsOnline() || !placement.Allowed(node) {
+						continue
+					}
 
-					logger.Debug("device %v[%v] > tpsize [%v] ?",
+					logger.Debug("device %v[%v] > required size [%v] ?",
 						device.Id(),
-						device.Info.Storage.Free, tpsize)
+						device.Info.Storage.Free, devicesize)
 					// Determine if we have space
-					if device.StorageCheck(tpsize) {
+					if device.StorageCheck(devicesize) {
 
 						// Create a new brick element
-						brick := NewBrickEntry(brick_size, device.Id(), device.NodeId)
-						if i == 0 {
-							brick.SetId(brickId)
-						}
+						brick := NewBrickEntry(size, tpsize, metadatasize,
+							device.Id(), device.NodeId)
+						brick.SetId(brickId)
+						brick.Info.VolumeId = v.Info.Id
+						brick.ReplicaSetId = setId
 						brick_entries = append(brick_entries, brick)
 
 						// Allocate space on device
-						device.StorageAllocate(tpsize)
+						device.StorageAllocate(devicesize)
 
 						// Add brick to device
 						device.BrickAdd(brick.Id())
@@ -541,25 +1434,20 @@ func (v *VolumeEntry) allocBricks(
 						// Add brick to volume
 						v.BrickAdd(brick.Id())
 
+						// Record the failure domain of the replica
+						placement.Add(node)
+
 						// Save values
 						err := device.Save(tx)
 						if err != nil {
 							return err
 						}
-						err = brick.Save(tx)
-						if err != nil {
-							return err
-						}
-						err = v.Save(tx)
-						if err != nil {
-							return err
-						}
-
-						break
+						return brick.Save(tx)
 					}
 				}
 
-				return nil
+				// No device has space for the brick
+				return ErrNoSpace
 			})
 			if err != nil {
 				return brick_entries, err
@@ -571,6 +1459,240 @@ func (v *VolumeEntry) allocBricks(
 
 }
 
+// Return the management hostname of a node in the cluster
+// used to run the GlusterFS volume commands
+func (v *VolumeEntry) peerHost(db *bolt.DB, cluster string) (string, error) {
+	var host string
+	err := db.View(func(tx *bolt.Tx) error {
+		entry, err := NewClusterEntryFromId(tx, cluster)
+		if err != nil {
+			return err
+		}
+
+		node, err := entry.PeerNode(tx)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			logger.LogError("No nodes available in cluster %v", cluster)
+			return ErrNotFound
+		}
+
+		host = node.ManageHostName()
+		return nil
+	})
+
+	return host, err
+}
+
+// Create a request for the executor with the bricks in the order
+// they were allocated, which keeps the members of each replica set together
+func (v *VolumeEntry) newVolumeRequest(db *bolt.DB,
+	brick_entries []*BrickEntry) (*executors.VolumeRequest, error) {
+
+	req := &executors.VolumeRequest{}
+	req.Name = v.Info.Name
+	req.Replica = v.Info.Replica
+	req.Arbiter = v.Info.Arbiter.Enable
+	if v.Info.Durability.Type == DURABILITY_DISPERSE {
+		req.DisperseData = v.Info.Durability.Disperse.Data
+		req.DisperseRedundancy = v.Info.Durability.Disperse.Redundancy
+	}
+	req.Bricks = make([]executors.BrickInfo, len(brick_entries))
+
+	err := db.View(func(tx *bolt.Tx) error {
+		for i, brick := range brick_entries {
+			node, err := NewNodeEntryFromId(tx, brick.Info.NodeId)
+			if err != nil {
+				return err
+			}
+
+			req.Bricks[i].Host = node.StorageHostName()
+			req.Bricks[i].Path = brick.Info.Path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func (v *VolumeEntry) createVolume(db *bolt.DB,
+	executor executors.Executor,
+	cluster string,
+	brick_entries []*BrickEntry) error {
+
+	// Get a node to execute the GlusterFS commands
+	host, err := v.peerHost(db, cluster)
+	if err != nil {
+		return err
+	}
+
+	// Create bricks
+	err = createBricks(db, executor, brick_entries)
+	if err != nil {
+		return err
+	}
+
+	// Create and start the volume
+	req, err := v.newVolumeRequest(db, brick_entries)
+	if err == nil {
+		err = executor.VolumeCreate(host, req)
+	}
+	if err != nil {
+		logger.LogError("Unable to create volume %v: %v", v.Info.Name, err)
+		DestroyBricks(db, executor, brick_entries)
+		return err
+	}
+
+	// Apply the requested options
+	for _, option := range v.sortedOptions() {
+		err = executor.VolumeSetOption(host, v.Info.Name, option, v.Info.Options[option])
+		if err != nil {
+			logger.LogError("Unable to set option %v on volume %v: %v",
+				option, v.Info.Name, err)
+			executor.VolumeDestroy(host, v.Info.Name)
+			DestroyBricks(db, executor, brick_entries)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the names of the volume options in order
+func (v *VolumeEntry) sortedOptions() []string {
+	options := make([]string, 0, len(v.Info.Options))
+	for option := range v.Info.Options {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+	return options
+}
+
+// Reset and set the GlusterFS options of the volume.  The options
+// applied are saved even if a later one fails.
+func (v *VolumeEntry) SetOptions(db *bolt.DB,
+	executor executors.Executor,
+	req *VolumeOptionsRequest) error {
+
+	godbc.Require(req != nil)
+
+	host, err := v.peerHost(db, v.Info.Cluster)
+	if err != nil {
+		return err
+	}
+
+	var opErr error
+	for _, option := range req.Reset {
+		opErr = executor.VolumeResetOption(host, v.Info.Name, option)
+		if opErr != nil {
+			break
+		}
+		delete(v.Info.Options, option)
+	}
+
+	if opErr == nil {
+		set := make([]string, 0, len(req.Set))
+		for option := range req.Set {
+			set = append(set, option)
+		}
+		sort.Strings(set)
+
+		for _, option := range set {
+			opErr = executor.VolumeSetOption(host, v.Info.Name, option, req.Set[option])
+			if opErr != nil {
+				break
+			}
+			if v.Info.Options == nil {
+				v.Info.Options = make(map[string]string)
+			}
+			v.Info.Options[option] = req.Set[option]
+		}
+	}
+	if len(v.Info.Options) == 0 {
+		v.Info.Options = nil
+	}
+
+	// Save the options which were applied
+	err = db.Update(func(tx *bolt.Tx) error {
+		entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		if err != nil {
+			return err
+		}
+
+		entry.Info.Options = v.Info.Options
+		return entry.Save(tx)
+	})
+	if err != nil {
+		logger.Err(err)
+		return err
+	}
+
+	return opErr
+}
+
+func (v *VolumeEntry) expandVolume(db *bolt.DB,
+	executor executors.Executor,
+	brick_entries []*BrickEntry) error {
+
+	// Get a node to execute the GlusterFS commands
+	host, err := v.peerHost(db, v.Info.Cluster)
+	if err != nil {
+		return err
+	}
+
+	// Add the new bricks to the volume
+	req, err := v.newVolumeRequest(db, brick_entries)
+	if err != nil {
+		return err
+	}
+
+	return executor.VolumeExpand(host, req)
+}
+
+func (v *VolumeEntry) destroyVolume(db *bolt.DB,
+	executor executors.Executor,
+	cluster string,
+	brick_entries []*BrickEntry) error {
+
+	// Get a node to execute the GlusterFS commands
+	host, err := v.peerHost(db, cluster)
+	if err != nil {
+		return err
+	}
+
+	// Stop and delete the volume
+	err = executor.VolumeDestroy(host, v.Info.Name)
+	if err != nil {
+		logger.LogError("Unable to delete volume %v: %v", v.Info.Name, err)
+		return err
+	}
+
+	// Destroy bricks
+	err = DestroyBricks(db, executor, brick_entries)
+	if err != nil {
+		logger.LogError("Unable to delete bricks: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (v *VolumeEntry) removeBricksFromDb(db *bolt.DB, brick_entries []*BrickEntry) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, brick := range brick_entries {
+			err := v.removeBrickFromDb(tx, brick)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (v *VolumeEntry) removeBrickFromDb(tx *bolt.Tx, brick *BrickEntry) error {
 
 	// Access device
@@ -583,6 +1705,9 @@ func (v *VolumeEntry) removeBrickFromDb(tx *bolt.Tx, brick *BrickEntry) error {
 	// Delete brick from device
 	device.BrickDelete(brick.Info.Id)
 
+	// Free space on device
+	device.StorageFree(brick.TpSize + brick.PoolMetadataSize)
+
 	// Save device
 	err = device.Save(tx)
 	if err != nil {
@@ -612,3 +1737,192 @@ func (v *VolumeEntry) BricksIds() sort.StringSlice {
 	copy(ids, v.Bricks)
 	return ids
 }
+
+// Create the volume by cloning the source snapshot.  The clone has
+// the same layout as the volume of the snapshot, and its bricks are
+// thin snapshots in the thin pools of the bricks of that volume.
+func (v *VolumeEntry) createClone(db *bolt.DB,
+	executor executors.Executor) error {
+
+	// Get the snapshot and its volume
+	var snapshot *SnapshotEntry
+	var source *VolumeEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		snapshot, err = NewSnapshotEntryFromId(tx, v.Info.SourceSnapshot)
+		if err != nil {
+			return err
+		}
+
+		source, err = NewVolumeEntryFromId(tx, snapshot.Info.VolumeId)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// The clone has the layout of the source volume
+	v.Info.Size = source.Info.Size
+	v.Info.Replica = source.Info.Replica
+	v.Info.Durability = source.Info.Durability
+	v.Info.Arbiter = source.Info.Arbiter
+	v.Info.Snapshot = source.Info.Snapshot
+	v.Info.Cluster = source.Info.Cluster
+	v.Info.Clusters = []string{source.Info.Cluster}
+	v.SourceVolumeId = source.Info.Id
+
+	// GlusterFS copies the options of the source volume to the clone
+	v.Info.Options = source.Info.Options
+
+	// Record the operation, so that the clone can be deleted if
+	// the server stops before it is saved
+	op := NewPendingOperationEntryFromVolume(OPERATION_VOLUME_CREATE, v)
+	op.Volume = v
+	err = op.Record(db)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			op.Clear(db)
+		}
+	}()
+
+	// Reserve the name of the clone in the cluster
+	err = db.Update(func(tx *bolt.Tx) error {
+		return volumeNameReserve(tx, v.Info.Cluster, v.Info.Name, v.Info.Id)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Clone the snapshot
+	host, err := v.peerHost(db, v.Info.Cluster)
+	if err != nil {
+		v.releaseName(db, v.Info.Cluster)
+		return err
+	}
+	clone_bricks, err := executor.SnapshotClone(host, source.Info.Name,
+		snapshot.Info.Name, v.Info.Name)
+	if err != nil {
+		v.releaseName(db, v.Info.Cluster)
+		return err
+	}
+
+	// Record the bricks against the devices of the source bricks
+	err = db.Update(func(tx *bolt.Tx) error {
+		source, err := NewVolumeEntryFromId(tx, source.Info.Id)
+		if err != nil {
+			return err
+		}
+
+		// Bricks of the source volume by path
+		source_bricks := make(map[string]*BrickEntry)
+		for _, id := range source.BricksIds() {
+			brick, err := NewBrickEntryFromId(tx, id)
+			if err != nil {
+				return err
+			}
+			source_bricks[brick.Info.Path] = brick
+		}
+
+		sets := make(map[string]string)
+		for _, clone_brick := range clone_bricks {
+
+			// Find the brick of the source volume the clone
+			// brick was created from
+			source_brick, ok := source_bricks[clone_brick.SourcePath]
+			if !ok || source_brick.Info.DeviceId != clone_brick.VgId {
+				logger.LogError("No brick of volume %v found at %v on device %v",
+					source.Info.Id, clone_brick.SourcePath, clone_brick.VgId)
+				return ErrNotFound
+			}
+			delete(source_bricks, clone_brick.SourcePath)
+
+			device, err := NewDeviceEntryFromId(tx, source_brick.Info.DeviceId)
+			if err != nil {
+				return err
+			}
+
+			// Keep the sets of the source volume
+			if _, ok := sets[source_brick.ReplicaSetId]; !ok {
+				sets[source_brick.ReplicaSetId] = utils.GenUUID()
+			}
+
+			// The brick uses space from the thin pool of the source
+			// brick, so nothing more is allocated on the device
+			brick := &BrickEntry{}
+			brick.Info.Id = utils.GenUUID()
+			brick.Info.Path = clone_brick.Path
+			brick.Info.Size = source_brick.Info.Size
+			brick.Info.DeviceId = device.Id()
+			brick.Info.NodeId = device.NodeId
+			brick.Info.VolumeId = v.Info.Id
+			brick.ReplicaSetId = sets[source_brick.ReplicaSetId]
+			brick.Cloned = true
+
+			device.BrickAdd(brick.Id())
+			v.BrickAdd(brick.Id())
+
+			err = device.Save(tx)
+			if err != nil {
+				return err
+			}
+			err = brick.Save(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Add the clone to the source volume
+		source.CloneAdd(v.Info.Id)
+		err = source.Save(tx)
+		if err != nil {
+			return err
+		}
+
+		// Add volume to cluster
+		cluster, err := NewClusterEntryFromId(tx, v.Info.Cluster)
+		if err != nil {
+			return err
+		}
+		cluster.VolumeAdd(v.Info.Id)
+		err = cluster.Save(tx)
+		if err != nil {
+			return err
+		}
+
+		err = v.Save(tx)
+		if err != nil {
+			return err
+		}
+
+		return op.Delete(tx)
+	})
+	if err != nil {
+		logger.LogError("Unable to save clone %v: %v", v.Info.Name, err)
+		executor.VolumeDestroy(host, v.Info.Name)
+		v.releaseName(db, v.Info.Cluster)
+		return err
+	}
+
+	committed = true
+	return nil
+}
+
+// Remove the clone from the volume of its source snapshot
+func (v *VolumeEntry) removeFromSourceVolume(tx *bolt.Tx) error {
+	source, err := NewVolumeEntryFromId(tx, v.SourceVolumeId)
+	if err == ErrNotFound {
+		logger.Critical("Volume id %v is expected be in db. Pointed to by clone %v",
+			v.SourceVolumeId,
+			v.Info.Id)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	source.CloneDelete(v.Info.Id)
+	return source.Save(tx)
+}
@@ -18,13 +18,17 @@ package glusterfs
 
 import (
 	"errors"
+	"fmt"
 	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/executors"
 	"github.com/heketi/heketi/tests"
 	"github.com/heketi/heketi/utils"
 	"os"
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 func createSampleVolumeEntry(size int) *VolumeEntry {
@@ -218,13 +222,13 @@ func TestNewVolumeEntryMarshal(t *testing.T) {
 	v.BrickAdd("abc")
 	v.BrickAdd("def")
 
-	buffer, err := v.Marshal()
+	buffer, err := v.Marshal(DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, buffer != nil)
 	tests.Assert(t, len(buffer) > 0)
 
 	um := &VolumeEntry{}
-	err = um.Unmarshal(buffer)
+	err = um.Unmarshal(buffer, DB_ENCODING_GOB)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, reflect.DeepEqual(v, um))
 
@@ -391,8 +395,69 @@ func TestNewVolumeEntryNewInfoResponse(t *testing.T) {
 	tests.Assert(t, info.Size == v.Info.Size)
 	tests.Assert(t, info.Replica == v.Info.Replica)
 	tests.Assert(t, len(info.Bricks) == 0)
+	tests.Assert(t, info.Mount.GlusterFS.MountPoint == "")
+	tests.Assert(t, len(info.Mount.GlusterFS.Options) == 0)
+}
+
+func TestVolumeEntryNewInfoResponseMount(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		3,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Place a brick on every node
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Replica = 3
+	req.Name = "myvol"
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Give each node its own storage hostname and take
+	// the first node offline after the bricks are placed
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		nodes := EntryKeys(tx, BOLTDB_BUCKET_NODE)
+		sort.Strings(nodes)
+		for i, id := range nodes {
+			node, err := NewNodeEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			node.Info.Hostnames.Storage = []string{fmt.Sprintf("storage%v", i)}
+			if i == 0 {
+				node.Info.State = NODE_STATE_OFFLINE
+			}
+			err = node.Save(tx)
+			tests.Assert(t, err == nil)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	var info *VolumeInfoResponse
+	err = app.db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, err = v.NewInfoResponse(tx)
+		return err
+	})
+	tests.Assert(t, err == nil)
 
-	// :TODO: Add Mount check
+	// The offline node is only used as a backup
+	tests.Assert(t, info.Mount.GlusterFS.MountPoint == "storage1:myvol",
+		info.Mount.GlusterFS.MountPoint)
+	tests.Assert(t, len(info.Mount.GlusterFS.Options) == 1)
+	tests.Assert(t,
+		info.Mount.GlusterFS.Options["backup-volfile-servers"] == "storage2,storage0",
+		info.Mount.GlusterFS.Options)
 }
 
 func TestVolumeEntryCreateMissingCluster(t *testing.T) {
@@ -413,7 +478,7 @@ func TestVolumeEntryCreateMissingCluster(t *testing.T) {
 	})
 	tests.Assert(t, err == nil)
 
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == ErrNoSpace)
 
 }
@@ -438,7 +503,7 @@ func TestVolumeEntryCreateRunOutOfSpaceMinBrickSizeLimit(t *testing.T) {
 	// Create a 100 GB volume
 	// Shouldn't be able to break it down enough to allocate volume
 	v := createSampleVolumeEntry(100)
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == ErrNoSpace)
 	tests.Assert(t, v.Info.Cluster == "")
 
@@ -486,7 +551,7 @@ func TestVolumeEntryCreateRunOutOfSpaceMaxBrickLimit(t *testing.T) {
 	// Create a volume who will be broken down to
 	// Shouldn't be able to break it down enough to allocate volume
 	v := createSampleVolumeEntry(BRICK_MAX_NUM * 2)
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == ErrNoSpace)
 
 	// Check database volume does not exist
@@ -530,7 +595,7 @@ func TestVolumeEntryCreateFourBricks(t *testing.T) {
 	// Create a volume who will be broken down to
 	// Shouldn't be able to break it down enough to allocate volume
 	v := createSampleVolumeEntry(250)
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Check database volume does not exist
@@ -582,7 +647,7 @@ func TestVolumeEntryCreateBrickDivision(t *testing.T) {
 	// Create a volume who will be broken down to
 	// Shouldn't be able to break it down enough to allocate volume
 	v := createSampleVolumeEntry(2000)
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Check database volume does not exist
@@ -634,7 +699,7 @@ func TestVolumeEntryCreateMaxBrickSize(t *testing.T) {
 	// Create a volume who will be broken down to
 	// Shouldn't be able to break it down enough to allocate volume
 	v := createSampleVolumeEntry(int(BRICK_MAX_SIZE / GB * 4))
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Check database volume does not exist
@@ -701,7 +766,7 @@ func TestVolumeEntryCreateOnClustersRequested(t *testing.T) {
 	v.Info.Clusters = []string{clusters[0]}
 
 	// Create volume
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Check database volume does not exist
@@ -727,7 +792,7 @@ func TestVolumeEntryCreateOnClustersRequested(t *testing.T) {
 	clusterset := clusters[2:5]
 	v = createSampleVolumeEntry(1024)
 	v.Info.Clusters = clusterset
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Check database volume exists
@@ -803,7 +868,7 @@ func TestVolumeEntryCreateCheckingClustersForSpace(t *testing.T) {
 	v := createSampleVolumeEntry(1024)
 
 	// Create volume
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Check database volume exists
@@ -850,7 +915,7 @@ func TestVolumeEntryCreateWithSnapshot(t *testing.T) {
 	v.Info.Snapshot.Enable = true
 	v.Info.Snapshot.Factor = 1.5
 
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Check database volume exists
@@ -912,11 +977,11 @@ func TestVolumeEntryDestroy(t *testing.T) {
 	v.Info.Snapshot.Enable = true
 	v.Info.Snapshot.Factor = 1.5
 
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Destroy the volume
-	err = v.Destroy(app.db)
+	err = v.Destroy(app.db, app.executor)
 	tests.Assert(t, err == nil)
 
 	// Check database volume does not exist
@@ -950,6 +1015,384 @@ func TestVolumeEntryDestroy(t *testing.T) {
 	tests.Assert(t, err == nil)
 }
 
+func TestVolumeEntryCreateGlusterVolume(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Check the request sent to the executor
+	var req *executors.VolumeRequest
+	app.xo.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		tests.Assert(t, host == "manage")
+		req = volume
+		return nil
+	}
+
+	v := createSampleVolumeEntry(250)
+	v.Info.Replica = 3
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, req != nil)
+	tests.Assert(t, req.Name == v.Info.Name)
+	tests.Assert(t, req.Replica == 3)
+	tests.Assert(t, len(req.Bricks) == len(v.Bricks))
+	for _, brick := range req.Bricks {
+		tests.Assert(t, brick.Host == "storage")
+		tests.Assert(t, brick.Path == "/mockpath")
+	}
+
+	// Check the volume is in the cluster
+	err = app.db.View(func(tx *bolt.Tx) error {
+		cluster, err := NewClusterEntryFromId(tx, v.Info.Cluster)
+		if err != nil {
+			return err
+		}
+		tests.Assert(t, utils.SortedStringHas(cluster.Info.Volumes, v.Info.Id))
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryCreateDisperse(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Each brick of a 4+2 set needs its own node
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		6,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Check the request sent to the executor
+	var req *executors.VolumeRequest
+	app.xo.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		req = volume
+		return nil
+	}
+
+	req_vol := &VolumeCreateRequest{}
+	req_vol.Size = 400
+	req_vol.Durability.Type = DURABILITY_DISPERSE
+	v := NewVolumeEntryFromRequest(req_vol)
+	tests.Assert(t, v.Info.Replica == 0)
+	tests.Assert(t, v.Info.Durability.Disperse.Data == DEFAULT_DISPERSE_DATA)
+	tests.Assert(t, v.Info.Durability.Disperse.Redundancy == DEFAULT_DISPERSE_REDUNDANCY)
+
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, req != nil)
+	tests.Assert(t, req.Replica == 0)
+	tests.Assert(t, req.DisperseData == 4)
+	tests.Assert(t, req.DisperseRedundancy == 2)
+	tests.Assert(t, req.BricksPerSet() == 6)
+
+	// Half of the volume goes to each set and is split
+	// across the four data bricks of the set
+	tests.Assert(t, len(v.Bricks) == 12)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		sets, err := v.replicaSets(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(sets) == 2)
+		for _, set := range sets {
+			tests.Assert(t, len(set) == 6)
+			tests.Assert(t, v.setDataSize(set) == 200*GB)
+
+			nodes := make(map[string]bool)
+			for _, brick := range set {
+				tests.Assert(t, brick.Info.Size == 50*GB)
+				nodes[brick.Info.NodeId] = true
+			}
+			tests.Assert(t, len(nodes) == 6)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryCreateDisperseNotEnoughNodes(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Durability.Type = DURABILITY_DISPERSE
+	req.Durability.Disperse.Data = 4
+	req.Durability.Disperse.Redundancy = 2
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == ErrNotEnoughNodes, err)
+}
+
+func TestVolumeEntryCreateArbiter(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Check the request sent to the executor
+	var req *executors.VolumeRequest
+	app.xo.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		req = volume
+		return nil
+	}
+
+	req_vol := &VolumeCreateRequest{}
+	req_vol.Size = 100
+	req_vol.Arbiter.Enable = true
+	v := NewVolumeEntryFromRequest(req_vol)
+	tests.Assert(t, v.Info.Replica == ARBITER_REPLICA)
+	tests.Assert(t, v.Info.Arbiter.Files == DEFAULT_ARBITER_FILES)
+
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, req != nil)
+	tests.Assert(t, req.Replica == 3)
+	tests.Assert(t, req.Arbiter)
+
+	// Each set has two data bricks and a small arbiter brick,
+	// and the devices only account for the arbiter size
+	arbiter_size := v.arbiterBrickSize(50 * GB)
+	tests.Assert(t, arbiter_size < 50*GB)
+	_, _, arbiter_devicesize := v.brickDeviceSizes(arbiter_size)
+	tests.Assert(t, len(v.Bricks) == 6)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		sets, err := v.replicaSets(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(sets) == 2)
+		for _, set := range sets {
+			tests.Assert(t, len(set) == 3)
+			tests.Assert(t, v.setDataSize(set) == 50*GB)
+
+			arbiters := 0
+			nodes := make(map[string]bool)
+			for _, brick := range set {
+				nodes[brick.Info.NodeId] = true
+				if brick.Info.Size == 50*GB {
+					continue
+				}
+
+				arbiters++
+				tests.Assert(t, brick.Info.Size == arbiter_size)
+				device, err := NewDeviceEntryFromId(tx, brick.Info.DeviceId)
+				tests.Assert(t, err == nil)
+				if len(device.Bricks) == 1 {
+					tests.Assert(t, device.Info.Storage.Used == arbiter_devicesize)
+				}
+			}
+			tests.Assert(t, arbiters == 1)
+			tests.Assert(t, len(nodes) == 3)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryArbiterBrickSize(t *testing.T) {
+	v := createSampleVolumeEntry(100)
+	v.Info.Arbiter.Enable = true
+
+	// Small file counts use the minimum brick size
+	v.Info.Arbiter.Files = 1000
+	tests.Assert(t, v.arbiterBrickSize(50*GB) == BRICK_MIN_SIZE)
+
+	// Each set holds metadata for its share of the files
+	v.Info.Arbiter.Files = 2 * 1024 * 1024
+	tests.Assert(t, v.arbiterBrickSize(50*GB) == 4*GB)
+	tests.Assert(t, v.arbiterBrickSize(25*GB) == 2*GB)
+
+	// Never larger than the data bricks
+	v.Info.Arbiter.Files = 1024 * 1024 * 1024
+	tests.Assert(t, v.arbiterBrickSize(50*GB) == 50*GB)
+}
+
+func TestVolumeEntryCreateGlusterVolumeFailure(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Fail volume creation
+	ErrMock := errors.New("MOCK")
+	app.xo.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		return ErrMock
+	}
+
+	// Count the bricks destroyed
+	var lock sync.Mutex
+	destroyed := 0
+	app.xo.MockBrickDestroy = func(host string, brick *executors.BrickRequest) error {
+		lock.Lock()
+		defer lock.Unlock()
+		destroyed++
+		return nil
+	}
+
+	v := createSampleVolumeEntry(250)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == ErrMock)
+	tests.Assert(t, destroyed == 4, destroyed)
+	tests.Assert(t, len(v.Bricks) == 0)
+
+	// Check the volume and bricks are not in the db
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == ErrNotFound)
+
+		bricks, err := BrickList(tx)
+		if err != nil {
+			return err
+		}
+		tests.Assert(t, len(bricks) == 0)
+
+		devices, err := DeviceList(tx)
+		if err != nil {
+			return err
+		}
+		for _, id := range devices {
+			device, err := NewDeviceEntryFromId(tx, id)
+			if err != nil {
+				return err
+			}
+			tests.Assert(t, len(device.Bricks) == 0)
+			tests.Assert(t, device.Info.Storage.Used == 0)
+		}
+
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryDestroyGlusterVolume(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(250)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Fail to delete the volume.  The bricks must be kept
+	ErrMock := errors.New("MOCK")
+	app.xo.MockVolumeDestroy = func(host string, volume string) error {
+		tests.Assert(t, volume == v.Info.Name)
+		return ErrMock
+	}
+	app.xo.MockBrickDestroy = func(host string, brick *executors.BrickRequest) error {
+		tests.Assert(t, false)
+		return nil
+	}
+	err = v.Destroy(app.db, app.executor)
+	tests.Assert(t, err == ErrMock)
+
+	// Delete the volume but fail to destroy the bricks.  The
+	// volume is kept so that it can be deleted again.
+	app.xo.MockVolumeDestroy = func(host string, volume string) error {
+		return nil
+	}
+	app.xo.MockBrickDestroy = func(host string, brick *executors.BrickRequest) error {
+		return ErrMock
+	}
+	err = v.Destroy(app.db, app.executor)
+	tests.Assert(t, err != nil)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		ops, err := PendingOperationList(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(ops) == 0)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Now delete the volume
+	called := false
+	app.xo.MockVolumeDestroy = func(host string, volume string) error {
+		called = true
+		return nil
+	}
+	app.xo.MockBrickDestroy = func(host string, brick *executors.BrickRequest) error {
+		return nil
+	}
+	err = v.Destroy(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, called)
+
+	// Check the volume is no longer in the cluster
+	err = app.db.View(func(tx *bolt.Tx) error {
+		cluster, err := NewClusterEntryFromId(tx, v.Info.Cluster)
+		if err != nil {
+			return err
+		}
+		tests.Assert(t, len(cluster.Info.Volumes) == 0)
+
+		_, err = NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == ErrNotFound)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
 func TestVolumeEntryExpandNoSpace(t *testing.T) {
 	tmpfile := tests.Tempfile()
 	defer os.Remove(tmpfile)
@@ -958,18 +1401,18 @@ func TestVolumeEntryExpandNoSpace(t *testing.T) {
 	app := NewTestApp(tmpfile)
 	defer app.Close()
 
-	// Create cluster
+	// Create cluster.  Each replica must be on a different node
 	err := setupSampleDbWithTopology(app.db,
 		10,     // clusters
-		1,      // nodes_per_cluster
-		2,      // devices_per_node,
+		2,      // nodes_per_cluster
+		1,      // devices_per_node,
 		600*GB, // disksize)
 	)
 	tests.Assert(t, err == nil)
 
-	// Create large volume
-	v := createSampleVolumeEntry(599)
-	err = v.Create(app.db)
+	// Create large volume.  Leave space for the thin pool metadata
+	v := createSampleVolumeEntry(595)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Save a copy of the volume before expansion
@@ -977,11 +1420,11 @@ func TestVolumeEntryExpandNoSpace(t *testing.T) {
 	*vcopy = *v
 
 	// Asking for a large amount will require too many little bricks
-	err = v.Expand(app.db, 500)
+	err = v.Expand(app.db, app.executor, app.allocator, 500)
 	tests.Assert(t, err == ErrMaxBricks)
 
 	// Asking for a small amount will set the bricks too small
-	err = v.Expand(app.db, 10)
+	err = v.Expand(app.db, app.executor, app.allocator, 10)
 	tests.Assert(t, err == ErrMininumBrickSize)
 
 	// Check db is the same as before expansion
@@ -1015,7 +1458,7 @@ func TestVolumeEntryExpandCreateBricksFailure(t *testing.T) {
 
 	// Create volume
 	v := createSampleVolumeEntry(100)
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 
 	// Save a copy of the volume before expansion
@@ -1024,13 +1467,13 @@ func TestVolumeEntryExpandCreateBricksFailure(t *testing.T) {
 
 	// Mock create bricks to fail
 	ErrMock := errors.New("MOCK")
-	mockCreateBricks := func(db *bolt.DB, brick_entries []*BrickEntry) error {
+	mockCreateBricks := func(db *bolt.DB, executor executors.Executor, brick_entries []*BrickEntry) error {
 		return ErrMock
 	}
 	defer tests.Patch(&createBricks, mockCreateBricks).Restore()
 
 	// Expand volume
-	err = v.Expand(app.db, 500)
+	err = v.Expand(app.db, app.executor, app.allocator, 500)
 	tests.Assert(t, err == ErrMock)
 
 	// Check db is the same as before expansion
@@ -1064,13 +1507,13 @@ func TestVolumeEntryExpand(t *testing.T) {
 
 	// Create volume
 	v := createSampleVolumeEntry(1024)
-	err = v.Create(app.db)
+	err = v.Create(app.db, app.executor, app.allocator)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, v.Info.Size == 1024)
 	tests.Assert(t, len(v.Bricks) == 4)
 
 	// Expand volume
-	err = v.Expand(app.db, 1234)
+	err = v.Expand(app.db, app.executor, app.allocator, 1234)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, v.Info.Size == 1024+1234)
 	tests.Assert(t, len(v.Bricks) == 8)
@@ -1086,3 +1529,1040 @@ func TestVolumeEntryExpand(t *testing.T) {
 	tests.Assert(t, err == nil)
 	tests.Assert(t, reflect.DeepEqual(entry, v))
 }
+
+func TestVolumeEntryExpandAddBrickFailure(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Create large cluster
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		10,   // nodes_per_cluster
+		20,   // devices_per_node,
+		6*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create volume
+	v := createSampleVolumeEntry(1024)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Save a copy of the volume before expansion
+	vcopy := &VolumeEntry{}
+	*vcopy = *v
+	vcopy.Bricks = v.BricksIds()
+
+	// Fail to add the bricks
+	ErrMock := errors.New("MOCK")
+	app.xo.MockVolumeExpand = func(host string, volume *executors.VolumeRequest) error {
+		tests.Assert(t, volume.Name == v.Info.Name)
+		tests.Assert(t, len(volume.Bricks) == 4)
+		return ErrMock
+	}
+
+	// Count the bricks destroyed
+	var lock sync.Mutex
+	destroyed := 0
+	app.xo.MockBrickDestroy = func(host string, brick *executors.BrickRequest) error {
+		lock.Lock()
+		defer lock.Unlock()
+		destroyed++
+		return nil
+	}
+
+	// Expand volume
+	err = v.Expand(app.db, app.executor, app.allocator, 1234)
+	tests.Assert(t, err == ErrMock)
+	tests.Assert(t, destroyed == 4)
+	tests.Assert(t, reflect.DeepEqual(vcopy, v))
+
+	// Check db is the same as before expansion
+	var entry *VolumeEntry
+	err = app.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = NewVolumeEntryFromId(tx, v.Info.Id)
+		if err != nil {
+			return err
+		}
+
+		bricks, err := BrickList(tx)
+		if err != nil {
+			return err
+		}
+		tests.Assert(t, len(bricks) == 4)
+
+		return nil
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, reflect.DeepEqual(vcopy, entry))
+}
+
+func TestVolumeEntryRebalance(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	defer tests.Patch(&rebalancePollInterval, time.Millisecond).Restore()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Report progress until completed
+	started := false
+	app.xo.MockVolumeRebalance = func(host string, volume string) error {
+		tests.Assert(t, volume == v.Info.Name)
+		started = true
+		return nil
+	}
+	polls := 0
+	app.xo.MockVolumeRebalanceStatus = func(host string,
+		volume string) (*executors.RebalanceStatus, error) {
+
+		polls++
+		status := &executors.RebalanceStatus{
+			Status: "in progress",
+			Files:  uint64(polls),
+		}
+		if polls == 3 {
+			status.Status = "completed"
+			status.Completed = true
+		}
+		return status, nil
+	}
+
+	reports := make([]string, 0)
+	err = v.Rebalance(app.db, app.executor, func(progress string) {
+		reports = append(reports, progress)
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, started)
+	tests.Assert(t, polls == 3)
+	tests.Assert(t, len(reports) == 3)
+	tests.Assert(t, reports[2] == "Rebalance completed: 3 files, 0 failures", reports)
+
+	// Rebalance fails
+	app.xo.MockVolumeRebalanceStatus = func(host string,
+		volume string) (*executors.RebalanceStatus, error) {
+		return &executors.RebalanceStatus{
+			Status:    "failed",
+			Completed: true,
+			Failed:    true,
+		}, nil
+	}
+	err = v.Rebalance(app.db, app.executor, nil)
+	tests.Assert(t, err == ErrRebalance)
+
+	// Unable to start
+	ErrMock := errors.New("MOCK")
+	app.xo.MockVolumeRebalance = func(host string, volume string) error {
+		return ErrMock
+	}
+	err = v.Rebalance(app.db, app.executor, nil)
+	tests.Assert(t, err == ErrMock)
+}
+
+func TestVolumeEntryShrink(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	defer tests.Patch(&rebalancePollInterval, time.Millisecond).Restore()
+
+	// Create large cluster
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		10,   // nodes_per_cluster
+		20,   // devices_per_node,
+		6*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create a volume with four replica sets of 512GB bricks
+	v := createSampleVolumeEntry(1024)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	err = v.Expand(app.db, app.executor, app.allocator, 1024)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(v.Bricks) == 8)
+
+	// Cannot shrink by less than a replica set
+	err = v.Shrink(app.db, app.executor, 100, nil)
+	tests.Assert(t, err == ErrShrinkSize)
+
+	// Fail the data migration
+	app.xo.MockVolumeRemoveBricksStatus = func(host string,
+		volume *executors.VolumeRequest) (*executors.RebalanceStatus, error) {
+		return &executors.RebalanceStatus{
+			Status:    "failed",
+			Completed: true,
+			Failed:    true,
+		}, nil
+	}
+	app.xo.MockVolumeRemoveBricksCommit = func(host string,
+		volume *executors.VolumeRequest) error {
+		tests.Assert(t, false)
+		return nil
+	}
+	err = v.Shrink(app.db, app.executor, 1024, nil)
+	tests.Assert(t, err == ErrRemoveBricks)
+	tests.Assert(t, len(v.Bricks) == 8)
+	tests.Assert(t, v.Info.Size == 2048)
+
+	// Shrink by half
+	var removed *executors.VolumeRequest
+	app.xo.MockVolumeRemoveBricks = func(host string,
+		volume *executors.VolumeRequest) error {
+		removed = volume
+		return nil
+	}
+	polls := 0
+	app.xo.MockVolumeRemoveBricksStatus = func(host string,
+		volume *executors.VolumeRequest) (*executors.RebalanceStatus, error) {
+		tests.Assert(t, reflect.DeepEqual(volume, removed))
+		polls++
+		status := &executors.RebalanceStatus{
+			Status: "in progress",
+		}
+		if polls%2 == 0 {
+			status.Status = "completed"
+			status.Completed = true
+		}
+		return status, nil
+	}
+	committed := false
+	app.xo.MockVolumeRemoveBricksCommit = func(host string,
+		volume *executors.VolumeRequest) error {
+		tests.Assert(t, reflect.DeepEqual(volume, removed))
+		committed = true
+		return nil
+	}
+	reports := 0
+	err = v.Shrink(app.db, app.executor, 1100, func(progress string) {
+		reports++
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, committed)
+	tests.Assert(t, reports == 2)
+	tests.Assert(t, removed.Replica == 2)
+	tests.Assert(t, len(removed.Bricks) == 4)
+	tests.Assert(t, v.Info.Size == 1024)
+	tests.Assert(t, len(v.Bricks) == 4)
+
+	// Check the db
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		if err != nil {
+			return err
+		}
+		tests.Assert(t, reflect.DeepEqual(entry, v))
+
+		bricks, err := BrickList(tx)
+		if err != nil {
+			return err
+		}
+		tests.Assert(t, len(bricks) == 4)
+
+		// Only the space for the remaining bricks is used
+		used := uint64(0)
+		devices, err := DeviceList(tx)
+		if err != nil {
+			return err
+		}
+		for _, id := range devices {
+			device, err := NewDeviceEntryFromId(tx, id)
+			if err != nil {
+				return err
+			}
+			used += device.Info.Storage.Used
+		}
+		tests.Assert(t, used == 4*(512*GB+BrickPoolMetadataSize(512*GB)))
+
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Cannot remove the last replica set
+	err = v.Shrink(app.db, app.executor, 1024, nil)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, v.Info.Size == 512)
+	err = v.Shrink(app.db, app.executor, 256, nil)
+	tests.Assert(t, err == ErrShrinkSize)
+}
+
+func TestVolumeEntryShrinkPartialGB(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+	defer tests.Patch(&rebalancePollInterval, time.Millisecond).Restore()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		10,   // nodes_per_cluster
+		20,   // devices_per_node,
+		6*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Each replica set provides half a GB more than 500GB
+	v := createSampleVolumeEntry(1001)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(v.Bricks) == 4)
+
+	// Removing a set would not shrink the volume by a whole GB
+	app.xo.MockVolumeRemoveBricks = func(host string,
+		volume *executors.VolumeRequest) error {
+		tests.Assert(t, false)
+		return nil
+	}
+	err = v.Shrink(app.db, app.executor, 600, nil)
+	tests.Assert(t, err == ErrShrinkSize)
+	tests.Assert(t, v.Info.Size == 1001)
+	tests.Assert(t, len(v.Bricks) == 4)
+}
+
+func TestVolumeEntryReplaceBrickNoRedundancy(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create a distribute only volume
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Durability.Type = DURABILITY_NONE
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Its bricks cannot be replaced without losing their data
+	replaced := false
+	app.xo.MockVolumeReplaceBrick = func(host string, volume string,
+		oldBrick, newBrick *executors.BrickInfo) error {
+		replaced = true
+		return nil
+	}
+	bricks := v.BricksIds()
+	err = v.ReplaceBrick(app.db, app.executor, app.allocator, bricks[0])
+	tests.Assert(t, err == ErrNoRedundancy)
+	tests.Assert(t, !replaced)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, reflect.DeepEqual(entry.BricksIds(), bricks))
+
+		list, err := BrickList(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(list) == len(bricks))
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryReplaceBrick(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create a volume with two replica sets
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(v.Bricks) == 4)
+
+	// Replace the first brick of the first set
+	var oldBrick, otherBrick *BrickEntry
+	err = app.db.View(func(tx *bolt.Tx) error {
+		sets, err := v.replicaSets(tx)
+		if err != nil {
+			return err
+		}
+		oldBrick = sets[0][0]
+		otherBrick = sets[0][1]
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Replace fails
+	ErrMock := errors.New("MOCK")
+	app.xo.MockVolumeReplaceBrick = func(host string, volume string,
+		oldBrick, newBrick *executors.BrickInfo) error {
+		return ErrMock
+	}
+	err = v.ReplaceBrick(app.db, app.executor, app.allocator, oldBrick.Id())
+	tests.Assert(t, err == ErrMock)
+	tests.Assert(t, len(v.Bricks) == 4)
+	tests.Assert(t, utils.SortedStringHas(v.Bricks, oldBrick.Id()))
+	err = app.db.View(func(tx *bolt.Tx) error {
+		bricks, err := BrickList(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(bricks) == 4)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Replace brick
+	var replaced *executors.BrickInfo
+	app.xo.MockVolumeReplaceBrick = func(host string, volume string,
+		oldBrick, newBrick *executors.BrickInfo) error {
+		tests.Assert(t, volume == v.Info.Name)
+		tests.Assert(t, oldBrick.Path == "/mockpath")
+		replaced = oldBrick
+		return nil
+	}
+	healed := false
+	app.xo.MockVolumeHeal = func(host string, volume string) error {
+		tests.Assert(t, volume == v.Info.Name)
+		healed = true
+		return nil
+	}
+	err = v.ReplaceBrick(app.db, app.executor, app.allocator, oldBrick.Id())
+	tests.Assert(t, err == nil)
+	tests.Assert(t, replaced != nil)
+	tests.Assert(t, healed)
+	tests.Assert(t, len(v.Bricks) == 4)
+	tests.Assert(t, !utils.SortedStringHas(v.Bricks, oldBrick.Id()))
+	tests.Assert(t, utils.SortedStringHas(v.Bricks, otherBrick.Id()))
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+
+		// Old brick is removed from the db and its device
+		_, err := NewBrickEntryFromId(tx, oldBrick.Id())
+		tests.Assert(t, err == ErrNotFound)
+		device, err := NewDeviceEntryFromId(tx, oldBrick.Info.DeviceId)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, !utils.SortedStringHas(device.Bricks, oldBrick.Id()))
+
+		// Saved volume has the new brick
+		entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, reflect.DeepEqual(entry.Bricks, v.Bricks))
+
+		// New brick is in the same replica set on another device
+		sets, err := entry.replicaSets(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(sets) == 2)
+		for _, brick := range sets[0] {
+			if brick.Id() == otherBrick.Id() {
+				continue
+			}
+			tests.Assert(t, brick.ReplicaSetId == oldBrick.ReplicaSetId)
+			tests.Assert(t, brick.Info.Size == oldBrick.Info.Size)
+			tests.Assert(t, brick.Info.VolumeId == v.Info.Id)
+			tests.Assert(t, brick.Info.DeviceId != oldBrick.Info.DeviceId)
+			tests.Assert(t, brick.Info.DeviceId != otherBrick.Info.DeviceId)
+
+			device, err := NewDeviceEntryFromId(tx, brick.Info.DeviceId)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, utils.SortedStringHas(device.Bricks, brick.Id()))
+		}
+
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryCreateSkipsOfflineNodes(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Take two nodes offline and mark one as failed
+	offline := make(map[string]bool)
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		nodes := EntryKeys(tx, BOLTDB_BUCKET_NODE)
+		for i, state := range []string{NODE_STATE_OFFLINE, NODE_STATE_FAILED} {
+			node, err := NewNodeEntryFromId(tx, nodes[i])
+			if err != nil {
+				return err
+			}
+
+			err = node.SetState(state)
+			if err != nil {
+				return err
+			}
+			offline[node.Info.Id] = true
+
+			err = node.Save(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	v := createSampleVolumeEntry(100)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		for _, id := range v.Bricks {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, !offline[brick.Info.NodeId])
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryCreateZonePlacement(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Nodes alternate between two zones
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		6,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	checkPlacement := func(v *VolumeEntry) {
+		err := app.db.View(func(tx *bolt.Tx) error {
+			sets, err := v.replicaSets(tx)
+			tests.Assert(t, err == nil)
+
+			for _, set := range sets {
+				tests.Assert(t, len(set) == v.Info.Replica)
+				nodes := make(map[string]bool)
+				zones := make(map[int]bool)
+				for _, brick := range set {
+					node, err := NewNodeEntryFromId(tx, brick.Info.NodeId)
+					tests.Assert(t, err == nil)
+					nodes[node.Info.Id] = true
+					zones[node.Info.Zone] = true
+				}
+
+				tests.Assert(t, len(nodes) == v.Info.Replica)
+				if v.Info.Replica <= 2 {
+					tests.Assert(t, len(zones) == v.Info.Replica)
+				}
+			}
+			return nil
+		})
+		tests.Assert(t, err == nil)
+	}
+
+	// Each replica in a different zone
+	v := createSampleVolumeEntry(200)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	checkPlacement(v)
+
+	// More replicas than zones, so each replica on a different node
+	v = createSampleVolumeEntry(200)
+	v.Info.Replica = 3
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	checkPlacement(v)
+
+	// Not enough nodes for the replica count
+	v = createSampleVolumeEntry(200)
+	v.Info.Replica = 7
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == ErrNotEnoughNodes)
+}
+
+func TestVolumeEntryCreateSpreadsBricks(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,    // clusters
+		4,    // nodes_per_cluster
+		4,    // devices_per_node,
+		1*TB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create small volumes which would all fit on the first devices
+	for i := 0; i < 10; i++ {
+		v := createSampleVolumeEntry(10)
+		err = v.Create(app.db, app.executor, app.allocator)
+		tests.Assert(t, err == nil)
+	}
+
+	// Bricks are spread over most of the devices
+	used := 0
+	err = app.db.View(func(tx *bolt.Tx) error {
+		devices, err := DeviceList(tx)
+		tests.Assert(t, err == nil)
+		for _, id := range devices {
+			device, err := NewDeviceEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			if len(device.Bricks) > 0 {
+				used++
+			}
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, used > 8, used)
+}
+
+func TestVolumeEntryCreateClone(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	// Each brick has its own path
+	app.xo.MockBrickCreate = func(host string,
+		brick *executors.BrickRequest) (*executors.BrickInfo, error) {
+		return &executors.BrickInfo{
+			Path: "/mockpath/" + brick.Name,
+		}, nil
+	}
+
+	source := createSampleSnapshotVolume(t, app, true)
+	s := NewSnapshotEntryFromRequest(source.Info.Id, &SnapshotCreateRequest{})
+	err := s.Create(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	// Record the devices used before the clone
+	used := make(map[string]uint64)
+	sets := make(map[string]string)
+	var clone_bricks []executors.CloneBrickInfo
+	err = app.db.View(func(tx *bolt.Tx) error {
+		for _, id := range source.Bricks {
+			brick, err := NewBrickEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			device, err := NewDeviceEntryFromId(tx, brick.Info.DeviceId)
+			tests.Assert(t, err == nil)
+			used[device.Id()] = device.Info.Storage.Used
+			sets["/clone"+brick.Info.Path] = brick.ReplicaSetId
+
+			// Gluster lists the bricks in its own order
+			clone_brick := executors.CloneBrickInfo{}
+			clone_brick.Host = "storage"
+			clone_brick.Path = "/clone" + brick.Info.Path
+			clone_brick.VgId = brick.Info.DeviceId
+			clone_brick.SourcePath = brick.Info.Path
+			clone_bricks = append([]executors.CloneBrickInfo{clone_brick},
+				clone_bricks...)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Bricks which do not match the source volume are refused
+	app.xo.MockSnapshotClone = func(host string, volume string, snapshot string, clone string) ([]executors.CloneBrickInfo, error) {
+		bad := make([]executors.CloneBrickInfo, len(clone_bricks))
+		copy(bad, clone_bricks)
+		bad[0].SourcePath = "/unknown"
+		return bad, nil
+	}
+	deleted := 0
+	app.xo.MockVolumeDestroy = func(host string, volume string) error {
+		deleted++
+		return nil
+	}
+	req := &VolumeCreateRequest{}
+	req.SourceSnapshot = s.Info.Id
+	bad := NewVolumeEntryFromRequest(req)
+	err = bad.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == ErrNotFound, err)
+	tests.Assert(t, deleted == 1)
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := VolumeIdFromName(tx, source.Info.Cluster, bad.Info.Name)
+		tests.Assert(t, err == ErrNotFound)
+		ops, err := PendingOperationList(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(ops) == 0)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	app.xo.MockSnapshotClone = func(host string, volume string, snapshot string, clone string) ([]executors.CloneBrickInfo, error) {
+		tests.Assert(t, volume == source.Info.Name)
+		tests.Assert(t, snapshot == s.Info.Name)
+		return clone_bricks, nil
+	}
+
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil, err)
+	tests.Assert(t, v.Info.Size == source.Info.Size)
+	tests.Assert(t, v.Info.Cluster == source.Info.Cluster)
+	tests.Assert(t, v.SourceVolumeId == source.Info.Id)
+	tests.Assert(t, len(v.Bricks) == len(source.Bricks))
+
+	// The clone bricks share the thin pools of the source bricks
+	err = app.db.View(func(tx *bolt.Tx) error {
+		clone_sets, err := v.replicaSets(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(clone_sets) == 2)
+		for _, set := range clone_sets {
+			tests.Assert(t, len(set) == source.Info.Replica)
+			for _, brick := range set {
+				tests.Assert(t, brick.Cloned)
+				tests.Assert(t, brick.TpSize == 0)
+
+				// The sets are those of the source bricks
+				tests.Assert(t, sets[brick.Info.Path] != "")
+				tests.Assert(t, sets[brick.Info.Path] == sets[set[0].Info.Path])
+
+				device, err := NewDeviceEntryFromId(tx, brick.Info.DeviceId)
+				tests.Assert(t, err == nil)
+				tests.Assert(t, utils.SortedStringHas(device.Bricks, brick.Id()))
+				tests.Assert(t, device.Info.Storage.Used == used[device.Id()])
+			}
+		}
+
+		entry, err := NewVolumeEntryFromId(tx, source.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(entry.Clones) == 1)
+		tests.Assert(t, entry.Clones[0] == v.Info.Id)
+		source = entry
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// The bricks of the source volume cannot be replaced
+	err = source.ReplaceBrick(app.db, app.executor, app.allocator, source.Bricks[0])
+	tests.Assert(t, err == ErrHasClones)
+
+	// Deleting the clone leaves the source bricks alone
+	destroyed := 0
+	app.xo.MockBrickDestroy = func(host string, brick *executors.BrickRequest) error {
+		destroyed++
+		return nil
+	}
+	err = v.Destroy(app.db, app.executor)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, destroyed == 0)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewVolumeEntryFromId(tx, source.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(entry.Clones) == 0)
+
+		for id, size := range used {
+			device, err := NewDeviceEntryFromId(tx, id)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, device.Info.Storage.Used == size)
+		}
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryCreateWithOptions(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	set := make([]string, 0)
+	app.xo.MockVolumeSetOption = func(host string, volume string, option string, value string) error {
+		set = append(set, option+"="+value)
+		return nil
+	}
+
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Options = map[string]string{
+		"performance.cache-size": "256MB",
+		"nfs.disable":            "on",
+	}
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, reflect.DeepEqual(set, []string{
+		"nfs.disable=on",
+		"performance.cache-size=256MB",
+	}))
+
+	// The options are saved and reported
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, reflect.DeepEqual(entry.Info.Options, req.Options))
+
+		info, err := entry.NewInfoResponse(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, reflect.DeepEqual(info.Options, req.Options))
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryCreateWithOptionsFailure(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	app.xo.MockVolumeSetOption = func(host string, volume string, option string, value string) error {
+		return errors.New("MOCK ERROR")
+	}
+	destroyed := false
+	app.xo.MockVolumeDestroy = func(host string, volume string) error {
+		destroyed = true
+		return nil
+	}
+
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Options = map[string]string{
+		"bad.option": "on",
+	}
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err != nil)
+	tests.Assert(t, destroyed)
+
+	// Nothing is left in the db
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == ErrNotFound)
+
+		bricks, err := BrickList(tx)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(bricks) == 0)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntrySetOptions(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		4,      // nodes_per_cluster
+		4,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Options = map[string]string{
+		"nfs.disable": "on",
+	}
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Reset one option and set others.  The second option fails.
+	reset := ""
+	app.xo.MockVolumeResetOption = func(host string, volume string, option string) error {
+		tests.Assert(t, volume == v.Info.Name)
+		reset = option
+		return nil
+	}
+	app.xo.MockVolumeSetOption = func(host string, volume string, option string, value string) error {
+		if option == "performance.cache-size" {
+			return errors.New("MOCK ERROR")
+		}
+		return nil
+	}
+	err = v.SetOptions(app.db, app.executor, &VolumeOptionsRequest{
+		Set: map[string]string{
+			"features.shard":         "on",
+			"performance.cache-size": "256MB",
+		},
+		Reset: []string{"nfs.disable"},
+	})
+	tests.Assert(t, err != nil)
+	tests.Assert(t, reset == "nfs.disable")
+
+	// Only the options applied are saved
+	err = app.db.View(func(tx *bolt.Tx) error {
+		entry, err := NewVolumeEntryFromId(tx, v.Info.Id)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, reflect.DeepEqual(entry.Info.Options, map[string]string{
+			"features.shard": "on",
+		}))
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeEntryCreateDuplicateName(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		2,      // clusters
+		3,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	create := func() (*VolumeEntry, error) {
+		req := &VolumeCreateRequest{}
+		req.Size = 100
+		req.Name = "myvol"
+		v := NewVolumeEntryFromRequest(req)
+		return v, v.Create(app.db, app.executor, app.allocator)
+	}
+
+	// The second volume goes to the other cluster
+	v1, err := create()
+	tests.Assert(t, err == nil)
+	v2, err := create()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, v1.Info.Cluster != v2.Info.Cluster)
+
+	// No cluster is left for a third one, and GlusterFS
+	// is never asked to create it
+	app.xo.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		tests.Assert(t, false)
+		return nil
+	}
+	v3, err := create()
+	tests.Assert(t, err == ErrConflict)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		_, err := NewVolumeEntryFromId(tx, v3.Info.Id)
+		tests.Assert(t, err == ErrNotFound)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+
+	// Deleting a volume frees its name
+	err = v1.Destroy(app.db, app.executor)
+	tests.Assert(t, err == nil)
+
+	app.xo.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		return nil
+	}
+	v4, err := create()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, v4.Info.Cluster == v1.Info.Cluster)
+}
+
+func TestVolumeEntryCreateFailureReleasesName(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		3,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	app.xo.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		return errors.New("MOCK ERROR")
+	}
+
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Name = "myvol"
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err != nil)
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		ids, err := VolumeIdsFromName(tx, "myvol")
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(ids) == 0)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
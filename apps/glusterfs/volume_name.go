@@ -0,0 +1,151 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/lpabon/godbc"
+)
+
+// The volume name index maps the name of each volume in a
+// cluster to the id of the volume.  GlusterFS only allows one
+// volume with a given name in a trusted storage pool.
+
+func volumeNameKey(cluster, name string) []byte {
+	return []byte(cluster + "/" + name)
+}
+
+// Returns the id of the volume with the given name in the cluster
+func VolumeIdFromName(tx *bolt.Tx, cluster, name string) (string, error) {
+	godbc.Require(tx != nil)
+
+	b := tx.Bucket([]byte(BOLTDB_BUCKET_VOLUME_NAME))
+	if b == nil {
+		logger.LogError("Unable to access volume name index")
+		return "", ErrDbAccess
+	}
+
+	id := b.Get(volumeNameKey(cluster, name))
+	if id == nil {
+		return "", ErrNotFound
+	}
+
+	return string(id), nil
+}
+
+// Returns the ids of the volumes with the given name in any cluster
+func VolumeIdsFromName(tx *bolt.Tx, name string) ([]string, error) {
+	clusters, err := ClusterList(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0)
+	for _, cluster := range clusters {
+		id, err := VolumeIdFromName(tx, cluster, name)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Record the name of the volume in the cluster.  Returns ErrConflict
+// if another volume in the cluster already has the name.
+func volumeNameReserve(tx *bolt.Tx, cluster, name, id string) error {
+	godbc.Require(tx != nil)
+	godbc.Require(cluster != "")
+	godbc.Require(name != "")
+	godbc.Require(id != "")
+
+	owner, err := VolumeIdFromName(tx, cluster, name)
+	if err == nil {
+		if owner != id {
+			return ErrConflict
+		}
+		return nil
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	b := tx.Bucket([]byte(BOLTDB_BUCKET_VOLUME_NAME))
+	return b.Put(volumeNameKey(cluster, name), []byte(id))
+}
+
+// Remove the name of the volume from the index if the
+// volume still owns it
+func volumeNameRelease(tx *bolt.Tx, cluster, name, id string) error {
+	godbc.Require(tx != nil)
+
+	owner, err := VolumeIdFromName(tx, cluster, name)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if owner != id {
+		return nil
+	}
+
+	b := tx.Bucket([]byte(BOLTDB_BUCKET_VOLUME_NAME))
+	return b.Delete(volumeNameKey(cluster, name))
+}
+
+// Index the volumes in the db.  Used when the index is first
+// created on a db with volumes.
+func volumeNameIndexBuild(tx *bolt.Tx) error {
+	volumes, err := VolumeList(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range volumes {
+		volume, err := NewVolumeEntryFromId(tx, id)
+		if err != nil {
+			return err
+		}
+		if volume.Info.Cluster == "" {
+			continue
+		}
+
+		err = volumeNameReserve(tx, volume.Info.Cluster, volume.Info.Name, id)
+		if err == ErrConflict {
+			logger.LogError("Volume %v has the same name as another volume in cluster %v: %v",
+				id, volume.Info.Cluster, volume.Info.Name)
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Release the name of the volume after it failed to be
+// created in the cluster
+func (v *VolumeEntry) releaseName(db *bolt.DB, cluster string) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return volumeNameRelease(tx, cluster, v.Info.Name, v.Info.Id)
+	})
+	if err != nil {
+		logger.Err(err)
+	}
+}
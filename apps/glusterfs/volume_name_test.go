@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package glusterfs
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/heketi/heketi/tests"
+	"os"
+	"testing"
+)
+
+func TestVolumeNameReserveRelease(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := app.db.Update(func(tx *bolt.Tx) error {
+		_, err := VolumeIdFromName(tx, "c1", "myvol")
+		tests.Assert(t, err == ErrNotFound)
+
+		// Reserve the name
+		err = volumeNameReserve(tx, "c1", "myvol", "v1")
+		tests.Assert(t, err == nil)
+		id, err := VolumeIdFromName(tx, "c1", "myvol")
+		tests.Assert(t, err == nil)
+		tests.Assert(t, id == "v1")
+
+		// Reserving it again for the same volume is fine
+		err = volumeNameReserve(tx, "c1", "myvol", "v1")
+		tests.Assert(t, err == nil)
+
+		// Another volume cannot have it in the same cluster
+		err = volumeNameReserve(tx, "c1", "myvol", "v2")
+		tests.Assert(t, err == ErrConflict)
+
+		// Another cluster can use it
+		err = volumeNameReserve(tx, "c2", "myvol", "v2")
+		tests.Assert(t, err == nil)
+
+		// Only the owner releases the name
+		err = volumeNameRelease(tx, "c1", "myvol", "v2")
+		tests.Assert(t, err == nil)
+		id, err = VolumeIdFromName(tx, "c1", "myvol")
+		tests.Assert(t, err == nil)
+		tests.Assert(t, id == "v1")
+
+		err = volumeNameRelease(tx, "c1", "myvol", "v1")
+		tests.Assert(t, err == nil)
+		_, err = VolumeIdFromName(tx, "c1", "myvol")
+		tests.Assert(t, err == ErrNotFound)
+
+		// Releasing a name which is not indexed is fine
+		err = volumeNameRelease(tx, "c1", "myvol", "v1")
+		tests.Assert(t, err == nil)
+
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeIdsFromName(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+	defer app.Close()
+
+	err := setupSampleDbWithTopology(app.db,
+		2,      // clusters
+		3,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	// Create a volume with the same name in each cluster
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		req := &VolumeCreateRequest{}
+		req.Size = 100
+		req.Name = "myvol"
+		v := NewVolumeEntryFromRequest(req)
+		err = v.Create(app.db, app.executor, app.allocator)
+		tests.Assert(t, err == nil)
+		ids[v.Info.Id] = true
+	}
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		found, err := VolumeIdsFromName(tx, "myvol")
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(found) == 2)
+		for _, id := range found {
+			tests.Assert(t, ids[id])
+		}
+
+		found, err = VolumeIdsFromName(tx, "other")
+		tests.Assert(t, err == nil)
+		tests.Assert(t, len(found) == 0)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
+
+func TestVolumeNameIndexBuild(t *testing.T) {
+	tmpfile := tests.Tempfile()
+	defer os.Remove(tmpfile)
+
+	// Create the app
+	app := NewTestApp(tmpfile)
+
+	err := setupSampleDbWithTopology(app.db,
+		1,      // clusters
+		3,      // nodes_per_cluster
+		2,      // devices_per_node,
+		500*GB, // disksize)
+	)
+	tests.Assert(t, err == nil)
+
+	req := &VolumeCreateRequest{}
+	req.Size = 100
+	req.Name = "myvol"
+	v := NewVolumeEntryFromRequest(req)
+	err = v.Create(app.db, app.executor, app.allocator)
+	tests.Assert(t, err == nil)
+
+	// Remove the index and the schema version as if the
+	// db was made before they existed
+	err = app.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(BOLTDB_BUCKET_VOLUME_NAME))
+		tests.Assert(t, err == nil)
+		return tx.DeleteBucket([]byte(BOLTDB_BUCKET_METADATA))
+	})
+	tests.Assert(t, err == nil)
+	app.Close()
+
+	// The index is built when the db is migrated
+	app = NewTestApp(tmpfile)
+	defer app.Close()
+
+	err = app.db.View(func(tx *bolt.Tx) error {
+		id, err := VolumeIdFromName(tx, v.Info.Cluster, "myvol")
+		tests.Assert(t, err == nil)
+		tests.Assert(t, id == v.Info.Id)
+		return nil
+	})
+	tests.Assert(t, err == nil)
+}
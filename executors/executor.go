@@ -18,12 +18,135 @@ package executors
 
 type Executor interface {
 	PeerProbe(exec_host, newnode string) error
-	PeerDetach(exec_host, detachnode string) error
+	PeerDetach(exec_host, detachnode string, force bool) error
 	DeviceSetup(host, device, vgid string) (*DeviceInfo, error)
 	DeviceTeardown(host, device, vgid string) error
+	BrickCreate(host string, brick *BrickRequest) (*BrickInfo, error)
+	BrickDestroy(host string, brick *BrickRequest) error
+	VolumeCreate(host string, volume *VolumeRequest) error
+	VolumeDestroy(host string, volume string) error
+	VolumeExpand(host string, volume *VolumeRequest) error
+	VolumeRebalance(host string, volume string) error
+	VolumeRebalanceStatus(host string, volume string) (*RebalanceStatus, error)
+	VolumeRemoveBricks(host string, volume *VolumeRequest) error
+	VolumeRemoveBricksStatus(host string, volume *VolumeRequest) (*RebalanceStatus, error)
+	VolumeRemoveBricksCommit(host string, volume *VolumeRequest) error
+	VolumeReplaceBrick(host string, volume string, oldBrick, newBrick *BrickInfo) error
+	VolumeHeal(host string, volume string) error
+	VolumeSetOption(host string, volume string, option string, value string) error
+	VolumeResetOption(host string, volume string, option string) error
+	SnapshotCreate(host string, snapshot *SnapshotRequest) error
+	SnapshotList(host string, volume string) ([]string, error)
+	SnapshotDelete(host string, snapshot string) error
+	SnapshotRestore(host string, volume string, snapshot string) ([]RestoreBrickInfo, error)
+	SnapshotClone(host string, volume string, snapshot string, clone string) ([]CloneBrickInfo, error)
+	QuotaEnable(host string, volume string) error
+	QuotaDisable(host string, volume string) error
+	QuotaLimitSet(host string, volume string, limit *QuotaLimitRequest) error
+	QuotaLimitRemove(host string, volume string, path string) error
+	QuotaList(host string, volume string) ([]QuotaUsage, error)
 }
 
 type DeviceInfo struct {
 	// Size in KB
 	Size uint64
 }
+
+type BrickRequest struct {
+	VgId string
+	Name string
+
+	// Sizes in KB
+	TpSize           uint64
+	Size             uint64
+	PoolMetadataSize uint64
+}
+
+type BrickInfo struct {
+	Path string
+	Host string
+}
+
+type VolumeRequest struct {
+	Name    string
+	Replica int
+
+	// The last brick of each replica set is an arbiter
+	Arbiter bool
+
+	// Disperse volumes set the number of data and redundancy
+	// bricks in each set instead of Replica
+	DisperseData       int
+	DisperseRedundancy int
+
+	// Bricks must be ordered so that each replica or
+	// disperse set is listed together
+	Bricks []BrickInfo
+}
+
+// Returns the number of bricks in each replica or disperse set
+func (v *VolumeRequest) BricksPerSet() int {
+	if v.DisperseData > 0 {
+		return v.DisperseData + v.DisperseRedundancy
+	}
+	return v.Replica
+}
+
+type SnapshotRequest struct {
+	Name        string
+	Volume      string
+	Description string
+}
+
+// Bricks of a volume cloned from a snapshot are thin snapshots
+// created in the volume group of the original brick
+type CloneBrickInfo struct {
+	BrickInfo
+	VgId string
+
+	// Path of the brick of the volume at the same position
+	SourcePath string
+}
+
+// Bricks of a volume restored from a snapshot are the bricks of the
+// snapshot, mounted in place of the original bricks
+type RestoreBrickInfo struct {
+	BrickInfo
+
+	// Path of the brick before the restore
+	SourcePath string
+}
+
+type QuotaLimitRequest struct {
+	// Directory relative to the root of the volume
+	Path string
+
+	// Size in KB
+	HardLimit uint64
+
+	// Percentage of the hard limit, or 0 for the GlusterFS default
+	SoftLimit int
+}
+
+type QuotaUsage struct {
+	Path string
+
+	// Sizes in KB
+	HardLimit uint64
+	Used      uint64
+	Available uint64
+
+	// Percentage of the hard limit
+	SoftLimit int
+
+	SoftLimitExceeded bool
+	HardLimitExceeded bool
+}
+
+type RebalanceStatus struct {
+	Completed bool
+	Failed    bool
+	Status    string
+	Files     uint64
+	Failures  uint64
+}
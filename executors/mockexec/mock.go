@@ -22,10 +22,34 @@ import (
 
 type MockExecutor struct {
 	// These functions can be overwritten for testing
-	MockPeerProbe      func(exec_host, newnode string) error
-	MockPeerDetach     func(exec_host, newnode string) error
-	MockDeviceSetup    func(host, device, vgid string) (*executors.DeviceInfo, error)
-	MockDeviceTeardown func(host, device, vgid string) error
+	MockPeerProbe                func(exec_host, newnode string) error
+	MockPeerDetach               func(exec_host, newnode string, force bool) error
+	MockDeviceSetup              func(host, device, vgid string) (*executors.DeviceInfo, error)
+	MockDeviceTeardown           func(host, device, vgid string) error
+	MockBrickCreate              func(host string, brick *executors.BrickRequest) (*executors.BrickInfo, error)
+	MockBrickDestroy             func(host string, brick *executors.BrickRequest) error
+	MockVolumeCreate             func(host string, volume *executors.VolumeRequest) error
+	MockVolumeDestroy            func(host string, volume string) error
+	MockVolumeExpand             func(host string, volume *executors.VolumeRequest) error
+	MockVolumeRebalance          func(host string, volume string) error
+	MockVolumeRebalanceStatus    func(host string, volume string) (*executors.RebalanceStatus, error)
+	MockVolumeRemoveBricks       func(host string, volume *executors.VolumeRequest) error
+	MockVolumeRemoveBricksStatus func(host string, volume *executors.VolumeRequest) (*executors.RebalanceStatus, error)
+	MockVolumeRemoveBricksCommit func(host string, volume *executors.VolumeRequest) error
+	MockVolumeReplaceBrick       func(host string, volume string, oldBrick, newBrick *executors.BrickInfo) error
+	MockVolumeHeal               func(host string, volume string) error
+	MockVolumeSetOption          func(host string, volume string, option string, value string) error
+	MockVolumeResetOption        func(host string, volume string, option string) error
+	MockSnapshotCreate           func(host string, snapshot *executors.SnapshotRequest) error
+	MockSnapshotList             func(host string, volume string) ([]string, error)
+	MockSnapshotDelete           func(host string, snapshot string) error
+	MockSnapshotRestore          func(host string, volume string, snapshot string) ([]executors.RestoreBrickInfo, error)
+	MockSnapshotClone            func(host string, volume string, snapshot string, clone string) ([]executors.CloneBrickInfo, error)
+	MockQuotaEnable              func(host string, volume string) error
+	MockQuotaDisable             func(host string, volume string) error
+	MockQuotaLimitSet            func(host string, volume string, limit *executors.QuotaLimitRequest) error
+	MockQuotaLimitRemove         func(host string, volume string, path string) error
+	MockQuotaList                func(host string, volume string) ([]executors.QuotaUsage, error)
 }
 
 func NewMockExecutor() *MockExecutor {
@@ -35,7 +59,7 @@ func NewMockExecutor() *MockExecutor {
 		return nil
 	}
 
-	m.MockPeerDetach = func(exec_host, newnode string) error {
+	m.MockPeerDetach = func(exec_host, newnode string, force bool) error {
 		return nil
 	}
 
@@ -49,6 +73,113 @@ func NewMockExecutor() *MockExecutor {
 		return nil
 	}
 
+	m.MockBrickCreate = func(host string, brick *executors.BrickRequest) (*executors.BrickInfo, error) {
+		b := &executors.BrickInfo{
+			Path: "/mockpath",
+		}
+		return b, nil
+	}
+
+	m.MockBrickDestroy = func(host string, brick *executors.BrickRequest) error {
+		return nil
+	}
+
+	m.MockVolumeCreate = func(host string, volume *executors.VolumeRequest) error {
+		return nil
+	}
+
+	m.MockVolumeDestroy = func(host string, volume string) error {
+		return nil
+	}
+
+	m.MockVolumeExpand = func(host string, volume *executors.VolumeRequest) error {
+		return nil
+	}
+
+	m.MockVolumeRebalance = func(host string, volume string) error {
+		return nil
+	}
+
+	m.MockVolumeRebalanceStatus = func(host string, volume string) (*executors.RebalanceStatus, error) {
+		r := &executors.RebalanceStatus{
+			Completed: true,
+			Status:    "completed",
+		}
+		return r, nil
+	}
+
+	m.MockVolumeRemoveBricks = func(host string, volume *executors.VolumeRequest) error {
+		return nil
+	}
+
+	m.MockVolumeRemoveBricksStatus = func(host string, volume *executors.VolumeRequest) (*executors.RebalanceStatus, error) {
+		r := &executors.RebalanceStatus{
+			Completed: true,
+			Status:    "completed",
+		}
+		return r, nil
+	}
+
+	m.MockVolumeRemoveBricksCommit = func(host string, volume *executors.VolumeRequest) error {
+		return nil
+	}
+
+	m.MockVolumeReplaceBrick = func(host string, volume string, oldBrick, newBrick *executors.BrickInfo) error {
+		return nil
+	}
+
+	m.MockVolumeHeal = func(host string, volume string) error {
+		return nil
+	}
+
+	m.MockVolumeSetOption = func(host string, volume string, option string, value string) error {
+		return nil
+	}
+
+	m.MockVolumeResetOption = func(host string, volume string, option string) error {
+		return nil
+	}
+
+	m.MockSnapshotCreate = func(host string, snapshot *executors.SnapshotRequest) error {
+		return nil
+	}
+
+	m.MockSnapshotList = func(host string, volume string) ([]string, error) {
+		return []string{}, nil
+	}
+
+	m.MockSnapshotDelete = func(host string, snapshot string) error {
+		return nil
+	}
+
+	m.MockSnapshotRestore = func(host string, volume string, snapshot string) ([]executors.RestoreBrickInfo, error) {
+		return []executors.RestoreBrickInfo{}, nil
+	}
+
+	m.MockSnapshotClone = func(host string, volume string, snapshot string, clone string) ([]executors.CloneBrickInfo, error) {
+		return []executors.CloneBrickInfo{}, nil
+	}
+
+	m.MockQuotaEnable = func(host string, volume string) error {
+		return nil
+	}
+
+	m.MockQuotaDisable = func(host string, volume string) error {
+		return nil
+	}
+
+	m.MockQuotaLimitSet = func(host string, volume string, limit *executors.QuotaLimitRequest) error {
+		return nil
+	}
+
+	m.MockQuotaLimitRemove = func(host string, volume string, path string) error {
+		return nil
+	}
+
+	m.MockQuotaList = func(host string, volume string) ([]executors.QuotaUsage, error) {
+		return []executors.QuotaUsage{}, nil
+	}
+
 	return m
 }
 
@@ -56,8 +187,8 @@ func (m *MockExecutor) PeerProbe(exec_host, newnode string) error {
 	return m.MockPeerProbe(exec_host, newnode)
 }
 
-func (m *MockExecutor) PeerDetach(exec_host, newnode string) error {
-	return m.MockPeerDetach(exec_host, newnode)
+func (m *MockExecutor) PeerDetach(exec_host, newnode string, force bool) error {
+	return m.MockPeerDetach(exec_host, newnode, force)
 }
 
 func (m *MockExecutor) DeviceSetup(host, device, vgid string) (*executors.DeviceInfo, error) {
@@ -67,3 +198,99 @@ func (m *MockExecutor) DeviceSetup(host, device, vgid string) (*executors.Device
 func (m *MockExecutor) DeviceTeardown(host, device, vgid string) error {
 	return m.MockDeviceTeardown(host, device, vgid)
 }
+
+func (m *MockExecutor) BrickCreate(host string, brick *executors.BrickRequest) (*executors.BrickInfo, error) {
+	return m.MockBrickCreate(host, brick)
+}
+
+func (m *MockExecutor) BrickDestroy(host string, brick *executors.BrickRequest) error {
+	return m.MockBrickDestroy(host, brick)
+}
+
+func (m *MockExecutor) VolumeCreate(host string, volume *executors.VolumeRequest) error {
+	return m.MockVolumeCreate(host, volume)
+}
+
+func (m *MockExecutor) VolumeDestroy(host string, volume string) error {
+	return m.MockVolumeDestroy(host, volume)
+}
+
+func (m *MockExecutor) VolumeExpand(host string, volume *executors.VolumeRequest) error {
+	return m.MockVolumeExpand(host, volume)
+}
+
+func (m *MockExecutor) VolumeRebalance(host string, volume string) error {
+	return m.MockVolumeRebalance(host, volume)
+}
+
+func (m *MockExecutor) VolumeRebalanceStatus(host string, volume string) (*executors.RebalanceStatus, error) {
+	return m.MockVolumeRebalanceStatus(host, volume)
+}
+
+func (m *MockExecutor) VolumeRemoveBricks(host string, volume *executors.VolumeRequest) error {
+	return m.MockVolumeRemoveBricks(host, volume)
+}
+
+func (m *MockExecutor) VolumeRemoveBricksStatus(host string, volume *executors.VolumeRequest) (*executors.RebalanceStatus, error) {
+	return m.MockVolumeRemoveBricksStatus(host, volume)
+}
+
+func (m *MockExecutor) VolumeRemoveBricksCommit(host string, volume *executors.VolumeRequest) error {
+	return m.MockVolumeRemoveBricksCommit(host, volume)
+}
+
+func (m *MockExecutor) VolumeReplaceBrick(host string, volume string, oldBrick, newBrick *executors.BrickInfo) error {
+	return m.MockVolumeReplaceBrick(host, volume, oldBrick, newBrick)
+}
+
+func (m *MockExecutor) VolumeHeal(host string, volume string) error {
+	return m.MockVolumeHeal(host, volume)
+}
+
+func (m *MockExecutor) VolumeSetOption(host string, volume string, option string, value string) error {
+	return m.MockVolumeSetOption(host, volume, option, value)
+}
+
+func (m *MockExecutor) VolumeResetOption(host string, volume string, option string) error {
+	return m.MockVolumeResetOption(host, volume, option)
+}
+
+func (m *MockExecutor) SnapshotCreate(host string, snapshot *executors.SnapshotRequest) error {
+	return m.MockSnapshotCreate(host, snapshot)
+}
+
+func (m *MockExecutor) SnapshotList(host string, volume string) ([]string, error) {
+	return m.MockSnapshotList(host, volume)
+}
+
+func (m *MockExecutor) SnapshotDelete(host string, snapshot string) error {
+	return m.MockSnapshotDelete(host, snapshot)
+}
+
+func (m *MockExecutor) SnapshotRestore(host string, volume string, snapshot string) ([]executors.RestoreBrickInfo, error) {
+	return m.MockSnapshotRestore(host, volume, snapshot)
+}
+
+func (m *MockExecutor) SnapshotClone(host string, volume string, snapshot string, clone string) ([]executors.CloneBrickInfo, error) {
+	return m.MockSnapshotClone(host, volume, snapshot, clone)
+}
+
+func (m *MockExecutor) QuotaEnable(host string, volume string) error {
+	return m.MockQuotaEnable(host, volume)
+}
+
+func (m *MockExecutor) QuotaDisable(host string, volume string) error {
+	return m.MockQuotaDisable(host, volume)
+}
+
+func (m *MockExecutor) QuotaLimitSet(host string, volume string, limit *executors.QuotaLimitRequest) error {
+	return m.MockQuotaLimitSet(host, volume, limit)
+}
+
+func (m *MockExecutor) QuotaLimitRemove(host string, volume string, path string) error {
+	return m.MockQuotaLimitRemove(host, volume, path)
+}
+
+func (m *MockExecutor) QuotaList(host string, volume string) ([]executors.QuotaUsage, error) {
+	return m.MockQuotaList(host, volume)
+}
@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sshexec
+
+import (
+	"fmt"
+	"github.com/heketi/heketi/executors"
+	"github.com/lpabon/godbc"
+)
+
+const (
+	BRICK_MOUNT_ROOT = "/var/lib/heketi/mounts"
+)
+
+func (s *SshExecutor) vgName(vgid string) string {
+	return "vg_" + vgid
+}
+
+func (s *SshExecutor) brickName(brickid string) string {
+	return "brick_" + brickid
+}
+
+func (s *SshExecutor) tpName(brickid string) string {
+	return "tp_" + brickid
+}
+
+func (s *SshExecutor) brickMountPoint(brick *executors.BrickRequest) string {
+	return BRICK_MOUNT_ROOT + "/" +
+		s.vgName(brick.VgId) + "/" +
+		s.brickName(brick.Name)
+}
+
+func (s *SshExecutor) devnode(brick *executors.BrickRequest) string {
+	return "/dev/mapper/" + s.vgName(brick.VgId) +
+		"-" + s.brickName(brick.Name)
+}
+
+func (s *SshExecutor) BrickCreate(host string,
+	brick *executors.BrickRequest) (*executors.BrickInfo, error) {
+
+	godbc.Require(brick != nil)
+	godbc.Require(host != "")
+	godbc.Require(brick.Name != "")
+	godbc.Require(brick.Size > 0)
+	godbc.Require(brick.TpSize >= brick.Size)
+	godbc.Require(brick.VgId != "")
+
+	// Create mountpoint name
+	mountpoint := s.brickMountPoint(brick)
+
+	// Create command set to execute on the node
+	commands := []string{
+
+		// Create a directory
+		fmt.Sprintf("sudo mkdir -p %v", mountpoint),
+
+		// Setup the thin pool and the thin LV
+		fmt.Sprintf("sudo lvcreate --poolmetadatasize %vK -c 256K -L %vK -T %v/%v -V %vK -n %v",
+			brick.PoolMetadataSize,
+			brick.TpSize,
+			s.vgName(brick.VgId),
+			s.tpName(brick.Name),
+			brick.Size,
+			s.brickName(brick.Name)),
+
+		// Format
+		fmt.Sprintf("sudo mkfs.xfs -i size=512 -n size=8192 %v", s.devnode(brick)),
+
+		// Fstab
+		fmt.Sprintf("echo \"%v %v xfs rw,inode64,noatime,nouuid 1 2\" | sudo tee -a %v > /dev/null",
+			s.devnode(brick),
+			mountpoint,
+			s.fstab),
+
+		// Mount
+		fmt.Sprintf("sudo mount -o rw,inode64,noatime,nouuid %v %v", s.devnode(brick), mountpoint),
+
+		// Create a directory inside the formated volume for GlusterFS
+		fmt.Sprintf("sudo mkdir %v/brick", mountpoint),
+	}
+
+	// Execute commands
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		// Undo whatever was done on the node
+		s.BrickDestroy(host, brick)
+		return nil, err
+	}
+
+	// Save brick location
+	b := &executors.BrickInfo{
+		Path: fmt.Sprintf("%v/brick", mountpoint),
+	}
+
+	return b, nil
+}
+
+func (s *SshExecutor) BrickDestroy(host string,
+	brick *executors.BrickRequest) error {
+
+	godbc.Require(brick != nil)
+	godbc.Require(host != "")
+	godbc.Require(brick.Name != "")
+	godbc.Require(brick.VgId != "")
+
+	// Each step is run on its own so that a failure in one of them,
+	// possibly because it was never done, does not stop the cleanup
+	var lasterr error
+	commands := []string{
+
+		// Unmount
+		fmt.Sprintf("sudo umount %v", s.brickMountPoint(brick)),
+
+		// Remove the thin pool, which also removes the thin LV
+		fmt.Sprintf("sudo lvremove -f %v/%v", s.vgName(brick.VgId), s.tpName(brick.Name)),
+
+		// Remove the mount point
+		fmt.Sprintf("sudo rmdir %v", s.brickMountPoint(brick)),
+
+		// Remove from fstab
+		fmt.Sprintf("sudo sed -i.save '/%v/d' %v", s.brickName(brick.Name), s.fstab),
+	}
+	for _, command := range commands {
+		_, err := s.sshExec(host, []string{command})
+		if err != nil {
+			logger.LogError("Unable to execute [%v] on %v: %v", command, host, err)
+			lasterr = err
+		}
+	}
+
+	return lasterr
+}
@@ -0,0 +1,182 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sshexec
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/heketi/heketi/executors"
+	"github.com/lpabon/godbc"
+	"strconv"
+	"strings"
+)
+
+// Sizes are in bytes.  GlusterFS reports N/A for the values of
+// directories it is unable to access.
+type cliQuotaLimit struct {
+	Path             string `xml:"path"`
+	HardLimit        string `xml:"hard_limit"`
+	SoftLimitPercent string `xml:"soft_limit_percent"`
+	UsedSpace        string `xml:"used_space"`
+	AvailSpace       string `xml:"avail_space"`
+	SlExceeded       string `xml:"sl_exceeded"`
+	HlExceeded       string `xml:"hl_exceeded"`
+}
+
+// Output of gluster volume quota <volume> list --xml
+type cliQuotaOutput struct {
+	OpRet    int    `xml:"opRet"`
+	OpErrStr string `xml:"opErrstr"`
+	Quota    struct {
+		Limits []cliQuotaLimit `xml:"limit"`
+	} `xml:"volQuota"`
+}
+
+func (s *SshExecutor) QuotaEnable(host string, volume string) error {
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+
+	logger.Info("Enabling quota on volume %v", volume)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume quota %v enable", volume),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) QuotaDisable(host string, volume string) error {
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+
+	// Disabling quota removes every limit on the volume
+	logger.Info("Disabling quota on volume %v", volume)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume quota %v disable", volume),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) QuotaLimitSet(host string,
+	volume string,
+	limit *executors.QuotaLimitRequest) error {
+
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+	godbc.Require(limit != nil)
+	godbc.Require(limit.Path != "")
+	godbc.Require(limit.HardLimit > 0)
+
+	// The directory must already exist in the volume
+	cmd := fmt.Sprintf("sudo gluster --mode=script volume quota %v limit-usage %q %vKB",
+		volume, limit.Path, limit.HardLimit)
+	if limit.SoftLimit > 0 {
+		cmd += fmt.Sprintf(" %v%%", limit.SoftLimit)
+	}
+
+	logger.Info("Setting quota limit of %v on volume %v", limit.Path, volume)
+	commands := []string{cmd}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) QuotaLimitRemove(host string, volume string, path string) error {
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+	godbc.Require(path != "")
+
+	logger.Info("Removing quota limit of %v on volume %v", path, volume)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume quota %v remove %q", volume, path),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) QuotaList(host string, volume string) ([]executors.QuotaUsage, error) {
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume quota %v list --xml", volume),
+	}
+	b, err := s.sshExec(host, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	var output cliQuotaOutput
+	err = xml.Unmarshal([]byte(b[0]), &output)
+	if err != nil {
+		logger.LogError("Unable to parse quota list of %v: %v", volume, err)
+		return nil, err
+	}
+	if output.OpRet != 0 {
+		return nil, errors.New(output.OpErrStr)
+	}
+
+	usage := make([]executors.QuotaUsage, 0, len(output.Quota.Limits))
+	for _, limit := range output.Quota.Limits {
+		usage = append(usage, newQuotaUsage(&limit))
+	}
+
+	return usage, nil
+}
+
+func newQuotaUsage(limit *cliQuotaLimit) executors.QuotaUsage {
+	usage := executors.QuotaUsage{}
+	usage.Path = limit.Path
+	usage.HardLimit = quotaSizeKb(limit.HardLimit)
+	usage.Used = quotaSizeKb(limit.UsedSpace)
+	usage.Available = quotaSizeKb(limit.AvailSpace)
+	usage.SoftLimitExceeded = limit.SlExceeded == "Yes"
+	usage.HardLimitExceeded = limit.HlExceeded == "Yes"
+
+	percent, err := strconv.Atoi(strings.TrimSuffix(limit.SoftLimitPercent, "%"))
+	if err == nil {
+		usage.SoftLimit = percent
+	}
+
+	return usage
+}
+
+// Convert a size in bytes from the quota list to KB.  Values
+// which are not available are reported as zero.
+func quotaSizeKb(bytes string) uint64 {
+	size, err := strconv.ParseUint(strings.TrimSpace(bytes), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size / 1024
+}
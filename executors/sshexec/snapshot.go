@@ -0,0 +1,270 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sshexec
+
+import (
+	"fmt"
+	"github.com/heketi/heketi/executors"
+	"github.com/lpabon/godbc"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Brick lines in the output of gluster volume info
+	volumeInfoBrickRegexp = regexp.MustCompile(`^Brick[0-9]+:\s*(\S+)$`)
+)
+
+func (s *SshExecutor) SnapshotCreate(host string,
+	snapshot *executors.SnapshotRequest) error {
+
+	godbc.Require(host != "")
+	godbc.Require(snapshot != nil)
+	godbc.Require(snapshot.Name != "")
+	godbc.Require(snapshot.Volume != "")
+
+	// Keep the requested name instead of appending a timestamp
+	cmd := fmt.Sprintf("sudo gluster --mode=script snapshot create %v %v no-timestamp",
+		snapshot.Name, snapshot.Volume)
+	if snapshot.Description != "" {
+		cmd += fmt.Sprintf(" description '%v'", snapshot.Description)
+	}
+
+	logger.Info("Creating snapshot %v of volume %v", snapshot.Name, snapshot.Volume)
+	commands := []string{cmd}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) SnapshotList(host string, volume string) ([]string, error) {
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script snapshot list %v", volume),
+	}
+	b, err := s.sshExec(host, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	// One snapshot name per line
+	snapshots := make([]string, 0)
+	for _, line := range strings.Split(b[0], "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" || strings.HasPrefix(name, "No snapshots present") {
+			continue
+		}
+		snapshots = append(snapshots, name)
+	}
+
+	return snapshots, nil
+}
+
+func (s *SshExecutor) SnapshotDelete(host string, snapshot string) error {
+	godbc.Require(host != "")
+	godbc.Require(snapshot != "")
+
+	logger.Info("Deleting snapshot %v", snapshot)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script snapshot delete %v", snapshot),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) SnapshotRestore(host string,
+	volume string,
+	snapshot string) ([]executors.RestoreBrickInfo, error) {
+
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+	godbc.Require(snapshot != "")
+
+	// Bricks of the volume before the restore
+	sources, err := s.volumeBricks(host, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	// The volume must be stopped while it is restored
+	logger.Info("Restoring volume %v from snapshot %v", volume, snapshot)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume stop %v", volume),
+	}
+	_, err = s.sshExec(host, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	// GlusterFS deletes the snapshot once it has been restored
+	commands = []string{
+		fmt.Sprintf("sudo gluster --mode=script snapshot restore %v", snapshot),
+	}
+	_, restoreErr := s.sshExec(host, commands)
+
+	// Start the volume again, whether or not it was restored
+	commands = []string{
+		fmt.Sprintf("sudo gluster --mode=script volume start %v", volume),
+	}
+	_, err = s.sshExec(host, commands)
+	if restoreErr != nil {
+		if err != nil {
+			logger.LogError("Unable to start volume %v: %v", volume, err)
+		}
+		return nil, restoreErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The bricks are now those of the snapshot, listed in the
+	// same order as the bricks they replaced
+	restored, err := s.volumeBricks(host, volume)
+	if err != nil {
+		return nil, err
+	}
+	if len(restored) != len(sources) {
+		return nil, fmt.Errorf("Unable to parse bricks of volume %v", volume)
+	}
+
+	bricks := make([]executors.RestoreBrickInfo, len(restored))
+	for i, brick := range restored {
+		bricks[i].BrickInfo = brick
+		bricks[i].SourcePath = sources[i].Path
+	}
+
+	return bricks, nil
+}
+
+func (s *SshExecutor) SnapshotClone(host string,
+	volume string,
+	snapshot string,
+	clone string) ([]executors.CloneBrickInfo, error) {
+
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+	godbc.Require(snapshot != "")
+	godbc.Require(clone != "")
+
+	// Only activated snapshots can be cloned.  Activating a snapshot
+	// which is already active fails, so the error is only logged.
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script snapshot activate %v", snapshot),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		logger.Warning("Unable to activate snapshot %v: %v", snapshot, err)
+	}
+
+	// Volume groups of the snapshot bricks, in brick order
+	commands = []string{
+		fmt.Sprintf("sudo gluster --mode=script snapshot status %v", snapshot),
+	}
+	b, err := s.sshExec(host, commands)
+	if err != nil {
+		return nil, err
+	}
+	vgs := make([]string, 0)
+	for _, line := range strings.Split(b[0], "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "Volume Group" {
+			vg := strings.TrimSpace(fields[1])
+			vgs = append(vgs, strings.TrimPrefix(vg, s.vgName("")))
+		}
+	}
+
+	// Bricks of the volume, in the order of the snapshot bricks
+	sources, err := s.volumeBricks(host, volume)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) != len(vgs) {
+		return nil, fmt.Errorf("Snapshot %v does not have the bricks of volume %v",
+			snapshot, volume)
+	}
+
+	// Create and start the clone
+	logger.Info("Cloning snapshot %v to volume %v", snapshot, clone)
+	commands = []string{
+		fmt.Sprintf("sudo gluster --mode=script snapshot clone %v %v", clone, snapshot),
+		fmt.Sprintf("sudo gluster --mode=script volume start %v", clone),
+	}
+	_, err = s.sshExec(host, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	// The clone bricks are listed in the same order as the snapshot bricks
+	clones, err := s.volumeBricks(host, clone)
+	if err != nil {
+		return nil, err
+	}
+	if len(clones) != len(vgs) {
+		return nil, fmt.Errorf("Unable to parse bricks of volume %v", clone)
+	}
+
+	bricks := make([]executors.CloneBrickInfo, len(clones))
+	for i, brick := range clones {
+		bricks[i].BrickInfo = brick
+		bricks[i].VgId = vgs[i]
+		bricks[i].SourcePath = sources[i].Path
+	}
+
+	return bricks, nil
+}
+
+// Return the bricks of the volume in the order listed by gluster
+func (s *SshExecutor) volumeBricks(host string,
+	volume string) ([]executors.BrickInfo, error) {
+
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume info %v", volume),
+	}
+	b, err := s.sshExec(host, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	bricks := make([]executors.BrickInfo, 0)
+	for _, line := range strings.Split(b[0], "\n") {
+		match := volumeInfoBrickRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+
+		fields := strings.SplitN(match[1], ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Unable to parse bricks of volume %v", volume)
+		}
+
+		bricks = append(bricks, executors.BrickInfo{
+			Host: fields[0],
+			Path: fields[1],
+		})
+	}
+
+	return bricks, nil
+}
@@ -28,11 +28,15 @@ import (
 type SshExecutor struct {
 	private_keyfile string
 	user            string
+	fstab           string
 }
 
 type SshConfig struct {
 	PrivateKeyFile string `json:"keyfile"`
 	User           string `json:"user"`
+
+	// Experimental Settings
+	Fstab string `json:"fstab"`
 }
 
 var (
@@ -59,9 +63,16 @@ func NewSshExecutor(config *SshConfig) *SshExecutor {
 		s.user = config.User
 	}
 
+	if config.Fstab == "" {
+		s.fstab = "/etc/fstab"
+	} else {
+		s.fstab = config.Fstab
+	}
+
 	godbc.Ensure(s != nil)
 	godbc.Ensure(s.user != "")
 	godbc.Ensure(s.private_keyfile != "")
+	godbc.Ensure(s.fstab != "")
 
 	return s
 }
@@ -99,7 +110,9 @@ func (s *SshExecutor) PeerProbe(exec_host, newnode string) error {
 	return nil
 }
 
-func (s *SshExecutor) PeerDetach(exec_host, detachnode string) error {
+// Detach the node from the trusted storage pool.  Nodes which cannot
+// be reached are only detached with force.
+func (s *SshExecutor) PeerDetach(exec_host, detachnode string, force bool) error {
 	godbc.Require(exec_host != "")
 	godbc.Require(detachnode != "")
 
@@ -110,12 +123,26 @@ func (s *SshExecutor) PeerDetach(exec_host, detachnode string) error {
 
 	// create the commands
 	logger.Info("Detaching node %v", detachnode)
-	commands := []string{
-		fmt.Sprintf("sudo gluster peer detach %v", detachnode),
+	cmd := fmt.Sprintf("sudo gluster --mode=script peer detach %v", detachnode)
+	if force {
+		cmd += " force"
 	}
+	commands := []string{cmd}
 	_, err := exec.ConnectAndExec(exec_host+":22", commands)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func (s *SshExecutor) sshExec(host string, commands []string) ([]string, error) {
+
+	// Setup ssh session
+	exec := ssh.NewSshExecWithKeyFile(logger, s.user, s.private_keyfile)
+	if exec == nil {
+		return nil, ErrSshPrivateKey
+	}
+
+	// Execute commands
+	return exec.ConnectAndExec(host+":22", commands)
+}
@@ -0,0 +1,409 @@
+//
+// Copyright (c) 2015 The heketi Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sshexec
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/heketi/heketi/executors"
+	"github.com/lpabon/godbc"
+	"strings"
+)
+
+type cliRebalanceAggregate struct {
+	Files     uint64 `xml:"files"`
+	Failures  uint64 `xml:"failures"`
+	StatusStr string `xml:"statusStr"`
+}
+
+// Output of gluster volume rebalance <volume> status --xml
+// and gluster volume remove-brick <volume> <bricks> status --xml
+type cliRebalanceOutput struct {
+	OpRet     int    `xml:"opRet"`
+	OpErrStr  string `xml:"opErrstr"`
+	Rebalance struct {
+		Aggregate cliRebalanceAggregate `xml:"aggregate"`
+	} `xml:"volRebalance"`
+	RemoveBrick struct {
+		Aggregate cliRebalanceAggregate `xml:"aggregate"`
+	} `xml:"volRemoveBrick"`
+}
+
+func (s *SshExecutor) VolumeCreate(host string,
+	volume *executors.VolumeRequest) error {
+
+	godbc.Require(volume != nil)
+	godbc.Require(host != "")
+	godbc.Require(volume.Name != "")
+	godbc.Require(volume.BricksPerSet() > 0)
+	godbc.Require(len(volume.Bricks) > 0)
+	godbc.Require(len(volume.Bricks)%volume.BricksPerSet() == 0)
+
+	// Create the volume with the bricks in set order
+	cmd := fmt.Sprintf("sudo gluster --mode=script volume create %v %v",
+		volume.Name, s.volumeTypeArgs(volume, true))
+	for _, brick := range volume.Bricks {
+		cmd += fmt.Sprintf("%v:%v ", brick.Host, brick.Path)
+	}
+
+	// Create and start the volume
+	commands := []string{
+		cmd,
+		fmt.Sprintf("sudo gluster --mode=script volume start %v", volume.Name),
+	}
+
+	logger.Info("Creating volume %v", volume.Name)
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		// Remove the volume if it was created
+		s.VolumeDestroy(host, volume.Name)
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) VolumeDestroy(host string, volume string) error {
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+
+	// Stop the volume.  Continue if it fails since the volume
+	// may have never been started
+	logger.Info("Stopping volume %v", volume)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume stop %v force", volume),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		logger.LogError("Unable to stop volume %v: %v", volume, err)
+	}
+
+	// Delete the volume
+	logger.Info("Deleting volume %v", volume)
+	commands = []string{
+		fmt.Sprintf("sudo gluster --mode=script volume delete %v", volume),
+	}
+	_, err = s.sshExec(host, commands)
+	if err != nil {
+		// The volume may have been deleted before
+		exists, existsErr := s.volumeExists(host, volume)
+		if existsErr == nil && !exists {
+			logger.Info("Volume %v was already deleted", volume)
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Returns true if GlusterFS has a volume with the given name
+func (s *SshExecutor) volumeExists(host string, volume string) (bool, error) {
+	commands := []string{
+		"sudo gluster --mode=script volume list",
+	}
+	b, err := s.sshExec(host, commands)
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range strings.Split(b[0], "\n") {
+		if strings.TrimSpace(name) == volume {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *SshExecutor) VolumeExpand(host string,
+	volume *executors.VolumeRequest) error {
+
+	godbc.Require(volume != nil)
+	godbc.Require(host != "")
+	godbc.Require(volume.Name != "")
+	godbc.Require(volume.BricksPerSet() > 0)
+	godbc.Require(len(volume.Bricks) > 0)
+	godbc.Require(len(volume.Bricks)%volume.BricksPerSet() == 0)
+
+	// Add the bricks in set order
+	cmd := fmt.Sprintf("sudo gluster --mode=script volume add-brick %v %v",
+		volume.Name, s.volumeTypeArgs(volume, false))
+	for _, brick := range volume.Bricks {
+		cmd += fmt.Sprintf("%v:%v ", brick.Host, brick.Path)
+	}
+
+	logger.Info("Adding %v bricks to volume %v", len(volume.Bricks), volume.Name)
+	_, err := s.sshExec(host, []string{cmd})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) VolumeRebalance(host string, volume string) error {
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+
+	logger.Info("Starting rebalance on volume %v", volume)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume rebalance %v start", volume),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) VolumeRebalanceStatus(host string,
+	volume string) (*executors.RebalanceStatus, error) {
+
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume rebalance %v status --xml", volume),
+	}
+	b, err := s.sshExec(host, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	var output cliRebalanceOutput
+	err = xml.Unmarshal([]byte(b[0]), &output)
+	if err != nil {
+		logger.LogError("Unable to parse rebalance status of %v: %v", volume, err)
+		return nil, err
+	}
+	if output.OpRet != 0 {
+		return nil, errors.New(output.OpErrStr)
+	}
+
+	return newRebalanceStatus(&output.Rebalance.Aggregate), nil
+}
+
+func newRebalanceStatus(aggregate *cliRebalanceAggregate) *executors.RebalanceStatus {
+	status := &executors.RebalanceStatus{}
+	status.Status = aggregate.StatusStr
+	status.Files = aggregate.Files
+	status.Failures = aggregate.Failures
+	switch status.Status {
+	case "completed":
+		status.Completed = true
+	case "failed", "stopped":
+		status.Completed = true
+		status.Failed = true
+	}
+
+	return status
+}
+
+// Return the arguments describing how the bricks are grouped into
+// sets.  Disperse and arbiter arguments are only given when the volume
+// is created.  Afterwards bricks are added and removed in whole sets.
+func (s *SshExecutor) volumeTypeArgs(volume *executors.VolumeRequest,
+	create bool) string {
+
+	if volume.DisperseData > 0 {
+		if create {
+			return fmt.Sprintf("disperse-data %v redundancy %v ",
+				volume.DisperseData, volume.DisperseRedundancy)
+		}
+		return ""
+	}
+
+	// Distribute only volumes do not have a replica count
+	if volume.Replica == 1 {
+		return ""
+	}
+
+	if volume.Arbiter && create {
+		return fmt.Sprintf("replica %v arbiter 1 ", volume.Replica)
+	}
+
+	return fmt.Sprintf("replica %v ", volume.Replica)
+}
+
+func (s *SshExecutor) removeBricksCommand(volume *executors.VolumeRequest,
+	op string) string {
+
+	cmd := fmt.Sprintf("sudo gluster --mode=script volume remove-brick %v %v",
+		volume.Name, s.volumeTypeArgs(volume, false))
+	for _, brick := range volume.Bricks {
+		cmd += fmt.Sprintf("%v:%v ", brick.Host, brick.Path)
+	}
+
+	return cmd + op
+}
+
+func (s *SshExecutor) VolumeRemoveBricks(host string,
+	volume *executors.VolumeRequest) error {
+
+	godbc.Require(volume != nil)
+	godbc.Require(host != "")
+	godbc.Require(volume.Name != "")
+	godbc.Require(volume.BricksPerSet() > 0)
+	godbc.Require(len(volume.Bricks) > 0)
+	godbc.Require(len(volume.Bricks)%volume.BricksPerSet() == 0)
+
+	// Start migrating the data out of the bricks
+	logger.Info("Removing %v bricks from volume %v", len(volume.Bricks), volume.Name)
+	commands := []string{
+		s.removeBricksCommand(volume, "start"),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) VolumeRemoveBricksStatus(host string,
+	volume *executors.VolumeRequest) (*executors.RebalanceStatus, error) {
+
+	godbc.Require(volume != nil)
+	godbc.Require(host != "")
+	godbc.Require(len(volume.Bricks) > 0)
+
+	commands := []string{
+		s.removeBricksCommand(volume, "status --xml"),
+	}
+	b, err := s.sshExec(host, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	var output cliRebalanceOutput
+	err = xml.Unmarshal([]byte(b[0]), &output)
+	if err != nil {
+		logger.LogError("Unable to parse remove-brick status of %v: %v", volume.Name, err)
+		return nil, err
+	}
+	if output.OpRet != 0 {
+		return nil, errors.New(output.OpErrStr)
+	}
+
+	return newRebalanceStatus(&output.RemoveBrick.Aggregate), nil
+}
+
+func (s *SshExecutor) VolumeRemoveBricksCommit(host string,
+	volume *executors.VolumeRequest) error {
+
+	godbc.Require(volume != nil)
+	godbc.Require(host != "")
+	godbc.Require(len(volume.Bricks) > 0)
+
+	logger.Info("Committing removal of %v bricks from volume %v",
+		len(volume.Bricks), volume.Name)
+	commands := []string{
+		s.removeBricksCommand(volume, "commit"),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) VolumeReplaceBrick(host string,
+	volume string,
+	oldBrick, newBrick *executors.BrickInfo) error {
+
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+	godbc.Require(oldBrick != nil)
+	godbc.Require(newBrick != nil)
+
+	// The old brick may be on a failed device, so the data is not
+	// migrated.  It is recovered by healing from the other replicas
+	logger.Info("Replacing brick %v:%v with %v:%v in volume %v",
+		oldBrick.Host, oldBrick.Path,
+		newBrick.Host, newBrick.Path,
+		volume)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume replace-brick %v %v:%v %v:%v commit force",
+			volume,
+			oldBrick.Host, oldBrick.Path,
+			newBrick.Host, newBrick.Path),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) VolumeHeal(host string, volume string) error {
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+
+	logger.Info("Starting heal on volume %v", volume)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume heal %v full", volume),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) VolumeSetOption(host string,
+	volume string,
+	option string,
+	value string) error {
+
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+	godbc.Require(option != "")
+
+	logger.Info("Setting option %v=%v on volume %v", option, value, volume)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume set %v %v '%v'", volume, option, value),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SshExecutor) VolumeResetOption(host string, volume string, option string) error {
+	godbc.Require(host != "")
+	godbc.Require(volume != "")
+	godbc.Require(option != "")
+
+	logger.Info("Resetting option %v on volume %v", option, volume)
+	commands := []string{
+		fmt.Sprintf("sudo gluster --mode=script volume reset %v %v", volume, option),
+	}
+	_, err := s.sshExec(host, commands)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -38,17 +38,92 @@ var (
 	HEKETI_VERSION = "(dev)"
 	configfile     string
 	showVersion    bool
+	dbCheckFile    string
+	dbRepair       bool
+	dbImportFile   string
+	dbFile         string
 )
 
 func init() {
 	flag.StringVar(&configfile, "config", "", "Configuration file")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
+	flag.StringVar(&dbCheckFile, "dbcheck", "",
+		"Check the db file of a stopped server and exit")
+	flag.BoolVar(&dbRepair, "dbrepair", false,
+		"Repair the problems found by -dbcheck")
+	flag.StringVar(&dbImportFile, "dbimport", "",
+		"Create the db file given by -db from a dump and exit")
+	flag.StringVar(&dbFile, "db", "", "Db file to create with -dbimport")
 }
 
 func printVersion() {
 	fmt.Printf("Heketi %v\n", HEKETI_VERSION)
 }
 
+// Check the db file and print the problems found.  Exits with
+// an error if there are problems which were not repaired.
+func checkDb() {
+	result, err := glusterfs.DbCheckFile(dbCheckFile, dbRepair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to check %v: %v\n",
+			dbCheckFile,
+			err.Error())
+		os.Exit(1)
+	}
+
+	output, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(string(output))
+
+	for _, problem := range result.Problems {
+		if !problem.Repaired {
+			os.Exit(1)
+		}
+	}
+}
+
+// Create a db file from a dump of the db of another server
+func importDb() {
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "Please provide the db file to create")
+		os.Exit(1)
+	}
+
+	fp, err := os.Open(dbImportFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open dump file %v: %v\n",
+			dbImportFile,
+			err.Error())
+		os.Exit(1)
+	}
+	defer fp.Close()
+
+	var dump glusterfs.DbDump
+	if err = json.NewDecoder(fp).Decode(&dump); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse %v: %v\n",
+			dbImportFile,
+			err.Error())
+		os.Exit(1)
+	}
+
+	problems, err := glusterfs.DbImport(dbFile, &dump)
+	if err != nil {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "%v %v: %v\n",
+				problem.Bucket,
+				problem.Id,
+				problem.Description)
+		}
+		fmt.Fprintf(os.Stderr, "Unable to import %v: %v\n",
+			dbImportFile,
+			err.Error())
+		os.Exit(1)
+	}
+}
+
 func main() {
 	flag.Parse()
 	printVersion()
@@ -58,6 +133,18 @@ func main() {
 		return
 	}
 
+	// Check the db instead of starting the server
+	if dbCheckFile != "" {
+		checkDb()
+		return
+	}
+
+	// Create a db instead of starting the server
+	if dbImportFile != "" {
+		importDb()
+		return
+	}
+
 	// Check configuration file was given
 	if configfile == "" {
 		fmt.Fprintln(os.Stderr, "Please provide configuration file")
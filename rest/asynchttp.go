@@ -34,6 +34,7 @@ type AsyncHttpHandler struct {
 	completed    bool
 	manager      *AsyncHttpManager
 	location, id string
+	progress     string
 }
 
 // Manager of asynchronous operations
@@ -120,12 +121,24 @@ func (a *AsyncHttpManager) AsyncHttpRedirectFunc(w http.ResponseWriter,
 	r *http.Request,
 	handlerfunc func() (string, error)) {
 
+	a.AsyncHttpRedirectHandlerFunc(w, r, func(h *AsyncHttpHandler) (string, error) {
+		return handlerfunc()
+	})
+}
+
+// Same as AsyncHttpRedirectFunc() except that handlerfunc() is passed
+// the asynchronous handler so that it can report its progress
+// using AsyncHttpHandler.Progress()
+func (a *AsyncHttpManager) AsyncHttpRedirectHandlerFunc(w http.ResponseWriter,
+	r *http.Request,
+	handlerfunc func(h *AsyncHttpHandler) (string, error)) {
+
 	handler := a.NewHandler()
 	go func() {
 		logger.Info("Started job %v", handler.id)
 
 		ts := time.Now()
-		url, err := handlerfunc()
+		url, err := handlerfunc(handler)
 		logger.Info("Completed job %v in %v", handler.id, time.Since(ts))
 
 		if err != nil {
@@ -143,7 +156,8 @@ func (a *AsyncHttpManager) AsyncHttpRedirectFunc(w http.ResponseWriter,
 // Register this handler with a router like Gorilla Mux
 //
 // Returns the following HTTP status codes
-// 		200 Operation is still pending
+// 		200 Operation is still pending.  If the operation has reported
+//			its progress, it is set in the X-Pending-Progress header
 //		404 Id requested does not exist
 //		500 Operation finished and has failed.  Body will be filled in with the
 //			error in plain text.
@@ -206,6 +220,9 @@ func (a *AsyncHttpManager) HandlerStatus(w http.ResponseWriter, r *http.Request)
 			// Still pending
 			// Could add a JSON body here later
 			w.Header().Add("X-Pending", "true")
+			if handler.progress != "" {
+				w.Header().Add("X-Pending-Progress", handler.progress)
+			}
 			w.WriteHeader(http.StatusOK)
 		}
 
@@ -214,6 +231,16 @@ func (a *AsyncHttpManager) HandlerStatus(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// Removes the handler from the manager, so that its url is no longer
+// found.  Handlers are otherwise removed once their completion has
+// been returned to a caller.
+func (h *AsyncHttpHandler) Remove() {
+	h.manager.lock.Lock()
+	defer h.manager.lock.Unlock()
+
+	delete(h.manager.handlers, h.id)
+}
+
 // Returns the url for the specified asynchronous handler
 func (h *AsyncHttpHandler) Url() string {
 	h.manager.lock.RLock()
@@ -222,6 +249,16 @@ func (h *AsyncHttpHandler) Url() string {
 	return h.manager.route + "/" + h.id
 }
 
+// Saves a message describing the progress of the operation which
+// is returned to the caller while the operation is still pending
+func (h *AsyncHttpHandler) Progress(progress string) {
+
+	h.manager.lock.Lock()
+	defer h.manager.lock.Unlock()
+
+	h.progress = progress
+}
+
 // Registers that the handler has completed with an error
 func (h *AsyncHttpHandler) CompletedWithError(err error) {
 
@@ -59,6 +59,20 @@ func TestHandlerUrl(t *testing.T) {
 	tests.Assert(t, handler.Url() == "/x/12345")
 }
 
+func TestHandlerRemove(t *testing.T) {
+	manager := NewAsyncHttpManager("/x")
+	handler := manager.NewHandler()
+	other := manager.NewHandler()
+
+	handler.Remove()
+	tests.Assert(t, len(manager.handlers) == 1)
+	tests.Assert(t, manager.handlers[other.id] == other)
+
+	// Removing it again does nothing
+	handler.Remove()
+	tests.Assert(t, len(manager.handlers) == 1)
+}
+
 func TestHandlerNotFound(t *testing.T) {
 
 	// Setup asynchronous manager
@@ -418,3 +432,63 @@ func TestApplicationWithRedirectFunc(t *testing.T) {
 	}
 
 }
+
+func TestApplicationWithRedirectHandlerFuncProgress(t *testing.T) {
+
+	// Setup asynchronous manager
+	route := "/x"
+	manager := NewAsyncHttpManager(route)
+
+	// Setup the route
+	router := mux.NewRouter()
+	router.HandleFunc(route+"/{id}", manager.HandlerStatus).Methods("GET")
+
+	step := make(chan bool)
+	router.HandleFunc("/app", func(w http.ResponseWriter, r *http.Request) {
+		manager.AsyncHttpRedirectHandlerFunc(w, r, func(h *AsyncHttpHandler) (string, error) {
+			h.Progress("step 1")
+			<-step
+			h.Progress("step 2")
+			<-step
+			return "", nil
+		})
+	}).Methods("GET")
+
+	// Setup the server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Get /app url
+	r, err := http.Get(ts.URL + "/app")
+	tests.Assert(t, r.StatusCode == http.StatusAccepted)
+	tests.Assert(t, err == nil)
+	location, err := r.Location()
+	tests.Assert(t, err == nil)
+
+	// Wait for each step to be reported
+	for _, progress := range []string{"step 1", "step 2"} {
+		for {
+			r, err := http.Get(location.String())
+			tests.Assert(t, err == nil)
+			tests.Assert(t, r.StatusCode == http.StatusOK)
+			tests.Assert(t, r.Header.Get("X-Pending") == "true")
+			if r.Header.Get("X-Pending-Progress") == progress {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		step <- true
+	}
+
+	// Wait for completion
+	for {
+		r, err := http.Get(location.String())
+		tests.Assert(t, err == nil)
+		if r.StatusCode == http.StatusNoContent {
+			tests.Assert(t, r.Header.Get("X-Pending-Progress") == "")
+			break
+		}
+		tests.Assert(t, r.StatusCode == http.StatusOK)
+		time.Sleep(time.Millisecond)
+	}
+}